@@ -1,25 +1,932 @@
 package command
 
 import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+
 	"github.com/SteveZhangBit/redigo"
+	"github.com/SteveZhangBit/redigo/protocol"
+	"github.com/SteveZhangBit/redigo/rtype"
+	"github.com/SteveZhangBit/redigo/rtype/rstring"
+)
+
+/* -----------------------------------------------------------------------------
+ * Helpers and low level bit functions.
+ * -------------------------------------------------------------------------- */
+
+/* Count number of bits set in the binary array s. The bytes are counted
+ * eight at a time, then the remaining ones one by one. */
+func redisPopcount(s []byte) int64 {
+	var bitcount int
+	for len(s) >= 8 {
+		bitcount += bits.OnesCount64(binary.LittleEndian.Uint64(s))
+		s = s[8:]
+	}
+	for _, b := range s {
+		bitcount += bits.OnesCount8(b)
+	}
+	return int64(bitcount)
+}
+
+/* Return the position of the first bit set to one (if 'bit' is 1) or
+ * zero (if 'bit' is 0) in the bitmap s.
+ *
+ * The function is guaranteed to return a value >= 0 if 'bit' is 0 since if
+ * no zero bit is found, it returns count*8 assuming the string is zero
+ * padded on the right. However if 'bit' is 1 it is possible that there is
+ * not a single set bit in the bitmap. In this special case -1 is returned. */
+func redisBitpos(s []byte, bit int) int64 {
+	// skipval is the byte that does not contain the bit we are looking for.
+	var skipval byte
+	if bit == 0 {
+		skipval = 0xff
+	}
+
+	/* Skip the bytes not containing the bit, eight at a time, then one by
+	 * one. */
+	var pos int64
+	skipword := uint64(skipval) * 0x0101010101010101
+	for len(s) >= 8 && binary.BigEndian.Uint64(s) == skipword {
+		s = s[8:]
+		pos += 64
+	}
+	for len(s) > 0 && s[0] == skipval {
+		s = s[1:]
+		pos += 8
+	}
+
+	if len(s) == 0 {
+		/* If we reached this point, there is no bit set (or clear) in the
+		 * bitmap. If we are looking for clear bits, the string is assumed to
+		 * be padded with zero bits on the right. */
+		if bit == 1 {
+			return -1
+		}
+		return pos
+	}
+
+	// The first byte not equal to skipval contains the bit.
+	b := s[0]
+	if bit == 0 {
+		b = ^b
+	}
+	return pos + int64(bits.LeadingZeros8(b))
+}
+
+/* This helper function used by GETBIT / SETBIT parses the bit offset
+ * argument making sure an error is returned if it is negative or if it
+ * overflows Redis 512 MB limit for the string value.
+ *
+ * If the 'hash' argument is true, and 'bits is positive, then the command
+ * will also parse bit offsets prefixed by "#". In such a case the offset
+ * is multiplied by 'bits'. This is useful for the BITFIELD command. */
+func getBitOffsetFromArgument(c *redigo.CommandArg, arg []byte, hash bool, bits int) (offset int64, ok bool) {
+	const err = "bit offset is not an integer or out of range"
+
+	usehash := hash && bits > 0 && len(arg) > 0 && arg[0] == '#'
+	if usehash {
+		arg = arg[1:]
+	}
+
+	if offset, ok = GetInt64FromStringOrReply(c, rstring.New(arg), err); !ok {
+		return
+	}
+
+	// Handle #<offset> form.
+	if usehash {
+		if offset < 0 || offset > math.MaxInt64/int64(bits) {
+			c.AddReplyError(err)
+			return 0, false
+		}
+		offset *= int64(bits)
+	}
+
+	// Limit offset to 512MB in bytes
+	if offset < 0 || offset>>3 >= 512*1024*1024 {
+		c.AddReplyError(err)
+		return 0, false
+	}
+	return offset, true
+}
+
+/* This helper function for BITFIELD parses a bitfield type in the form
+ * <sign><bits> where sign is 'u' or 'i' for unsigned and signed, and
+ * the bits is a value between 1 and 64. However 64 bits unsigned integers
+ * are reported as an error because of current limitations of Redis protocol
+ * to return unsigned integer values greater than INT64_MAX. */
+func getBitfieldTypeFromArgument(c *redigo.CommandArg, arg []byte) (sign bool, bits int, ok bool) {
+	const err = "Invalid bitfield type. Use something like i16 u8. " +
+		"Note that u64 is not supported but i64 is."
+
+	if len(arg) > 1 && (arg[0] == 'i' || arg[0] == 'I') {
+		sign = true
+	} else if len(arg) > 1 && (arg[0] == 'u' || arg[0] == 'U') {
+		sign = false
+	} else {
+		c.AddReplyError(err)
+		return false, 0, false
+	}
+
+	x, e := strconv.Atoi(string(arg[1:]))
+	if e != nil || x < 1 || (sign && x > 64) || (!sign && x > 63) {
+		c.AddReplyError(err)
+		return false, 0, false
+	}
+	return sign, x, true
+}
+
+/* This is a helper function for commands implementations that need to write
+ * bits to a string object. The command creates or pads with zeroes the string
+ * so that the 'maxbit' bit can be addressed. The object is finally
+ * returned. Otherwise if the key holds a wrong type nil is returned and
+ * an error is sent to the client. An integer encoded string is converted
+ * to a BytesString, so that it can be modified in place. */
+func lookupStringForBitCommand(c *redigo.CommandArg, maxbit int64) *rstring.BytesString {
+	bytepos := int(maxbit >> 3)
+
+	o := c.DB().LookupKeyWrite(c.Argv[1])
+	if o == nil {
+		str := &rstring.BytesString{Val: make([]byte, bytepos+1)}
+		c.DB().Add(c.Argv[1], str)
+		return str
+	}
+
+	var str *rstring.BytesString
+	switch s := o.(type) {
+	case *rstring.BytesString:
+		str = s
+	case *rstring.IntString:
+		str = &rstring.BytesString{Val: s.Bytes()}
+		c.DB().Update(c.Argv[1], str)
+	default:
+		c.AddReply(protocol.WrongTypeErr)
+		return nil
+	}
+
+	if len(str.Val) < bytepos+1 {
+		str.Val = append(str.Val, make([]byte, bytepos+1-len(str.Val))...)
+	}
+	return str
+}
+
+/* Get the unsigned integer of bits bits, stored at the bit offset offset of
+ * p, most significant bit first. */
+func getUnsignedBitfield(p []byte, offset uint64, bits int) uint64 {
+	var value uint64
+	for j := 0; j < bits; j++ {
+		bytepos := offset >> 3
+		bit := 7 - uint(offset&0x7)
+		bitval := uint64(p[bytepos]>>bit) & 1
+		value = value<<1 | bitval
+		offset++
+	}
+	return value
+}
+
+/* Like getUnsignedBitfield, but the most significant bit of the field is
+ * the sign, and is extended to the returned 64 bit integer. */
+func getSignedBitfield(p []byte, offset uint64, bits int) int64 {
+	value := getUnsignedBitfield(p, offset, bits)
+	/* If the top significant bit is 1, propagate it to all the
+	 * higher bits for two's complement representation of signed
+	 * integers. */
+	if bits < 64 && value&(1<<uint(bits-1)) != 0 {
+		value |= math.MaxUint64 << uint(bits)
+	}
+	return int64(value)
+}
+
+/* Set the bits bits at the bit offset offset of p to the lowest bits bits
+ * of value. Signed integers are set as well, since they are stored in two's
+ * complement. */
+func setUnsignedBitfield(p []byte, offset uint64, bits int, value uint64) {
+	for j := 0; j < bits; j++ {
+		bitval := byte(value>>uint(bits-1-j)) & 1
+		bytepos := offset >> 3
+		bit := 7 - uint(offset&0x7)
+		p[bytepos] = p[bytepos]&^(1<<bit) | bitval<<bit
+		offset++
+	}
+}
+
+/* The overflow behaviors of BITFIELD SET and INCRBY. */
+const (
+	BFOVERFLOW_WRAP = iota
+	BFOVERFLOW_SAT
+	BFOVERFLOW_FAIL
+)
+
+/* Check if an unsigned field of bits bits holding value overflows when incr
+ * is added. Return 1 on overflow, -1 on underflow and 0 otherwise. On
+ * overflow, limit is the value to store according to the owtype behavior:
+ * the wrapped around result, or the maximum or minimum value on
+ * saturation. */
+func checkUnsignedBitfieldOverflow(value uint64, incr int64, bits int, owtype int) (limit uint64, overflow int) {
+	max := uint64(math.MaxUint64)
+	if bits != 64 {
+		max = 1<<uint(bits) - 1
+	}
+	maxincr := int64(max - value)
+	minincr := -int64(value)
+
+	if value > max || (incr > 0 && incr > maxincr) {
+		overflow = 1
+		limit = max
+	} else if incr < 0 && incr < minincr {
+		overflow = -1
+		limit = 0
+	} else {
+		return 0, 0
+	}
+
+	if owtype == BFOVERFLOW_WRAP {
+		limit = (value + uint64(incr)) &^ (math.MaxUint64 << uint(bits))
+		return limit, 1
+	}
+	return limit, overflow
+}
+
+/* The same of checkUnsignedBitfieldOverflow for signed fields. */
+func checkSignedBitfieldOverflow(value int64, incr int64, bits int, owtype int) (limit int64, overflow int) {
+	max := int64(math.MaxInt64)
+	if bits != 64 {
+		max = 1<<uint(bits-1) - 1
+	}
+	min := -max - 1
+
+	/* Note that maxincr and minincr could overflow, but we use the values
+	 * only after checking 'value' range, so when we use it no overflow
+	 * happens. */
+	maxincr := max - value
+	minincr := min - value
+
+	if value > max || (bits != 64 && incr > maxincr) || (value >= 0 && incr > 0 && incr > maxincr) {
+		overflow = 1
+		limit = max
+	} else if value < min || (bits != 64 && incr < minincr) || (value < 0 && incr < 0 && incr < minincr) {
+		overflow = -1
+		limit = min
+	} else {
+		return 0, 0
+	}
+
+	if owtype == BFOVERFLOW_WRAP {
+		/* Perform the addition as unsigned, and if the sign bit is set,
+		 * propagate to all the higher order bits, to cap the negative
+		 * value. If it's clear, mask to the positive integer limit. */
+		c := uint64(value) + uint64(incr)
+		if bits < 64 {
+			mask := uint64(math.MaxUint64) << uint(bits)
+			if c&(1<<uint(bits-1)) != 0 {
+				c |= mask
+			} else {
+				c &^= mask
+			}
+		}
+		return int64(c), 1
+	}
+	return limit, overflow
+}
+
+/* Return the bytes of the string object o, and false if the key holds a
+ * value of another type, replying with an error. */
+func getStringBytesOrReply(c *redigo.CommandArg, o interface{}) ([]byte, bool) {
+	str, ok := o.(rtype.String)
+	if !ok {
+		c.AddReply(protocol.WrongTypeErr)
+		return nil, false
+	}
+	return str.Bytes(), true
+}
+
+/* Parse the optional BYTE|BIT argument of BITCOUNT and BITPOS. */
+func parseBitRangeUnitOrReply(c *redigo.CommandArg, arg []byte) (isbit bool, ok bool) {
+	switch strings.ToLower(string(arg)) {
+	case "bit":
+		return true, true
+	case "byte":
+		return false, true
+	default:
+		c.AddReply(protocol.SyntaxErr)
+		return false, false
+	}
+}
+
+/* Convert the start and end arguments of BITCOUNT and BITPOS, that may be
+ * negative, into a range of the totlen long string. The range is empty if
+ * start > end. */
+func normalizeBitRange(start, end, totlen int64) (int64, int64) {
+	if start < 0 {
+		start = totlen + start
+	}
+	if end < 0 {
+		end = totlen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= totlen {
+		end = totlen - 1
+	}
+	return start, end
+}
+
+/* Return the masks of the bits outside a range given in bits, in the first
+ * and the last byte of the range. */
+func bitRangeMasks(start, end int64) (firstByteNegMask, lastByteNegMask byte) {
+	firstByteNegMask = ^byte((1 << (8 - uint(start&7))) - 1)
+	lastByteNegMask = byte((1 << (7 - uint(end&7))) - 1)
+	return
+}
+
+/* -----------------------------------------------------------------------------
+ * Bits related string commands: GETBIT, SETBIT, BITCOUNT, BITOP.
+ * -------------------------------------------------------------------------- */
+
+const (
+	BITOP_AND = iota
+	BITOP_OR
+	BITOP_XOR
+	BITOP_NOT
 )
 
+// SETBIT key offset bitvalue
 func SETBITCommand(c *redigo.CommandArg) {
+	bitoffset, ok := getBitOffsetFromArgument(c, c.Argv[2], false, 0)
+	if !ok {
+		return
+	}
+
+	const err = "bit is not an integer or out of range"
+	on, ok := GetInt64FromStringOrReply(c, rstring.New(c.Argv[3]), err)
+	if !ok {
+		return
+	}
+
+	// Bits can only be set or cleared...
+	if on&^1 != 0 {
+		c.AddReplyError(err)
+		return
+	}
 
+	str := lookupStringForBitCommand(c, bitoffset)
+	if str == nil {
+		return
+	}
+
+	// Get current values
+	bytepos := bitoffset >> 3
+	byteval := str.Val[bytepos]
+	bit := 7 - uint(bitoffset&0x7)
+	bitval := byteval & (1 << bit)
+
+	// Update byte with new bit value and return original value
+	byteval &^= 1 << bit
+	byteval |= byte(on&0x1) << bit
+	str.Val[bytepos] = byteval
+	c.DB().SignalModifyKey(c.Argv[1])
+	c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_STRING, "setbit", c.Argv[1], c.DB().GetID())
+	c.Server().AddDirty(1)
+	if bitval != 0 {
+		c.AddReply(protocol.COne)
+	} else {
+		c.AddReply(protocol.CZero)
+	}
 }
 
+// GETBIT key offset
 func GETBITCommand(c *redigo.CommandArg) {
+	bitoffset, ok := getBitOffsetFromArgument(c, c.Argv[2], false, 0)
+	if !ok {
+		return
+	}
+
+	o := c.LookupKeyReadOrReply(c.Argv[1], protocol.CZero)
+	if o == nil {
+		return
+	}
+	s, ok := getStringBytesOrReply(c, o)
+	if !ok {
+		return
+	}
 
+	bytepos := bitoffset >> 3
+	bit := 7 - uint(bitoffset&0x7)
+	if bytepos < int64(len(s)) && s[bytepos]&(1<<bit) != 0 {
+		c.AddReply(protocol.COne)
+	} else {
+		c.AddReply(protocol.CZero)
+	}
 }
 
+// BITOP op_name target_key src_key1 src_key2 src_key3 ... src_keyN
 func BITOPCommand(c *redigo.CommandArg) {
+	var op int
 
+	// Parse the operation name.
+	switch strings.ToLower(string(c.Argv[1])) {
+	case "and":
+		op = BITOP_AND
+	case "or":
+		op = BITOP_OR
+	case "xor":
+		op = BITOP_XOR
+	case "not":
+		op = BITOP_NOT
+	default:
+		c.AddReply(protocol.SyntaxErr)
+		return
+	}
+
+	// Sanity check: NOT accepts only a single key argument.
+	if op == BITOP_NOT && c.Argc != 4 {
+		c.AddReplyError("BITOP NOT must be called with a single source key.")
+		return
+	}
+
+	// Lookup keys, and store pointers to the string objects into an array.
+	targetkey := c.Argv[2]
+	numkeys := c.Argc - 3
+	srcs := make([][]byte, numkeys)
+	var maxlen int
+	for j := 0; j < numkeys; j++ {
+		o := c.DB().LookupKeyRead(c.Argv[j+3])
+		// Handle non-existing keys as empty strings.
+		if o == nil {
+			continue
+		}
+		s, ok := getStringBytesOrReply(c, o)
+		if !ok {
+			return
+		}
+		srcs[j] = s
+		if len(s) > maxlen {
+			maxlen = len(s)
+		}
+	}
+
+	/* Compute the bit operation, if at least one string is not empty. The
+	 * shorter strings are handled as if they were padded with zero bytes. */
+	var res []byte
+	if maxlen > 0 {
+		res = make([]byte, maxlen)
+		for j := 0; j < maxlen; j++ {
+			var output byte
+			if j < len(srcs[0]) {
+				output = srcs[0][j]
+			}
+			if op == BITOP_NOT {
+				output = ^output
+			}
+			for i := 1; i < numkeys; i++ {
+				var b byte
+				if j < len(srcs[i]) {
+					b = srcs[i][j]
+				}
+				switch op {
+				case BITOP_AND:
+					output &= b
+				case BITOP_OR:
+					output |= b
+				case BITOP_XOR:
+					output ^= b
+				}
+			}
+			res[j] = output
+		}
+	}
+
+	// Store the computed value into the target key
+	if maxlen > 0 {
+		c.DB().SetKeyPersist(targetkey, &rstring.BytesString{Val: res})
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_STRING, "set", targetkey, c.DB().GetID())
+	} else if c.DB().Delete(targetkey) {
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "del", targetkey, c.DB().GetID())
+	}
+	c.DB().SignalModifyKey(targetkey)
+	c.Server().AddDirty(1)
+	c.AddReplyInt64(int64(maxlen))
 }
 
+// BITCOUNT key [start end [BIT|BYTE]]
 func BITCOUNTCommand(c *redigo.CommandArg) {
+	var start, end int64
+	var isbit, ok bool
+
+	// Parse start/end range if any.
+	if c.Argc == 4 || c.Argc == 5 {
+		if start, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[2]), ""); !ok {
+			return
+		}
+		if end, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[3]), ""); !ok {
+			return
+		}
+		if c.Argc == 5 {
+			if isbit, ok = parseBitRangeUnitOrReply(c, c.Argv[4]); !ok {
+				return
+			}
+		}
+	} else if c.Argc != 2 {
+		c.AddReply(protocol.SyntaxErr)
+		return
+	}
+
+	// Lookup, check for type, and return 0 for non existing keys.
+	o := c.LookupKeyReadOrReply(c.Argv[1], protocol.CZero)
+	if o == nil {
+		return
+	}
+	p, ok := getStringBytesOrReply(c, o)
+	if !ok {
+		return
+	}
+	strlen := int64(len(p))
 
+	var firstByteNegMask, lastByteNegMask byte
+	if c.Argc == 2 {
+		// The whole string.
+		start, end = 0, strlen-1
+	} else {
+		totlen := strlen
+		if isbit {
+			totlen <<= 3
+		}
+		start, end = normalizeBitRange(start, end, totlen)
+		if isbit && start <= end {
+			/* Before converting bit offset to byte offset, create negative
+			 * masks for the edges. */
+			firstByteNegMask, lastByteNegMask = bitRangeMasks(start, end)
+			start >>= 3
+			end >>= 3
+		}
+	}
+
+	// Precondition: end >= 0 && end < strlen, so the only condition where
+	// zero can be returned is: start > end.
+	if start > end {
+		c.AddReply(protocol.CZero)
+		return
+	}
+
+	count := redisPopcount(p[start : end+1])
+	if firstByteNegMask != 0 || lastByteNegMask != 0 {
+		// Remove the bits outside the range from the count.
+		count -= redisPopcount([]byte{p[start] & firstByteNegMask, p[end] & lastByteNegMask})
+	}
+	c.AddReplyInt64(count)
 }
 
+// BITPOS key bit [start [end [BIT|BYTE]]]
 func BITPOSCommand(c *redigo.CommandArg) {
+	var start, end int64
+	var isbit, endGiven, ok bool
+
+	// Parse the bit argument to understand what we are looking for, set
+	// or clear bits.
+	bit, ok := GetInt64FromStringOrReply(c, rstring.New(c.Argv[2]), "")
+	if !ok {
+		return
+	}
+	if bit != 0 && bit != 1 {
+		c.AddReplyError("The bit argument must be 1 or 0.")
+		return
+	}
+
+	// Parse start/end range if any.
+	if c.Argc == 4 || c.Argc == 5 || c.Argc == 6 {
+		if start, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[3]), ""); !ok {
+			return
+		}
+		if c.Argc == 6 {
+			if isbit, ok = parseBitRangeUnitOrReply(c, c.Argv[5]); !ok {
+				return
+			}
+		}
+		if c.Argc >= 5 {
+			if end, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[4]), ""); !ok {
+				return
+			}
+			endGiven = true
+		}
+	} else if c.Argc != 3 {
+		c.AddReply(protocol.SyntaxErr)
+		return
+	}
+
+	/* If the key does not exist, from our point of view it is an infinite
+	 * array of 0 bits. If the user is looking for the first clear bit return 0,
+	 * If the user is looking for the first set bit, return -1. */
+	o := c.DB().LookupKeyRead(c.Argv[1])
+	if o == nil {
+		if bit == 1 {
+			c.AddReplyInt64(-1)
+		} else {
+			c.AddReplyInt64(0)
+		}
+		return
+	}
+	p, ok := getStringBytesOrReply(c, o)
+	if !ok {
+		return
+	}
+	strlen := int64(len(p))
+
+	totlen := strlen
+	if isbit {
+		totlen <<= 3
+	}
+	if !endGiven {
+		end = totlen - 1
+	}
+	start, end = normalizeBitRange(start, end, totlen)
+
+	// For empty ranges (start > end) we return -1 as an empty range does
+	// not contain a 0 nor a 1.
+	if start > end {
+		c.AddReplyInt64(-1)
+		return
+	}
+
+	var firstByteNegMask, lastByteNegMask byte
+	if isbit {
+		/* Before converting bit offset to byte offset, create negative
+		 * masks for the edges. */
+		firstByteNegMask, lastByteNegMask = bitRangeMasks(start, end)
+		start >>= 3
+		end >>= 3
+	}
+
+	s := p[start : end+1]
+	if firstByteNegMask != 0 || lastByteNegMask != 0 {
+		/* The bits outside the range are set to the value we are not
+		 * looking for, on a copy of the range. */
+		s = append([]byte(nil), s...)
+		last := len(s) - 1
+		if bit == 1 {
+			s[0] &^= firstByteNegMask
+			s[last] &^= lastByteNegMask
+		} else {
+			s[0] |= firstByteNegMask
+			s[last] |= lastByteNegMask
+		}
+	}
+	pos := redisBitpos(s, int(bit))
+
+	/* If we are looking for clear bits, and the user specified an exact
+	 * range with start-end, we can't consider the right of the range as
+	 * zero padded (as we do when no explicit end is given).
+	 *
+	 * So if redisBitpos() returns the first bit outside the range,
+	 * we return -1 to the caller, to mean, in the specified range there
+	 * is not a single "0" bit. */
+	if endGiven && bit == 0 && pos == int64(len(s))*8 {
+		c.AddReplyInt64(-1)
+		return
+	}
+
+	/* If we are not looking for clear bits, or no explicit end was given,
+	 * the returned position is adjusted by the offset of the first byte of
+	 * the range. */
+	if pos != -1 {
+		pos += start * 8
+	}
+	c.AddReplyInt64(pos)
+}
+
+/* -----------------------------------------------------------------------------
+ * BITFIELD command.
+ * -------------------------------------------------------------------------- */
+
+const (
+	BITFIELDOP_GET = iota
+	BITFIELDOP_SET
+	BITFIELDOP_INCRBY
+)
+
+/* This structure represents a single operation for BITFIELD. */
+type bitfieldOp struct {
+	offset uint64 // Bitfield offset.
+	i64    int64  // Increment amount (INCRBY) or SET value
+	opcode int    // Operation id.
+	owtype int    // Overflow type to use.
+	bits   int    // Integer bitfield bits width.
+	sign   bool   // True if signed, otherwise unsigned op.
+}
+
+const (
+	BITFIELD_FLAG_NONE     = 0
+	BITFIELD_FLAG_READONLY = 1 << 0
+)
+
+/* BITFIELD key subcommand-1 arg ... subcommand-2 arg ... subcommand-N ...
+ *
+ * Supported subcommands:
+ *
+ * GET <type> <offset>
+ * SET <type> <offset> <value>
+ * INCRBY <type> <offset> <increment>
+ * OVERFLOW [WRAP|SAT|FAIL]
+ */
+func bitfieldGeneric(c *redigo.CommandArg, flags int) {
+	var ops []bitfieldOp
+	owtype := BFOVERFLOW_WRAP // Overflow type.
+	readonly := true
+	var highestWriteOffset uint64
+
+	for j := 2; j < c.Argc; j++ {
+		remargs := c.Argc - j - 1 // Remaining args other than current.
+		subcmd := strings.ToLower(string(c.Argv[j]))
+		var opcode int
+
+		// Get the subcommand name.
+		if subcmd == "get" && remargs >= 2 {
+			opcode = BITFIELDOP_GET
+		} else if subcmd == "set" && remargs >= 3 {
+			opcode = BITFIELDOP_SET
+		} else if subcmd == "incrby" && remargs >= 3 {
+			opcode = BITFIELDOP_INCRBY
+		} else if subcmd == "overflow" && remargs >= 1 {
+			j++
+			switch strings.ToLower(string(c.Argv[j])) {
+			case "wrap":
+				owtype = BFOVERFLOW_WRAP
+			case "sat":
+				owtype = BFOVERFLOW_SAT
+			case "fail":
+				owtype = BFOVERFLOW_FAIL
+			default:
+				c.AddReplyError("Invalid OVERFLOW type specified")
+				return
+			}
+			continue
+		} else {
+			c.AddReply(protocol.SyntaxErr)
+			return
+		}
+
+		// Get the type and offset arguments, common to all the ops.
+		sign, bits, ok := getBitfieldTypeFromArgument(c, c.Argv[j+1])
+		if !ok {
+			return
+		}
+		bitoffset, ok := getBitOffsetFromArgument(c, c.Argv[j+2], true, bits)
+		if !ok {
+			return
+		}
+
+		var i64 int64
+		if opcode != BITFIELDOP_GET {
+			readonly = false
+			if highestWriteOffset < uint64(bitoffset)+uint64(bits)-1 {
+				highestWriteOffset = uint64(bitoffset) + uint64(bits) - 1
+			}
+			// INCRBY and SET require another argument.
+			if i64, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[j+3]), ""); !ok {
+				return
+			}
+		}
+
+		// Populate the array of operations we'll process.
+		ops = append(ops, bitfieldOp{
+			offset: uint64(bitoffset),
+			i64:    i64,
+			opcode: opcode,
+			owtype: owtype,
+			bits:   bits,
+			sign:   sign,
+		})
+
+		if opcode == BITFIELDOP_GET {
+			j += 2
+		} else {
+			j += 3
+		}
+	}
+
+	var p []byte
+	var str *rstring.BytesString
+	if readonly {
+		/* Lookup for read is ok if key doesn't exit, but errors
+		 * if it's not a string. */
+		if o := c.DB().LookupKeyRead(c.Argv[1]); o != nil {
+			var ok bool
+			if p, ok = getStringBytesOrReply(c, o); !ok {
+				return
+			}
+		}
+	} else {
+		if flags&BITFIELD_FLAG_READONLY != 0 {
+			c.AddReplyError("BITFIELD_RO only supports the GET subcommand")
+			return
+		}
+
+		// Lookup by making room up to the farest bit reached by
+		// this operation.
+		if str = lookupStringForBitCommand(c, int64(highestWriteOffset)); str == nil {
+			return
+		}
+		p = str.Val
+	}
+
+	c.AddReplyMultiBulkLen(len(ops))
+
+	// Actually process the operations.
+	changes := 0
+	for _, op := range ops {
+		if op.opcode == BITFIELDOP_SET || op.opcode == BITFIELDOP_INCRBY {
+			/* SET and INCRBY: We handle both with the same code path
+			 * for simplicity. SET return value is the previous value so
+			 * we need fetch & store as well. */
+			var newval, retval uint64
+			var overflow int
+
+			// We need two different but very similar code paths for signed
+			// and unsigned operations, since the set of functions to get/set
+			// the integers and the used variables types are different.
+			if op.sign {
+				oldval := getSignedBitfield(p, op.offset, op.bits)
+				var wrapped int64
+				if op.opcode == BITFIELDOP_INCRBY {
+					newval = uint64(oldval) + uint64(op.i64)
+					wrapped, overflow = checkSignedBitfieldOverflow(oldval, op.i64, op.bits, op.owtype)
+					retval = newval
+				} else {
+					newval = uint64(op.i64)
+					wrapped, overflow = checkSignedBitfieldOverflow(op.i64, 0, op.bits, op.owtype)
+					retval = uint64(oldval)
+				}
+				if overflow != 0 {
+					newval = uint64(wrapped)
+					if op.opcode == BITFIELDOP_INCRBY {
+						retval = newval
+					}
+				}
+			} else {
+				oldval := getUnsignedBitfield(p, op.offset, op.bits)
+				var wrapped uint64
+				if op.opcode == BITFIELDOP_INCRBY {
+					newval = oldval + uint64(op.i64)
+					wrapped, overflow = checkUnsignedBitfieldOverflow(oldval, op.i64, op.bits, op.owtype)
+					retval = newval
+				} else {
+					newval = uint64(op.i64)
+					wrapped, overflow = checkUnsignedBitfieldOverflow(uint64(op.i64), 0, op.bits, op.owtype)
+					retval = oldval
+				}
+				if overflow != 0 {
+					newval = wrapped
+					if op.opcode == BITFIELDOP_INCRBY {
+						retval = newval
+					}
+				}
+			}
+
+			/* On overflow of type is "FAIL", don't write and return
+			 * NULL to signal the condition. */
+			if !(overflow != 0 && op.owtype == BFOVERFLOW_FAIL) {
+				c.AddReplyInt64(int64(retval))
+				setUnsignedBitfield(p, op.offset, op.bits, newval)
+			} else {
+				c.AddReply(protocol.NullBulk)
+			}
+			changes++
+		} else {
+			/* GET: the string may be shorter than the field, so the
+			 * bytes are copied into a zero padded buffer. */
+			var buf [9]byte
+			bytepos := op.offset >> 3
+			for i := uint64(0); i < uint64(len(buf)) && bytepos+i < uint64(len(p)); i++ {
+				buf[i] = p[bytepos+i]
+			}
+
+			offset := op.offset - bytepos*8
+			if op.sign {
+				c.AddReplyInt64(getSignedBitfield(buf[:], offset, op.bits))
+			} else {
+				c.AddReplyInt64(int64(getUnsignedBitfield(buf[:], offset, op.bits)))
+			}
+		}
+	}
+
+	if changes != 0 {
+		c.DB().SignalModifyKey(c.Argv[1])
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_STRING, "setbit", c.Argv[1], c.DB().GetID())
+		c.Server().AddDirty(changes)
+	}
+}
+
+// BITFIELD key [GET type offset] [SET type offset value] [INCRBY type offset incr] [OVERFLOW WRAP|SAT|FAIL]
+func BITFIELDCommand(c *redigo.CommandArg) {
+	bitfieldGeneric(c, BITFIELD_FLAG_NONE)
+}
 
+// BITFIELD_RO key [GET type offset]
+func BITFIELD_ROCommand(c *redigo.CommandArg) {
+	bitfieldGeneric(c, BITFIELD_FLAG_READONLY)
 }
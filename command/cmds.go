@@ -1,8 +1,10 @@
 package command
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/SteveZhangBit/redigo"
 	"github.com/SteveZhangBit/redigo/protocol"
@@ -10,12 +12,26 @@ import (
 
 /*============================== client commands ====================================*/
 func CLIENTCommand(c *redigo.CommandArg) {
+	if strings.ToLower(string(c.Argv[1])) == "list" && c.Argc == 2 {
+		c.AddReplyBulk([]byte(c.Server().GetAllClientsInfoString()))
+	} else {
+		c.AddReplyError("Syntax error, try CLIENT (LIST)")
+	}
 }
 
 /*================================= Server Side Commands ===================================== */
 
 func AUTHCommand(c *redigo.CommandArg) {
-
+	pass := c.Server().GetRequirePass()
+	if pass == "" {
+		c.AddReplyError("Client sent AUTH, but no password is set")
+	} else if subtle.ConstantTimeCompare(c.Argv[1], []byte(pass)) == 1 {
+		c.SetAuthenticated(true)
+		c.AddReply(protocol.OK)
+	} else {
+		c.SetAuthenticated(false)
+		c.AddReplyError("invalid password")
+	}
 }
 
 func PINGCommand(c *redigo.CommandArg) {
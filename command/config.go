@@ -1,9 +1,42 @@
 package command
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/SteveZhangBit/redigo"
+	"github.com/SteveZhangBit/redigo/protocol"
 )
 
+/*-----------------------------------------------------------------------------
+ * CONFIG command entry point
+ *----------------------------------------------------------------------------*/
+
 func CONFIGCommand(c *redigo.CommandArg) {
+	switch strings.ToLower(string(c.Argv[1])) {
+	case "get":
+		if c.Argc != 3 {
+			goto badarity
+		}
+		pairs := c.Server().ConfigGet(string(c.Argv[2]))
+		c.AddReplyMultiBulkLen(len(pairs))
+		for _, x := range pairs {
+			c.AddReplyBulk([]byte(x))
+		}
+	case "set":
+		if c.Argc != 4 {
+			goto badarity
+		}
+		if err := c.Server().ConfigSet(string(c.Argv[2]), string(c.Argv[3])); err != nil {
+			c.AddReplyError(err.Error())
+		} else {
+			c.AddReply(protocol.OK)
+		}
+	default:
+		c.AddReplyError("CONFIG subcommand must be one of GET, SET")
+	}
+	return
 
+badarity:
+	c.AddReplyError(fmt.Sprintf("Wrong number of arguments for CONFIG %s", c.Argv[1]))
 }
@@ -2,6 +2,9 @@ package command
 
 import (
 	"bytes"
+	"math"
+	"strconv"
+	"strings"
 
 	"github.com/SteveZhangBit/redigo"
 	"github.com/SteveZhangBit/redigo/protocol"
@@ -89,6 +92,93 @@ func KEYSCommand(c *redigo.CommandArg) {
 	}
 }
 
+/* Try to parse a SCAN cursor stored at arg: if the cursor is valid return
+ * it and true, otherwise reply with an error and return false. */
+func parseScanCursorOrReply(c *redigo.CommandArg, arg []byte) (uint64, bool) {
+	/* Use strconv.ParseUint() to perform an unsigned conversion, rejecting
+	 * signs, spaces and trailing garbage. */
+	cursor, err := strconv.ParseUint(string(arg), 10, 64)
+	if err != nil {
+		c.AddReplyError("invalid cursor")
+		return 0, false
+	}
+	return cursor, true
+}
+
+/* This command implements SCAN, HSCAN and SSCAN commands.
+ * The object o must be a Hash object, the only one scanned for now.
+ *
+ * When the object is encoded as a listpack all the elements are returned
+ * in a single call, with a zero cursor.
+ *
+ * The function returns the elements in the output of the scan, after the
+ * MATCH filter is applied: the COUNT option is just a hint about how many
+ * elements are visited. */
+func scanGeneric(c *redigo.CommandArg, o interface{}, cursor uint64) {
+	count := 10
+	var pattern []byte
+	novalues := false
+
+	// Step 1: Parse options. Object is always the first argument.
+	for i := 3; i < c.Argc; i++ {
+		opt := strings.ToLower(string(c.Argv[i]))
+		if opt == "count" && i+1 < c.Argc {
+			x, ok := GetInt64FromStringOrReply(c, rstring.New(c.Argv[i+1]), "")
+			if !ok {
+				return
+			}
+			if x < 1 || x > math.MaxInt32 {
+				c.AddReply(protocol.SyntaxErr)
+				return
+			}
+			count = int(x)
+			i++
+		} else if opt == "match" && i+1 < c.Argc {
+			pattern = c.Argv[i+1]
+			// The pattern always matches if it is exactly "*".
+			if len(pattern) == 1 && pattern[0] == '*' {
+				pattern = nil
+			}
+			i++
+		} else if opt == "novalues" {
+			if _, ok := o.(rtype.HashMap); !ok {
+				c.AddReplyError("NOVALUES option can only be used in HSCAN")
+				return
+			}
+			novalues = true
+		} else {
+			c.AddReply(protocol.SyntaxErr)
+			return
+		}
+	}
+
+	/* Step 2: Iterate the collection, filtering the elements with MATCH.
+	 * A key-value pair is filtered by the key. */
+	var elems [][]byte
+	switch v := o.(type) {
+	case rtype.HashMap:
+		cursor = v.Scan(cursor, count, func(key []byte, val rtype.String) {
+			if pattern != nil && !util.MatchPattern(pattern, key, false) {
+				return
+			}
+			elems = append(elems, key)
+			if !novalues {
+				elems = append(elems, val.Bytes())
+			}
+		})
+	default:
+		panic("Not handled encoding in SCAN.")
+	}
+
+	// Step 3: Reply to the client.
+	c.AddReplyMultiBulkLen(2)
+	c.AddReplyBulk([]byte(strconv.FormatUint(cursor, 10)))
+	c.AddReplyMultiBulkLen(len(elems))
+	for _, elem := range elems {
+		c.AddReplyBulk(elem)
+	}
+}
+
 func SCANCommand(c *redigo.CommandArg) {
 
 }
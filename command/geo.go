@@ -0,0 +1,751 @@
+package command
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SteveZhangBit/redigo"
+	"github.com/SteveZhangBit/redigo/protocol"
+	"github.com/SteveZhangBit/redigo/rtype"
+	"github.com/SteveZhangBit/redigo/rtype/rstring"
+	"github.com/SteveZhangBit/redigo/util/geohash"
+)
+
+/*-----------------------------------------------------------------------------
+ * GEO commands
+ *----------------------------------------------------------------------------*/
+
+/* Geo positions are stored as sorted set members, whose score is the 52 bit
+ * geohash (see util/geohash) of the position. */
+
+// georadiusGeneric() flags.
+const (
+	REDIS_GEO_RADIUS_COORDS  = 1 << iota // Search around coordinates.
+	REDIS_GEO_RADIUS_MEMBER              // Search around member.
+	REDIS_GEO_RADIUS_NOSTORE             // Do not accept STORE/STOREDIST option.
+	REDIS_GEO_SEARCH                     // GEOSEARCH command variant (different arguments supported)
+	REDIS_GEO_SEARCHSTORE                // GEOSEARCHSTORE just accept STOREDIST option
+)
+
+// Sorting of the search results.
+const (
+	REDIS_GEO_SORT_NONE = iota
+	REDIS_GEO_SORT_ASC
+	REDIS_GEO_SORT_DESC
+)
+
+// Represent a point found by a search.
+type geoPoint struct {
+	longitude, latitude float64
+	dist                float64
+	score               float64
+	member              []byte
+}
+
+/* Input Argument Helper
+ * Take a pointer to the longitude arg then use the next arg for latitude. */
+func extractLongLatOrReply(c *redigo.CommandArg, argv [][]byte) (xy [2]float64, ok bool) {
+	for i := 0; i < 2; i++ {
+		if xy[i], ok = GetFloat64FromStringOrReply(c, rstring.New(argv[i]), ""); !ok {
+			return
+		}
+	}
+	if xy[0] < geohash.GEO_LONG_MIN || xy[0] > geohash.GEO_LONG_MAX ||
+		xy[1] < geohash.GEO_LAT_MIN || xy[1] > geohash.GEO_LAT_MAX {
+		c.AddReplyError(fmt.Sprintf("invalid longitude,latitude pair %f,%f", xy[0], xy[1]))
+		return xy, false
+	}
+	return xy, true
+}
+
+// Decode the longitude, latitude pair from the geohash score of an element.
+func decodeGeohash(bits float64) ([2]float64, bool) {
+	hash := geohash.HashBits{Bits: uint64(bits), Step: geohash.GEO_STEP_MAX}
+	return geohash.DecodeToLongLatWGS84(hash)
+}
+
+/* Input Argument Helper
+ * Decode lat/long from a zset member's score. */
+func longLatFromMember(z rtype.ZSet, member []byte) (xy [2]float64, ok bool) {
+	score, ok := z.Get(rstring.New(member))
+	if !ok {
+		return
+	}
+	return decodeGeohash(score)
+}
+
+/* Check that the unit argument matches one of the known units, and returns
+ * the conversion factor to meters (you need to divide meters by the conversion
+ * factor to convert to the right unit).
+ *
+ * If the unit is not valid, an error is reported to the client, and a value
+ * less than zero is returned. */
+func extractUnitOrReply(c *redigo.CommandArg, unit []byte) float64 {
+	switch strings.ToLower(string(unit)) {
+	case "m":
+		return 1
+	case "km":
+		return 1000
+	case "ft":
+		return 0.3048
+	case "mi":
+		return 1609.34
+	default:
+		c.AddReplyError("unsupported unit provided. please use M, KM, FT, MI")
+		return -1
+	}
+}
+
+/* Input Argument Helper.
+ * Extract the distance from the specified two arguments starting at 'argv'
+ * that should be in the form: <number> <unit>. The conversion is the
+ * coefficient to use in order to convert meters to the unit. */
+func extractDistanceOrReply(c *redigo.CommandArg, argv [][]byte) (conversion, radius float64, ok bool) {
+	if radius, ok = GetFloat64FromStringOrReply(c, rstring.New(argv[0]), "need numeric radius"); !ok {
+		return
+	}
+	if radius < 0 {
+		c.AddReplyError("radius cannot be negative")
+		return 0, 0, false
+	}
+
+	if conversion = extractUnitOrReply(c, argv[1]); conversion < 0 {
+		return 0, 0, false
+	}
+	return conversion, radius, true
+}
+
+/* Input Argument Helper.
+ * Extract height and width from the specified three arguments starting at 'argv'
+ * that should be in the form: <number> <number> <unit>. */
+func extractBoxOrReply(c *redigo.CommandArg, argv [][]byte) (conversion, width, height float64, ok bool) {
+	if width, ok = GetFloat64FromStringOrReply(c, rstring.New(argv[0]), "need numeric width"); !ok {
+		return
+	}
+	if height, ok = GetFloat64FromStringOrReply(c, rstring.New(argv[1]), "need numeric height"); !ok {
+		return
+	}
+	if height < 0 || width < 0 {
+		c.AddReplyError("height or width cannot be negative")
+		return 0, 0, 0, false
+	}
+
+	if conversion = extractUnitOrReply(c, argv[2]); conversion < 0 {
+		return 0, 0, 0, false
+	}
+	return conversion, width, height, true
+}
+
+/* The default AddReplyFloat64 has too much accuracy. We use this
+ * for returning location distances. "5.2145 meters away" is nicer
+ * than "5.2144992818115 meters away." We provide 4 digits after the dot
+ * so that the returned value is decently accurate even when the unit is
+ * the kilometer. */
+func addReplyDoubleDistance(c *redigo.CommandArg, d float64) {
+	c.AddReplyBulk([]byte(strconv.FormatFloat(d, 'f', 4, 64)))
+}
+
+/* Reply the coordinate in a human friendly form: 17 digits after the dot,
+ * without the trailing zeroes. */
+func addReplyHumanFloat64(c *redigo.CommandArg, x float64) {
+	s := strconv.FormatFloat(x, 'f', 17, 64)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	c.AddReplyBulk([]byte(s))
+}
+
+/* Helper function for geoGetPointsInRange(): given a sorted set score
+ * representing a point, and a GeoShape, checks if the point is within the search area.
+ *
+ * The return value is true if the point is within search area, with the decoded
+ * lat,long and the distance between the center of the shape and the point. */
+func geoWithinShape(shape *geohash.Shape, score float64) (xy [2]float64, distance float64, ok bool) {
+	if xy, ok = decodeGeohash(score); !ok {
+		return // Can't decode.
+	}
+
+	/* Note that GetDistanceIfInRadiusWGS84() takes arguments in
+	 * reverse order: longitude first, latitude later. */
+	if shape.Type == geohash.CIRCULAR_TYPE {
+		distance, ok = geohash.GetDistanceIfInRadiusWGS84(shape.XY[0], shape.XY[1], xy[0], xy[1],
+			shape.Radius*shape.Conversion)
+	} else {
+		distance, ok = geohash.GetDistanceIfInRectangle(shape.Width*shape.Conversion,
+			shape.Height*shape.Conversion, shape.XY[0], shape.XY[1], xy[0], xy[1])
+	}
+	return
+}
+
+/* Query a sorted set to extract all the elements between 'min' and
+ * 'max', appending them into the array of geoPoint structures 'ga'.
+ *
+ * Elements which are outside the search shape are not included.
+ *
+ * The ability of this function to append to an existing set of points is
+ * important for good performances because querying by radius is performed
+ * using multiple queries to the sorted set, that we later need to sort.
+ * Similarly we need to be able to reject points outside the search
+ * radius area ASAP in order to allocate and process more points than needed. */
+func geoGetPointsInRange(z rtype.ZSet, min, max float64, shape *geohash.Shape, ga []geoPoint, limit int64) []geoPoint {
+	/* MinEx false = include min in range; MaxEx true = exclude max in range.
+	 * That's: min <= val < max */
+	spec := &rtype.ZRangeSpec{Min: min, Max: max, MinEx: false, MaxEx: true}
+
+	for ln := z.FirstInRange(spec); ln != nil; ln = ln.Next() {
+		score := ln.Score()
+		// If we fell out of range, break.
+		if !spec.ValueLteMax(score) {
+			break
+		}
+		if xy, distance, ok := geoWithinShape(shape, score); ok {
+			ga = append(ga, geoPoint{
+				longitude: xy[0],
+				latitude:  xy[1],
+				dist:      distance,
+				score:     score,
+				member:    ln.Value().Bytes(),
+			})
+		}
+		if len(ga) > 0 && limit > 0 && int64(len(ga)) >= limit {
+			break
+		}
+	}
+	return ga
+}
+
+/* Compute the sorted set scores min (inclusive), max (exclusive) we should
+ * query in order to retrieve all the elements inside the specified area
+ * 'hash'.
+ *
+ * We want to compute the sorted set scores that will include all the
+ * elements inside the specified Geohash 'hash', which has as many
+ * bits as specified by hash.Step * 2.
+ *
+ * So if step is, for example, 3, and the hash value in binary
+ * is 101010, since our score is 52 bits we want every element which
+ * is in binary: 101010?????????????????????????????????????????????
+ * Where ? can be 0 or 1.
+ *
+ * To get the min score we just use the initial hash value left
+ * shifted enough to get the 52 bit value. Later we increment the
+ * 6 bit prefix (see the hash.Bits++ statement), and get the new
+ * prefix: 101011, which we align again to 52 bits to get the maximum
+ * value (which is excluded from the search). So we get everything
+ * between the two following scores (represented in binary):
+ *
+ * 1010100000000000000000000000000000000000000000000000 (included)
+ * and
+ * 1010110000000000000000000000000000000000000000000000 (excluded). */
+func scoresOfGeoHashBox(hash geohash.HashBits) (min, max uint64) {
+	min = geohash.Align52Bits(hash)
+	hash.Bits++
+	max = geohash.Align52Bits(hash)
+	return
+}
+
+// Search all eight neighbors + self geohash box.
+func membersOfAllNeighbors(z rtype.ZSet, n *geohash.HashRadius, shape *geohash.Shape, limit int64) []geoPoint {
+	neighbors := [...]geohash.HashBits{
+		n.Hash,
+		n.Neighbors.North,
+		n.Neighbors.South,
+		n.Neighbors.East,
+		n.Neighbors.West,
+		n.Neighbors.NorthEast,
+		n.Neighbors.NorthWest,
+		n.Neighbors.SouthEast,
+		n.Neighbors.SouthWest,
+	}
+
+	var ga []geoPoint
+	lastProcessed := 0
+	/* For each neighbor (*and* our own hashbox), get all the matching
+	 * members and add them to the potential result list. */
+	for i := range neighbors {
+		if neighbors[i].IsZero() {
+			continue
+		}
+
+		/* When a huge Radius (in the 5000 km range or more) is used,
+		 * adjacent neighbors can be the same, leading to duplicated
+		 * elements. Skip every range which is the same as the one
+		 * processed previously. */
+		if lastProcessed != 0 && neighbors[i] == neighbors[lastProcessed] {
+			continue
+		}
+		if len(ga) > 0 && limit > 0 && int64(len(ga)) >= limit {
+			break
+		}
+		min, max := scoresOfGeoHashBox(neighbors[i])
+		ga = geoGetPointsInRange(z, float64(min), float64(max), shape, ga, limit)
+		lastProcessed = i
+	}
+	return ga
+}
+
+/* GEOADD key [CH] [NX|XX] long lat name [long2 lat2 name2 ... longN latN nameN] */
+func GEOADDCommand(c *redigo.CommandArg) {
+	var xx, nx bool
+
+	/* Parse options. At the end 'longidx' is set to the argument position
+	 * of the longitude of the first element. */
+	longidx := 2
+	for ; longidx < c.Argc; longidx++ {
+		switch strings.ToLower(string(c.Argv[longidx])) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "ch":
+			// Handle in zaddGeneric.
+		default:
+			goto parsed
+		}
+	}
+parsed:
+
+	if (c.Argc-longidx)%3 != 0 || (xx && nx) {
+		// Need an odd number of arguments if we got this far...
+		c.AddReply(protocol.SyntaxErr)
+		return
+	}
+
+	// Set up the vector for calling ZADD.
+	elements := (c.Argc - longidx) / 3
+	argv := make([][]byte, longidx+elements*2) // ZADD key [CH] [NX|XX] score ele ...
+	argv[0] = []byte("zadd")
+	copy(argv[1:], c.Argv[1:longidx])
+
+	/* Create the argument vector to call ZADD in order to add all
+	 * the score,value pairs to the requested zset, where score is actually
+	 * an encoded version of lat,long. */
+	for i := 0; i < elements; i++ {
+		xy, ok := extractLongLatOrReply(c, c.Argv[longidx+i*3:])
+		if !ok {
+			return
+		}
+
+		// Turn the coordinates into the score of the element.
+		hash, _ := geohash.EncodeWGS84(xy[0], xy[1], geohash.GEO_STEP_MAX)
+		bits := geohash.Align52Bits(hash)
+		argv[longidx+i*2] = []byte(strconv.FormatUint(bits, 10))
+		argv[longidx+1+i*2] = c.Argv[longidx+i*3+2]
+	}
+
+	// Finally call ZADD that will do the work for us.
+	c.Argv, c.Argc = argv, len(argv)
+	zaddGeneric(c, REDIS_ZADD_IN_NONE)
+}
+
+/* GEOSEARCH key [FROMMEMBER member] [FROMLONLAT long lat] [BYRADIUS radius unit]
+ *               [BYBOX width height unit] [WITHCOORD] [WITHDIST] [WITHASH] [COUNT count [ANY]] [ASC|DESC]
+ *
+ * GEOSEARCHSTORE dest_key src_key [FROMMEMBER member] [FROMLONLAT long lat] [BYRADIUS radius unit]
+ *               [BYBOX width height unit] [COUNT count [ANY]] [ASC|DESC] [STOREDIST]
+ *  */
+func georadiusGeneric(c *redigo.CommandArg, srcKeyIndex int, flags int) {
+	var storekey []byte
+	storedist := false // false for STORE, true for STOREDIST.
+
+	// Look up the requested zset
+	var z rtype.ZSet
+	if o := c.DB().LookupKeyRead(c.Argv[srcKeyIndex]); o != nil {
+		var ok bool
+		if z, ok = o.(rtype.ZSet); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+			return
+		}
+	}
+
+	// Find long/lat to use for radius or box search based on inquiry type
+	var baseArgs int
+	var shape geohash.Shape
+	if flags&REDIS_GEO_SEARCH != 0 {
+		// GEOSEARCH or GEOSEARCHSTORE
+		baseArgs = 2
+		if flags&REDIS_GEO_SEARCHSTORE != 0 {
+			baseArgs = 3
+			storekey = c.Argv[1]
+		}
+	} else {
+		c.AddReplyError("Unknown georadius search type")
+		return
+	}
+
+	// Discover and populate all optional parameters.
+	var withdist, withhash, withcoords bool
+	var frommember, fromloc, byradius, bybox bool
+	sorting := REDIS_GEO_SORT_NONE
+	any := false    // any=true means a limited search, stop as soon as enough results were found.
+	var count int64 // Max number of results to return. 0 means unlimited.
+	remaining := c.Argc - baseArgs
+	for i := 0; i < remaining; i++ {
+		arg := strings.ToLower(string(c.Argv[baseArgs+i]))
+		switch {
+		case arg == "withdist":
+			withdist = true
+		case arg == "withhash":
+			withhash = true
+		case arg == "withcoord":
+			withcoords = true
+		case arg == "any":
+			any = true
+		case arg == "asc":
+			sorting = REDIS_GEO_SORT_ASC
+		case arg == "desc":
+			sorting = REDIS_GEO_SORT_DESC
+		case arg == "count" && i+1 < remaining:
+			var ok bool
+			if count, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[baseArgs+i+1]), ""); !ok {
+				return
+			}
+			if count <= 0 {
+				c.AddReplyError("COUNT must be > 0")
+				return
+			}
+			i++
+		case arg == "storedist" && flags&REDIS_GEO_SEARCHSTORE != 0:
+			storedist = true
+		case arg == "frommember" && i+1 < remaining && !fromloc:
+			// No source key, proceed with argument parsing and return an error when done.
+			if z != nil {
+				var ok bool
+				if shape.XY, ok = longLatFromMember(z, c.Argv[baseArgs+i+1]); !ok {
+					c.AddReplyError("could not decode requested zset member")
+					return
+				}
+			}
+			frommember = true
+			i++
+		case arg == "fromlonlat" && i+2 < remaining && !frommember:
+			var ok bool
+			if shape.XY, ok = extractLongLatOrReply(c, c.Argv[baseArgs+i+1:]); !ok {
+				return
+			}
+			fromloc = true
+			i += 2
+		case arg == "byradius" && i+2 < remaining && !bybox:
+			var ok bool
+			if shape.Conversion, shape.Radius, ok = extractDistanceOrReply(c, c.Argv[baseArgs+i+1:]); !ok {
+				return
+			}
+			shape.Type = geohash.CIRCULAR_TYPE
+			byradius = true
+			i += 2
+		case arg == "bybox" && i+3 < remaining && !byradius:
+			var ok bool
+			if shape.Conversion, shape.Width, shape.Height, ok = extractBoxOrReply(c, c.Argv[baseArgs+i+1:]); !ok {
+				return
+			}
+			shape.Type = geohash.RECTANGLE_TYPE
+			bybox = true
+			i += 3
+		default:
+			c.AddReply(protocol.SyntaxErr)
+			return
+		}
+	}
+
+	// Trap options not compatible with STORE and STOREDIST.
+	if storekey != nil && (withdist || withhash || withcoords) {
+		c.AddReplyError("GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+		return
+	}
+
+	if !frommember && !fromloc {
+		c.AddReplyError(fmt.Sprintf("exactly one of FROMMEMBER or FROMLONLAT can be specified for %s", c.Argv[0]))
+		return
+	}
+
+	if !byradius && !bybox {
+		c.AddReplyError(fmt.Sprintf("exactly one of BYRADIUS and BYBOX can be specified for %s", c.Argv[0]))
+		return
+	}
+
+	if any && count == 0 {
+		c.AddReplyError("the ANY argument requires COUNT argument")
+		return
+	}
+
+	// Return ASAP when src key does not exist.
+	if z == nil {
+		if storekey != nil {
+			// store key is not nil, try to delete it and return 0.
+			if c.DB().Delete(storekey) {
+				c.DB().SignalModifyKey(storekey)
+				c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "del", storekey, c.DB().GetID())
+				c.Server().AddDirty(1)
+			}
+			c.AddReply(protocol.CZero)
+		} else {
+			// Otherwise we return an empty array.
+			c.AddReply(protocol.EmptyMultiBulk)
+		}
+		return
+	}
+
+	/* COUNT without ordering does not make much sense (we need to
+	 * sort in order to return the closest N entries),
+	 * force ASC ordering if COUNT was specified but no sorting was
+	 * requested. Note that this is not needed for ANY option. */
+	if count != 0 && sorting == REDIS_GEO_SORT_NONE && !any {
+		sorting = REDIS_GEO_SORT_ASC
+	}
+
+	// Get all neighbor geohash boxes for our radius search
+	georadius := geohash.CalculateAreasByShapeWGS84(&shape)
+
+	// Search the zset for all matching points
+	var limit int64
+	if any {
+		limit = count
+	}
+	ga := membersOfAllNeighbors(z, &georadius, &shape, limit)
+
+	// If no matching results, the user gets an empty reply.
+	if len(ga) == 0 && storekey == nil {
+		c.AddReply(protocol.EmptyMultiBulk)
+		return
+	}
+
+	returnedItems := len(ga)
+	if count != 0 && int64(returnedItems) > count {
+		returnedItems = int(count)
+	}
+
+	// Process [optional] requested sorting
+	switch sorting {
+	case REDIS_GEO_SORT_ASC:
+		sortGeoPoints(ga, func(a, b *geoPoint) bool { return a.dist < b.dist })
+	case REDIS_GEO_SORT_DESC:
+		sortGeoPoints(ga, func(a, b *geoPoint) bool { return a.dist > b.dist })
+	}
+	ga = ga[:returnedItems]
+
+	if storekey == nil {
+		// No target key, return results to user.
+
+		/* Our options are self-contained nested multibulk replies, so we
+		 * only need to track how many of those nested replies we return. */
+		optionLength := 0
+		if withdist {
+			optionLength++
+		}
+		if withcoords {
+			optionLength++
+		}
+		if withhash {
+			optionLength++
+		}
+
+		/* The array len we send is exactly returnedItems. The result is
+		 * either all strings of just zset members *or* a nested multi-bulk
+		 * reply containing the zset member string _and_ all the additional
+		 * options the user enabled for this request. */
+		c.AddReplyMultiBulkLen(returnedItems)
+
+		// Finally send results back to the caller
+		for i := range ga {
+			gp := &ga[i]
+			gp.dist /= shape.Conversion // Fix according to unit.
+
+			/* If we have options in optionLength, return each sub-result
+			 * as a nested multi-bulk. Add 1 to account for result value
+			 * itself. */
+			if optionLength > 0 {
+				c.AddReplyMultiBulkLen(optionLength + 1)
+			}
+
+			c.AddReplyBulk(gp.member)
+
+			if withdist {
+				addReplyDoubleDistance(c, gp.dist)
+			}
+
+			if withhash {
+				c.AddReplyInt64(int64(gp.score))
+			}
+
+			if withcoords {
+				c.AddReplyMultiBulkLen(2)
+				addReplyHumanFloat64(c, gp.longitude)
+				addReplyHumanFloat64(c, gp.latitude)
+			}
+		}
+	} else {
+		// Target key, create a sorted set with the results.
+		maxelelen := 0
+		for i := range ga {
+			if len(ga[i].member) > maxelelen {
+				maxelelen = len(ga[i].member)
+			}
+		}
+
+		dstzset := zsetTypeCreate(returnedItems, maxelelen)
+		for i := range ga {
+			gp := &ga[i]
+			gp.dist /= shape.Conversion // Fix according to unit.
+			score := gp.score
+			if storedist {
+				score = gp.dist
+			}
+			dstzset.Add(score, &rstring.BytesString{Val: gp.member})
+		}
+
+		if returnedItems > 0 {
+			c.DB().SetKeyPersist(storekey, dstzset)
+			c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_ZSET, "geosearchstore", storekey, c.DB().GetID())
+			c.Server().AddDirty(returnedItems)
+		} else if c.DB().Delete(storekey) {
+			c.DB().SignalModifyKey(storekey)
+			c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "del", storekey, c.DB().GetID())
+			c.Server().AddDirty(1)
+		}
+		c.AddReplyInt64(int64(returnedItems))
+	}
+}
+
+func sortGeoPoints(ga []geoPoint, less func(a, b *geoPoint) bool) {
+	sort.Slice(ga, func(i, j int) bool { return less(&ga[i], &ga[j]) })
+}
+
+// GEOSEARCH key options...
+func GEOSEARCHCommand(c *redigo.CommandArg) {
+	georadiusGeneric(c, 1, REDIS_GEO_SEARCH)
+}
+
+// GEOSEARCHSTORE dest_key src_key options...
+func GEOSEARCHSTORECommand(c *redigo.CommandArg) {
+	georadiusGeneric(c, 2, REDIS_GEO_SEARCH|REDIS_GEO_SEARCHSTORE)
+}
+
+/* GEOHASH key ele1 ele2 ... eleN
+ *
+ * Returns an array with an 11 characters geohash representation of the
+ * position of the specified elements. */
+func GEOHASHCommand(c *redigo.CommandArg) {
+	const geoalphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+	// Look up the requested zset
+	var z rtype.ZSet
+	if o := c.DB().LookupKeyRead(c.Argv[1]); o != nil {
+		var ok bool
+		if z, ok = o.(rtype.ZSet); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+			return
+		}
+	}
+
+	/* Geohash elements one after the other, using a null bulk reply for
+	 * missing elements. */
+	c.AddReplyMultiBulkLen(c.Argc - 2)
+	for j := 2; j < c.Argc; j++ {
+		var xy [2]float64
+		ok := false
+		if z != nil {
+			xy, ok = longLatFromMember(z, c.Argv[j])
+		}
+		if !ok {
+			c.AddReply(protocol.NullBulk)
+			continue
+		}
+
+		/* The internal format we use for geocoding is a bit different
+		 * than the standard, since we use as initial latitude range
+		 * -85,85, while the normal geohashing algorithm uses -90,90.
+		 * So we have to decode our position and re-encode using the
+		 * standard ranges in order to output a valid geohash string. */
+		hash, _ := geohash.Encode(geohash.HashRange{Min: -180, Max: 180},
+			geohash.HashRange{Min: -90, Max: 90}, xy[0], xy[1], geohash.GEO_STEP_MAX)
+
+		buf := make([]byte, 11)
+		for i := range buf {
+			idx := 0
+			/* We have just 52 bits, but the API used to output
+			 * an 11 bytes geohash. For compatibility we assume
+			 * zero for the last one. */
+			if i < 10 {
+				idx = int((hash.Bits >> (52 - (uint(i)+1)*5)) & 0x1f)
+			}
+			buf[i] = geoalphabet[idx]
+		}
+		c.AddReplyBulk(buf)
+	}
+}
+
+/* GEOPOS key ele1 ele2 ... eleN
+ *
+ * Returns an array of two-items arrays representing the x,y position of each
+ * element specified in the arguments. For missing elements NULL is returned. */
+func GEOPOSCommand(c *redigo.CommandArg) {
+	// Look up the requested zset
+	var z rtype.ZSet
+	if o := c.DB().LookupKeyRead(c.Argv[1]); o != nil {
+		var ok bool
+		if z, ok = o.(rtype.ZSet); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+			return
+		}
+	}
+
+	// Report elements one after the other, using a null bulk reply for missing elements.
+	c.AddReplyMultiBulkLen(c.Argc - 2)
+	for j := 2; j < c.Argc; j++ {
+		var xy [2]float64
+		ok := false
+		if z != nil {
+			xy, ok = longLatFromMember(z, c.Argv[j])
+		}
+		if !ok {
+			c.AddReply(protocol.NullMultiBulk)
+			continue
+		}
+		c.AddReplyMultiBulkLen(2)
+		addReplyHumanFloat64(c, xy[0])
+		addReplyHumanFloat64(c, xy[1])
+	}
+}
+
+/* GEODIST key ele1 ele2 [unit]
+ *
+ * Return the distance, in meters by default, otherwise according to "unit",
+ * between points ele1 and ele2. If one or more elements are missing NULL
+ * is returned. */
+func GEODISTCommand(c *redigo.CommandArg) {
+	toMeter := 1.0
+
+	// Check if there is the unit to extract, otherwise assume meters.
+	if c.Argc == 5 {
+		if toMeter = extractUnitOrReply(c, c.Argv[4]); toMeter < 0 {
+			return
+		}
+	} else if c.Argc > 5 {
+		c.AddReply(protocol.SyntaxErr)
+		return
+	}
+
+	// Look up the requested zset
+	var z rtype.ZSet
+	if o := c.LookupKeyReadOrReply(c.Argv[1], protocol.NullBulk); o == nil {
+		return
+	} else {
+		var ok bool
+		if z, ok = o.(rtype.ZSet); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+			return
+		}
+	}
+
+	// Get the positions. We need both otherwise NULL is returned.
+	xy1, ok1 := longLatFromMember(z, c.Argv[2])
+	xy2, ok2 := longLatFromMember(z, c.Argv[3])
+	if !ok1 || !ok2 {
+		c.AddReply(protocol.NullBulk)
+		return
+	}
+
+	// Compute the distance.
+	addReplyDoubleDistance(c, geohash.GetDistance(xy1[0], xy1[1], xy2[0], xy2[1])/toMeter)
+}
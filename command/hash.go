@@ -1,7 +1,12 @@
 package command
 
 import (
+	"fmt"
 	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/SteveZhangBit/redigo"
 	"github.com/SteveZhangBit/redigo/protocol"
@@ -16,7 +21,7 @@ import (
 
 func hashLookupWriteOrCreate(c *redigo.CommandArg, key []byte) (h rtype.HashMap) {
 	if o := c.DB().LookupKeyWrite(key); o == nil {
-		h = hash.New()
+		h = hash.NewListpack()
 		c.DB().Add(key, h)
 	} else {
 		var ok bool
@@ -27,12 +32,48 @@ func hashLookupWriteOrCreate(c *redigo.CommandArg, key []byte) (h rtype.HashMap)
 	return
 }
 
+/* Add a new field, overwrite the old with the new value if it already exists.
+ * Return false on insert and true on update.
+ *
+ * A listpack is converted to a hash table when the field or the value is
+ * longer than hash-max-listpack-value, or when the hash grows past
+ * hash-max-listpack-entries: the converted hash takes the place of the old
+ * one in the DB and is returned to the caller. */
+func hashTypeSet(c *redigo.CommandArg, key []byte, h rtype.HashMap, field []byte, val rtype.String) (rtype.HashMap, bool) {
+	if lh, ok := h.(*hash.ListpackMap); ok {
+		if len(field) > hash.MaxListpackValue || int(val.Len()) > hash.MaxListpackValue {
+			h = lh.Convert()
+			c.DB().Update(key, h)
+		} else {
+			update := lh.Set(field, val)
+			// Check if the listpack needs to be converted to a hash table.
+			if lh.Len() > hash.MaxListpackEntries {
+				h = lh.Convert()
+				c.DB().Update(key, h)
+			}
+			return h, update
+		}
+	}
+	return h, h.Set(field, val)
+}
+
+/* Like hashTypeSet, but the expire of the field, if any, is retained instead
+ * of being removed as when the field is overwritten. */
+func hashTypeSetKeepTTL(c *redigo.CommandArg, key []byte, h rtype.HashMap, field []byte, val rtype.String) (rtype.HashMap, bool) {
+	when := h.GetExpire(field)
+	h, update := hashTypeSet(c, key, h, field, val)
+	if when >= 0 {
+		c.DB().SetFieldExpire(key, field, when)
+	}
+	return h, update
+}
+
 func HSETCommand(c *redigo.CommandArg) {
 	var h rtype.HashMap
 	if h = hashLookupWriteOrCreate(c, c.Argv[1]); h == nil {
 		return
 	}
-	update := h.Set(c.Argv[2], rstring.New(c.Argv[3]))
+	_, update := hashTypeSet(c, c.Argv[1], h, c.Argv[2], rstring.New(c.Argv[3]))
 	if update {
 		c.AddReply(protocol.CZero)
 	} else {
@@ -51,7 +92,7 @@ func HSETNXCommand(c *redigo.CommandArg) {
 	if _, ok := h.Get(c.Argv[2]); ok {
 		c.AddReply(protocol.CZero)
 	} else {
-		h.Set(c.Argv[2], rstring.New(c.Argv[3]))
+		hashTypeSet(c, c.Argv[1], h, c.Argv[2], rstring.New(c.Argv[3]))
 		c.AddReply(protocol.COne)
 		c.DB().SignalModifyKey(c.Argv[1])
 		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_HASH, "hset", c.Argv[1], c.DB().GetID())
@@ -69,7 +110,7 @@ func HMSETCommand(c *redigo.CommandArg) {
 		return
 	}
 	for i := 2; i < c.Argc; i += 2 {
-		h.Set(c.Argv[i], rstring.New(c.Argv[i+1]))
+		h, _ = hashTypeSet(c, c.Argv[1], h, c.Argv[i], rstring.New(c.Argv[i+1]))
 	}
 	c.AddReply(protocol.OK)
 	c.DB().SignalModifyKey(c.Argv[1])
@@ -100,7 +141,7 @@ func HINCRBYCommand(c *redigo.CommandArg) {
 		return
 	}
 	val += incr
-	h.Set(c.Argv[2], rstring.NewFromInt64(val))
+	hashTypeSetKeepTTL(c, c.Argv[1], h, c.Argv[2], rstring.NewFromInt64(val))
 	c.AddReplyInt64(val)
 	c.DB().SignalModifyKey(c.Argv[1])
 	c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_HASH, "hincrby", c.Argv[1], c.DB().GetID())
@@ -115,26 +156,46 @@ func HINCRBYFLOATCommand(c *redigo.CommandArg) {
 	} else {
 		return
 	}
-	if h = hashLookupWriteOrCreate(c, c.Argv[1]); h == nil {
+	if math.IsNaN(incr) || math.IsInf(incr, 0) {
+		c.AddReplyError("value is NaN or Infinity")
 		return
 	}
-	if cur, ok := h.Get(c.Argv[2]); ok {
-		if val, ok = GetFloat64FromStringOrReply(c, cur, "hash value is not a valid float"); !ok {
+
+	/* The hash is created only once the new value is known to be valid, so
+	 * that an error never leaves an empty hash in the keyspace. */
+	if o := c.DB().LookupKeyWrite(c.Argv[1]); o != nil {
+		var ok bool
+		if h, ok = o.(rtype.HashMap); !ok {
+			c.AddReply(protocol.WrongTypeErr)
 			return
 		}
+		if cur, ok := h.Get(c.Argv[2]); ok {
+			if val, ok = GetFloat64FromStringOrReply(c, cur, "hash value is not a valid float"); !ok {
+				return
+			}
+		}
 	}
 
 	val += incr
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		c.AddReplyError("increment would produce NaN or Infinity")
+		return
+	}
+	if h == nil {
+		h = hashLookupWriteOrCreate(c, c.Argv[1])
+	}
 	str := rstring.NewFromFloat64(val)
-	h.Set(c.Argv[2], str)
+	hashTypeSetKeepTTL(c, c.Argv[1], h, c.Argv[2], str)
 	c.AddReplyBulk(str.Bytes())
 	c.DB().SignalModifyKey(c.Argv[1])
 	c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_HASH, "hincrbyfloat", c.Argv[1], c.DB().GetID())
 	c.Server().AddDirty(1)
 
-	/* TODO: Always replicate HINCRBYFLOAT as an HSET command with the final value
+	/* Always replicate HINCRBYFLOAT as an HSET command with the final value
 	 * in order to make sure that differences in float pricision or formatting
 	 * will not create differences in replicas or after an AOF restart. */
+	c.Argv[0] = []byte("hset")
+	c.Argv[3] = str.Bytes()
 }
 
 func hashAddFieldToReply(c *redigo.CommandArg, h rtype.HashMap, key []byte) {
@@ -279,6 +340,670 @@ func HEXISTSCommand(c *redigo.CommandArg) {
 	}
 }
 
+// HSTRLEN key field
+func HSTRLENCommand(c *redigo.CommandArg) {
+	if o := c.LookupKeyReadOrReply(c.Argv[1], protocol.CZero); o != nil {
+		if h, ok := o.(rtype.HashMap); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+		} else if val, ok := h.Get(c.Argv[2]); ok {
+			c.AddReplyInt64(val.Len())
+		} else {
+			c.AddReply(protocol.CZero)
+		}
+	}
+}
+
 func HSCANCommand(c *redigo.CommandArg) {
+	cursor, ok := parseScanCursorOrReply(c, c.Argv[2])
+	if !ok {
+		return
+	}
+	if o := c.LookupKeyReadOrReply(c.Argv[1], protocol.EmptyScan); o != nil {
+		if _, ok := o.(rtype.HashMap); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+		} else {
+			scanGeneric(c, o, cursor)
+		}
+	}
+}
+
+/* How many times bigger should be the hash compared to the requested size
+ * for us to not use the "remove elements" strategy? Read later in the
+ * implementation for more info. */
+const HRANDFIELD_SUB_STRATEGY_MUL = 3
+
+func hrandfieldWithCount(c *redigo.CommandArg) {
+	var h rtype.HashMap
+	uniq := true
+	withvalues := false
+
+	l, ok := GetInt64FromStringOrReply(c, rstring.New(c.Argv[2]), "")
+	if !ok {
+		return
+	}
+	if c.Argc == 4 {
+		if strings.ToLower(string(c.Argv[3])) != "withvalues" {
+			c.AddReply(protocol.SyntaxErr)
+			return
+		}
+		withvalues = true
+	}
+	count := l
+	if l < 0 {
+		/* A negative count means: return the same elements multiple times
+		 * (i.e. don't remove the extracted element after every extraction).
+		 * Make sure the count, and the reply length with WITHVALUES, can't
+		 * overflow. */
+		if (withvalues && l < -math.MaxInt64/2) || l < -math.MaxInt64 {
+			c.AddReplyError("value is out of range")
+			return
+		}
+		count = -l
+		uniq = false
+	}
+
+	if o := c.LookupKeyReadOrReply(c.Argv[1], protocol.EmptyMultiBulk); o == nil {
+		return
+	} else if h, ok = o.(rtype.HashMap); !ok {
+		c.AddReply(protocol.WrongTypeErr)
+		return
+	}
+	size := int64(h.Len())
+
+	// If count is zero, serve it ASAP to avoid special cases later.
+	if count == 0 {
+		c.AddReply(protocol.EmptyMultiBulk)
+		return
+	}
+
+	replyLen := func(n int64) int {
+		if withvalues {
+			return int(2 * n)
+		}
+		return int(n)
+	}
+	addField := func(key []byte, val rtype.String) {
+		c.AddReplyBulk(key)
+		if withvalues {
+			c.AddReplyBulk(val.Bytes())
+		}
+	}
+
+	/* CASE 1: The count was negative, so the extraction method is just:
+	 * "return N random elements" sampling the whole hash every time.
+	 * This case is trivial and can be served without auxiliary data
+	 * structures. */
+	if !uniq {
+		c.AddReplyMultiBulkLen(replyLen(count))
+		for ; count > 0; count-- {
+			addField(h.RandomField())
+			/* Stop if the client is going to be closed because of the
+			 * output buffer limits: the reply can't be delivered anyway. */
+			if c.CloseOnOutputBufferLimitReached() {
+				break
+			}
+		}
+		return
+	}
+
+	/* CASE 2:
+	 * The number of requested elements is greater than the number of
+	 * elements inside the hash: simply return the whole hash. */
+	if count >= size {
+		c.AddReplyMultiBulkLen(replyLen(size))
+		h.Iterate(addField)
+		return
+	}
+
+	type pair struct {
+		key []byte
+		val rtype.String
+	}
+	var d []pair
+
+	if count*HRANDFIELD_SUB_STRATEGY_MUL > size {
+		/* CASE 3:
+		 * The number of elements inside the hash is not greater than
+		 * HRANDFIELD_SUB_STRATEGY_MUL times the number of requested
+		 * elements. In this case we copy all the fields, and remove random
+		 * fields to reach the requested number of elements.
+		 *
+		 * This is done because if the number of requested elements is just
+		 * a bit less than the number of elements in the hash, the natural
+		 * approach used into CASE 4 is highly inefficient. */
+		d = make([]pair, 0, size)
+		h.Iterate(func(key []byte, val rtype.String) {
+			d = append(d, pair{key, val})
+		})
+
+		// Remove random elements to reach the right count.
+		for ; size > count; size-- {
+			i := rand.Int63n(size)
+			d[i] = d[size-1]
+			d = d[:size-1]
+		}
+	} else {
+		/* CASE 4: We have a big hash compared to the requested number of
+		 * elements. In this case we can simply get random elements from the
+		 * hash and add them to the result, trying to eventually get enough
+		 * unique elements to reach the specified count. */
+		d = make([]pair, 0, count)
+		seen := make(map[string]struct{}, count)
+		for int64(len(d)) < count {
+			key, val := h.RandomField()
+			if _, ok := seen[string(key)]; !ok {
+				seen[string(key)] = struct{}{}
+				d = append(d, pair{key, val})
+			}
+		}
+	}
+
+	// CASE 3 & 4: send the result to the user.
+	c.AddReplyMultiBulkLen(replyLen(int64(len(d))))
+	for _, p := range d {
+		addField(p.key, p.val)
+	}
+}
+
+// HRANDFIELD key [<count> [WITHVALUES]]
+func HRANDFIELDCommand(c *redigo.CommandArg) {
+	if c.Argc >= 3 {
+		if c.Argc > 4 {
+			c.AddReply(protocol.SyntaxErr)
+			return
+		}
+		hrandfieldWithCount(c)
+		return
+	}
+
+	// Handle variant without <count> argument. Reply with simple bulk string
+	if o := c.LookupKeyReadOrReply(c.Argv[1], protocol.NullBulk); o != nil {
+		if h, ok := o.(rtype.HashMap); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+		} else {
+			key, _ := h.RandomField()
+			c.AddReplyBulk(key)
+		}
+	}
+}
+
+/*-----------------------------------------------------------------------------
+ * Hash field expiration commands
+ *----------------------------------------------------------------------------*/
+
+// Conditions of the HEXPIRE family of commands.
+const (
+	REDIS_HFE_NO_FLAGS = 0
+	REDIS_HFE_NX       = 1 << 0 // Set only if the field has no expire
+	REDIS_HFE_XX       = 1 << 1 // Set only if the field has an expire
+	REDIS_HFE_GT       = 1 << 2 // Set only if greater than the current expire
+	REDIS_HFE_LT       = 1 << 3 // Set only if less than the current expire
+)
+
+// Replies of the hash field expiration commands, one for every field.
+const (
+	REDIS_HFE_REPLY_NO_FIELD     = -2 // The field does not exist
+	REDIS_HFE_REPLY_NO_TTL       = -1 // The field has no expire
+	REDIS_HFE_REPLY_NO_CONDITION = 0  // The NX|XX|GT|LT|FNX|FXX condition is not met
+	REDIS_HFE_REPLY_OK           = 1  // The expire was set, or removed
+	REDIS_HFE_REPLY_DELETED      = 2  // The field was deleted at once
+)
+
+/* Parse the "FIELDS numfields field1 ... fieldN" arguments starting at the
+ * argument idx. Every field is followed by stride-1 more arguments, that is
+ * its value in HSETEX. Return the index of the first field and the number of
+ * the fields. The FIELDS block must end the command. */
+func getHashFieldsOrReply(c *redigo.CommandArg, idx int, stride int) (first int, numFields int, ok bool) {
+	if idx >= c.Argc-1 || strings.ToLower(string(c.Argv[idx])) != "fields" {
+		c.AddReplyError("Mandatory argument FIELDS is missing or not at the right position")
+		return
+	}
+	x, err := strconv.ParseInt(string(c.Argv[idx+1]), 10, 64)
+	if err != nil || x <= 0 {
+		c.AddReplyError("Parameter `numFields` should be greater than 0")
+		return
+	}
+	if x != int64(c.Argc-idx-2)/int64(stride) || (c.Argc-idx-2)%stride != 0 {
+		c.AddReplyError("The `numfields` parameter must match the number of arguments")
+		return
+	}
+	return idx + 2, int(x), true
+}
+
+/* Parse the expire time of a field, in the given unit, as an absolute Unix
+ * time. If relative is true the time is relative to now. A time in the past,
+ * or zero, is accepted and deletes the fields at once. */
+func getFieldExpireTimeOrReply(c *redigo.CommandArg, arg []byte, unit time.Duration, relative bool) (time.Duration, bool) {
+	x, ok := GetInt64FromStringOrReply(c, rstring.New(arg), "")
+	if !ok {
+		return 0, false
+	}
+	var base int64
+	if relative {
+		base = time.Now().UnixNano()
+	}
+	if x < 0 || x > (math.MaxInt64-base)/int64(unit) {
+		c.AddReplyError(fmt.Sprintf("invalid expire time in '%s' command", c.Argv[0]))
+		return 0, false
+	}
+	return time.Duration(base + x*int64(unit)), true
+}
+
+/* Delete the hash stored at key if its last field was deleted, notifying
+ * the event. Return true if the key was deleted. */
+func hashDeleteIfEmpty(c *redigo.CommandArg, key []byte, h rtype.HashMap) bool {
+	if h.Len() > 0 {
+		return false
+	}
+	c.DB().Delete(key)
+	c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "del", key, c.DB().GetID())
+	return true
+}
+
+/* This is the generic command implementation for HEXPIRE, HPEXPIRE,
+ * HEXPIREAT and HPEXPIREAT:
+ *
+ * HEXPIRE key seconds [NX|XX|GT|LT] FIELDS numfields field [field ...]
+ *
+ * The expire is set on every field, and the reply is an array with the
+ * result for every field: -2 if the field does not exist, 0 if the condition
+ * is not met, 1 if the expire was set, 2 if the field was deleted because
+ * the expire time is already in the past. */
+func hexpireGeneric(c *redigo.CommandArg, unit time.Duration, relative bool) {
+	flags := REDIS_HFE_NO_FLAGS
+	idx := 3
+	if c.Argc > 3 {
+		switch strings.ToLower(string(c.Argv[3])) {
+		case "nx":
+			flags = REDIS_HFE_NX
+		case "xx":
+			flags = REDIS_HFE_XX
+		case "gt":
+			flags = REDIS_HFE_GT
+		case "lt":
+			flags = REDIS_HFE_LT
+		}
+		if flags != REDIS_HFE_NO_FLAGS {
+			idx++
+		}
+	}
+
+	var h rtype.HashMap
+	o := c.DB().LookupKeyWrite(c.Argv[1])
+	if o != nil {
+		var ok bool
+		if h, ok = o.(rtype.HashMap); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+			return
+		}
+	}
+	when, ok := getFieldExpireTimeOrReply(c, c.Argv[2], unit, relative)
+	if !ok {
+		return
+	}
+	first, numFields, ok := getHashFieldsOrReply(c, idx, 1)
+	if !ok {
+		return
+	}
+
+	c.AddReplyMultiBulkLen(numFields)
+	if h == nil {
+		for i := 0; i < numFields; i++ {
+			c.AddReplyInt64(REDIS_HFE_REPLY_NO_FIELD)
+		}
+		return
+	}
 
+	expired := when <= time.Duration(time.Now().UnixNano())
+	var updated, deleted int
+	for _, field := range c.Argv[first : first+numFields] {
+		if _, ok := h.Get(field); !ok {
+			c.AddReplyInt64(REDIS_HFE_REPLY_NO_FIELD)
+			continue
+		}
+
+		/* A field without an expire is considered to have an infinite
+		 * TTL by the GT and LT conditions. */
+		cur := h.GetExpire(field)
+		if (flags&REDIS_HFE_NX != 0 && cur >= 0) ||
+			(flags&REDIS_HFE_XX != 0 && cur < 0) ||
+			(flags&REDIS_HFE_GT != 0 && (cur < 0 || when <= cur)) ||
+			(flags&REDIS_HFE_LT != 0 && cur >= 0 && when >= cur) {
+			c.AddReplyInt64(REDIS_HFE_REPLY_NO_CONDITION)
+			continue
+		}
+
+		if expired {
+			h.Delete(field)
+			deleted++
+			c.AddReplyInt64(REDIS_HFE_REPLY_DELETED)
+		} else {
+			c.DB().SetFieldExpire(c.Argv[1], field, when)
+			updated++
+			c.AddReplyInt64(REDIS_HFE_REPLY_OK)
+		}
+	}
+
+	if updated > 0 {
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_HASH, "hexpire", c.Argv[1], c.DB().GetID())
+	}
+	if deleted > 0 {
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_HASH, "hdel", c.Argv[1], c.DB().GetID())
+		hashDeleteIfEmpty(c, c.Argv[1], h)
+	}
+	if updated+deleted > 0 {
+		c.DB().SignalModifyKey(c.Argv[1])
+		c.Server().AddDirty(updated + deleted)
+	}
+}
+
+func HEXPIRECommand(c *redigo.CommandArg) {
+	hexpireGeneric(c, time.Second, true)
+}
+
+func HPEXPIRECommand(c *redigo.CommandArg) {
+	hexpireGeneric(c, time.Millisecond, true)
+}
+
+func HEXPIREATCommand(c *redigo.CommandArg) {
+	hexpireGeneric(c, time.Second, false)
+}
+
+func HPEXPIREATCommand(c *redigo.CommandArg) {
+	hexpireGeneric(c, time.Millisecond, false)
+}
+
+/* This is the generic command implementation for HTTL, HPTTL, HEXPIRETIME
+ * and HPEXPIRETIME, replying with the TTL, or the Unix time of the expire,
+ * of every field in the given unit. -2 is returned for the fields that don't
+ * exist and -1 for the fields without an expire. */
+func httlGeneric(c *redigo.CommandArg, unit time.Duration, relative bool) {
+	var h rtype.HashMap
+	o := c.DB().LookupKeyRead(c.Argv[1])
+	if o != nil {
+		var ok bool
+		if h, ok = o.(rtype.HashMap); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+			return
+		}
+	}
+	first, numFields, ok := getHashFieldsOrReply(c, 2, 1)
+	if !ok {
+		return
+	}
+
+	c.AddReplyMultiBulkLen(numFields)
+	now := time.Duration(time.Now().UnixNano())
+	for _, field := range c.Argv[first : first+numFields] {
+		if h == nil {
+			c.AddReplyInt64(REDIS_HFE_REPLY_NO_FIELD)
+			continue
+		}
+		if _, ok := h.Get(field); !ok {
+			c.AddReplyInt64(REDIS_HFE_REPLY_NO_FIELD)
+			continue
+		}
+		when := h.GetExpire(field)
+		if when < 0 {
+			c.AddReplyInt64(REDIS_HFE_REPLY_NO_TTL)
+		} else if relative {
+			ttl := when - now
+			if ttl < 0 {
+				ttl = 0
+			}
+			// Round the TTL up, a field never has a TTL of 0 before expiring.
+			c.AddReplyInt64(int64((ttl + unit - 1) / unit))
+		} else {
+			c.AddReplyInt64(int64(when / unit))
+		}
+	}
+}
+
+func HTTLCommand(c *redigo.CommandArg) {
+	httlGeneric(c, time.Second, true)
+}
+
+func HPTTLCommand(c *redigo.CommandArg) {
+	httlGeneric(c, time.Millisecond, true)
+}
+
+func HEXPIRETIMECommand(c *redigo.CommandArg) {
+	httlGeneric(c, time.Second, false)
+}
+
+func HPEXPIRETIMECommand(c *redigo.CommandArg) {
+	httlGeneric(c, time.Millisecond, false)
+}
+
+// HPERSIST key FIELDS numfields field [field ...]
+func HPERSISTCommand(c *redigo.CommandArg) {
+	var h rtype.HashMap
+	o := c.DB().LookupKeyWrite(c.Argv[1])
+	if o != nil {
+		var ok bool
+		if h, ok = o.(rtype.HashMap); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+			return
+		}
+	}
+	first, numFields, ok := getHashFieldsOrReply(c, 2, 1)
+	if !ok {
+		return
+	}
+
+	c.AddReplyMultiBulkLen(numFields)
+	changed := 0
+	for _, field := range c.Argv[first : first+numFields] {
+		if h == nil {
+			c.AddReplyInt64(REDIS_HFE_REPLY_NO_FIELD)
+		} else if _, ok := h.Get(field); !ok {
+			c.AddReplyInt64(REDIS_HFE_REPLY_NO_FIELD)
+		} else if !h.RemoveExpire(field) {
+			c.AddReplyInt64(REDIS_HFE_REPLY_NO_TTL)
+		} else {
+			changed++
+			c.AddReplyInt64(REDIS_HFE_REPLY_OK)
+		}
+	}
+	if changed > 0 {
+		c.DB().SignalModifyKey(c.Argv[1])
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_HASH, "hpersist", c.Argv[1], c.DB().GetID())
+		c.Server().AddDirty(changed)
+	}
+}
+
+/* Parse the EX|PX|EXAT|PXAT option of HGETEX and HSETEX, returning the unit
+ * of the time and whether the time is relative. */
+func parseFieldExpireOption(opt string) (unit time.Duration, relative bool, ok bool) {
+	switch opt {
+	case "ex":
+		return time.Second, true, true
+	case "px":
+		return time.Millisecond, true, true
+	case "exat":
+		return time.Second, false, true
+	case "pxat":
+		return time.Millisecond, false, true
+	}
+	return 0, false, false
+}
+
+/* HGETEX key [EX seconds|PX milliseconds|EXAT timestamp|PXAT timestamp|PERSIST]
+ *        FIELDS numfields field [field ...]
+ *
+ * Like HMGET, but the expire of the existing fields is set, or removed with
+ * PERSIST, at the same time. */
+func HGETEXCommand(c *redigo.CommandArg) {
+	var when time.Duration
+	var setExpire, persist bool
+
+	idx := 2
+	if idx < c.Argc {
+		opt := strings.ToLower(string(c.Argv[idx]))
+		if unit, relative, ok := parseFieldExpireOption(opt); ok {
+			if idx+1 >= c.Argc {
+				c.AddReply(protocol.SyntaxErr)
+				return
+			}
+			if when, ok = getFieldExpireTimeOrReply(c, c.Argv[idx+1], unit, relative); !ok {
+				return
+			}
+			setExpire = true
+			idx += 2
+		} else if opt == "persist" {
+			persist = true
+			idx++
+		}
+	}
+	first, numFields, ok := getHashFieldsOrReply(c, idx, 1)
+	if !ok {
+		return
+	}
+
+	var h rtype.HashMap
+	if o := c.DB().LookupKeyWrite(c.Argv[1]); o != nil {
+		if h, ok = o.(rtype.HashMap); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+			return
+		}
+	}
+
+	c.AddReplyMultiBulkLen(numFields)
+	for _, field := range c.Argv[first : first+numFields] {
+		hashAddFieldToReply(c, h, field)
+	}
+	if h == nil || (!setExpire && !persist) {
+		return
+	}
+
+	expired := when <= time.Duration(time.Now().UnixNano())
+	changed := 0
+	for _, field := range c.Argv[first : first+numFields] {
+		if _, ok := h.Get(field); !ok {
+			continue
+		}
+		if persist {
+			if h.RemoveExpire(field) {
+				changed++
+			}
+		} else if expired {
+			h.Delete(field)
+			changed++
+		} else {
+			c.DB().SetFieldExpire(c.Argv[1], field, when)
+			changed++
+		}
+	}
+	if changed == 0 {
+		return
+	}
+
+	if persist {
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_HASH, "hpersist", c.Argv[1], c.DB().GetID())
+	} else if expired {
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_HASH, "hdel", c.Argv[1], c.DB().GetID())
+		hashDeleteIfEmpty(c, c.Argv[1], h)
+	} else {
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_HASH, "hexpire", c.Argv[1], c.DB().GetID())
+	}
+	c.DB().SignalModifyKey(c.Argv[1])
+	c.Server().AddDirty(changed)
+}
+
+/* HSETEX key [FNX|FXX] [EX seconds|PX milliseconds|EXAT timestamp|PXAT timestamp|KEEPTTL]
+ *        FIELDS numfields field value [field value ...]
+ *
+ * Like HSET, but the expire of the fields is set at the same time. FNX sets
+ * the fields only if none of them exist, FXX only if all of them exist.
+ * KEEPTTL retains the expire of the fields already existing, that is
+ * otherwise removed. Reply with 1 if the fields were set and 0 otherwise. */
+func HSETEXCommand(c *redigo.CommandArg) {
+	var when time.Duration
+	var setExpire, keepTTL, fnx, fxx bool
+
+	idx := 2
+	for ; idx < c.Argc; idx++ {
+		opt := strings.ToLower(string(c.Argv[idx]))
+		if opt == "fields" {
+			break
+		}
+
+		if unit, relative, ok := parseFieldExpireOption(opt); ok && !setExpire && !keepTTL && idx+1 < c.Argc {
+			if when, ok = getFieldExpireTimeOrReply(c, c.Argv[idx+1], unit, relative); !ok {
+				return
+			}
+			setExpire = true
+			idx++
+		} else if opt == "keepttl" && !setExpire && !keepTTL {
+			keepTTL = true
+		} else if opt == "fnx" && !fnx && !fxx {
+			fnx = true
+		} else if opt == "fxx" && !fnx && !fxx {
+			fxx = true
+		} else {
+			c.AddReply(protocol.SyntaxErr)
+			return
+		}
+	}
+	first, numFields, ok := getHashFieldsOrReply(c, idx, 2)
+	if !ok {
+		return
+	}
+
+	var h rtype.HashMap
+	o := c.DB().LookupKeyWrite(c.Argv[1])
+	if o != nil {
+		if h, ok = o.(rtype.HashMap); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+			return
+		}
+	}
+
+	// Check the FNX and FXX conditions before changing anything.
+	if fnx || fxx {
+		for i := first; i < first+2*numFields; i += 2 {
+			exists := false
+			if h != nil {
+				_, exists = h.Get(c.Argv[i])
+			}
+			if (fnx && exists) || (fxx && !exists) {
+				c.AddReplyInt64(REDIS_HFE_REPLY_NO_CONDITION)
+				return
+			}
+		}
+	}
+
+	if h = hashLookupWriteOrCreate(c, c.Argv[1]); h == nil {
+		return
+	}
+	expired := setExpire && when <= time.Duration(time.Now().UnixNano())
+	for i := first; i < first+2*numFields; i += 2 {
+		field := c.Argv[i]
+		if expired {
+			// Setting a field that is expired at once is just a delete.
+			h.Delete(field)
+			continue
+		}
+		if keepTTL {
+			h, _ = hashTypeSetKeepTTL(c, c.Argv[1], h, field, rstring.New(c.Argv[i+1]))
+		} else {
+			h, _ = hashTypeSet(c, c.Argv[1], h, field, rstring.New(c.Argv[i+1]))
+		}
+		if setExpire {
+			c.DB().SetFieldExpire(c.Argv[1], field, when)
+		}
+	}
+
+	c.AddReplyInt64(REDIS_HFE_REPLY_OK)
+	if expired {
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_HASH, "hdel", c.Argv[1], c.DB().GetID())
+		hashDeleteIfEmpty(c, c.Argv[1], h)
+	} else {
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_HASH, "hset", c.Argv[1], c.DB().GetID())
+		if setExpire {
+			c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_HASH, "hexpire", c.Argv[1], c.DB().GetID())
+		}
+	}
+	c.DB().SignalModifyKey(c.Argv[1])
+	c.Server().AddDirty(numFields)
 }
@@ -0,0 +1,308 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/SteveZhangBit/redigo"
+	"github.com/SteveZhangBit/redigo/protocol"
+	"github.com/SteveZhangBit/redigo/rtype"
+	"github.com/SteveZhangBit/redigo/rtype/hyperloglog"
+	"github.com/SteveZhangBit/redigo/rtype/rstring"
+)
+
+/*-----------------------------------------------------------------------------
+ * HyperLogLog commands
+ *----------------------------------------------------------------------------*/
+
+var (
+	invalidHLLErr   = []byte("-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n")
+	corruptedHLLErr = []byte("-INVALIDOBJ Corrupted HLL object detected\r\n")
+)
+
+/* Check if the object is a String with a valid HLL representation.
+ * Return the string holding the HLL if this is true, otherwise reply to the
+ * client with an error and return nil. */
+func isHLLObjectOrReply(c *redigo.CommandArg, o interface{}) *rstring.BytesString {
+	str, ok := o.(rtype.String)
+	if !ok {
+		c.AddReply(protocol.WrongTypeErr)
+		return nil
+	}
+	// An integer can't be a valid HLL.
+	if bstr, ok := str.(*rstring.BytesString); ok && hyperloglog.IsValid(bstr.Val) {
+		return bstr
+	}
+	c.AddReply(invalidHLLErr)
+	return nil
+}
+
+// PFADD var ele ele ele ... ele => :0 or :1
+func PFADDCommand(c *redigo.CommandArg) {
+	var str *rstring.BytesString
+	updated := 0
+
+	if o := c.DB().LookupKeyWrite(c.Argv[1]); o == nil {
+		/* Create the key with a string value of the exact length to
+		 * hold our HLL data structure. */
+		str = &rstring.BytesString{Val: hyperloglog.New()}
+		c.DB().Add(c.Argv[1], str)
+		updated++
+	} else if str = isHLLObjectOrReply(c, o); str == nil {
+		return
+	}
+
+	// Perform the low level ADD operation for every element.
+	h := hyperloglog.HLL(str.Val)
+	for j := 2; j < c.Argc; j++ {
+		retval, err := h.Add(c.Argv[j])
+		str.Val = h
+		if err != nil {
+			c.AddReply(corruptedHLLErr)
+			return
+		}
+		updated += retval
+	}
+	if updated > 0 {
+		h.InvalidateCache()
+		c.DB().SignalModifyKey(c.Argv[1])
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_STRING, "pfadd", c.Argv[1], c.DB().GetID())
+		c.Server().AddDirty(updated)
+		c.AddReply(protocol.COne)
+	} else {
+		c.AddReply(protocol.CZero)
+	}
+}
+
+// PFCOUNT var -> approximated cardinality of set.
+func PFCOUNTCommand(c *redigo.CommandArg) {
+	/* Case 1: multi-key keys, cardinality of the union.
+	 *
+	 * When multiple keys are specified, PFCOUNT actually computes
+	 * the cardinality of the merge of the N HLLs specified. */
+	if c.Argc > 2 {
+		// Compute an HLL with M[i] = MAX(M[i]_j).
+		max := make([]byte, hyperloglog.HLL_REGISTERS)
+		for j := 1; j < c.Argc; j++ {
+			// Check type and size.
+			o := c.DB().LookupKeyRead(c.Argv[j])
+			if o == nil {
+				continue // Assume empty HLL for non existing var.
+			}
+			str := isHLLObjectOrReply(c, o)
+			if str == nil {
+				return
+			}
+
+			/* Merge with this HLL with our 'max' HLL by setting max[i]
+			 * to MAX(max[i],hll[i]). */
+			if hyperloglog.HLL(str.Val).Merge(max) != nil {
+				c.AddReply(corruptedHLLErr)
+				return
+			}
+		}
+
+		// Compute cardinality of the resulting set.
+		c.AddReplyInt64(int64(hyperloglog.CountRegisters(max)))
+		return
+	}
+
+	/* Case 2: cardinality of the single HLL.
+	 *
+	 * The user specified a single key. Either return the cached value
+	 * or compute one and update the cache.
+	 *
+	 * Since a HLL is a regular Redis string type value, updating the cache
+	 * does modify the value. */
+	o := c.DB().LookupKeyRead(c.Argv[1])
+	if o == nil {
+		/* No key? Cardinality is zero since no element was added, otherwise
+		 * we would have a key as HLLADD creates it as a side effect. */
+		c.AddReply(protocol.CZero)
+		return
+	}
+	str := isHLLObjectOrReply(c, o)
+	if str == nil {
+		return
+	}
+
+	// Check if the cached cardinality is valid.
+	h := hyperloglog.HLL(str.Val)
+	card, ok := h.CachedCard()
+	if !ok {
+		// Recompute it and update the cached value.
+		var err error
+		if card, err = h.Count(); err != nil {
+			c.AddReply(corruptedHLLErr)
+			return
+		}
+		h.SetCachedCard(card)
+
+		/* This is not considered a read-only command even if the
+		 * data structure is not modified, since the cached value
+		 * may be modified and given that the HLL is a Redis string
+		 * we need to propagate the change. */
+		c.DB().SignalModifyKey(c.Argv[1])
+		c.Server().AddDirty(1)
+	}
+	c.AddReplyInt64(int64(card))
+}
+
+// PFMERGE dest src1 src2 src3 ... srcN => OK
+func PFMERGECommand(c *redigo.CommandArg) {
+	useDense := false // Use dense representation as target?
+
+	/* Compute an HLL with M[i] = MAX(M[i]_j).
+	 * We store the maximum into the max array of registers. We'll write
+	 * it to the target variable later. */
+	max := make([]byte, hyperloglog.HLL_REGISTERS)
+	for j := 1; j < c.Argc; j++ {
+		// Check type and size.
+		o := c.DB().LookupKeyRead(c.Argv[j])
+		if o == nil {
+			continue // Assume empty HLL for non existing var.
+		}
+		str := isHLLObjectOrReply(c, o)
+		if str == nil {
+			return
+		}
+
+		/* If at least one involved HLL is dense, use the dense representation
+		 * as target ASAP to save time and avoid the conversion step. */
+		h := hyperloglog.HLL(str.Val)
+		if h.Encoding() == hyperloglog.HLL_DENSE {
+			useDense = true
+		}
+
+		/* Merge with this HLL with our 'max' HLL by setting max[i]
+		 * to MAX(max[i],hll[i]). */
+		if h.Merge(max) != nil {
+			c.AddReply(corruptedHLLErr)
+			return
+		}
+	}
+
+	// Create the destination key's value if needed.
+	var str *rstring.BytesString
+	if o := c.DB().LookupKeyWrite(c.Argv[1]); o == nil {
+		str = &rstring.BytesString{Val: hyperloglog.New()}
+		c.DB().Add(c.Argv[1], str)
+	} else {
+		/* If key exists we are sure it's of the right type/size
+		 * since we checked when merging the different HLLs, so we
+		 * don't need to check again. */
+		str = o.(*rstring.BytesString)
+	}
+
+	/* Convert the destination object to dense representation if at least
+	 * one of the inputs was dense. */
+	h := hyperloglog.HLL(str.Val)
+	if useDense {
+		if h.ToDense() != nil {
+			c.AddReply(corruptedHLLErr)
+			return
+		}
+		// Write the resulting HLL to the destination HLL registers.
+		h.DenseCompress(max)
+	} else {
+		for j, val := range max {
+			if val != 0 {
+				h.Set(j, val)
+			}
+		}
+	}
+	// Invalidate the cached value.
+	h.InvalidateCache()
+	str.Val = h
+
+	c.DB().SignalModifyKey(c.Argv[1])
+	/* We generate a PFADD event for PFMERGE for semantical simplicity
+	 * since in theory this is a mass-add of elements. */
+	c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_STRING, "pfadd", c.Argv[1], c.DB().GetID())
+	c.Server().AddDirty(1)
+	c.AddReply(protocol.OK)
+}
+
+/* PFSELFTEST
+ * This command performs a self-test of the HLL registers implementation.
+ * Something that is not easy to test from within the outside. */
+func PFSELFTESTCommand(c *redigo.CommandArg) {
+	if err := hyperloglog.SelfTest(); err != nil {
+		c.AddReplyError(err.Error())
+		return
+	}
+	c.AddReply(protocol.OK)
+}
+
+/* PFDEBUG <subcommand> <key> ... args ...
+ * Different debugging related operations about the HLL implementation. */
+func PFDEBUGCommand(c *redigo.CommandArg) {
+	cmd := strings.ToLower(string(c.Argv[1]))
+
+	o := c.DB().LookupKeyWrite(c.Argv[2])
+	if o == nil {
+		c.AddReplyError("The specified key does not exist")
+		return
+	}
+	str := isHLLObjectOrReply(c, o)
+	if str == nil {
+		return
+	}
+	h := hyperloglog.HLL(str.Val)
+	if c.Argc != 3 {
+		c.AddReplyError(fmt.Sprintf("Wrong number of arguments for the '%s' subcommand", c.Argv[1]))
+		return
+	}
+
+	switch cmd {
+	case "getreg":
+		// PFDEBUG GETREG <key>
+		if h.Encoding() == hyperloglog.HLL_SPARSE {
+			if h.ToDense() != nil {
+				c.AddReply(corruptedHLLErr)
+				return
+			}
+			str.Val = h
+			c.Server().AddDirty(1) // Force propagation on encoding change.
+		}
+
+		regs := h.Registers()
+		c.AddReplyMultiBulkLen(len(regs))
+		for _, val := range regs {
+			c.AddReplyInt64(int64(val))
+		}
+	case "decode":
+		// PFDEBUG DECODE <key>
+		if h.Encoding() != hyperloglog.HLL_SPARSE {
+			c.AddReplyError("HLL encoding is not sparse")
+			return
+		}
+		c.AddReplyBulk([]byte(h.DecodeSparse()))
+	case "encoding":
+		// PFDEBUG ENCODING <key>
+		if h.Encoding() == hyperloglog.HLL_DENSE {
+			c.AddReplyStatus("dense")
+		} else {
+			c.AddReplyStatus("sparse")
+		}
+	case "todense":
+		// PFDEBUG TODENSE <key>
+		conv := false
+		if h.Encoding() == hyperloglog.HLL_SPARSE {
+			if h.ToDense() != nil {
+				c.AddReply(corruptedHLLErr)
+				return
+			}
+			str.Val = h
+			conv = true
+			c.Server().AddDirty(1) // Force propagation on encoding change.
+		}
+		if conv {
+			c.AddReply(protocol.COne)
+		} else {
+			c.AddReply(protocol.CZero)
+		}
+	default:
+		c.AddReplyError(fmt.Sprintf("Unknown PFDEBUG subcommand '%s'", c.Argv[1]))
+	}
+}
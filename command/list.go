@@ -1,6 +1,10 @@
 package command
 
 import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/SteveZhangBit/redigo"
@@ -193,17 +197,50 @@ func LSETCommand(c *redigo.CommandArg) {
 	}
 }
 
+// LPOP/RPOP key [count]
 func listPop(c *redigo.CommandArg, where int) {
 	var l rtype.List
-
 	var ok bool
-	if o := c.LookupKeyWriteOrReply(c.Argv[1], protocol.NullBulk); o == nil {
+
+	hascount := c.Argc == 3
+	var count int64
+	if c.Argc > 3 {
+		c.AddReplyError(fmt.Sprintf("wrong number of arguments for '%s' command", c.Argv[0]))
+		return
+	} else if hascount {
+		// Parse the optional count argument.
+		if count, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[2]),
+			"value is out of range, must be positive"); !ok {
+			return
+		}
+		if count < 0 {
+			c.AddReplyError("value is out of range, must be positive")
+			return
+		}
+	}
+
+	reply := protocol.NullBulk
+	if hascount {
+		reply = protocol.NullMultiBulk
+	}
+	if o := c.LookupKeyWriteOrReply(c.Argv[1], reply); o == nil {
 		return
 	} else if l, ok = o.(rtype.List); !ok {
 		c.AddReply(protocol.WrongTypeErr)
 		return
 	}
 
+	if hascount {
+		if count == 0 {
+			// Fast exit path.
+			c.AddReply(protocol.EmptyMultiBulk)
+			return
+		}
+		// Pop a range of elements in a nested arrays way.
+		listPopRangeAndReply(c, l, c.Argv[1], where, count)
+		return
+	}
+
 	var event string
 	var e rtype.ListElement
 	if where == rtype.REDIS_LIST_HEAD {
@@ -283,15 +320,14 @@ func LRANGECommand(c *redigo.CommandArg) {
 	// Return the result in form of a multi-bulk reply
 	c.AddReplyMultiBulkLen(rangelen)
 	/* If we are nearest to the end of the list, reach the element
-	 * starting from tail and going backward, as it is faster. */
+	 * starting from tail and going backward, as it is faster. The element
+	 * is sought once, then the iterator walks the range. */
 	if start > llen/2 {
 		start -= llen
 	}
-	e := l.Index(start)
-	for rangelen > 0 {
-		c.AddReplyBulk(e.Value().Bytes())
-		e = e.Next()
-		rangelen--
+	iter := l.IteratorAt(start, rtype.REDIS_LIST_HEAD)
+	for ; rangelen > 0; rangelen-- {
+		c.AddReplyBulk(iter.Next().(rtype.ListElement).Value().Bytes())
 	}
 }
 
@@ -343,14 +379,8 @@ func LTRIMCommand(c *redigo.CommandArg) {
 	}
 
 	// Remove list elements to perform the trim
-	for i := 0; i < ltrim; i++ {
-		e := l.Front()
-		l.Remove(e)
-	}
-	for i := 0; i < rtrim; i++ {
-		e := l.Back()
-		l.Remove(e)
-	}
+	l.DeleteRange(0, ltrim)
+	l.DeleteRange(-rtrim, rtrim)
 
 	c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_LIST, "ltrim", c.Argv[1], c.DB().GetID())
 	if l.Len() == 0 {
@@ -426,8 +456,371 @@ func LREMCommand(c *redigo.CommandArg) {
 	}
 }
 
+/* LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+ *
+ * The "rank" is the position of the match, so if it is 1, the first match
+ * is returned, if it is 2 the second match is returned and so forth.
+ * It is 1 by default. If negative has the same meaning but the search is
+ * performed starting from the end of the list.
+ *
+ * If COUNT is given, instead of returning the single element, a list of
+ * all the matching elements up to "num-matches" are returned. COUNT can
+ * be combined with RANK in order to returning only the element starting
+ * from the Nth. If COUNT is zero, all the matching elements are returned.
+ *
+ * MAXLEN tells the command to scan a max of len elements. If zero (the
+ * default), all the elements in the list are scanned if needed.
+ *
+ * The returned elements indexes are always referring to what LINDEX
+ * would return. So first element from head is 0, and so forth. */
+func LPOSCommand(c *redigo.CommandArg) {
+	var l rtype.List
+	var ok bool
+	var rank, count, maxlen int64 = 1, -1, 0 // Count -1: option not given.
+
+	// Parse the optional arguments.
+	for j := 3; j < c.Argc; j++ {
+		opt := strings.ToLower(string(c.Argv[j]))
+		moreargs := c.Argc - 1 - j
+
+		if opt == "rank" && moreargs > 0 {
+			j++
+			if rank, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[j]), ""); !ok {
+				return
+			}
+			if rank == 0 {
+				c.AddReplyError("RANK can't be zero: use 1 to start from " +
+					"the first match, 2 from the second ... " +
+					"or use negative to start from the end of the list")
+				return
+			} else if rank == math.MinInt64 {
+				c.AddReplyError("value is out of range, value must between " +
+					"-9223372036854775807 and 9223372036854775807")
+				return
+			}
+		} else if opt == "count" && moreargs > 0 {
+			j++
+			if count, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[j]), ""); !ok {
+				return
+			}
+			if count < 0 {
+				c.AddReplyError("COUNT can't be negative")
+				return
+			}
+		} else if opt == "maxlen" && moreargs > 0 {
+			j++
+			if maxlen, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[j]), ""); !ok {
+				return
+			}
+			if maxlen < 0 {
+				c.AddReplyError("MAXLEN can't be negative")
+				return
+			}
+		} else {
+			c.AddReply(protocol.SyntaxErr)
+			return
+		}
+	}
+
+	/* A negative rank means start from the tail, however the rank is then
+	 * used as a positive number of matches to skip. */
+	direction := rtype.REDIS_LIST_HEAD
+	if rank < 0 {
+		rank = -rank
+		direction = rtype.REDIS_LIST_TAIL
+	}
+
+	/* We return NULL or an empty array if there is no such key (or
+	 * if we find no matches, depending on the presence of the COUNT option. */
+	reply := protocol.NullBulk
+	if count != -1 {
+		reply = protocol.EmptyMultiBulk
+	}
+	if o := c.LookupKeyReadOrReply(c.Argv[1], reply); o == nil {
+		return
+	} else if l, ok = o.(rtype.List); !ok {
+		c.AddReply(protocol.WrongTypeErr)
+		return
+	}
+
+	/* Seek the element. The index of the elements found from the tail is
+	 * converted so that it is what LINDEX would return. */
+	ele := rstring.New(c.Argv[2])
+	llen := int64(l.Len())
+	var matches []int64
+	var index int64
+	iter := l.Iterator(direction)
+	for iter.HasNext() && (maxlen == 0 || index < maxlen) {
+		e := iter.Next().(rtype.ListElement)
+		if rstring.EqualStringObjects(e.Value(), ele) {
+			if rank == 1 {
+				if direction == rtype.REDIS_LIST_HEAD {
+					matches = append(matches, index)
+				} else {
+					matches = append(matches, llen-index-1)
+				}
+				if int64(len(matches)) == count || count == -1 {
+					break
+				}
+			} else {
+				rank--
+			}
+		}
+		index++
+	}
+
+	// Reply to the client, with an array if COUNT was given.
+	if count != -1 {
+		c.AddReplyMultiBulkLen(len(matches))
+		for _, m := range matches {
+			c.AddReplyInt64(m)
+		}
+	} else if len(matches) != 0 {
+		c.AddReplyInt64(matches[0])
+	} else {
+		c.AddReply(protocol.NullBulk)
+	}
+}
+
+// RPOPLPUSH source destination
 func RPOPLPUSHCommand(c *redigo.CommandArg) {
+	lmoveGeneric(c, rtype.REDIS_LIST_TAIL, rtype.REDIS_LIST_HEAD)
+}
+
+// LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+func LMOVECommand(c *redigo.CommandArg) {
+	wherefrom, ok := getListPositionFromObjectOrReply(c, c.Argv[3])
+	if !ok {
+		return
+	}
+	whereto, ok := getListPositionFromObjectOrReply(c, c.Argv[4])
+	if !ok {
+		return
+	}
+	lmoveGeneric(c, wherefrom, whereto)
+}
 
+// LMPOP numkeys <key> [<key> ...] LEFT|RIGHT [COUNT count]
+func LMPOPCommand(c *redigo.CommandArg) {
+	if keys, where, count, ok := parseMpopArgs(c, 1); ok {
+		mpopGeneric(c, keys, where, count, true)
+	}
+}
+
+/* Push the value popped by LMOVE & co. on the destination list dstobj,
+ * creating it at dstkey if it does not exist yet, and reply with it. */
+func lmoveHandlePush(c *redigo.CommandArg, dstkey []byte, dstobj rtype.List, value rtype.String, where int) {
+	// Create the list if the key does not exist
+	if dstobj == nil {
+		dstobj = list.New()
+		c.DB().Add(dstkey, dstobj)
+	}
+	c.DB().SignalModifyKey(dstkey)
+
+	var event string
+	if where == rtype.REDIS_LIST_HEAD {
+		dstobj.PushFront(value)
+		event = "lpush"
+	} else {
+		dstobj.PushBack(value)
+		event = "rpush"
+	}
+	c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_LIST, event, dstkey, c.DB().GetID())
+	// Always send the pushed value to the client.
+	c.AddReplyBulk(value.Bytes())
+}
+
+/* Pop an element from the wherefrom side of the list at argv[1] and push
+ * it on the whereto side of the list at argv[2], the core of RPOPLPUSH,
+ * LMOVE and their blocking variants. */
+func lmoveGeneric(c *redigo.CommandArg, wherefrom, whereto int) {
+	var sobj, dobj rtype.List
+	var ok bool
+
+	if o := c.LookupKeyWriteOrReply(c.Argv[1], protocol.NullBulk); o == nil {
+		return
+	} else if sobj, ok = o.(rtype.List); !ok {
+		c.AddReply(protocol.WrongTypeErr)
+		return
+	}
+
+	if sobj.Len() == 0 {
+		/* This may only happen after loading very old RDB files. Recent
+		 * versions of Redis delete keys of empty lists. */
+		c.AddReply(protocol.NullBulk)
+		return
+	}
+
+	// Check the type of the destination before popping from the source.
+	touchedkey := c.Argv[1]
+	if o := c.DB().LookupKeyWrite(c.Argv[2]); o != nil {
+		if dobj, ok = o.(rtype.List); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+			return
+		}
+	}
+
+	if dobj != nil && dobj == sobj && wherefrom == rtype.REDIS_LIST_TAIL && whereto == rtype.REDIS_LIST_HEAD {
+		/* The source and destination are the same list and the tail goes
+		 * to the head, so rotate the list in place. */
+		sobj.Rotate()
+		value := sobj.Front().Value()
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_LIST, "rpop", touchedkey, c.DB().GetID())
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_LIST, "lpush", touchedkey, c.DB().GetID())
+		c.AddReplyBulk(value.Bytes())
+		c.DB().SignalModifyKey(touchedkey)
+		c.Server().AddDirty(1)
+		return
+	}
+
+	var value rtype.String
+	var event string
+	if wherefrom == rtype.REDIS_LIST_HEAD {
+		value = sobj.PopFront().Value()
+		event = "lpop"
+	} else {
+		value = sobj.PopBack().Value()
+		event = "rpop"
+	}
+	lmoveHandlePush(c, c.Argv[2], dobj, value, whereto)
+
+	c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_LIST, event, touchedkey, c.DB().GetID())
+	if sobj.Len() == 0 {
+		c.DB().Delete(touchedkey)
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "del", touchedkey, c.DB().GetID())
+	}
+	c.DB().SignalModifyKey(touchedkey)
+	c.Server().AddDirty(1)
+}
+
+/* Parse the LEFT|RIGHT argument of LMOVE, LMPOP and their blocking
+ * variants. */
+func getListPositionFromObjectOrReply(c *redigo.CommandArg, arg []byte) (where int, ok bool) {
+	switch strings.ToLower(string(arg)) {
+	case "left":
+		return rtype.REDIS_LIST_HEAD, true
+	case "right":
+		return rtype.REDIS_LIST_TAIL, true
+	default:
+		c.AddReply(protocol.SyntaxErr)
+		return 0, false
+	}
+}
+
+/* Pop up to count elements from the where side of the list at key and
+ * reply with them. The key is deleted if the list is left empty. */
+func listPopRangeAndReply(c *redigo.CommandArg, l rtype.List, key []byte, where int, count int64) {
+	if llen := int64(l.Len()); count > llen {
+		count = llen
+	}
+
+	var event string
+	if where == rtype.REDIS_LIST_HEAD {
+		event = "lpop"
+	} else {
+		event = "rpop"
+	}
+
+	c.AddReplyMultiBulkLen(int(count))
+	for i := int64(0); i < count; i++ {
+		var e rtype.ListElement
+		if where == rtype.REDIS_LIST_HEAD {
+			e = l.PopFront()
+		} else {
+			e = l.PopBack()
+		}
+		c.AddReplyBulk(e.Value().Bytes())
+	}
+
+	c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_LIST, event, key, c.DB().GetID())
+	if l.Len() == 0 {
+		c.DB().Delete(key)
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "del", key, c.DB().GetID())
+	}
+	c.DB().SignalModifyKey(key)
+	c.Server().AddDirty(int(count))
+}
+
+/* Like listPopRangeAndReply, but the reply is a two elements array: the key
+ * name and the popped elements. */
+func listPopRangeAndReplyWithKey(c *redigo.CommandArg, l rtype.List, key []byte, where int, count int64) {
+	c.AddReplyMultiBulkLen(2)
+	c.AddReplyBulk(key)
+	listPopRangeAndReply(c, l, key, where, count)
+}
+
+/* Pop up to count elements from the first non empty list among keys, and
+ * reply with the key name and the elements, or with a null reply if all the
+ * lists are empty. The core of LMPOP and BLMPOP. Return false when all the
+ * lists are empty and nothing is replied, if nullReply is false. */
+func mpopGeneric(c *redigo.CommandArg, keys [][]byte, where int, count int64, nullReply bool) bool {
+	for _, key := range keys {
+		o := c.DB().LookupKeyWrite(key)
+		if o == nil {
+			continue
+		}
+		if l, ok := o.(rtype.List); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+			return true
+		} else if l.Len() != 0 {
+			// Non empty list, this is like a normal [LR]POP with count option.
+			listPopRangeAndReplyWithKey(c, l, key, where, count)
+			return true
+		}
+	}
+
+	// Look like we are not able to pop up any elements.
+	if nullReply {
+		c.AddReply(protocol.NullMultiBulk)
+	}
+	return false
+}
+
+/* Parse the arguments of LMPOP and BLMPOP, starting at numkeys:
+ * numkeys key [key ...] LEFT|RIGHT [COUNT count]. */
+func parseMpopArgs(c *redigo.CommandArg, numkeysIdx int) (keys [][]byte, where int, count int64, ok bool) {
+	numkeys, ok := GetInt64FromStringOrReply(c, rstring.New(c.Argv[numkeysIdx]), "")
+	if !ok {
+		return
+	}
+	if numkeys <= 0 {
+		c.AddReplyError("numkeys should be greater than 0")
+		return nil, 0, 0, false
+	}
+
+	// Parse the where. whereIdx: the index of where in the c.Argv.
+	if numkeys > int64(c.Argc-numkeysIdx-2) {
+		c.AddReply(protocol.SyntaxErr)
+		return nil, 0, 0, false
+	}
+	whereIdx := numkeysIdx + int(numkeys) + 1
+	if where, ok = getListPositionFromObjectOrReply(c, c.Argv[whereIdx]); !ok {
+		return
+	}
+
+	// Parse the optional arguments.
+	count = -1
+	for j := whereIdx + 1; j < c.Argc; j++ {
+		moreargs := c.Argc - 1 - j
+		if count == -1 && strings.ToLower(string(c.Argv[j])) == "count" && moreargs > 0 {
+			j++
+			if count, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[j]),
+				"count should be greater than 0"); !ok {
+				return
+			}
+			if count <= 0 {
+				c.AddReplyError("count should be greater than 0")
+				return nil, 0, 0, false
+			}
+		} else {
+			c.AddReply(protocol.SyntaxErr)
+			return nil, 0, 0, false
+		}
+	}
+	if count == -1 {
+		count = 1
+	}
+	return c.Argv[numkeysIdx+1 : whereIdx], where, count, true
 }
 
 /*============================== blocking APIs ========================================*/
@@ -437,33 +830,45 @@ func RPOPLPUSHCommand(c *redigo.CommandArg) {
  *   then LPOP is called instead. So BLPOP is semantically the same as LPOP
  *   if blocking is not required.
  * - If instead BLPOP is called and the key does not exists or the list is
- *   empty we need to block. In order to do so we remove the notification for
- *   new data to read in the client socket (so that we'll not serve new
- *   requests if the blocking request is not served). Also we put the client
- *   in a dictionary (db->blocking_keys) mapping keys to a list of clients
+ *   empty we need to block. In order to do so the goroutine of the client
+ *   stops processing the commands (so that we'll not serve new requests if
+ *   the blocking request is not served). Also we put the client in a
+ *   dictionary (db->blocking_keys) mapping keys to a list of clients
  *   blocking for this keys.
  * - If a PUSH operation against a key with blocked clients waiting is
  *   performed, we mark this key as "ready", and after the current command,
  *   MULTI/EXEC block, or script, is executed, we serve all the clients waiting
  *   for this list, from the one that blocked first, to the last, accordingly
- *   to the number of elements we have in the ready list.
+ *   to the number of elements we have in the ready list. A client is served
+ *   executing again its blocking command, that this time finds a non empty
+ *   list.
+ * - If the timeout is reached first, the client is unblocked with a null
+ *   reply. Serving and timing out are both done holding the server lock, so
+ *   only one of the two may happen.
  */
 
+/* Parse a timeout in seconds, that may have a decimal part. A zero timeout
+ * means to block forever. */
 func GetTimeoutFromStringOrReply(c *redigo.CommandArg, o rtype.String, unit time.Duration) (t time.Duration, ok bool) {
-	var x int64
-
-	if x, ok = GetInt64FromStringOrReply(c, o, "timeout is not an integer or out of range"); !ok {
-		return
+	x, err := strconv.ParseFloat(o.String(), 64)
+	if err != nil || math.IsNaN(x) || math.IsInf(x, 0) {
+		c.AddReplyError("timeout is not a float or out of range")
+		return 0, false
 	}
 
 	if x < 0 {
-		c.AddReplyError("timeout is negtive")
-		ok = false
-		return
+		c.AddReplyError("timeout is negative")
+		return 0, false
 	}
 
-	t = time.Duration(x) * unit
-	return
+	if x*float64(unit) >= math.MaxInt64 {
+		c.AddReplyError("timeout is out of range")
+		return 0, false
+	}
+
+	// Round up, a timeout of a fraction of a millisecond would never block.
+	t = time.Duration(math.Ceil(x * float64(unit)))
+	return t, true
 }
 
 func listBlockingPop(c *redigo.CommandArg, where int) {
@@ -512,7 +917,7 @@ func listBlockingPop(c *redigo.CommandArg, where int) {
 	}
 
 	// If the list is empty or the key does not exists we must block
-	c.Client.BlockForKeys(c.Argv[1:c.Argc-1], timeout)
+	c.Client.BlockForKeys(redigo.REDIS_BLOCKED_LIST, c.Argv[1:c.Argc-1], timeout)
 }
 
 func BLPOPCommand(c *redigo.CommandArg) {
@@ -523,6 +928,58 @@ func BRPOPCommand(c *redigo.CommandArg) {
 	listBlockingPop(c, rtype.REDIS_LIST_TAIL)
 }
 
+/* Blocking LMOVE: if the source list is empty or does not exist, block
+ * until the source key is pushed. The destination is created or pushed
+ * only once the client is served. */
+func blmoveGeneric(c *redigo.CommandArg, wherefrom, whereto int, timeoutIdx int) {
+	timeout, ok := GetTimeoutFromStringOrReply(c, rstring.New(c.Argv[timeoutIdx]), time.Second)
+	if !ok {
+		return
+	}
+
+	if o := c.DB().LookupKeyWrite(c.Argv[1]); o == nil {
+		// The list is empty and the client blocks.
+		c.Client.BlockForKeys(redigo.REDIS_BLOCKED_LIST, c.Argv[1:2], timeout)
+	} else if _, ok := o.(rtype.List); !ok {
+		c.AddReply(protocol.WrongTypeErr)
+	} else {
+		/* The list exists and has elements, so the regular lmoveCommand is
+		 * executed. */
+		lmoveGeneric(c, wherefrom, whereto)
+	}
+}
+
+// BRPOPLPUSH source destination timeout
 func BRPOPLPUSHCommand(c *redigo.CommandArg) {
+	blmoveGeneric(c, rtype.REDIS_LIST_TAIL, rtype.REDIS_LIST_HEAD, 3)
+}
 
+// BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+func BLMOVECommand(c *redigo.CommandArg) {
+	wherefrom, ok := getListPositionFromObjectOrReply(c, c.Argv[3])
+	if !ok {
+		return
+	}
+	whereto, ok := getListPositionFromObjectOrReply(c, c.Argv[4])
+	if !ok {
+		return
+	}
+	blmoveGeneric(c, wherefrom, whereto, 5)
+}
+
+// BLMPOP timeout numkeys key [<key> ...] LEFT|RIGHT [COUNT count]
+func BLMPOPCommand(c *redigo.CommandArg) {
+	keys, where, count, ok := parseMpopArgs(c, 2)
+	if !ok {
+		return
+	}
+	timeout, ok := GetTimeoutFromStringOrReply(c, rstring.New(c.Argv[1]), time.Second)
+	if !ok {
+		return
+	}
+
+	// If the keys do not exist or are all empty we must block.
+	if !mpopGeneric(c, keys, where, count, false) {
+		c.Client.BlockForKeys(redigo.REDIS_BLOCKED_LIST, keys, timeout)
+	}
 }
@@ -0,0 +1,217 @@
+package command
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/SteveZhangBit/redigo"
+	"github.com/SteveZhangBit/redigo/protocol"
+	"github.com/SteveZhangBit/redigo/rtype"
+	"github.com/SteveZhangBit/redigo/rtype/hash"
+	"github.com/SteveZhangBit/redigo/rtype/list"
+	"github.com/SteveZhangBit/redigo/rtype/rstring"
+	"github.com/SteveZhangBit/redigo/rtype/set"
+	"github.com/SteveZhangBit/redigo/rtype/zset"
+)
+
+/* Strings up to this length are allocated in a single chunk together with
+ * the object in Redis, and reported with the "embstr" encoding. */
+const REDIS_ENCODING_EMBSTR_SIZE_LIMIT = 44
+
+func strEncoding(o interface{}) string {
+	switch x := o.(type) {
+	case *rstring.IntString:
+		return "int"
+	case *rstring.BytesString:
+		if len(x.Val) <= REDIS_ENCODING_EMBSTR_SIZE_LIMIT {
+			return "embstr"
+		}
+		return "raw"
+	case *list.LinkedList:
+		return "linkedlist"
+	case *list.QuickList:
+		return "quicklist"
+	case *set.HashSet, *hash.BasicMap:
+		return "hashtable"
+	case *set.IntsetSet:
+		return "intset"
+	case *zset.ZSetSkiplist:
+		return "skiplist"
+	case *hash.ListpackMap, *set.ListpackSet, *zset.ZSetListpack:
+		return "listpack"
+	default:
+		return "unknown"
+	}
+}
+
+/* Lookup the key for the OBJECT command: the logically expired keys (and
+ * hash fields) are deleted as by the normal read lookup, but the access
+ * time is not updated, so that OBJECT doesn't change the idle time of the
+ * keys it inspects. */
+func objectCommandLookup(c *redigo.CommandArg, key []byte) interface{} {
+	c.DB().ExpireIfNeed(key)
+	return c.DB().GetDict()[string(key)]
+}
+
+/* Object command allows to inspect the internals of an Redis Object.
+ * Usage: OBJECT <refcount|encoding|idletime|freq> <key> */
+func OBJECTCommand(c *redigo.CommandArg) {
+	switch sub := strings.ToLower(string(c.Argv[1])); {
+	case sub == "help" && c.Argc == 2:
+		c.AddReplyMultiBulkLen(5)
+		c.AddReplyStatus("OBJECT <subcommand> key. Subcommands:")
+		c.AddReplyStatus("refcount -- Return the number of references of the value associated with the specified key.")
+		c.AddReplyStatus("encoding -- Return the kind of internal representation used in order to store the value associated with a key.")
+		c.AddReplyStatus("idletime -- Return the idle time of the key, that is the approximated number of seconds elapsed since the last access to the key.")
+		c.AddReplyStatus("freq -- Return the access frequency index of the key. The returned integer is proportional to the logarithm of the recent access frequency of the key.")
+
+	case sub == "refcount" && c.Argc == 3:
+		// Values are never shared between keys.
+		if objectCommandLookup(c, c.Argv[2]) == nil {
+			c.AddReply(protocol.NullBulk)
+		} else {
+			c.AddReply(protocol.COne)
+		}
+
+	case sub == "encoding" && c.Argc == 3:
+		if o := objectCommandLookup(c, c.Argv[2]); o == nil {
+			c.AddReply(protocol.NullBulk)
+		} else {
+			c.AddReplyBulk([]byte(strEncoding(o)))
+		}
+
+	case sub == "idletime" && c.Argc == 3:
+		if c.Server().IsLFUPolicy() {
+			c.AddReplyError("An LFU maxmemory policy is selected, idle time not tracked. " +
+				"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+		} else if objectCommandLookup(c, c.Argv[2]) == nil {
+			c.AddReply(protocol.NullBulk)
+		} else if idle, ok := c.DB().GetIdleTime(c.Argv[2]); !ok {
+			c.AddReply(protocol.NullBulk)
+		} else {
+			c.AddReplyInt64(int64(idle / time.Second))
+		}
+
+	case sub == "freq" && c.Argc == 3:
+		if !c.Server().IsLFUPolicy() {
+			c.AddReplyError("An LFU maxmemory policy is not selected, access frequency not tracked. " +
+				"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+		} else if objectCommandLookup(c, c.Argv[2]) == nil {
+			c.AddReply(protocol.NullBulk)
+		} else if freq, ok := c.DB().GetLFUFrequency(c.Argv[2]); !ok {
+			c.AddReply(protocol.NullBulk)
+		} else {
+			c.AddReplyInt64(int64(freq))
+		}
+
+	default:
+		c.AddReplyError(fmt.Sprintf("Unknown subcommand or wrong number of arguments for '%s'. Try OBJECT help", c.Argv[1]))
+	}
+}
+
+/* The memory command will eventually be a complete interface for the
+ * memory introspection capabilities of Redis.
+ *
+ * Usage: MEMORY usage <key> */
+func MEMORYCommand(c *redigo.CommandArg) {
+	switch sub := strings.ToLower(string(c.Argv[1])); {
+	case sub == "usage" && c.Argc >= 3:
+		samples := int64(rtype.REDIS_COMPUTE_SIZE_DEF_SAMPLES)
+		for j := 3; j < c.Argc; j++ {
+			if strings.ToLower(string(c.Argv[j])) == "samples" && j+1 < c.Argc {
+				var ok bool
+				if samples, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[j+1]), ""); !ok {
+					return
+				}
+				if samples < 0 {
+					c.AddReply(protocol.SyntaxErr)
+					return
+				}
+				if samples == 0 || samples > math.MaxInt32 {
+					samples = 0 // Inspect all the elements.
+				}
+				j++ // skip option argument.
+			} else {
+				c.AddReply(protocol.SyntaxErr)
+				return
+			}
+		}
+		if usage, ok := c.DB().MemoryUsage(c.Argv[2], int(samples)); ok {
+			c.AddReplyInt64(usage)
+		} else {
+			c.AddReply(protocol.NullBulk)
+		}
+
+	case sub == "stats" && c.Argc == 2:
+		mh := c.Server().GetMemoryOverheadData()
+
+		c.AddReplyMultiBulkLen((14 + len(mh.DB)) * 2)
+
+		c.AddReplyBulk([]byte("peak.allocated"))
+		c.AddReplyInt64(mh.PeakAllocated)
+
+		c.AddReplyBulk([]byte("total.allocated"))
+		c.AddReplyInt64(mh.TotalAllocated)
+
+		c.AddReplyBulk([]byte("startup.allocated"))
+		c.AddReplyInt64(mh.StartupAllocated)
+
+		c.AddReplyBulk([]byte("replication.backlog"))
+		c.AddReplyInt64(mh.ReplBacklog)
+
+		c.AddReplyBulk([]byte("clients.slaves"))
+		c.AddReplyInt64(mh.ClientsSlaves)
+
+		c.AddReplyBulk([]byte("clients.normal"))
+		c.AddReplyInt64(mh.ClientsNormal)
+
+		c.AddReplyBulk([]byte("aof.buffer"))
+		c.AddReplyInt64(mh.AOFBuffer)
+
+		for _, db := range mh.DB {
+			c.AddReplyBulk([]byte(fmt.Sprintf("db.%d", db.ID)))
+			c.AddReplyMultiBulkLen(4)
+
+			c.AddReplyBulk([]byte("overhead.hashtable.main"))
+			c.AddReplyInt64(db.OverheadHTMain)
+
+			c.AddReplyBulk([]byte("overhead.hashtable.expires"))
+			c.AddReplyInt64(db.OverheadHTExpires)
+		}
+
+		c.AddReplyBulk([]byte("overhead.total"))
+		c.AddReplyInt64(mh.OverheadTotal)
+
+		c.AddReplyBulk([]byte("keys.count"))
+		c.AddReplyInt64(mh.TotalKeys)
+
+		c.AddReplyBulk([]byte("keys.bytes-per-key"))
+		c.AddReplyInt64(mh.BytesPerKey)
+
+		c.AddReplyBulk([]byte("dataset.bytes"))
+		c.AddReplyInt64(mh.Dataset)
+
+		c.AddReplyBulk([]byte("dataset.percentage"))
+		c.AddReplyFloat64(mh.DatasetPerc)
+
+		c.AddReplyBulk([]byte("peak.percentage"))
+		c.AddReplyFloat64(mh.PeakPerc)
+
+		c.AddReplyBulk([]byte("fragmentation"))
+		c.AddReplyFloat64(mh.Fragmentation)
+
+	case sub == "doctor" && c.Argc == 2:
+		c.AddReplyBulk([]byte(c.Server().GetMemoryDoctorReport()))
+
+	case sub == "help" && c.Argc == 2:
+		c.AddReplyMultiBulkLen(3)
+		c.AddReplyBulk([]byte("MEMORY DOCTOR                        - Outputs memory problems report"))
+		c.AddReplyBulk([]byte("MEMORY USAGE <key> [SAMPLES <count>] - Estimate memory usage of key"))
+		c.AddReplyBulk([]byte("MEMORY STATS                         - Show memory usage details"))
+
+	default:
+		c.AddReplyError("Syntax error. Try MEMORY HELP")
+	}
+}
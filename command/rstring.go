@@ -1,14 +1,17 @@
 package command
 
 import (
+	"fmt"
 	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/SteveZhangBit/redigo"
 	"github.com/SteveZhangBit/redigo/protocol"
 	"github.com/SteveZhangBit/redigo/rtype"
 	"github.com/SteveZhangBit/redigo/rtype/rstring"
+	"github.com/SteveZhangBit/redigo/rtype/rstring/sds"
 )
 
 func GetInt64FromStringOrReply(c *redigo.CommandArg, o rtype.String, msg string) (x int64, ok bool) {
@@ -37,7 +40,7 @@ func GetFloat64FromStringOrReply(c *redigo.CommandArg, o rtype.String, msg strin
 	case *rstring.IntString:
 		x, ok = float64(str.Val), true
 	case *rstring.BytesString:
-		if i, err := strconv.ParseFloat(string(str.Val), 64); err != nil {
+		if i, err := strconv.ParseFloat(string(str.Val), 64); err != nil || math.IsNaN(i) {
 			ok = false
 		} else {
 			x, ok = i, true
@@ -55,8 +58,12 @@ func GetFloat64FromStringOrReply(c *redigo.CommandArg, o rtype.String, msg strin
 	return
 }
 
-func CheckStringlength(c *redigo.CommandArg, size int64) bool {
-	if size > 512*1024*1024 {
+/* Check that a string of size bytes, that is going to grow of appendlen
+ * bytes, doesn't exceed the maximum allowed size. The sum is computed
+ * checking for overflows, as the size may come from the user. */
+func CheckStringlength(c *redigo.CommandArg, size, appendlen int64) bool {
+	total := uint64(size) + uint64(appendlen)
+	if total > 512*1024*1024 || total < uint64(size) || total < uint64(appendlen) {
 		c.AddReplyError("string exceeds maximum allowed size (512MB)")
 		return false
 	}
@@ -161,12 +168,252 @@ func GETSETCommand(c *redigo.CommandArg) {
 	}
 }
 
+/* The expire options of GETEX, the absolute time of the expire is
+ * computed from the unit and whether the time is relative. */
+const (
+	REDIS_GETEX_NO_FLAGS = 0
+	REDIS_GETEX_EX       = 1 << 0 // Set expire in seconds
+	REDIS_GETEX_PX       = 1 << 1 // Set expire in milliseconds
+	REDIS_GETEX_EXAT     = 1 << 2 // Set expire at a Unix time in seconds
+	REDIS_GETEX_PXAT     = 1 << 3 // Set expire at a Unix time in milliseconds
+	REDIS_GETEX_PERSIST  = 1 << 4 // Remove the expire
+)
+
+/* GETEX <key> [PERSIST][EX seconds][PX milliseconds][EXAT seconds-timestamp][PXAT milliseconds-timestamp]
+ *
+ * The getexCommand() function implements extended options and variants of the GET command. Unlike GET
+ * command this command is not read-only.
+ *
+ * The default behavior when no options are specified is same as GET and does not alter any TTL.
+ *
+ * Only one of the below options can be used at a given time.
+ *
+ * 1. PERSIST removes any TTL associated with the key.
+ * 2. EX Set expiry TTL in seconds.
+ * 3. PX Set expiry TTL in milliseconds.
+ * 4. EXAT Same like EX instead of specifying the number of seconds representing the TTL
+ *      (time to live), it takes an absolute Unix timestamp
+ * 5. PXAT Same like PX instead of specifying the number of milliseconds representing the TTL
+ *      (time to live), it takes an absolute Unix timestamp
+ *
+ * Command would either return the bulk string, error or nil. */
+func GETEXCommand(c *redigo.CommandArg) {
+	flags := REDIS_GETEX_NO_FLAGS
+	var expire []byte
+
+	for j := 2; j < c.Argc; j++ {
+		opt := strings.ToLower(string(c.Argv[j]))
+		var next []byte
+		if j < c.Argc-1 {
+			next = c.Argv[j+1]
+		}
+
+		var flag int
+		switch {
+		case opt == "persist":
+			flag = REDIS_GETEX_PERSIST
+		case opt == "ex" && next != nil:
+			flag = REDIS_GETEX_EX
+		case opt == "px" && next != nil:
+			flag = REDIS_GETEX_PX
+		case opt == "exat" && next != nil:
+			flag = REDIS_GETEX_EXAT
+		case opt == "pxat" && next != nil:
+			flag = REDIS_GETEX_PXAT
+		}
+		// Only one option can be used.
+		if flag == 0 || flags != REDIS_GETEX_NO_FLAGS {
+			c.AddReply(protocol.SyntaxErr)
+			return
+		}
+		flags = flag
+		if flag != REDIS_GETEX_PERSIST {
+			expire = next
+			j++
+		}
+	}
+
+	// Parse the expire time, converted to an absolute Unix time.
+	var when time.Duration
+	if expire != nil {
+		x, ok := GetInt64FromStringOrReply(c, rstring.New(expire), "")
+		if !ok {
+			return
+		}
+
+		unit := time.Millisecond
+		if flags&(REDIS_GETEX_EX|REDIS_GETEX_EXAT) != 0 {
+			unit = time.Second
+		}
+		var base int64
+		if flags&(REDIS_GETEX_EX|REDIS_GETEX_PX) != 0 {
+			base = time.Now().UnixNano()
+		}
+		if x <= 0 || x > (math.MaxInt64-base)/int64(unit) {
+			c.AddReplyError(fmt.Sprintf("invalid expire time in '%s' command", c.Argv[0]))
+			return
+		}
+		when = time.Duration(base + x*int64(unit))
+	}
+
+	// We need to do this before we expire the key or delete it
+	o := c.LookupKeyReadOrReply(c.Argv[1], protocol.NullBulk)
+	if o == nil {
+		return
+	}
+	str, ok := o.(rtype.String)
+	if !ok {
+		c.AddReply(protocol.WrongTypeErr)
+		return
+	}
+	c.AddReplyBulk(str.Bytes())
+
+	if expire != nil {
+		/* An expire time in the past deletes the key at once, as it would
+		 * be expired at the next access anyway. */
+		if when <= time.Duration(time.Now().UnixNano()) {
+			c.DB().Delete(c.Argv[1])
+			c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "del", c.Argv[1], c.DB().GetID())
+		} else {
+			c.DB().SetExpire(c.Argv[1], when)
+			c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "expire", c.Argv[1], c.DB().GetID())
+		}
+		c.DB().SignalModifyKey(c.Argv[1])
+		c.Server().AddDirty(1)
+	} else if flags&REDIS_GETEX_PERSIST != 0 {
+		if c.DB().RemoveExpire(c.Argv[1]) {
+			c.DB().SignalModifyKey(c.Argv[1])
+			c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "persist", c.Argv[1], c.DB().GetID())
+			c.Server().AddDirty(1)
+		}
+	}
+}
+
+// GETDEL key
+func GETDELCommand(c *redigo.CommandArg) {
+	if rstringGet(c) && c.DB().Delete(c.Argv[1]) {
+		/* If the key exists, and it was a string, delete it. */
+		c.DB().SignalModifyKey(c.Argv[1])
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "del", c.Argv[1], c.DB().GetID())
+		c.Server().AddDirty(1)
+	}
+}
+
+// SETRANGE key offset value
 func SETRANGECommand(c *redigo.CommandArg) {
+	var str *rstring.BytesString
+	value := c.Argv[3]
+
+	offset, ok := GetInt64FromStringOrReply(c, rstring.New(c.Argv[2]), "")
+	if !ok {
+		return
+	}
+	if offset < 0 {
+		c.AddReplyError("offset is out of range")
+		return
+	}
+
+	o := c.DB().LookupKeyWrite(c.Argv[1])
+	if o == nil {
+		// Return 0 when setting nothing on a non-existing string
+		if len(value) == 0 {
+			c.AddReply(protocol.CZero)
+			return
+		}
+
+		// Return when the resulting string exceeds allowed size
+		if !CheckStringlength(c, offset, int64(len(value))) {
+			return
+		}
+
+		str = &rstring.BytesString{}
+		c.DB().Add(c.Argv[1], str)
+	} else {
+		s, ok := o.(rtype.String)
+		if !ok {
+			c.AddReply(protocol.WrongTypeErr)
+			return
+		}
+
+		// Return existing string length when setting nothing
+		if len(value) == 0 {
+			c.AddReplyInt64(s.Len())
+			return
+		}
 
+		// Return when the resulting string exceeds allowed size
+		if !CheckStringlength(c, offset, int64(len(value))) {
+			return
+		}
+
+		// Create a copy when the object is an integer, that can't be modified.
+		if str, ok = s.(*rstring.BytesString); !ok {
+			str = &rstring.BytesString{Val: s.Bytes()}
+			c.DB().Update(c.Argv[1], str)
+		}
+	}
+
+	buf := sds.SDS(str.Val)
+	buf.GrowZero(int(offset) + len(value))
+	copy(buf[offset:], value)
+	str.Val = buf
+	c.DB().SignalModifyKey(c.Argv[1])
+	c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_STRING, "setrange", c.Argv[1], c.DB().GetID())
+	c.Server().AddDirty(1)
+	c.AddReplyInt64(str.Len())
 }
 
+// GETRANGE key start end
 func GETRANGECommand(c *redigo.CommandArg) {
+	start, ok := GetInt64FromStringOrReply(c, rstring.New(c.Argv[2]), "")
+	if !ok {
+		return
+	}
+	end, ok := GetInt64FromStringOrReply(c, rstring.New(c.Argv[3]), "")
+	if !ok {
+		return
+	}
+
+	o := c.LookupKeyReadOrReply(c.Argv[1], protocol.EmptyBulk)
+	if o == nil {
+		return
+	}
+	str, ok := o.(rtype.String)
+	if !ok {
+		c.AddReply(protocol.WrongTypeErr)
+		return
+	}
+	s := str.Bytes()
+	strlen := int64(len(s))
 
+	// Convert negative indexes
+	if start < 0 && end < 0 && start > end {
+		c.AddReply(protocol.EmptyBulk)
+		return
+	}
+	if start < 0 {
+		start = strlen + start
+	}
+	if end < 0 {
+		end = strlen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= strlen {
+		end = strlen - 1
+	}
+
+	/* Precondition: end >= 0 && end < strlen, so the only condition where
+	 * nothing can be returned is: start > end. */
+	if start > end || strlen == 0 {
+		c.AddReply(protocol.EmptyBulk)
+	} else {
+		c.AddReplyBulk(s[start : end+1])
+	}
 }
 
 func MGETCommand(c *redigo.CommandArg) {
@@ -198,7 +445,7 @@ func rstringmset(c *redigo.CommandArg, nx bool) {
 				busykeys++
 			}
 		}
-		if busykeys {
+		if busykeys > 0 {
 			c.AddReply(protocol.CZero)
 			return
 		}
@@ -331,10 +578,10 @@ func APPENDCommand(c *redigo.CommandArg) {
 		c.AddReply(protocol.WrongTypeErr)
 		return
 	} else {
-		totallen = str.Len() + int64(len(c.Argv[2]))
-		if !CheckStringlength(c, totallen) {
+		if !CheckStringlength(c, str.Len(), int64(len(c.Argv[2]))) {
 			return
 		}
+		totallen = str.Len() + int64(len(c.Argv[2]))
 
 		c.DB().Update(c.Argv[1], str.Append(c.Argv[2]))
 	}
@@ -353,3 +600,192 @@ func STRLENCommand(c *redigo.CommandArg) {
 		}
 	}
 }
+
+/* LCS key1 key2 [LEN] [IDX] [MINMATCHLEN <len>] [WITHMATCHLEN] */
+func LCSCommand(c *redigo.CommandArg) {
+	var minmatchlen int64
+	var getlen, getidx, withmatchlen bool
+
+	for j := 3; j < c.Argc; j++ {
+		opt := strings.ToLower(string(c.Argv[j]))
+		moreargs := c.Argc - 1 - j
+
+		if opt == "idx" {
+			getidx = true
+		} else if opt == "len" {
+			getlen = true
+		} else if opt == "withmatchlen" {
+			withmatchlen = true
+		} else if opt == "minmatchlen" && moreargs > 0 {
+			var ok bool
+			if minmatchlen, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[j+1]), ""); !ok {
+				return
+			}
+			if minmatchlen < 0 {
+				minmatchlen = 0
+			}
+			j++
+		} else {
+			c.AddReply(protocol.SyntaxErr)
+			return
+		}
+	}
+
+	// Complain if the user passed ambiguous parameters.
+	if getlen && getidx {
+		c.AddReplyError("If you want both the length and indexes, please just use IDX.")
+		return
+	}
+
+	// Fetch the strings, a missing key is an empty string.
+	var a, b []byte
+	for i, key := range c.Argv[1:3] {
+		o := c.DB().LookupKeyRead(key)
+		if o == nil {
+			continue
+		}
+		str, ok := o.(rtype.String)
+		if !ok {
+			c.AddReplyError("The specified keys must contain string values")
+			return
+		}
+		if i == 0 {
+			a = str.Bytes()
+		} else {
+			b = str.Bytes()
+		}
+	}
+	alen, blen := len(a), len(b)
+
+	/* Setup an uint32_t array to store at LCS[i,j] the length of the
+	 * LCS A0..i-1, B0..j-1. Note that we have a linear array here, so
+	 * we index it as LCS[j+(blen+1)*i] */
+	if int64(alen+1)*int64(blen+1) > 512*1024*1024/4 {
+		c.AddReplyError("Insufficient memory, transient memory for LCS exceeds proto-max-bulk-len")
+		return
+	}
+	lcs := make([]uint32, (alen+1)*(blen+1))
+	LCS := func(i, j int) uint32 { return lcs[j+(blen+1)*i] }
+
+	/* Start building the LCS table. The first row and the first column are
+	 * already zero, since an empty string has no common subsequence. */
+	for i := 1; i <= alen; i++ {
+		for j := 1; j <= blen; j++ {
+			if a[i-1] == b[j-1] {
+				/* The len LCS (and the LCS itself) of two
+				 * sequences with the same final character, is the
+				 * LCS of the two sequences without the last char
+				 * plus that last char. */
+				lcs[j+(blen+1)*i] = LCS(i-1, j-1) + 1
+			} else {
+				/* If the last character is different, take the longest
+				 * between the LCS of the first string and the second
+				 * minus the last char, and the reverse. */
+				lcs1, lcs2 := LCS(i-1, j), LCS(i, j-1)
+				if lcs1 > lcs2 {
+					lcs[j+(blen+1)*i] = lcs1
+				} else {
+					lcs[j+(blen+1)*i] = lcs2
+				}
+			}
+		}
+	}
+
+	/* Store the actual LCS string in "result" if needed. We create
+	 * it backward, but the length is already known, we store it into idx. */
+	idx := LCS(alen, blen)
+	var result []byte
+	type lcsMatch struct {
+		astart, aend, bstart, bend int
+	}
+	var matches []lcsMatch
+
+	// Do we need to compute the actual LCS string or the matches?
+	computelcs := getidx || !getlen
+	if computelcs {
+		result = make([]byte, idx)
+	}
+
+	/* The ranges are collected walking the LCS table backward from the
+	 * bottom-right corner. */
+	i, j := alen, blen
+	arangeStart := alen // alen signals that values are not set.
+	var arangeEnd, brangeStart, brangeEnd int
+	for computelcs && i > 0 && j > 0 {
+		emitRange := false
+		if a[i-1] == b[j-1] {
+			/* If there is a match, store the character and reduce
+			 * the indexes to look for a new match. */
+			result[idx-1] = a[i-1]
+
+			// Track the current range.
+			if arangeStart == alen {
+				arangeStart, arangeEnd = i-1, i-1
+				brangeStart, brangeEnd = j-1, j-1
+			} else if arangeStart == i && brangeStart == j {
+				/* Let's see if we can extend the range backward since
+				 * it is contiguous. */
+				arangeStart--
+				brangeStart--
+			} else {
+				emitRange = true
+			}
+			/* Emit the range if we matched with the first byte of
+			 * one of the two strings. We'll exit the loop ASAP. */
+			if arangeStart == 0 || brangeStart == 0 {
+				emitRange = true
+			}
+			idx--
+			i--
+			j--
+		} else {
+			/* Otherwise reduce i and j depending on the largest
+			 * LCS between, to understand what direction we need to go. */
+			if LCS(i-1, j) > LCS(i, j-1) {
+				i--
+			} else {
+				j--
+			}
+			if arangeStart != alen {
+				emitRange = true
+			}
+		}
+
+		// Emit the current range if needed.
+		if emitRange {
+			if matchLen := arangeEnd - arangeStart + 1; minmatchlen == 0 || int64(matchLen) >= minmatchlen {
+				matches = append(matches, lcsMatch{arangeStart, arangeEnd, brangeStart, brangeEnd})
+			}
+			arangeStart = alen // Restart at the next match.
+		}
+	}
+
+	// Reply depending on the given options.
+	if getidx {
+		c.AddReplyMultiBulkLen(4)
+		c.AddReplyBulk([]byte("matches"))
+		c.AddReplyMultiBulkLen(len(matches))
+		for _, m := range matches {
+			if withmatchlen {
+				c.AddReplyMultiBulkLen(3)
+			} else {
+				c.AddReplyMultiBulkLen(2)
+			}
+			c.AddReplyMultiBulkLen(2)
+			c.AddReplyInt64(int64(m.astart))
+			c.AddReplyInt64(int64(m.aend))
+			c.AddReplyMultiBulkLen(2)
+			c.AddReplyInt64(int64(m.bstart))
+			c.AddReplyInt64(int64(m.bend))
+			if withmatchlen {
+				c.AddReplyInt64(int64(m.aend - m.astart + 1))
+			}
+		}
+		c.AddReplyBulk([]byte("len"))
+		c.AddReplyInt64(int64(LCS(alen, blen)))
+	} else if getlen {
+		c.AddReplyInt64(int64(LCS(alen, blen)))
+	} else {
+		c.AddReplyBulk(result)
+	}
+}
@@ -1,6 +1,11 @@
 package command
 
 import (
+	"bytes"
+	"math"
+	"sort"
+	"strings"
+
 	"github.com/SteveZhangBit/redigo"
 	"github.com/SteveZhangBit/redigo/protocol"
 	"github.com/SteveZhangBit/redigo/rtype"
@@ -8,11 +13,72 @@ import (
 	"github.com/SteveZhangBit/redigo/rtype/set"
 )
 
+/* Add the specified value into a set.
+ *
+ * If the value was already member of the set, nothing is done and false is
+ * returned, otherwise the new element is added and true is returned.
+ *
+ * An intset is converted to a listpack or a hash table when the value is not
+ * an integer or the intset grows past set-max-intset-entries, and a listpack
+ * is converted to a hash table when it grows past set-max-listpack-entries or
+ * the value is longer than set-max-listpack-value: the converted set takes
+ * the place of the old one in the DB, unless key is nil because the set is
+ * not stored yet, and is returned to the caller. */
+func setTypeAdd(c *redigo.CommandArg, key []byte, s rtype.Set, val rtype.String) (rtype.Set, bool) {
+	var converted bool
+	switch x := s.(type) {
+	case *set.IntsetSet:
+		if !x.CanAdd(val) {
+			/* Failed to get integer from object, convert to a listpack if
+			 * the set is still small, or to a regular set otherwise. */
+			if x.FitsListpack(val) {
+				s = x.ConvertToListpack()
+			} else {
+				s = x.Convert()
+			}
+			converted = true
+		} else if x.Add(val) {
+			// Convert to regular set when the intset contains too many entries.
+			if x.Size() > set.MaxIntsetEntries {
+				s = x.Convert()
+				if key != nil {
+					c.DB().Update(key, s)
+				}
+			}
+			return s, true
+		} else {
+			return s, false
+		}
+	case *set.ListpackSet:
+		if x.IsMember(val) {
+			return s, false
+		}
+		if x.Size()+1 > set.MaxListpackEntries || int(val.Len()) > set.MaxListpackValue {
+			s = x.Convert()
+			converted = true
+		}
+	}
+	if converted && key != nil {
+		c.DB().Update(key, s)
+	}
+	return s, s.Add(val)
+}
+
+/* Create a set holding the specified elements, that must not be empty, with
+ * the most compact encoding that fits them. */
+func setTypeCreateFrom(c *redigo.CommandArg, elems []rtype.String) rtype.Set {
+	s := set.New(elems[0], len(elems))
+	for _, e := range elems {
+		s, _ = setTypeAdd(c, nil, s, e)
+	}
+	return s
+}
+
 func SADDCommand(c *redigo.CommandArg) {
 	var s rtype.Set
 
 	if o := c.DB().LookupKeyWrite(c.Argv[1]); o == nil {
-		s = set.New(rstring.New(c.Argv[2]))
+		s = set.New(rstring.New(c.Argv[2]), c.Argc-2)
 		c.DB().Add(c.Argv[1], s)
 	} else {
 		var ok bool
@@ -24,7 +90,8 @@ func SADDCommand(c *redigo.CommandArg) {
 
 	var added int
 	for i := 2; i < c.Argc; i++ {
-		if s.Add(rstring.New(c.Argv[i])) {
+		var ok bool
+		if s, ok = setTypeAdd(c, c.Argv[1], s, rstring.New(c.Argv[i])); ok {
 			added++
 		}
 	}
@@ -71,7 +138,66 @@ func SREMCommand(c *redigo.CommandArg) {
 }
 
 func SMOVECommand(c *redigo.CommandArg) {
+	var srcset, dstset rtype.Set
+	var ok bool
+
+	// If the source key does not exist return 0
+	o := c.LookupKeyWriteOrReply(c.Argv[1], protocol.CZero)
+	if o == nil {
+		return
+	}
+	/* If the source key has the wrong type, or the destination key
+	 * is set and has the wrong type, return with an error. */
+	if srcset, ok = o.(rtype.Set); !ok {
+		c.AddReply(protocol.WrongTypeErr)
+		return
+	}
+	if o = c.DB().LookupKeyWrite(c.Argv[2]); o != nil {
+		if dstset, ok = o.(rtype.Set); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+			return
+		}
+	}
+	ele := rstring.New(c.Argv[3])
 
+	// If srcset and dstset are equal, SMOVE is a no-op
+	if bytes.Equal(c.Argv[1], c.Argv[2]) {
+		if srcset.IsMember(ele) {
+			c.AddReply(protocol.COne)
+		} else {
+			c.AddReply(protocol.CZero)
+		}
+		return
+	}
+
+	// If the element cannot be removed from the src set, return 0.
+	if !srcset.Remove(ele) {
+		c.AddReply(protocol.CZero)
+		return
+	}
+	c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_SET, "srem", c.Argv[1], c.DB().GetID())
+
+	// Remove the src set from the database when empty
+	if srcset.Size() == 0 {
+		c.DB().Delete(c.Argv[1])
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "del", c.Argv[1], c.DB().GetID())
+	}
+
+	// Create the destination set when it doesn't exist
+	if dstset == nil {
+		dstset = set.New(ele, 1)
+		c.DB().Add(c.Argv[2], dstset)
+	}
+	c.DB().SignalModifyKey(c.Argv[1])
+	c.Server().AddDirty(1)
+
+	// An extra key has changed when ele was successfully added to dstset
+	if _, ok = setTypeAdd(c, c.Argv[2], dstset, ele); ok {
+		c.Server().AddDirty(1)
+		c.DB().SignalModifyKey(c.Argv[2])
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_SET, "sadd", c.Argv[2], c.DB().GetID())
+	}
+	c.AddReply(protocol.COne)
 }
 
 func SISMEMBERCommand(c *redigo.CommandArg) {
@@ -92,6 +218,29 @@ func SISMEMBERCommand(c *redigo.CommandArg) {
 	}
 }
 
+func SMISMEMBERCommand(c *redigo.CommandArg) {
+	var s rtype.Set
+
+	/* Don't abort when the key cannot be found. Non-existing keys are empty
+	 * sets, where SMISMEMBER should respond with a series of zeros. */
+	if o := c.DB().LookupKeyRead(c.Argv[1]); o != nil {
+		var ok bool
+		if s, ok = o.(rtype.Set); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+			return
+		}
+	}
+
+	c.AddReplyMultiBulkLen(c.Argc - 2)
+	for j := 2; j < c.Argc; j++ {
+		if s != nil && s.IsMember(rstring.New(c.Argv[j])) {
+			c.AddReply(protocol.COne)
+		} else {
+			c.AddReply(protocol.CZero)
+		}
+	}
+}
+
 func SCARDCommand(c *redigo.CommandArg) {
 	if o := c.LookupKeyReadOrReply(c.Argv[1], protocol.CZero); o != nil {
 		if s, ok := o.(rtype.Set); !ok {
@@ -102,17 +251,135 @@ func SCARDCommand(c *redigo.CommandArg) {
 	}
 }
 
+/* How many times bigger should be the set compared to the remaining size
+ * for us to use the "create new set" strategy? Read later in the
+ * implementation for more info. */
+const SPOP_MOVE_STRATEGY_MUL = 5
+
+func spopWithCount(c *redigo.CommandArg) {
+	var s rtype.Set
+
+	// Get the count argument
+	count, ok := GetInt64FromStringOrReply(c, rstring.New(c.Argv[2]), "")
+	if !ok {
+		return
+	}
+	if count < 0 {
+		c.AddReplyError("value is out of range, must be positive")
+		return
+	}
+
+	/* Make sure a key with the name inputted exists, and that it's type is
+	 * indeed a set. Otherwise, return nil */
+	if o := c.LookupKeyWriteOrReply(c.Argv[1], protocol.EmptyMultiBulk); o == nil {
+		return
+	} else if s, ok = o.(rtype.Set); !ok {
+		c.AddReply(protocol.WrongTypeErr)
+		return
+	}
+
+	/* If count is zero, serve an empty multibulk ASAP to avoid special
+	 * cases later. */
+	if count == 0 {
+		c.AddReply(protocol.EmptyMultiBulk)
+		return
+	}
+
+	size := int64(s.Size())
+
+	// Generate an SPOP keyspace notification
+	c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_SET, "spop", c.Argv[1], c.DB().GetID())
+
+	/* CASE 1:
+	 * The number of requested elements is greater than or equal to
+	 * the number of elements inside the set: simply return the whole set. */
+	if count >= size {
+		// We just return the entire set
+		c.AddReplyMultiBulkLen(int(size))
+		s.Iterate(func(v rtype.String) bool {
+			c.AddReplyBulk(v.Bytes())
+			return true
+		})
+
+		// Delete the set as it is now empty
+		c.DB().Delete(c.Argv[1])
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "del", c.Argv[1], c.DB().GetID())
+		c.DB().SignalModifyKey(c.Argv[1])
+		c.Server().AddDirty(int(size))
+		return
+	}
+
+	/* TODO: Case 2 and 3 require to replicate SPOP as a set of SREM commands. */
+	c.AddReplyMultiBulkLen(int(count))
+	c.Server().AddDirty(int(count))
+	remaining := size - count // Elements left after SPOP.
+
+	/* If we are here, the number of requested elements is less than the
+	 * number of elements inside the set. Also we are sure that count < size.
+	 * Use two different strategies.
+	 *
+	 * CASE 2: The number of elements to return is small compared to the
+	 * set size. We can just extract random elements and return them to
+	 * the set. */
+	if remaining*SPOP_MOVE_STRATEGY_MUL > count {
+		for ; count > 0; count-- {
+			// Emit and remove.
+			e := s.RandomElement()
+			c.AddReplyBulk(e.Bytes())
+			s.Remove(e)
+		}
+	} else {
+		/* CASE 3: The number of elements to return is very big, approaching
+		 * the size of the set itself. After some time extracting random
+		 * elements from such a set becomes computationally expensive, so we
+		 * use a different strategy, we extract random elements that we don't
+		 * want to return (the elements that will remain part of the set),
+		 * creating a new set as we do this (that will be stored as the
+		 * original set). Then we return the elements left in the original
+		 * set and release it. */
+		elems := make([]rtype.String, 0, remaining)
+
+		// Create a new set with just the remaining elements.
+		for ; remaining > 0; remaining-- {
+			e := s.RandomElement()
+			elems = append(elems, e)
+			s.Remove(e)
+		}
+
+		// Transfer the old set to the client.
+		s.Iterate(func(v rtype.String) bool {
+			c.AddReplyBulk(v.Bytes())
+			return true
+		})
+
+		// Assign the new set as the key value.
+		c.DB().Update(c.Argv[1], setTypeCreateFrom(c, elems))
+	}
+	c.DB().SignalModifyKey(c.Argv[1])
+}
+
 func SPOPCommand(c *redigo.CommandArg) {
 	var s rtype.Set
 
+	if c.Argc == 3 {
+		spopWithCount(c)
+		return
+	} else if c.Argc > 3 {
+		c.AddReply(protocol.SyntaxErr)
+		return
+	}
+
+	/* Make sure a key with the name inputted exists, and that it's type is
+	 * indeed a set */
 	var ok bool
-	if o := c.LookupKeyWriteOrReply(c.Argv[1], protocol.CZero); o == nil {
+	if o := c.LookupKeyWriteOrReply(c.Argv[1], protocol.NullBulk); o == nil {
 		return
 	} else if s, ok = o.(rtype.Set); !ok {
 		c.AddReply(protocol.WrongTypeErr)
 		return
 	}
 
+	// Pop a random element from the set
 	e := s.RandomElement()
 	s.Remove(e)
 	c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_SET, "spop", c.Argv[1], c.DB().GetID())
@@ -128,32 +395,454 @@ func SPOPCommand(c *redigo.CommandArg) {
 	c.Server().AddDirty(1)
 }
 
+/* How many times bigger should be the set compared to the requested size
+ * for us to don't use the "remove elements" strategy? Read later in the
+ * implementation for more info. */
+const SRANDMEMBER_SUB_STRATEGY_MUL = 3
+
+func srandmemberWithCount(c *redigo.CommandArg) {
+	var s rtype.Set
+	uniq := true
+
+	l, ok := GetInt64FromStringOrReply(c, rstring.New(c.Argv[2]), "")
+	if !ok {
+		return
+	}
+	count := l
+	if l < 0 {
+		/* A negative count means: return the same elements multiple times
+		 * (i.e. don't remove the extracted element after every extraction).
+		 * Make sure the count can't overflow. */
+		if l < -math.MaxInt64 {
+			c.AddReplyError("value is out of range")
+			return
+		}
+		count = -l
+		uniq = false
+	}
+
+	if o := c.LookupKeyReadOrReply(c.Argv[1], protocol.EmptyMultiBulk); o == nil {
+		return
+	} else if s, ok = o.(rtype.Set); !ok {
+		c.AddReply(protocol.WrongTypeErr)
+		return
+	}
+	size := int64(s.Size())
+
+	// If count is zero, serve it ASAP to avoid special cases later.
+	if count == 0 {
+		c.AddReply(protocol.EmptyMultiBulk)
+		return
+	}
+
+	/* CASE 1: The count was negative, so the extraction method is just:
+	 * "return N random elements" sampling the whole set every time.
+	 * This case is trivial and can be served without auxiliary data
+	 * structures. */
+	if !uniq {
+		c.AddReplyMultiBulkLen(int(count))
+		for ; count > 0; count-- {
+			c.AddReplyBulk(s.RandomElement().Bytes())
+			/* Stop if the client is going to be closed because of the
+			 * output buffer limits: the reply can't be delivered anyway. */
+			if c.CloseOnOutputBufferLimitReached() {
+				break
+			}
+		}
+		return
+	}
+
+	/* CASE 2:
+	 * The number of requested elements is greater than the number of
+	 * elements inside the set: simply return the whole set. */
+	if count >= size {
+		c.AddReplyMultiBulkLen(int(size))
+		s.Iterate(func(v rtype.String) bool {
+			c.AddReplyBulk(v.Bytes())
+			return true
+		})
+		return
+	}
+
+	// For CASE 3 and CASE 4 we need an auxiliary set.
+	var d *set.HashSet
+
+	if count*SRANDMEMBER_SUB_STRATEGY_MUL > size {
+		/* CASE 3:
+		 * The number of elements inside the set is not greater than
+		 * SRANDMEMBER_SUB_STRATEGY_MUL times the number of requested
+		 * elements. In this case we create a set from scratch with all the
+		 * elements, and subtract random elements to reach the requested
+		 * number of elements.
+		 *
+		 * This is done because if the number of requested elements is just
+		 * a bit less than the number of elements in the set, the natural
+		 * approach used into CASE 4 is highly inefficient. */
+		d = set.NewHashSet(int(size))
+
+		// Add all the elements into the temporary set.
+		s.Iterate(func(v rtype.String) bool {
+			d.Add(v)
+			return true
+		})
+
+		// Remove random elements to reach the right count.
+		for ; size > count; size-- {
+			d.Remove(d.RandomElement())
+		}
+	} else {
+		/* CASE 4: We have a big set compared to the requested number of
+		 * elements. In this case we can simply get random elements from the
+		 * set and add to the temporary set, trying to eventually get enough
+		 * unique elements to reach the specified count. */
+		d = set.NewHashSet(int(count))
+		for int64(d.Size()) < count {
+			d.Add(s.RandomElement())
+		}
+	}
+
+	// CASE 3 & 4: send the result to the user.
+	c.AddReplyMultiBulkLen(d.Size())
+	d.Iterate(func(v rtype.String) bool {
+		c.AddReplyBulk(v.Bytes())
+		return true
+	})
+}
+
 func SRANDMEMBERCommand(c *redigo.CommandArg) {
+	if c.Argc == 3 {
+		srandmemberWithCount(c)
+		return
+	} else if c.Argc > 3 {
+		c.AddReply(protocol.SyntaxErr)
+		return
+	}
 
+	// Handle variant without <count> argument. Reply with simple bulk string
+	if o := c.LookupKeyReadOrReply(c.Argv[1], protocol.NullBulk); o != nil {
+		if s, ok := o.(rtype.Set); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+		} else {
+			c.AddReplyBulk(s.RandomElement().Bytes())
+		}
+	}
 }
 
-func SINTERCommand(c *redigo.CommandArg) {
+/* Lookup the sets at the specified keys. Non existing keys are returned as
+ * nil sets, if a key holds another type an error is returned to the client
+ * and ok is false. */
+func setLookupKeys(c *redigo.CommandArg, setkeys [][]byte, write bool) (sets []rtype.Set, ok bool) {
+	sets = make([]rtype.Set, len(setkeys))
+	for j, key := range setkeys {
+		var o interface{}
+		if write {
+			o = c.DB().LookupKeyWrite(key)
+		} else {
+			o = c.DB().LookupKeyRead(key)
+		}
+		if o == nil {
+			continue
+		}
+		if sets[j], ok = o.(rtype.Set); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+			return nil, false
+		}
+	}
+	return sets, true
+}
+
+/* Store the result of a set operation into dstkey, or delete dstkey if the
+ * result is empty, and reply with the cardinality of the result. */
+func setStoreResult(c *redigo.CommandArg, dstkey []byte, elems []rtype.String, event string) {
+	if len(elems) > 0 {
+		c.DB().SetKeyPersist(dstkey, setTypeCreateFrom(c, elems))
+		c.AddReplyInt64(int64(len(elems)))
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_SET, event, dstkey, c.DB().GetID())
+		c.Server().AddDirty(1)
+	} else {
+		c.AddReply(protocol.CZero)
+		if c.DB().Delete(dstkey) {
+			c.Server().AddDirty(1)
+			c.DB().SignalModifyKey(dstkey)
+			c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "del", dstkey, c.DB().GetID())
+		}
+	}
+}
+
+func setReplyElements(c *redigo.CommandArg, elems []rtype.String) {
+	c.AddReplyMultiBulkLen(len(elems))
+	for _, e := range elems {
+		c.AddReplyBulk(e.Bytes())
+	}
+}
+
+/* SINTER, SINTERSTORE and SINTERCARD. When dstkey is not nil the result is
+ * stored there, when cardinalityOnly is set only the cardinality of the
+ * intersection is returned, up to limit elements if limit is not 0. */
+func sinterGeneric(c *redigo.CommandArg, setkeys [][]byte, dstkey []byte, cardinalityOnly bool, limit int64) {
+	sets, ok := setLookupKeys(c, setkeys, dstkey != nil)
+	if !ok {
+		return
+	}
+	for _, s := range sets {
+		// A non existing key is an empty set, so the intersection is empty.
+		if s == nil {
+			if dstkey != nil {
+				setStoreResult(c, dstkey, nil, "")
+			} else if cardinalityOnly {
+				c.AddReply(protocol.CZero)
+			} else {
+				c.AddReply(protocol.EmptyMultiBulk)
+			}
+			return
+		}
+	}
+
+	/* Sort sets from the smallest to largest, this will improve our
+	 * algorithm's performance */
+	sort.Slice(sets, func(i, j int) bool { return sets[i].Size() < sets[j].Size() })
+
+	/* Iterate all the elements of the first (smallest) set, and test
+	 * the element against all the other sets, if at least one set does
+	 * not include the element it is discarded */
+	var elems []rtype.String
+	var cardinality int64
+	sets[0].Iterate(func(v rtype.String) bool {
+		for _, s := range sets[1:] {
+			if !s.IsMember(v) {
+				return true
+			}
+		}
+		// Only take action when all sets contain the member
+		if cardinalityOnly {
+			cardinality++
+			// Stop as soon as the LIMIT is reached.
+			return limit == 0 || cardinality < limit
+		}
+		elems = append(elems, v)
+		return true
+	})
+
+	switch {
+	case cardinalityOnly:
+		c.AddReplyInt64(cardinality)
+	case dstkey != nil:
+		setStoreResult(c, dstkey, elems, "sinterstore")
+	default:
+		setReplyElements(c, elems)
+	}
+}
 
+func SINTERCommand(c *redigo.CommandArg) {
+	sinterGeneric(c, c.Argv[1:c.Argc], nil, false, 0)
 }
 
 func SINTERSTORECommand(c *redigo.CommandArg) {
+	sinterGeneric(c, c.Argv[2:c.Argc], c.Argv[1], false, 0)
+}
+
+/* SINTERCARD numkeys key [key ...] [LIMIT limit] */
+func SINTERCARDCommand(c *redigo.CommandArg) {
+	var limit int64 // 0 means not limit.
+
+	numkeys, ok := GetInt64FromStringOrReply(c, rstring.New(c.Argv[1]), "")
+	if !ok {
+		return
+	}
+	if numkeys <= 0 {
+		c.AddReplyError("numkeys should be greater than 0")
+		return
+	}
+	if numkeys > int64(c.Argc-2) {
+		c.AddReplyError("Number of keys can't be greater than number of args")
+		return
+	}
+
+	for j := 2 + int(numkeys); j < c.Argc; j++ {
+		moreargs := c.Argc - 1 - j
+		if strings.ToLower(string(c.Argv[j])) == "limit" && moreargs > 0 {
+			j++
+			if limit, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[j]), ""); !ok {
+				return
+			}
+			if limit < 0 {
+				c.AddReplyError("LIMIT can't be negative")
+				return
+			}
+		} else {
+			c.AddReply(protocol.SyntaxErr)
+			return
+		}
+	}
 
+	sinterGeneric(c, c.Argv[2:2+numkeys], nil, true, limit)
 }
 
-func SUNIONCommand(c *redigo.CommandArg) {
+func SMEMBERSCommand(c *redigo.CommandArg) {
+	sinterGeneric(c, c.Argv[1:2], nil, false, 0)
+}
+
+const (
+	REDIS_OP_UNION = iota
+	REDIS_OP_DIFF
+	REDIS_OP_INTER
+)
+
+func sunionDiffGeneric(c *redigo.CommandArg, setkeys [][]byte, dstkey []byte, op int) {
+	sets, ok := setLookupKeys(c, setkeys, dstkey != nil)
+	if !ok {
+		return
+	}
+
+	/* Select what DIFF algorithm to use.
+	 *
+	 * Algorithm 1 is O(N*M) where N is the size of the element first set
+	 * and M the total number of sets.
+	 *
+	 * Algorithm 2 is O(N) where N is the total number of elements in all
+	 * the sets.
+	 *
+	 * We compute what is the best bet with the current input here. */
+	diffAlgo := 1
+	sameset := false
+	for j := 1; op == REDIS_OP_DIFF && j < len(setkeys); j++ {
+		// The diff of a set with itself is always empty.
+		if bytes.Equal(setkeys[0], setkeys[j]) {
+			sameset = true
+		}
+	}
+	if op == REDIS_OP_DIFF && sets[0] != nil && !sameset {
+		var algoOneWork, algoTwoWork int
+		for _, s := range sets {
+			if s == nil {
+				continue
+			}
+			algoOneWork += sets[0].Size()
+			algoTwoWork += s.Size()
+		}
+
+		/* Algorithm 1 has better constant times and performs less operations
+		 * if there are elements in common. Give it some advantage. */
+		algoOneWork /= 2
+		if algoOneWork > algoTwoWork {
+			diffAlgo = 2
+		}
+
+		if diffAlgo == 1 && len(sets) > 1 {
+			/* With algorithm 1 it is better to order the sets to subtract
+			 * by decreasing size, so that we are more likely to find
+			 * duplicated elements ASAP. */
+			others := sets[1:]
+			sort.Slice(others, func(i, j int) bool {
+				return setTypeSize(others[i]) > setTypeSize(others[j])
+			})
+		}
+	}
+
+	var elems []rtype.String
+	switch {
+	case op == REDIS_OP_UNION:
+		/* Union is trivial, just add every element of every set to the
+		 * temporary set. */
+		union := set.NewHashSet(0)
+		for _, s := range sets {
+			if s == nil {
+				continue // non existing keys are like empty sets
+			}
+			s.Iterate(func(v rtype.String) bool {
+				if union.Add(v) {
+					elems = append(elems, v)
+				}
+				return true
+			})
+		}
+
+	case sets[0] == nil || sameset:
+		// The result is empty.
+
+	case diffAlgo == 1:
+		/* DIFF Algorithm 1:
+		 *
+		 * We perform the diff by iterating all the elements of the first set,
+		 * and only adding it to the target set if the element does not exist
+		 * into all the other sets.
+		 *
+		 * This way we perform at max N*M operations, where N is the size of
+		 * the first set, and M the number of sets. */
+		sets[0].Iterate(func(v rtype.String) bool {
+			for _, s := range sets[1:] {
+				if s != nil && s.IsMember(v) { // no key is an empty set.
+					return true
+				}
+			}
+			// There is no other set with this element. Add it.
+			elems = append(elems, v)
+			return true
+		})
+
+	case diffAlgo == 2:
+		/* DIFF Algorithm 2:
+		 *
+		 * Add all the elements of the first set to the auxiliary set.
+		 * Then remove all the elements of all the next sets from it.
+		 *
+		 * This is O(N) where N is the sum of all the elements in every set. */
+		diff := set.NewHashSet(sets[0].Size())
+		sets[0].Iterate(func(v rtype.String) bool {
+			diff.Add(v)
+			return true
+		})
+		for _, s := range sets[1:] {
+			// Exit if result set is empty as any additional removal
+			// of elements will have no effect.
+			if diff.Size() == 0 {
+				break
+			}
+			if s != nil {
+				s.Iterate(func(v rtype.String) bool {
+					diff.Remove(v)
+					return true
+				})
+			}
+		}
+		diff.Iterate(func(v rtype.String) bool {
+			elems = append(elems, v)
+			return true
+		})
+	}
 
+	// Output the content of the resulting set, if not in STORE mode
+	if dstkey == nil {
+		setReplyElements(c, elems)
+	} else if op == REDIS_OP_UNION {
+		setStoreResult(c, dstkey, elems, "sunionstore")
+	} else {
+		setStoreResult(c, dstkey, elems, "sdiffstore")
+	}
 }
 
-func SUNIONSTORECommand(c *redigo.CommandArg) {
+// Return the size of s, non existing sets are empty.
+func setTypeSize(s rtype.Set) int {
+	if s == nil {
+		return 0
+	}
+	return s.Size()
+}
 
+func SUNIONCommand(c *redigo.CommandArg) {
+	sunionDiffGeneric(c, c.Argv[1:c.Argc], nil, REDIS_OP_UNION)
 }
 
-func SDIFFCommand(c *redigo.CommandArg) {
+func SUNIONSTORECommand(c *redigo.CommandArg) {
+	sunionDiffGeneric(c, c.Argv[2:c.Argc], c.Argv[1], REDIS_OP_UNION)
+}
 
+func SDIFFCommand(c *redigo.CommandArg) {
+	sunionDiffGeneric(c, c.Argv[1:c.Argc], nil, REDIS_OP_DIFF)
 }
 
 func SDIFFSTORECommand(c *redigo.CommandArg) {
-
+	sunionDiffGeneric(c, c.Argv[2:c.Argc], c.Argv[1], REDIS_OP_DIFF)
 }
 
 func SSCANCommand(c *redigo.CommandArg) {
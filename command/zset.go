@@ -2,6 +2,12 @@ package command
 
 import (
 	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/SteveZhangBit/redigo"
 	"github.com/SteveZhangBit/redigo/protocol"
@@ -14,18 +20,163 @@ import (
  * Sorted set commands
  *----------------------------------------------------------------------------*/
 
-func ZADDCommand(c *redigo.CommandArg) {
+/* Create a sorted set, using the listpack encoding when sizeHint elements no
+ * longer than valueLenHint bytes fit zset-max-listpack-entries and
+ * zset-max-listpack-value. */
+func zsetTypeCreate(sizeHint, valueLenHint int) rtype.ZSet {
+	if sizeHint <= zset.MaxListpackEntries && valueLenHint <= zset.MaxListpackValue {
+		return zset.NewListpack()
+	}
+	return zset.New()
+}
+
+/* Add a new element to the sorted set, the element must not be already part
+ * of it. A listpack is converted to a skiplist first if the new element does
+ * not fit in it: the converted sorted set takes the place of the old one in
+ * the DB and is returned to the caller. */
+func zsetTypeAdd(c *redigo.CommandArg, key []byte, z rtype.ZSet, score float64, val rtype.String) rtype.ZSet {
+	if lz, ok := z.(*zset.ZSetListpack); ok {
+		if lz.Len()+1 > zset.MaxListpackEntries || int(val.Len()) > zset.MaxListpackValue {
+			z = lz.Convert()
+			c.DB().Update(key, z)
+		}
+	}
+	z.Add(score, val)
+	return z
+}
+
+// Input flags of zsetAdd.
+const REDIS_ZADD_IN_NONE = 0
+
+const (
+	REDIS_ZADD_IN_INCR = 1 << iota // Increment the score instead of setting it.
+	REDIS_ZADD_IN_NX               // Don't touch elements not already existing.
+	REDIS_ZADD_IN_XX               // Only touch elements already existing.
+	REDIS_ZADD_IN_GT               // Only update existing when new scores are higher.
+	REDIS_ZADD_IN_LT               // Only update existing when new scores are lower.
+)
+
+// Output flags of zsetAdd.
+const (
+	REDIS_ZADD_OUT_NOP     = 1 << iota // Operation not performed because of conditionals.
+	REDIS_ZADD_OUT_NAN                 // Only happens with INCR, the resulting score is NaN.
+	REDIS_ZADD_OUT_ADDED               // The element was new and was added.
+	REDIS_ZADD_OUT_UPDATED             // The element already existed, score updated.
+)
+
+/* Add a new element or update the score of an existing element in a sorted
+ * set, regardless of its encoding.
+ *
+ * The set of flags change the command behavior, see the REDIS_ZADD_IN_*
+ * constants.
+ *
+ * The returned outflags report what happened, see the REDIS_ZADD_OUT_*
+ * constants. When the resulting score of an increment is NaN the sorted set
+ * is left unchanged and REDIS_ZADD_OUT_NAN is returned. newscore is the
+ * score of the element after the increment when REDIS_ZADD_IN_INCR is set.
+ *
+ * Like zsetTypeAdd, the sorted set is returned since it may be converted to
+ * the skiplist encoding. */
+func zsetAdd(c *redigo.CommandArg, key []byte, z rtype.ZSet, score float64, ele rtype.String, inflags int) (
+	rtype.ZSet, int, float64) {
+	incr := inflags&REDIS_ZADD_IN_INCR != 0
+	nx := inflags&REDIS_ZADD_IN_NX != 0
+	xx := inflags&REDIS_ZADD_IN_XX != 0
+	gt := inflags&REDIS_ZADD_IN_GT != 0
+	lt := inflags&REDIS_ZADD_IN_LT != 0
+
+	if curscore, ok := z.Get(ele); ok {
+		// NX? Return, same element already exists.
+		if nx {
+			return z, REDIS_ZADD_OUT_NOP, 0
+		}
+
+		// Prepare the score for the increment if needed.
+		if incr {
+			score += curscore
+			if math.IsNaN(score) {
+				return z, REDIS_ZADD_OUT_NAN, 0
+			}
+		}
+
+		// GT/LT? Only update if score is greater/less than current.
+		if (lt && score >= curscore) || (gt && score <= curscore) {
+			return z, REDIS_ZADD_OUT_NOP, 0
+		}
+
+		// Remove and re-insert when score changed.
+		if score != curscore {
+			z.Update(score, ele)
+			return z, REDIS_ZADD_OUT_UPDATED, score
+		}
+		return z, 0, score
+	} else if !xx {
+		z = zsetTypeAdd(c, key, z, score, ele)
+		return z, REDIS_ZADD_OUT_ADDED, score
+	}
+	return z, REDIS_ZADD_OUT_NOP, 0
+}
+
+/* This generic command implements both ZADD and ZINCRBY. */
+func zaddGeneric(c *redigo.CommandArg, flags int) {
 	var z rtype.ZSet
+	var ch bool
 
-	/* TODO: Parse options. At the end 'scoreidx' is set to the argument position
+	/* Parse options. At the end 'scoreidx' is set to the argument position
 	 * of the score of the first score-element pair. */
 	scoreidx := 2
+	for ; scoreidx < c.Argc; scoreidx++ {
+		switch strings.ToLower(string(c.Argv[scoreidx])) {
+		case "nx":
+			flags |= REDIS_ZADD_IN_NX
+		case "xx":
+			flags |= REDIS_ZADD_IN_XX
+		case "ch":
+			ch = true // Return num of elements added or updated.
+		case "incr":
+			flags |= REDIS_ZADD_IN_INCR
+		case "gt":
+			flags |= REDIS_ZADD_IN_GT
+		case "lt":
+			flags |= REDIS_ZADD_IN_LT
+		default:
+			goto parsed
+		}
+	}
+parsed:
+
+	// Turn options into simple to check vars.
+	incr := flags&REDIS_ZADD_IN_INCR != 0
+	nx := flags&REDIS_ZADD_IN_NX != 0
+	xx := flags&REDIS_ZADD_IN_XX != 0
+	gt := flags&REDIS_ZADD_IN_GT != 0
+	lt := flags&REDIS_ZADD_IN_LT != 0
+
+	/* After the options, we expect to have an even number of args, since
+	 * we expect any number of score-element pairs. */
 	elements := c.Argc - scoreidx
-	if elements%2 != 0 {
+	if elements%2 != 0 || elements == 0 {
 		c.AddReply(protocol.SyntaxErr)
 		return
 	}
-	elements /= 2
+	elements /= 2 // Now this holds the number of score-element pairs.
+
+	/* Check for incompatible options. */
+	if nx && xx {
+		c.AddReplyError("XX and NX options at the same time are not compatible")
+		return
+	}
+
+	if (gt && nx) || (lt && nx) || (gt && lt) {
+		c.AddReplyError("GT, LT, and/or NX options at the same time are not compatible")
+		return
+	}
+	// Note that XX is compatible with either GT or LT
+
+	if incr && elements > 1 {
+		c.AddReplyError("INCR option supports a single increment-element pair")
+		return
+	}
 
 	/* Start parsing all the scores, we need to emit any syntax error
 	 * before executing additions to the sorted set, as the command should
@@ -39,9 +190,21 @@ func ZADDCommand(c *redigo.CommandArg) {
 		}
 	}
 
+	var added, updated, processed int64
+	var score float64
+
 	// Lookup the key and create the sorted set if does not exist.
 	if o := c.DB().LookupKeyWrite(c.Argv[1]); o == nil {
-		z = zset.New()
+		if xx {
+			goto reply // No key + XX option: nothing to do.
+		}
+		var maxelelen int
+		for i := 0; i < elements; i++ {
+			if l := len(c.Argv[scoreidx+i*2+1]); l > maxelelen {
+				maxelelen = l
+			}
+		}
+		z = zsetTypeCreate(elements, maxelelen)
 		c.DB().Add(c.Argv[1], z)
 	} else {
 		var ok bool
@@ -51,36 +214,57 @@ func ZADDCommand(c *redigo.CommandArg) {
 		}
 	}
 
-	var added, updated int64
 	for i := 0; i < elements; i++ {
-		curobj := rstring.New(c.Argv[scoreidx+i*2+1])
-		score := scores[i]
-
-		// Check if the key is already in the set
-		if curscore, ok := z.Get(curobj); ok {
-			/* Remove and re-insert when score changed. We can safely
-			 * delete the key object from the skiplist, since the
-			 * dictionary still has a reference to it. */
-			if score != curscore {
-				z.Update(score, curobj)
-				c.Server().AddDirty(1)
-				updated++
-			}
-		} else {
-			z.Add(score, curobj)
-			c.Server().AddDirty(1)
+		var retflags int
+		z, retflags, score = zsetAdd(c, c.Argv[1], z, scores[i], rstring.New(c.Argv[scoreidx+i*2+1]), flags)
+		if retflags&REDIS_ZADD_OUT_NAN != 0 {
+			c.AddReplyError("resulting score is not a number (NaN)")
+			goto cleanup
+		}
+		if retflags&REDIS_ZADD_OUT_ADDED != 0 {
 			added++
 		}
+		if retflags&REDIS_ZADD_OUT_UPDATED != 0 {
+			updated++
+		}
+		if retflags&REDIS_ZADD_OUT_NOP == 0 {
+			processed++
+		}
+	}
+	c.Server().AddDirty(int(added + updated))
+
+reply:
+	if incr { // ZINCRBY or INCR option.
+		if processed > 0 {
+			c.AddReplyFloat64(score)
+		} else {
+			c.AddReply(protocol.NullBulk)
+		}
+	} else { // ZADD.
+		if ch {
+			c.AddReplyInt64(added + updated)
+		} else {
+			c.AddReplyInt64(added)
+		}
 	}
-	c.AddReplyInt64(added + updated)
+
+cleanup:
 	if added > 0 || updated > 0 {
 		c.DB().SignalModifyKey(c.Argv[1])
-		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_ZSET, "zadd", c.Argv[1], c.DB().GetID())
+		if incr {
+			c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_ZSET, "zincr", c.Argv[1], c.DB().GetID())
+		} else {
+			c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_ZSET, "zadd", c.Argv[1], c.DB().GetID())
+		}
 	}
 }
 
-func ZINCRBYCommand(c *redigo.CommandArg) {
+func ZADDCommand(c *redigo.CommandArg) {
+	zaddGeneric(c, REDIS_ZADD_IN_NONE)
+}
 
+func ZINCRBYCommand(c *redigo.CommandArg) {
+	zaddGeneric(c, REDIS_ZADD_IN_INCR)
 }
 
 func ZREMCommand(c *redigo.CommandArg) {
@@ -120,24 +304,403 @@ func ZREMCommand(c *redigo.CommandArg) {
 	c.AddReplyInt64(deleted)
 }
 
-func ZREMRANGEBYRANKCommand(c *redigo.CommandArg) {
+/* Implements ZREMRANGEBYRANK, ZREMRANGEBYSCORE, ZREMRANGEBYLEX commands. */
+const (
+	REDIS_ZRANGE_RANK = iota
+	REDIS_ZRANGE_SCORE
+	REDIS_ZRANGE_LEX
+)
+
+func zremrangeGeneric(c *redigo.CommandArg, rangetype int) {
+	var z rtype.ZSet
+	var r *rtype.ZRangeSpec
+	var lexrange *rtype.ZLexRangeSpec
+	var start, end int64
+	var ok bool
+	var event string
+
+	// Step 1: Parse the range.
+	switch rangetype {
+	case REDIS_ZRANGE_RANK:
+		if start, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[2]), ""); !ok {
+			return
+		}
+		if end, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[3]), ""); !ok {
+			return
+		}
+		event = "zremrangebyrank"
+	case REDIS_ZRANGE_SCORE:
+		if r, ok = zslParseRange(c.Argv[2], c.Argv[3]); !ok {
+			c.AddReplyError("min or max is not a float")
+			return
+		}
+		event = "zremrangebyscore"
+	case REDIS_ZRANGE_LEX:
+		if lexrange, ok = zslParseLexRange(c.Argv[2], c.Argv[3]); !ok {
+			c.AddReplyError("min or max not valid string range item")
+			return
+		}
+		event = "zremrangebylex"
+	}
 
+	// Step 2: Lookup & range sanity checks if needed.
+	if o := c.LookupKeyWriteOrReply(c.Argv[1], protocol.CZero); o == nil {
+		return
+	} else if z, ok = o.(rtype.ZSet); !ok {
+		c.AddReply(protocol.WrongTypeErr)
+		return
+	}
+
+	if rangetype == REDIS_ZRANGE_RANK {
+		// Sanitize indexes.
+		llen := int64(z.Len())
+		if start < 0 {
+			start = llen + start
+		}
+		if end < 0 {
+			end = llen + end
+		}
+		if start < 0 {
+			start = 0
+		}
+
+		/* Invariant: start >= 0, so this test will be true when end < 0.
+		 * The range is empty when start > end or start >= length. */
+		if start > end || start >= llen {
+			c.AddReply(protocol.CZero)
+			return
+		}
+		if end >= llen {
+			end = llen - 1
+		}
+	}
+
+	// Step 3: Perform the range deletion operation.
+	var deleted int
+	switch rangetype {
+	case REDIS_ZRANGE_RANK:
+		// Correct for 1-based rank.
+		deleted = z.DeleteRangeByRank(uint(start+1), uint(end+1))
+	case REDIS_ZRANGE_SCORE:
+		deleted = z.DeleteRangeByScore(r)
+	case REDIS_ZRANGE_LEX:
+		deleted = z.DeleteRangeByLex(lexrange)
+	}
+
+	// Step 4: Notifications and reply.
+	if deleted > 0 {
+		c.DB().SignalModifyKey(c.Argv[1])
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_ZSET, event, c.Argv[1], c.DB().GetID())
+		if z.Len() == 0 {
+			c.DB().Delete(c.Argv[1])
+			c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "del", c.Argv[1], c.DB().GetID())
+		}
+	}
+	c.Server().AddDirty(deleted)
+	c.AddReplyInt64(int64(deleted))
 }
 
-func ZREMRANGEBYSCORECommand(c *redigo.CommandArg) {
+func ZREMRANGEBYRANKCommand(c *redigo.CommandArg) {
+	zremrangeGeneric(c, REDIS_ZRANGE_RANK)
+}
 
+func ZREMRANGEBYSCORECommand(c *redigo.CommandArg) {
+	zremrangeGeneric(c, REDIS_ZRANGE_SCORE)
 }
 
 func ZREMRANGEBYLEXCommand(c *redigo.CommandArg) {
+	zremrangeGeneric(c, REDIS_ZRANGE_LEX)
+}
+
+const (
+	REDIS_AGGR_SUM = iota
+	REDIS_AGGR_MIN
+	REDIS_AGGR_MAX
+)
 
+/* The input of ZUNION, ZINTER and ZDIFF, either a sorted set or a plain set
+ * whose elements all have score 1. Both are nil for a missing key. */
+type zsetopsrc struct {
+	set    rtype.Set
+	zset   rtype.ZSet
+	weight float64
 }
 
-func ZUNIONSTORECommand(c *redigo.CommandArg) {
+func (src *zsetopsrc) size() int {
+	if src.zset != nil {
+		return src.zset.Len()
+	} else if src.set != nil {
+		return src.set.Size()
+	}
+	return 0
+}
 
+func (src *zsetopsrc) iterate(iterf func(ele rtype.String, score float64)) {
+	if src.zset != nil {
+		for ln := src.zset.Head(); ln != nil; ln = ln.Next() {
+			iterf(ln.Value(), ln.Score())
+		}
+	} else if src.set != nil {
+		src.set.Iterate(func(v rtype.String) bool {
+			iterf(v, 1.0)
+			return true
+		})
+	}
+}
+
+func (src *zsetopsrc) find(ele rtype.String) (float64, bool) {
+	if src.zset != nil {
+		return src.zset.Get(ele)
+	} else if src.set != nil && src.set.IsMember(ele) {
+		return 1.0, true
+	}
+	return 0, false
+}
+
+func zunionInterAggregate(target *float64, val float64, aggregate int) {
+	switch aggregate {
+	case REDIS_AGGR_SUM:
+		*target = *target + val
+		/* The result of adding two doubles is NaN when one variable
+		 * is +inf and the other is -inf. When these numbers are added,
+		 * we maintain the convention of the result being 0.0. */
+		if math.IsNaN(*target) {
+			*target = 0.0
+		}
+	case REDIS_AGGR_MIN:
+		if val < *target {
+			*target = val
+		}
+	case REDIS_AGGR_MAX:
+		if val > *target {
+			*target = val
+		}
+	}
+}
+
+/* The result of a sorted set operation: the scores of the elements, plus
+ * the elements in the order they were added. */
+type zsetopResult struct {
+	dict      map[string]float64
+	elems     []rtype.String
+	maxelelen int
+}
+
+func (r *zsetopResult) add(ele rtype.String, score float64) {
+	r.dict[ele.String()] = score
+	r.elems = append(r.elems, ele)
+	if l := int(ele.Len()); l > r.maxelelen {
+		r.maxelelen = l
+	}
+}
+
+/* This generic command implements ZUNION, ZINTER, ZDIFF and their STORE
+ * variants. numkeysIndex is the position of the numkeys argument, dstkey
+ * is nil for the commands replying with the result. */
+func zunionInterDiffGeneric(c *redigo.CommandArg, dstkey []byte, numkeysIndex int, op int, event string) {
+	var withscores bool
+	aggregate := REDIS_AGGR_SUM
+
+	// Expect setnum input keys to be given.
+	setnum, ok := GetInt64FromStringOrReply(c, rstring.New(c.Argv[numkeysIndex]), "")
+	if !ok {
+		return
+	}
+	if setnum < 1 {
+		c.AddReplyError(fmt.Sprintf("at least 1 input key is needed for '%s' command",
+			strings.ToLower(string(c.Argv[0]))))
+		return
+	}
+
+	// Test if the expected number of keys would overflow.
+	if setnum > int64(c.Argc-(numkeysIndex+1)) {
+		c.AddReply(protocol.SyntaxErr)
+		return
+	}
+
+	// Read keys to be used for input.
+	src := make([]zsetopsrc, setnum)
+	j := numkeysIndex + 1
+	for i := range src {
+		var o interface{}
+		if dstkey != nil {
+			o = c.DB().LookupKeyWrite(c.Argv[j])
+		} else {
+			o = c.DB().LookupKeyRead(c.Argv[j])
+		}
+		switch x := o.(type) {
+		case nil:
+		case rtype.ZSet:
+			src[i].zset = x
+		case rtype.Set:
+			src[i].set = x
+		default:
+			c.AddReply(protocol.WrongTypeErr)
+			return
+		}
+		// Default all weights to 1.
+		src[i].weight = 1.0
+		j++
+	}
+
+	// Parse optional extra arguments.
+	for ; j < c.Argc; j++ {
+		remaining := c.Argc - j
+		arg := strings.ToLower(string(c.Argv[j]))
+		if op != REDIS_OP_DIFF && remaining >= int(setnum)+1 && arg == "weights" {
+			j++
+			for i := range src {
+				if src[i].weight, ok = GetFloat64FromStringOrReply(c, rstring.New(c.Argv[j]),
+					"weight value is not a float"); !ok {
+					return
+				}
+				j++
+			}
+			j--
+		} else if op != REDIS_OP_DIFF && remaining >= 2 && arg == "aggregate" {
+			j++
+			switch strings.ToLower(string(c.Argv[j])) {
+			case "sum":
+				aggregate = REDIS_AGGR_SUM
+			case "min":
+				aggregate = REDIS_AGGR_MIN
+			case "max":
+				aggregate = REDIS_AGGR_MAX
+			default:
+				c.AddReply(protocol.SyntaxErr)
+				return
+			}
+		} else if remaining >= 1 && dstkey == nil && arg == "withscores" {
+			withscores = true
+		} else {
+			c.AddReply(protocol.SyntaxErr)
+			return
+		}
+	}
+
+	result := &zsetopResult{dict: make(map[string]float64)}
+
+	switch op {
+	case REDIS_OP_INTER:
+		/* sort sets from the smallest to largest, this will improve our
+		 * algorithm's performance */
+		sort.SliceStable(src, func(i, j int) bool {
+			return src[i].size() < src[j].size()
+		})
+
+		// Skip everything if the smallest input is empty.
+		if src[0].size() > 0 {
+			/* Precondition: as src[0] is non-empty and the inputs are ordered
+			 * by size, all src[i > 0] are non-empty too. */
+			src[0].iterate(func(ele rtype.String, value float64) {
+				score := src[0].weight * value
+				if math.IsNaN(score) {
+					score = 0
+				}
+
+				for j := 1; j < len(src); j++ {
+					value, ok := src[j].find(ele)
+					if !ok {
+						return
+					}
+					value = value * src[j].weight
+					zunionInterAggregate(&score, value, aggregate)
+				}
+
+				// Only continue when present in every input.
+				result.add(ele, score)
+			})
+		}
+
+	case REDIS_OP_UNION:
+		for i := range src {
+			src[i].iterate(func(ele rtype.String, value float64) {
+				// Initialize value
+				score := src[i].weight * value
+				if math.IsNaN(score) {
+					score = 0
+				}
+
+				// Search for this element in the accumulating dictionary.
+				if existing, ok := result.dict[ele.String()]; !ok {
+					result.add(ele, score)
+				} else {
+					// Update the element with its initial score.
+					zunionInterAggregate(&existing, score, aggregate)
+					result.dict[ele.String()] = existing
+				}
+			})
+		}
+
+	case REDIS_OP_DIFF:
+		// An element is part of the difference when no other input has it.
+		src[0].iterate(func(ele rtype.String, value float64) {
+			for j := 1; j < len(src); j++ {
+				if _, ok := src[j].find(ele); ok {
+					return
+				}
+			}
+			result.add(ele, value)
+		})
+	}
+
+	dstzset := zsetTypeCreate(len(result.elems), result.maxelelen)
+	for _, ele := range result.elems {
+		dstzset.Add(result.dict[ele.String()], ele)
+	}
+
+	if dstkey != nil {
+		if dstzset.Len() > 0 {
+			c.DB().SetKeyPersist(dstkey, dstzset)
+			c.AddReplyInt64(int64(dstzset.Len()))
+			c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_ZSET, event, dstkey, c.DB().GetID())
+			c.Server().AddDirty(1)
+		} else {
+			c.AddReply(protocol.CZero)
+			if c.DB().Delete(dstkey) {
+				c.DB().SignalModifyKey(dstkey)
+				c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "del", dstkey, c.DB().GetID())
+				c.Server().AddDirty(1)
+			}
+		}
+		return
+	}
+
+	if withscores {
+		c.AddReplyMultiBulkLen(dstzset.Len() * 2)
+	} else {
+		c.AddReplyMultiBulkLen(dstzset.Len())
+	}
+	for ln := dstzset.Head(); ln != nil; ln = ln.Next() {
+		c.AddReplyBulk(ln.Value().Bytes())
+		if withscores {
+			c.AddReplyFloat64(ln.Score())
+		}
+	}
+}
+
+func ZUNIONSTORECommand(c *redigo.CommandArg) {
+	zunionInterDiffGeneric(c, c.Argv[1], 2, REDIS_OP_UNION, "zunionstore")
 }
 
 func ZINTERSTORECommand(c *redigo.CommandArg) {
+	zunionInterDiffGeneric(c, c.Argv[1], 2, REDIS_OP_INTER, "zinterstore")
+}
+
+func ZDIFFSTORECommand(c *redigo.CommandArg) {
+	zunionInterDiffGeneric(c, c.Argv[1], 2, REDIS_OP_DIFF, "zdiffstore")
+}
+
+func ZUNIONCommand(c *redigo.CommandArg) {
+	zunionInterDiffGeneric(c, nil, 1, REDIS_OP_UNION, "zunion")
+}
+
+func ZINTERCommand(c *redigo.CommandArg) {
+	zunionInterDiffGeneric(c, nil, 1, REDIS_OP_INTER, "zinter")
+}
 
+func ZDIFFCommand(c *redigo.CommandArg) {
+	zunionInterDiffGeneric(c, nil, 1, REDIS_OP_DIFF, "zdiff")
 }
 
 func zrange(c *redigo.CommandArg, reverse bool) {
@@ -234,32 +797,354 @@ func ZREVRANGECommand(c *redigo.CommandArg) {
 	zrange(c, true)
 }
 
+/* Parse a score range of the form min and max, where both of them may be
+ * prefixed by "(" to make them exclusive, and may be "-inf" or "+inf".
+ * Returns false when the range is not valid. */
+func zslParseRange(min, max []byte) (spec *rtype.ZRangeSpec, ok bool) {
+	spec = &rtype.ZRangeSpec{}
+
+	/* Parse the min-max interval. If one of the values is prefixed
+	 * by the "(" character, it's considered "open". For instance
+	 * ZRANGEBYSCORE zset (1.5 (2.5 will match min < x < max
+	 * ZRANGEBYSCORE zset 1.5 2.5 will instead match min <= x <= max */
+	if spec.Min, spec.MinEx, ok = parseRangeScore(min); !ok {
+		return nil, false
+	}
+	if spec.Max, spec.MaxEx, ok = parseRangeScore(max); !ok {
+		return nil, false
+	}
+	return spec, true
+}
+
+func parseRangeScore(b []byte) (score float64, exclusive bool, ok bool) {
+	if len(b) > 0 && b[0] == '(' {
+		b, exclusive = b[1:], true
+	}
+	score, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, false, false
+	}
+	return score, exclusive, true
+}
+
+/* Parse a lex range item, that is "[" or "(" followed by the string, or the
+ * special "-" and "+" strings, respectively the smallest and the greatest
+ * of all strings. */
+func zslParseLexRangeItem(b []byte) (item []byte, exclusive bool, ok bool) {
+	if len(b) == 0 {
+		return nil, false, false
+	}
+	switch b[0] {
+	case '+':
+		if len(b) != 1 {
+			return nil, false, false
+		}
+		return rtype.ZLexMaxString, false, true
+	case '-':
+		if len(b) != 1 {
+			return nil, false, false
+		}
+		return rtype.ZLexMinString, false, true
+	case '(':
+		return b[1:], true, true
+	case '[':
+		return b[1:], false, true
+	default:
+		return nil, false, false
+	}
+}
+
+/* Populate the lex range spec from the min and max arguments. Returns false
+ * when either of the two items is not valid. */
+func zslParseLexRange(min, max []byte) (spec *rtype.ZLexRangeSpec, ok bool) {
+	spec = &rtype.ZLexRangeSpec{}
+	if spec.Min, spec.MinEx, ok = zslParseLexRangeItem(min); !ok {
+		return nil, false
+	}
+	if spec.Max, spec.MaxEx, ok = zslParseLexRangeItem(max); !ok {
+		return nil, false
+	}
+	return spec, true
+}
+
+/* Parse the optional WITHSCORES and LIMIT offset count arguments starting
+ * at argv[4], replying with an error and returning false on failure. A
+ * negative count means no limit. */
+func zrangeParseOptions(c *redigo.CommandArg, allowScores bool) (withscores bool, offset, limit int64, ok bool) {
+	limit = -1
+	for pos := 4; pos < c.Argc; pos++ {
+		remaining := c.Argc - pos
+		if allowScores && remaining >= 1 && strings.ToLower(string(c.Argv[pos])) == "withscores" {
+			withscores = true
+		} else if remaining >= 3 && strings.ToLower(string(c.Argv[pos])) == "limit" {
+			if offset, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[pos+1]), ""); !ok {
+				return
+			}
+			if limit, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[pos+2]), ""); !ok {
+				return
+			}
+			pos += 2
+		} else {
+			c.AddReply(protocol.SyntaxErr)
+			return false, 0, 0, false
+		}
+	}
+	return withscores, offset, limit, true
+}
+
+/* Reply with the elements in range, starting from ln and walking toward the
+ * tail, or toward the head when reverse is true. The offset first elements
+ * are skipped, and at most limit elements are returned unless limit is
+ * negative. inRange checks whether an element is still in range. */
+func zrangeReplyRange(c *redigo.CommandArg, ln rtype.ZSetItem, reverse, withscores bool, offset, limit int64,
+	inRange func(ln rtype.ZSetItem) bool) {
+	next := func(ln rtype.ZSetItem) rtype.ZSetItem {
+		if reverse {
+			return ln.Prev()
+		}
+		return ln.Next()
+	}
+
+	// If there is an offset, just element per element until we reach it.
+	for ln != nil && offset > 0 {
+		ln = next(ln)
+		offset--
+	}
+
+	/* We don't know in advance how many matching elements there are in the
+	 * list, so we collect them before emitting the multi bulk length. */
+	var items []rtype.ZSetItem
+	for ln != nil && limit != 0 {
+		// Abort when the node is no longer in range.
+		if !inRange(ln) {
+			break
+		}
+		items = append(items, ln)
+		ln = next(ln)
+		limit--
+	}
+
+	if withscores {
+		c.AddReplyMultiBulkLen(len(items) * 2)
+	} else {
+		c.AddReplyMultiBulkLen(len(items))
+	}
+	for _, ln := range items {
+		c.AddReplyBulk(ln.Value().Bytes())
+		if withscores {
+			c.AddReplyFloat64(ln.Score())
+		}
+	}
+}
+
+// This command implements ZRANGEBYSCORE, ZREVRANGEBYSCORE.
 func zrangescore(c *redigo.CommandArg, reverse bool) {
+	var z rtype.ZSet
+	var minidx, maxidx int
+
+	// Parse the range arguments.
+	if reverse {
+		// Range is given as [max,min]
+		maxidx, minidx = 2, 3
+	} else {
+		// Range is given as [min,max]
+		minidx, maxidx = 2, 3
+	}
 
+	r, ok := zslParseRange(c.Argv[minidx], c.Argv[maxidx])
+	if !ok {
+		c.AddReplyError("min or max is not a float")
+		return
+	}
+
+	// Parse optional extra arguments.
+	withscores, offset, limit, ok := zrangeParseOptions(c, true)
+	if !ok {
+		return
+	}
+
+	// Ok, lookup the key and get the range
+	if o := c.LookupKeyReadOrReply(c.Argv[1], protocol.EmptyMultiBulk); o == nil {
+		return
+	} else if z, ok = o.(rtype.ZSet); !ok {
+		c.AddReply(protocol.WrongTypeErr)
+		return
+	}
+
+	// If reversed, get the last node in range as starting point.
+	var ln rtype.ZSetItem
+	if reverse {
+		ln = z.LastInRange(r)
+	} else {
+		ln = z.FirstInRange(r)
+	}
+
+	// No "first" element in the specified interval.
+	if ln == nil || offset < 0 {
+		c.AddReply(protocol.EmptyMultiBulk)
+		return
+	}
+
+	zrangeReplyRange(c, ln, reverse, withscores, offset, limit, func(ln rtype.ZSetItem) bool {
+		if reverse {
+			return r.ValueGteMin(ln.Score())
+		}
+		return r.ValueLteMax(ln.Score())
+	})
 }
 
 func ZRANGEBYSCORECommand(c *redigo.CommandArg) {
-
+	zrangescore(c, false)
 }
 
 func ZREVRANGEBYSCORECommand(c *redigo.CommandArg) {
-
+	zrangescore(c, true)
 }
 
 func ZCOUNTCommand(c *redigo.CommandArg) {
+	var z rtype.ZSet
+
+	// Parse the range arguments
+	r, ok := zslParseRange(c.Argv[2], c.Argv[3])
+	if !ok {
+		c.AddReplyError("min or max is not a float")
+		return
+	}
+
+	// Lookup the sorted set
+	if o := c.LookupKeyReadOrReply(c.Argv[1], protocol.CZero); o == nil {
+		return
+	} else if z, ok = o.(rtype.ZSet); !ok {
+		c.AddReply(protocol.WrongTypeErr)
+		return
+	}
+
+	var count int64
+
+	// Find first element in range
+	if zn := z.FirstInRange(r); zn != nil {
+		/* Use rank of first element, if any, to determine preliminary
+		 * count. With the skiplist encoding the ranks are computed from the
+		 * spans in O(log(N)). */
+		length := int64(z.Len())
+		rank := int64(z.GetRank(zn.Score(), zn.Value()))
+		count = length - (rank - 1)
 
+		// Find last element in range
+		zn = z.LastInRange(r)
+
+		// Use rank of last element, if any, to determine the actual count
+		if zn != nil {
+			rank = int64(z.GetRank(zn.Score(), zn.Value()))
+			count -= length - rank
+		}
+	}
+
+	c.AddReplyInt64(count)
 }
 
 func ZLEXCOUNTCommand(c *redigo.CommandArg) {
+	var z rtype.ZSet
+
+	// Parse the range arguments
+	r, ok := zslParseLexRange(c.Argv[2], c.Argv[3])
+	if !ok {
+		c.AddReplyError("min or max not valid string range item")
+		return
+	}
+
+	// Lookup the sorted set
+	if o := c.LookupKeyReadOrReply(c.Argv[1], protocol.CZero); o == nil {
+		return
+	} else if z, ok = o.(rtype.ZSet); !ok {
+		c.AddReply(protocol.WrongTypeErr)
+		return
+	}
 
+	var count int64
+
+	// Find first element in range
+	if zn := z.FirstInLexRange(r); zn != nil {
+		// Use rank of first element, if any, to determine preliminary count
+		length := int64(z.Len())
+		rank := int64(z.GetRank(zn.Score(), zn.Value()))
+		count = length - (rank - 1)
+
+		// Find last element in range
+		zn = z.LastInLexRange(r)
+
+		// Use rank of last element, if any, to determine the actual count
+		if zn != nil {
+			rank = int64(z.GetRank(zn.Score(), zn.Value()))
+			count -= length - rank
+		}
+	}
+
+	c.AddReplyInt64(count)
 }
 
-func ZRANGEBYLEXCommand(c *redigo.CommandArg) {
+// This command implements ZRANGEBYLEX, ZREVRANGEBYLEX.
+func zrangelex(c *redigo.CommandArg, reverse bool) {
+	var z rtype.ZSet
+	var minidx, maxidx int
+
+	// Parse the range arguments.
+	if reverse {
+		// Range is given as [max,min]
+		maxidx, minidx = 2, 3
+	} else {
+		// Range is given as [min,max]
+		minidx, maxidx = 2, 3
+	}
+
+	r, ok := zslParseLexRange(c.Argv[minidx], c.Argv[maxidx])
+	if !ok {
+		c.AddReplyError("min or max not valid string range item")
+		return
+	}
+
+	// Parse optional extra arguments.
+	_, offset, limit, ok := zrangeParseOptions(c, false)
+	if !ok {
+		return
+	}
+
+	// Ok, lookup the key and get the range
+	if o := c.LookupKeyReadOrReply(c.Argv[1], protocol.EmptyMultiBulk); o == nil {
+		return
+	} else if z, ok = o.(rtype.ZSet); !ok {
+		c.AddReply(protocol.WrongTypeErr)
+		return
+	}
+
+	// If reversed, get the last node in range as starting point.
+	var ln rtype.ZSetItem
+	if reverse {
+		ln = z.LastInLexRange(r)
+	} else {
+		ln = z.FirstInLexRange(r)
+	}
+
+	// No "first" element in the specified interval.
+	if ln == nil || offset < 0 {
+		c.AddReply(protocol.EmptyMultiBulk)
+		return
+	}
 
+	zrangeReplyRange(c, ln, reverse, false, offset, limit, func(ln rtype.ZSetItem) bool {
+		if reverse {
+			return r.ValueGteMin(ln.Value().Bytes())
+		}
+		return r.ValueLteMax(ln.Value().Bytes())
+	})
 }
 
-func ZREVRANGEBYLEXCommand(c *redigo.CommandArg) {
+func ZRANGEBYLEXCommand(c *redigo.CommandArg) {
+	zrangelex(c, false)
+}
 
+func ZREVRANGEBYLEXCommand(c *redigo.CommandArg) {
+	zrangelex(c, true)
 }
 
 func ZCARDCommand(c *redigo.CommandArg) {
@@ -323,6 +1208,274 @@ func ZREVRANKCommand(c *redigo.CommandArg) {
 	zrank(c, true)
 }
 
+const (
+	REDIS_ZSET_MIN = iota
+	REDIS_ZSET_MAX
+)
+
+/* This command implements the generic zpop operation, used by:
+ * ZPOPMIN, ZPOPMAX, BZPOPMIN, BZPOPMAX, ZMPOP and BZMPOP.
+ *
+ * If 'emitkey' is true also the key name is emitted, useful for the blocking
+ * behavior of BZPOP[MIN|MAX], since we can block into multiple keys.
+ * Or in ZMPOP/BZMPOP, because we also can take multiple keys.
+ *
+ * 'count' is the number of elements requested to pop.
+ *
+ * 'useNested' when false it generates a flat array (with or without key
+ * name). When true, it generates a nested 2 level array of field + score
+ * pairs, or 3 level when emitkey is set.
+ *
+ * 'replyNilWhenEmpty' when true we reply a NIL if we are not able to pop up
+ * any elements. Like in ZMPOP/BZMPOP we reply with a structured nested
+ * array containing key name and member + score pairs. In these commands, we
+ * reply with null when we have no result. Otherwise in ZPOPMIN/ZPOPMAX we
+ * reply an empty array by default. */
+func genericZpop(c *redigo.CommandArg, keys [][]byte, where int, emitkey bool, count int64,
+	useNested bool, replyNilWhenEmpty bool) {
+	var z rtype.ZSet
+	var key []byte
+
+	// Check type and break on the first error, otherwise identify candidate.
+	for _, k := range keys {
+		o := c.DB().LookupKeyWrite(k)
+		if o == nil {
+			continue
+		}
+		var ok bool
+		if z, ok = o.(rtype.ZSet); !ok {
+			c.AddReply(protocol.WrongTypeErr)
+			return
+		}
+		key = k
+		break
+	}
+
+	// No candidate for zpopping, return empty.
+	if z == nil {
+		if replyNilWhenEmpty {
+			c.AddReply(protocol.NullMultiBulk)
+		} else {
+			c.AddReply(protocol.EmptyMultiBulk)
+		}
+		return
+	}
+
+	if count == 0 {
+		// ZPOPMIN/ZPOPMAX with count 0.
+		c.AddReply(protocol.EmptyMultiBulk)
+		return
+	}
+
+	// When count is -1, we need to correct it to 1 for plain single pop.
+	if count < 0 {
+		count = 1
+	}
+	if l := int64(z.Len()); count > l {
+		count = l
+	}
+
+	var event string
+	if where == REDIS_ZSET_MIN {
+		event = "zpopmin"
+	} else {
+		event = "zpopmax"
+	}
+
+	// Remove the elements.
+	items := make([]struct {
+		ele   rtype.String
+		score float64
+	}, count)
+	for i := range items {
+		var ln rtype.ZSetItem
+		if where == REDIS_ZSET_MIN {
+			ln = z.Head()
+		} else {
+			ln = z.Tail()
+		}
+		items[i].ele, items[i].score = ln.Value(), ln.Score()
+		z.Delete(items[i].score, items[i].ele)
+	}
+
+	if useNested {
+		c.AddReplyMultiBulkLen(2)
+		c.AddReplyBulk(key)
+		c.AddReplyMultiBulkLen(len(items))
+		for _, item := range items {
+			c.AddReplyMultiBulkLen(2)
+			c.AddReplyBulk(item.ele.Bytes())
+			c.AddReplyFloat64(item.score)
+		}
+	} else {
+		if emitkey {
+			c.AddReplyMultiBulkLen(len(items)*2 + 1)
+			c.AddReplyBulk(key)
+		} else {
+			c.AddReplyMultiBulkLen(len(items) * 2)
+		}
+		for _, item := range items {
+			c.AddReplyBulk(item.ele.Bytes())
+			c.AddReplyFloat64(item.score)
+		}
+	}
+
+	c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_ZSET, event, key, c.DB().GetID())
+	if z.Len() == 0 {
+		c.DB().Delete(key)
+		c.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "del", key, c.DB().GetID())
+	}
+	c.DB().SignalModifyKey(key)
+	c.Server().AddDirty(len(items))
+}
+
+// ZPOPMIN/ZPOPMAX key [<count>]
+func zpopMinMax(c *redigo.CommandArg, where int) {
+	if c.Argc > 3 {
+		c.AddReply(protocol.SyntaxErr)
+		return
+	}
+
+	count := int64(-1) // -1 for plain single pop.
+	if c.Argc == 3 {
+		var ok bool
+		if count, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[2]), ""); !ok {
+			return
+		}
+		if count < 0 {
+			c.AddReplyError("value is out of range, must be positive")
+			return
+		}
+	}
+
+	// Respond with a single (flat) array of member + score pairs.
+	genericZpop(c, c.Argv[1:2], where, false, count, false, false)
+}
+
+// ZPOPMIN key [<count>]
+func ZPOPMINCommand(c *redigo.CommandArg) {
+	zpopMinMax(c, REDIS_ZSET_MIN)
+}
+
+// ZPOPMAX key [<count>]
+func ZPOPMAXCommand(c *redigo.CommandArg) {
+	zpopMinMax(c, REDIS_ZSET_MAX)
+}
+
+/* BZPOPMIN, BZPOPMAX, BZMPOP actual implementation. The sorted sets are
+ * looked up in order, the elements are popped from the first non empty
+ * one, or the client blocks if all of them are empty. */
+func blockingGenericZpop(c *redigo.CommandArg, keys [][]byte, where int, timeoutIdx int, count int64,
+	useNested bool, replyNilWhenEmpty bool) {
+	timeout, ok := GetTimeoutFromStringOrReply(c, rstring.New(c.Argv[timeoutIdx]), time.Second)
+	if !ok {
+		return
+	}
+
+	for _, key := range keys {
+		if o := c.DB().LookupKeyWrite(key); o != nil {
+			if z, ok := o.(rtype.ZSet); !ok {
+				c.AddReply(protocol.WrongTypeErr)
+				return
+			} else if z.Len() != 0 {
+				// Non empty zset, this is like a normal ZPOP[MIN|MAX].
+				genericZpop(c, [][]byte{key}, where, true, count, useNested, replyNilWhenEmpty)
+				return
+			}
+		}
+	}
+
+	// If the keys do not exist we must block
+	c.Client.BlockForKeys(redigo.REDIS_BLOCKED_ZSET, keys, timeout)
+}
+
+// BZPOPMIN key [key ...] timeout
+func BZPOPMINCommand(c *redigo.CommandArg) {
+	blockingGenericZpop(c, c.Argv[1:c.Argc-1], REDIS_ZSET_MIN, c.Argc-1, -1, false, false)
+}
+
+// BZPOPMAX key [key ...] timeout
+func BZPOPMAXCommand(c *redigo.CommandArg) {
+	blockingGenericZpop(c, c.Argv[1:c.Argc-1], REDIS_ZSET_MAX, c.Argc-1, -1, false, false)
+}
+
+/* ZMPOP/BZMPOP
+ *
+ * 'numkeysIdx' parameter position of key number.
+ * 'isBlock' this indicates whether it is a blocking variant. */
+func zmpopGeneric(c *redigo.CommandArg, numkeysIdx int, isBlock bool) {
+	var where int
+	count := int64(-1)
+
+	// Parse the numkeys.
+	numkeys, ok := GetInt64FromStringOrReply(c, rstring.New(c.Argv[numkeysIdx]), "")
+	if !ok {
+		return
+	}
+	if numkeys <= 0 {
+		c.AddReplyError("numkeys should be greater than 0")
+		return
+	}
+
+	// Parse the where. whereIdx: the index of where in the c.Argv.
+	if numkeys > int64(c.Argc-numkeysIdx-2) {
+		c.AddReply(protocol.SyntaxErr)
+		return
+	}
+	whereIdx := numkeysIdx + int(numkeys) + 1
+	switch strings.ToLower(string(c.Argv[whereIdx])) {
+	case "min":
+		where = REDIS_ZSET_MIN
+	case "max":
+		where = REDIS_ZSET_MAX
+	default:
+		c.AddReply(protocol.SyntaxErr)
+		return
+	}
+
+	// Parse the optional arguments.
+	for j := whereIdx + 1; j < c.Argc; j++ {
+		moreargs := c.Argc - 1 - j
+		if count == -1 && strings.ToLower(string(c.Argv[j])) == "count" && moreargs > 0 {
+			j++
+			if count, ok = GetInt64FromStringOrReply(c, rstring.New(c.Argv[j]),
+				"count should be greater than 0"); !ok {
+				return
+			}
+			if count <= 0 {
+				c.AddReplyError("count should be greater than 0")
+				return
+			}
+		} else {
+			c.AddReply(protocol.SyntaxErr)
+			return
+		}
+	}
+
+	if count == -1 {
+		count = 1
+	}
+
+	keys := c.Argv[numkeysIdx+1 : whereIdx]
+	if isBlock {
+		// BLOCK. The timeout is the first argument.
+		blockingGenericZpop(c, keys, where, 1, count, true, true)
+	} else {
+		// NON-BLOCK
+		genericZpop(c, keys, where, true, count, true, true)
+	}
+}
+
+// ZMPOP numkeys key [<key> ...] MIN|MAX [COUNT count]
+func ZMPOPCommand(c *redigo.CommandArg) {
+	zmpopGeneric(c, 1, false)
+}
+
+// BZMPOP timeout numkeys key [<key> ...] MIN|MAX [COUNT count]
+func BZMPOPCommand(c *redigo.CommandArg) {
+	zmpopGeneric(c, 2, true)
+}
+
 func ZSCANCommand(c *redigo.CommandArg) {
 
 }
@@ -9,6 +9,7 @@ import (
 	"io"
 	"math"
 	"strconv"
+	"sync"
 	"unicode"
 )
 
@@ -23,6 +24,7 @@ type Writer interface {
 	AddReplyError(msg string)
 	AddReplyStatus(msg string)
 	Flush() error
+	Buffered() int
 }
 
 type Reader interface {
@@ -45,14 +47,36 @@ var (
 	COne           = []byte(":1\r\n")
 	CNegOne        = []byte(":-1\r\n")
 	NullBulk       = []byte("$-1\r\n")
+	EmptyBulk      = []byte("$0\r\n\r\n")
 	NullMultiBulk  = []byte("*-1\r\n")
 	EmptyMultiBulk = []byte("*0\r\n")
+	EmptyScan      = []byte("*2\r\n$1\r\n0\r\n*0\r\n")
 	Pong           = []byte("+PONG\r\n")
 	WrongTypeErr   = []byte("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
 	SyntaxErr      = []byte("-ERR syntax error\r\n")
 	NoKeyErr       = []byte("-ERR no such key\r\n")
 	OutOfRangeErr  = []byte("-ERR index out of range\r\n")
 	SameObjectErr  = []byte("-ERR source and destination objects are the same\r\n")
+	NoAuthErr      = []byte("-NOAUTH Authentication required.\r\n")
+	OOMErr         = []byte("-OOM command not allowed when used memory > 'maxmemory'.\r\n")
+
+	ProtectedModeErr = []byte("-DENIED Redis is running in protected mode because protected " +
+		"mode is enabled, no bind address was specified, no " +
+		"authentication password is requested to clients. In this mode " +
+		"connections are only accepted from the loopback interface. " +
+		"If you want to connect from external computers to Redis you " +
+		"may adopt one of the following solutions: " +
+		"1) Just disable protected mode sending the command " +
+		"'CONFIG SET protected-mode no' from the loopback interface " +
+		"by connecting to Redis from the same host the server is " +
+		"running, however MAKE SURE Redis is not publicly accessible " +
+		"from internet if you do so. " +
+		"2) Alternatively you can just disable the protected mode by " +
+		"editing the Redis configuration file, and setting the protected " +
+		"mode option to 'no', and then restarting the server. " +
+		"3) Setup a bind address or an authentication password. " +
+		"NOTE: You only need to do one of the above things in order for " +
+		"the server to start accepting connections from the outside.\r\n")
 )
 
 var (
@@ -75,38 +99,82 @@ func init() {
 	}
 }
 
+/* RESPWriter accumulates the replies in memory until Flush() is called, so
+ * that commands never block on the client socket. The pending reply is
+ * protected by a mutex, as replies may also be added by other goroutines
+ * (e.g. when serving a client blocked on a list). */
 type RESPWriter struct {
-	*bufio.Writer
-	err error
+	w     io.Writer
+	mu    sync.Mutex
+	buf   []byte // Replies not yet written to the socket
+	spare []byte // Buffer being written by Flush(), reused afterwards
+	// Bytes handed to the socket by Flush() and not yet written.
+	flushing int
+	err      error
 }
 
 func NewRESPWriter(w io.Writer) *RESPWriter {
-	return &RESPWriter{Writer: bufio.NewWriter(w)}
+	return &RESPWriter{w: w}
 }
 
 func (r *RESPWriter) AddReply(x []byte) {
-	if r.err != nil {
-		_, r.err = r.Write(x)
+	r.mu.Lock()
+	if r.err == nil {
+		r.buf = append(r.buf, x...)
 	}
+	r.mu.Unlock()
 }
 
 func (r *RESPWriter) AddReplyByte(x byte) {
-	if r.err != nil {
-		r.err = r.WriteByte(x)
+	r.mu.Lock()
+	if r.err == nil {
+		r.buf = append(r.buf, x)
 	}
+	r.mu.Unlock()
 }
 
 func (r *RESPWriter) AddReplyString(x string) {
-	if r.err != nil {
-		_, r.err = r.WriteString(x)
+	r.mu.Lock()
+	if r.err == nil {
+		r.buf = append(r.buf, x...)
 	}
+	r.mu.Unlock()
 }
 
+/* Write the pending replies to the socket. The lock is not held while
+ * writing, so a slow client never blocks the goroutines adding replies. */
 func (r *RESPWriter) Flush() error {
-	if r.err != nil {
-		r.err = r.Writer.Flush()
+	r.mu.Lock()
+	if r.err != nil || len(r.buf) == 0 {
+		err := r.err
+		r.mu.Unlock()
+		return err
 	}
-	return r.err
+	out := r.buf
+	r.buf = r.spare[:0]
+	r.flushing = len(out)
+	r.mu.Unlock()
+
+	_, err := r.w.Write(out)
+
+	r.mu.Lock()
+	r.spare = out[:0]
+	r.flushing = 0
+	if err != nil {
+		r.err = err
+	}
+	err = r.err
+	r.mu.Unlock()
+	return err
+}
+
+/* Return the number of reply bytes not yet written to the socket,
+ * including the ones Flush() is writing: a slow client blocks Flush(), so
+ * they are still in memory and count for the output buffer limits. */
+func (r *RESPWriter) Buffered() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.buf) + r.flushing
 }
 
 func (r *RESPWriter) AddReplyInt64(x int64) {
@@ -114,7 +182,7 @@ func (r *RESPWriter) AddReplyInt64(x int64) {
 		r.AddReply(CZero)
 	} else if x == 1 {
 		r.AddReply(COne)
-	} else if x < REDIS_SHARED_INTEGERS {
+	} else if x >= 0 && x < REDIS_SHARED_INTEGERS {
 		r.AddReplyByte(':')
 		r.AddReply(SharedIntegers[x])
 		r.AddReply(CRLF)
@@ -172,12 +240,11 @@ func (r *RESPWriter) AddReplyStatus(msg string) {
 }
 
 type RESPReader struct {
-	argv    [][]byte
 	scanner *bufio.Scanner
 }
 
 func NewRESPReader(r io.Reader) *RESPReader {
-	return &RESPReader{argv: make([][]byte, 4), scanner: bufio.NewScanner(r)}
+	return &RESPReader{scanner: bufio.NewScanner(r)}
 }
 
 func (r *RESPReader) Read() (arg *redigo.CommandArg, err error) {
@@ -313,9 +380,11 @@ func (r *RESPReader) ReadMultiBulkCommand() (arg *redigo.CommandArg, err error)
 		mbulklen = x
 	}
 
+	/* Every command gets its own arguments vector: the command is executed
+	 * while the next one is read, and a blocked command is executed again
+	 * later with the same arguments. */
 	var i int64
-
-	argv_len := int64(len(r.argv))
+	var argv [][]byte
 	for i = 0; i < mbulklen && r.scanner.Scan(); i++ {
 		line = r.scanner.Bytes()
 		if len(line) > REDIS_INLINE_MAXSIZE {
@@ -341,11 +410,10 @@ func (r *RESPReader) ReadMultiBulkCommand() (arg *redigo.CommandArg, err error)
 				err = errors.New("Protocol error: bulk length doesn't match data length")
 				return
 			}
-			if i < argv_len {
-				r.argv[i] = line
-			} else {
-				r.argv = append(r.argv, line)
-			}
+			/* The scanner reuses its buffer on the next Scan(), while the
+			 * arguments may be stored in the DB by the command. */
+			line = append([]byte(nil), line...)
+			argv = append(argv, line)
 		}
 	}
 	if i != mbulklen {
@@ -353,6 +421,6 @@ func (r *RESPReader) ReadMultiBulkCommand() (arg *redigo.CommandArg, err error)
 		return
 	}
 
-	arg = &redigo.CommandArg{Argc: int(mbulklen), Argv: r.argv}
+	arg = &redigo.CommandArg{Argc: int(mbulklen), Argv: argv}
 	return
 }
@@ -50,6 +50,9 @@ func main() {
 	}
 
 	s := server.NewServer()
+	if flag.NArg() > 0 {
+		s.LoadServerConfig(flag.Arg(0))
+	}
 	s.RedigoLog(server.REDIS_NOTICE|server.REDIS_LOG_RAW,
 		Logo,
 		redigo.Version,
@@ -19,6 +19,12 @@ const (
 	REDIS_NOTIFY_GENERIC
 )
 
+// Client block type (btype field in client structure)
+const (
+	REDIS_BLOCKED_LIST = iota // BLPOP & co.
+	REDIS_BLOCKED_ZSET        // BZPOP et al.
+)
+
 /* With multiplexing we need to take per-client state.
  * Clients are taken in a linked list. */
 type Client interface {
@@ -29,16 +35,54 @@ type Client interface {
 	DB() DB
 	Server() Server
 	SelectDB(id int) bool
+	SetAuthenticated(ok bool)
 
 	LookupKeyReadOrReply(key []byte, reply []byte) interface{}
 	LookupKeyWriteOrReply(key []byte, reply []byte) interface{}
 
-	BlockForKeys(keys [][]byte, timeout time.Duration)
+	BlockForKeys(btype int, keys [][]byte, timeout time.Duration)
+	CloseOnOutputBufferLimitReached() bool
 }
 
 type Server interface {
 	PrepareForShutdown() bool
 	AddDirty(i int)
+	GetRequirePass() string
+	IsLFUPolicy() bool
+
+	ConfigGet(pattern string) []string
+	ConfigSet(name string, value string) error
+
+	GetAllClientsInfoString() string
+
+	GetMemoryOverheadData() *MemoryOverhead
+	GetMemoryDoctorReport() string
+}
+
+/* Memory used by the server for other things than the dataset, reported by
+ * MEMORY STATS. All the sizes are in bytes. */
+type MemoryOverhead struct {
+	PeakAllocated    int64
+	TotalAllocated   int64
+	StartupAllocated int64
+	ReplBacklog      int64
+	ClientsSlaves    int64
+	ClientsNormal    int64
+	AOFBuffer        int64
+	OverheadTotal    int64
+	Dataset          int64
+	TotalKeys        int64
+	BytesPerKey      int64
+	DatasetPerc      float64
+	PeakPerc         float64
+	Fragmentation    float64
+	DB               []DBMemoryOverhead // Only the non empty DBs
+}
+
+type DBMemoryOverhead struct {
+	ID                int
+	OverheadHTMain    int64
+	OverheadHTExpires int64
 }
 
 /* Redis database representation. There are multiple databases identified
@@ -61,9 +105,15 @@ type DB interface {
 
 	SignalModifyKey(key []byte)
 
+	MemoryUsage(key []byte, samples int) (usage int64, ok bool)
+	GetIdleTime(key []byte) (idle time.Duration, ok bool)
+	GetLFUFrequency(key []byte) (freq int, ok bool)
+
 	ExpireIfNeed(key []byte) bool
 	GetExpire(key []byte) time.Duration
 	SetExpire(key []byte, t time.Duration)
+	RemoveExpire(key []byte) bool
+	SetFieldExpire(key []byte, field []byte, when time.Duration)
 }
 
 type PubSub interface {
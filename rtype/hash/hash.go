@@ -1,34 +1,298 @@
 package hash
 
-import "github.com/SteveZhangBit/redigo/rtype"
+import (
+	"math/rand"
+	"time"
+	"unsafe"
 
-type BasicMap map[string]rtype.String
+	"github.com/SteveZhangBit/redigo/rtype"
+	"github.com/SteveZhangBit/redigo/rtype/listpack"
+)
 
-func (b BasicMap) Set(key []byte, val rtype.String) (update bool) {
-	_, update = b[string(key)]
-	b[string(key)] = val
+const (
+	REDIS_HASH_MAX_LISTPACK_ENTRIES = 128
+	REDIS_HASH_MAX_LISTPACK_VALUE   = 64
+)
+
+/* Hashes are encoded as listpacks while they have up to MaxListpackEntries
+ * fields and no field or value longer than MaxListpackValue bytes
+ * (hash-max-listpack-entries and hash-max-listpack-value). */
+var (
+	MaxListpackEntries = REDIS_HASH_MAX_LISTPACK_ENTRIES
+	MaxListpackValue   = REDIS_HASH_MAX_LISTPACK_VALUE
+)
+
+/* fieldExpires holds the expires of the fields of a hash. The earliest
+ * expire is remembered, so that most of the times checking for expired
+ * fields is O(1). It may be the expire of a field that was deleted or made
+ * persistent since then, which only costs a useless scan. */
+type fieldExpires struct {
+	expires map[string]time.Duration
+	next    time.Duration
+}
+
+func (f *fieldExpires) GetExpire(key []byte) time.Duration {
+	if when, ok := f.expires[string(key)]; ok {
+		return when
+	}
+	return -1
+}
+
+func (f *fieldExpires) SetExpire(key []byte, when time.Duration) {
+	if f.expires == nil {
+		f.expires = make(map[string]time.Duration)
+	}
+	if len(f.expires) == 0 || when < f.next {
+		f.next = when
+	}
+	f.expires[string(key)] = when
+}
+
+func (f *fieldExpires) RemoveExpire(key []byte) bool {
+	if _, ok := f.expires[string(key)]; ok {
+		delete(f.expires, string(key))
+		return true
+	}
+	return false
+}
+
+func (f *fieldExpires) HasExpires() bool {
+	return len(f.expires) > 0
+}
+
+/* Remove the expires of the fields expired at now, calling deletef to delete
+ * every field, and compute the earliest of the remaining expires. */
+func (f *fieldExpires) deleteExpired(now time.Duration, deletef func(key string)) int {
+	if len(f.expires) == 0 || now <= f.next {
+		return 0
+	}
+
+	deleted := 0
+	first := true
+	for key, when := range f.expires {
+		if now > when {
+			delete(f.expires, key)
+			deletef(key)
+			deleted++
+		} else if first || when < f.next {
+			f.next = when
+			first = false
+		}
+	}
+	return deleted
+}
+
+func (f *fieldExpires) memoryUsage() int64 {
+	if f.expires == nil {
+		return 0
+	}
+	var size int64 = rtype.MapOverhead
+	for key := range f.expires {
+		size += int64(unsafe.Sizeof(key)+unsafe.Sizeof(time.Duration(0))) + int64(len(key)) + rtype.MapEntryOverhead
+	}
+	return size
+}
+
+/* BasicMap is a hash stored in a hash table. Like set.HashSet the fields are
+ * also kept in a slice, with the hash table mapping every field to its
+ * index, so that random fields are picked in O(1): deleted fields are
+ * replaced by the last one of the slice. */
+type BasicMap struct {
+	dict    map[string]int
+	entries []mapEntry
+	fieldExpires
+}
+
+type mapEntry struct {
+	key string
+	val rtype.String
+}
+
+func (b *BasicMap) Set(key []byte, val rtype.String) (update bool) {
+	var i int
+	if i, update = b.dict[string(key)]; update {
+		b.entries[i].val = val
+		b.RemoveExpire(key)
+	} else {
+		b.dict[string(key)] = len(b.entries)
+		b.entries = append(b.entries, mapEntry{key: string(key), val: val})
+	}
 	return
 }
 
-func (b BasicMap) Get(key []byte) (val rtype.String, ok bool) {
-	val, ok = b[string(key)]
+func (b *BasicMap) Get(key []byte) (val rtype.String, ok bool) {
+	var i int
+	if i, ok = b.dict[string(key)]; ok {
+		val = b.entries[i].val
+	}
 	return
 }
 
-func (b BasicMap) Delete(key []byte) {
-	delete(b, string(key))
+func (b *BasicMap) delete(key string) {
+	if i, ok := b.dict[key]; ok {
+		last := len(b.entries) - 1
+		b.entries[i] = b.entries[last]
+		b.dict[b.entries[i].key] = i
+		b.entries[last] = mapEntry{} // Don't retain the field and the value.
+		b.entries = b.entries[:last]
+		delete(b.dict, key)
+	}
+}
+
+func (b *BasicMap) Delete(key []byte) {
+	b.delete(string(key))
+	b.RemoveExpire(key)
+}
+
+func (b *BasicMap) Len() int {
+	return len(b.entries)
+}
+
+/* The hash must not be modified by iterf, since the fields are visited in
+ * the order of the slice. */
+func (b *BasicMap) Iterate(iterf func(key []byte, val rtype.String)) {
+	for _, e := range b.entries {
+		iterf([]byte(e.key), e.val)
+	}
+}
+
+func (b *BasicMap) RandomField() ([]byte, rtype.String) {
+	e := b.entries[rand.Intn(len(b.entries))]
+	return []byte(e.key), e.val
+}
+
+/* The fields are visited from the end of the slice, the cursor being the
+ * number of fields not visited yet, and 0 starting a new iteration. A
+ * deleted field is replaced by the last one, so fields only move toward
+ * the start of the slice: a field in the hash from the start to the end of
+ * the iteration stays below the cursor until it is returned. It may be
+ * returned twice, when it's moved again below the cursor, and new fields
+ * are added at the end, so they may not be returned. Every call visits at
+ * most count fields. */
+func (b *BasicMap) Scan(cursor uint64, count int, scanf func(key []byte, val rtype.String)) uint64 {
+	if cursor == 0 || cursor > uint64(len(b.entries)) {
+		cursor = uint64(len(b.entries))
+	}
+	for ; cursor > 0 && count > 0; count-- {
+		cursor--
+		e := b.entries[cursor]
+		scanf([]byte(e.key), e.val)
+	}
+	return cursor
 }
 
-func (b BasicMap) Len() int {
-	return len(b)
+func (b *BasicMap) DeleteExpired(now time.Duration) int {
+	return b.deleteExpired(now, b.delete)
 }
 
-func (b BasicMap) Iterate(iterf func(key []byte, val rtype.String)) {
-	for key, val := range b {
-		iterf([]byte(key), val)
+func (b *BasicMap) MemoryUsage(samples int) int64 {
+	var elesize int64
+	var count int
+	for _, e := range b.entries {
+		if samples > 0 && count == samples {
+			break
+		}
+		// The string of the field is shared by the slice and the map.
+		elesize += int64(2*unsafe.Sizeof(e.key)+unsafe.Sizeof(e.val)+unsafe.Sizeof(0)) + int64(len(e.key)) +
+			e.val.MemoryUsage(0) + rtype.MapEntryOverhead
+		count++
+	}
+	size := int64(unsafe.Sizeof(*b)) + rtype.MapOverhead + b.memoryUsage()
+	if count > 0 {
+		size += int64(float64(elesize) / float64(count) * float64(len(b.entries)))
 	}
+	return size
 }
 
 func New() rtype.HashMap {
-	return make(BasicMap)
+	return newBasicMap(0)
+}
+
+func newBasicMap(size int) *BasicMap {
+	return &BasicMap{dict: make(map[string]int, size), entries: make([]mapEntry, 0, size)}
+}
+
+/* ListpackMap is a small hash stored as a listpack of field-value pairs, the
+ * field of every pair coming just before its value. */
+type ListpackMap struct {
+	lp *listpack.Listpack
+	fieldExpires
+}
+
+func (l *ListpackMap) Set(key []byte, val rtype.String) bool {
+	if fptr := l.lp.Find(l.lp.First(), key, 1); fptr != -1 {
+		// Replace value
+		l.lp.Replace(l.lp.Next(fptr), val.Bytes())
+		l.RemoveExpire(key)
+		return true
+	}
+	// Push new field/value pair onto the tail of the listpack
+	l.lp.Append(key)
+	l.lp.Append(val.Bytes())
+	return false
+}
+
+func (l *ListpackMap) Get(key []byte) (rtype.String, bool) {
+	if fptr := l.lp.Find(l.lp.First(), key, 1); fptr != -1 {
+		return l.lp.GetString(l.lp.Next(fptr)), true
+	}
+	return nil, false
+}
+
+func (l *ListpackMap) Delete(key []byte) {
+	if fptr := l.lp.Find(l.lp.First(), key, 1); fptr != -1 {
+		l.lp.DeleteRange(fptr, 2)
+		l.RemoveExpire(key)
+	}
+}
+
+func (l *ListpackMap) DeleteExpired(now time.Duration) int {
+	return l.deleteExpired(now, func(key string) {
+		if fptr := l.lp.Find(l.lp.First(), []byte(key), 1); fptr != -1 {
+			l.lp.DeleteRange(fptr, 2)
+		}
+	})
+}
+
+func (l *ListpackMap) Len() int {
+	return l.lp.Length() / 2
+}
+
+func (l *ListpackMap) Iterate(iterf func(key []byte, val rtype.String)) {
+	for fptr := l.lp.First(); fptr != -1; {
+		vptr := l.lp.Next(fptr)
+		iterf(l.lp.GetBytes(fptr), l.lp.GetString(vptr))
+		fptr = l.lp.Next(vptr)
+	}
+}
+
+func (l *ListpackMap) RandomField() ([]byte, rtype.String) {
+	fptr := l.lp.Seek(2 * rand.Intn(l.Len()))
+	return l.lp.GetBytes(fptr), l.lp.GetString(l.lp.Next(fptr))
+}
+
+/* A listpack is small enough to be returned in a single call, so the cursor
+ * is always 0, like in Redis. */
+func (l *ListpackMap) Scan(cursor uint64, count int, scanf func(key []byte, val rtype.String)) uint64 {
+	l.Iterate(scanf)
+	return 0
+}
+
+func (l *ListpackMap) MemoryUsage(samples int) int64 {
+	return int64(unsafe.Sizeof(*l)) + int64(l.lp.BlobSize()) + l.memoryUsage()
+}
+
+// Convert the listpack to a hash table holding the same fields and expires.
+func (l *ListpackMap) Convert() *BasicMap {
+	b := newBasicMap(l.Len())
+	b.fieldExpires = l.fieldExpires
+	l.Iterate(func(key []byte, val rtype.String) {
+		b.dict[string(key)] = len(b.entries)
+		b.entries = append(b.entries, mapEntry{key: string(key), val: val})
+	})
+	return b
+}
+
+func NewListpack() *ListpackMap {
+	return &ListpackMap{lp: listpack.New()}
 }
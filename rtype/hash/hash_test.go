@@ -0,0 +1,53 @@
+package hash
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/SteveZhangBit/redigo/rtype"
+	"github.com/SteveZhangBit/redigo/rtype/rstring"
+)
+
+/* Every field in the hash from the start to the end of a scan is returned,
+ * even if fields are added and deleted between the calls. */
+func TestBasicMapScan(t *testing.T) {
+	b := newBasicMap(0)
+	for i := 0; i < 1000; i++ {
+		b.Set([]byte(fmt.Sprint("f", i)), rstring.New([]byte("v")))
+	}
+
+	deleted := make(map[string]bool)
+	returned := make(map[string]bool)
+	var cursor uint64
+	for calls := 0; ; calls++ {
+		n := 0
+		cursor = b.Scan(cursor, 10, func(key []byte, val rtype.String) {
+			returned[string(key)] = true
+			n++
+		})
+		if n > 10 {
+			t.Fatalf("%d fields returned with a count of 10", n)
+		}
+		if cursor == 0 {
+			break
+		}
+		if calls > 1000 {
+			t.Fatal("the scan never ends")
+		}
+
+		for i := 0; i < 3; i++ {
+			key := fmt.Sprint("f", rand.Intn(1000))
+			b.Delete([]byte(key))
+			deleted[key] = true
+		}
+		b.Set([]byte(fmt.Sprint("new", calls)), rstring.New([]byte("v")))
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint("f", i)
+		if !deleted[key] && !returned[key] {
+			t.Errorf("%s was not returned", key)
+		}
+	}
+}
@@ -0,0 +1,1077 @@
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+	"strings"
+)
+
+/* The Redis HyperLogLog implementation is based on the following ideas:
+ *
+ * * The use of a 64 bit hash function as proposed in [1], in order to don't
+ *   limited to cardinalities up to 10^9, at the cost of just 1 additional
+ *   bit per register.
+ * * The use of 16384 6-bit registers for a great level of accuracy, using
+ *   a total of 12k per key.
+ * * The use of the Redis string data type. No new type is introduced.
+ * * No attempt is made to compress the data structure as in [1]. Also the
+ *   algorithm used is the original HyperLogLog Algorithm as in [2], with
+ *   the only difference that a 64 bit hash function is used, so no correction
+ *   is performed for values near 2^32 as in [1].
+ *
+ * [1] Heule, Nunkesser, Hall: HyperLogLog in Practice: Algorithmic
+ *     Engineering of a State of The Art Cardinality Estimation Algorithm.
+ *
+ * [2] P. Flajolet, Éric Fusy, O. Gandouet, and F. Meunier. Hyperloglog: The
+ *     analysis of a near-optimal cardinality estimation algorithm.
+ *
+ * Redis uses two representations:
+ *
+ * 1) A "dense" representation where every entry is represented by
+ *    a 6-bit integer.
+ * 2) A "sparse" representation using run length compression suitable
+ *    for representing HyperLogLogs with many registers set to 0 in
+ *    a memory efficient way.
+ *
+ * HLL header
+ * ===
+ *
+ * Both the dense and sparse representation have a 16 byte header as follows:
+ *
+ * +------+---+-----+----------+
+ * | HYLL | E | N/U | Cardin.  |
+ * +------+---+-----+----------+
+ *
+ * The first 4 bytes are a magic string set to the bytes "HYLL".
+ * "E" is one byte encoding, currently set to HLL_DENSE or
+ * HLL_SPARSE. N/U are three not used bytes.
+ *
+ * The "Cardin." field is a 64 bit integer stored in little endian format
+ * with the latest cardinality computed that can be reused if the data
+ * structure was not modified since the last computation (this is useful
+ * because there are high probabilities that HLLADD operations don't
+ * modify the actual data structure and hence the approximated cardinality).
+ *
+ * When the most significant bit in the most significant byte of the cached
+ * cardinality is set, it means that the data structure was modified and
+ * we can't reuse the cached value that must be recomputed.
+ *
+ * Dense representation
+ * ===
+ *
+ * The dense representation used by Redis is the following:
+ *
+ * +--------+--------+--------+------//      //--+
+ * |11000000|22221111|33333322|55444444 ....     |
+ * +--------+--------+--------+------//      //--+
+ *
+ * The 6 bits counters are encoded one after the other starting from the
+ * LSB to the MSB, and using the next bytes as needed.
+ *
+ * Sparse representation
+ * ===
+ *
+ * The sparse representation encodes registers using a run length
+ * encoding composed of three opcodes, two using one byte, and one using
+ * of two bytes. The opcodes are called ZERO, XZERO and VAL.
+ *
+ * ZERO opcode is represented as 00xxxxxx. The 6-bit integer represented
+ * by the six bits 'xxxxxx', plus 1, means that there are N registers set
+ * to 0. This opcode can represent from 1 to 64 contiguous registers set
+ * to the value of 0.
+ *
+ * XZERO opcode is represented by two bytes 01xxxxxx yyyyyyyy. The 14-bit
+ * integer represented by the bits 'xxxxxx' as most significant bits and
+ * 'yyyyyyyy' as least significant bits, plus 1, means that there are N
+ * registers set to 0. This opcode can represent from 0 to 16384 contiguous
+ * registers set to the value of 0.
+ *
+ * VAL opcode is represented as 1vvvvvxx. It contains a 5-bit integer
+ * representing the value of a register, and a 2-bit integer representing
+ * the number of contiguous registers set to that value 'vvvvv'.
+ * To obtain the value and run length, the integers vvvvv and xx must be
+ * incremented by one. This opcode can represent values from 1 to 32,
+ * repeated from 1 to 4 times.
+ *
+ * The sparse representation can't represent registers with a value greater
+ * than 32, however it is very unlikely that we find such a register in an
+ * HLL with a cardinality where the sparse representation is still more
+ * memory efficient than the dense representation. When this happens the
+ * HLL is converted to the dense representation.
+ *
+ * The sparse representation is purely positional. For example a sparse
+ * representation of an empty HLL is just: XZERO:16384.
+ *
+ * An HLL having only 3 non-zero registers at position 1000, 1020, 1021
+ * respectively set to 2, 3, 3, is represented by the following three
+ * opcodes:
+ *
+ * XZERO:1000 (Registers 0-999 are set to 0)
+ * VAL:2,1    (1 register set to value 2, that is register 1000)
+ * ZERO:19    (Registers 1001-1019 set to 0)
+ * VAL:3,2    (2 registers set to value 3, that is registers 1020,1021)
+ * ZERO:16362 (Registers 1022-16383 set to 0)
+ *
+ * In the example the sparse representation used just 7 bytes instead
+ * of 12k in order to represent the HLL registers. In general for low
+ * cardinality there is a big win in terms of space efficiency, traded
+ * with CPU time since the sparse representation is slower to access.
+ *
+ * The sparse representation is converted to the dense one when the
+ * length of the string exceeds SparseMaxBytes (hll-sparse-max-bytes), or
+ * when a register is set to a value greater than 32. */
+
+const (
+	HLL_P              = 14                // The greater is P, the smaller the error.
+	HLL_Q              = 64 - HLL_P        // The number of bits of the hash value used for determining the number of leading zeros.
+	HLL_REGISTERS      = 1 << HLL_P        // With P=14, 16384 registers.
+	HLL_P_MASK         = HLL_REGISTERS - 1 // Mask to index register.
+	HLL_BITS           = 6                 // Enough to count up to 63 leading zeroes.
+	HLL_REGISTER_MAX   = (1 << HLL_BITS) - 1
+	HLL_HDR_SIZE       = 16
+	HLL_DENSE_SIZE     = HLL_HDR_SIZE + (HLL_REGISTERS*HLL_BITS+7)/8
+	HLL_DENSE          = 0   // Dense encoding.
+	HLL_SPARSE         = 1   // Sparse encoding.
+	HLL_RAW            = 255 // Only used internally, never exposed.
+	HLL_MAX_ENCODING   = 1
+	HLL_DEFAULT_SPARSE = 3000 // Default hll-sparse-max-bytes.
+
+	HLL_SPARSE_XZERO_BIT     = 0x40 // 01xxxxxx
+	HLL_SPARSE_VAL_BIT       = 0x80 // 1vvvvvxx
+	HLL_SPARSE_VAL_MAX_VALUE = 32
+	HLL_SPARSE_VAL_MAX_LEN   = 4
+	HLL_SPARSE_ZERO_MAX_LEN  = 64
+	HLL_SPARSE_XZERO_MAX_LEN = 16384
+	HLL_ALPHA_INF            = 0.721347520444481703680 // constant for 0.5/ln(2)
+	HLL_TEST_CYCLES          = 1000
+)
+
+// Layout of the header.
+const (
+	hllMagic           = "HYLL"
+	hllEncodingOffset  = 4
+	hllCardOffset      = 8
+	hllCardInvalidBit  = 1 << 7 // In the most significant byte of the cardinality.
+	hllRegistersOffset = HLL_HDR_SIZE
+)
+
+// Seed of the hash of the elements, the same of Redis.
+const hllHashSeed = 0xadc83b19
+
+/* The sparse representation is converted to the dense one when it grows
+ * past SparseMaxBytes bytes, header included (hll-sparse-max-bytes). */
+var SparseMaxBytes = HLL_DEFAULT_SPARSE
+
+var ErrInvalid = errors.New("Corrupted HLL object detected")
+
+/* HLL is a HyperLogLog stored in a string value, header included, so that
+ * it can be saved and loaded as a plain string. */
+type HLL []byte
+
+/* Create an HLL object. We always create the HLL using sparse encoding.
+ * This will be upgraded to the dense representation as needed. */
+func New() HLL {
+	/* Populate the sparse representation with as many XZERO opcodes as
+	 * needed to represent all the registers. */
+	sparselen := HLL_HDR_SIZE + ((HLL_REGISTERS+(HLL_SPARSE_XZERO_MAX_LEN-1))/HLL_SPARSE_XZERO_MAX_LEN)*2
+	h := make(HLL, HLL_HDR_SIZE, sparselen)
+	copy(h, hllMagic)
+	h[hllEncodingOffset] = HLL_SPARSE
+	for aux := HLL_REGISTERS; aux > 0; {
+		xzero := HLL_SPARSE_XZERO_MAX_LEN
+		if xzero > aux {
+			xzero = aux
+		}
+		h = append(h, 0, 0)
+		sparseXZeroSet(h[len(h)-2:], xzero)
+		aux -= xzero
+	}
+	return h
+}
+
+/* Check if the string is a valid HLL: it has the header, a known encoding
+ * and the right length if dense. The sparse registers are only checked when
+ * they are used, and ErrInvalid is returned if they are corrupted. */
+func IsValid(s []byte) bool {
+	if len(s) < HLL_HDR_SIZE || string(s[:4]) != hllMagic {
+		return false
+	}
+	if s[hllEncodingOffset] > HLL_MAX_ENCODING {
+		return false
+	}
+	if s[hllEncodingOffset] == HLL_DENSE && len(s) != HLL_DENSE_SIZE {
+		return false
+	}
+	return true
+}
+
+func (h HLL) Encoding() int {
+	return int(h[hllEncodingOffset])
+}
+
+func (h HLL) registers() []byte {
+	return h[hllRegistersOffset:]
+}
+
+/* Return the cached cardinality, and false if the HLL was modified since
+ * it was computed. */
+func (h HLL) CachedCard() (uint64, bool) {
+	if h[hllCardOffset+7]&hllCardInvalidBit != 0 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(h[hllCardOffset:]), true
+}
+
+func (h HLL) SetCachedCard(card uint64) {
+	binary.LittleEndian.PutUint64(h[hllCardOffset:], card)
+}
+
+func (h HLL) InvalidateCache() {
+	h[hllCardOffset+7] |= hllCardInvalidBit
+}
+
+/* =========================== Low level bit macros ========================= */
+
+// Return the value of the register at position 'regnum' of the registers p.
+func denseGetRegister(p []byte, regnum int) uint8 {
+	byt := regnum * HLL_BITS / 8
+	fb := uint(regnum * HLL_BITS & 7)
+	fb8 := 8 - fb
+	b0 := p[byt]
+	var b1 byte
+	// The last register doesn't span the next byte.
+	if byt+1 < len(p) {
+		b1 = p[byt+1]
+	}
+	return ((b0 >> fb) | (b1 << fb8)) & HLL_REGISTER_MAX
+}
+
+// Set the value of the register at position 'regnum' of the registers p.
+func denseSetRegister(p []byte, regnum int, val uint8) {
+	byt := regnum * HLL_BITS / 8
+	fb := uint(regnum * HLL_BITS & 7)
+	fb8 := 8 - fb
+	p[byt] &^= HLL_REGISTER_MAX << fb
+	p[byt] |= val << fb
+	if byt+1 < len(p) {
+		p[byt+1] &^= HLL_REGISTER_MAX >> fb8
+		p[byt+1] |= val >> fb8
+	}
+}
+
+// Macros to access the sparse representation.
+func sparseIsZero(b byte) bool {
+	return b&0xc0 == 0 // 00xxxxxx
+}
+
+func sparseIsXZero(b byte) bool {
+	return b&0xc0 == HLL_SPARSE_XZERO_BIT
+}
+
+func sparseIsVal(b byte) bool {
+	return b&HLL_SPARSE_VAL_BIT != 0
+}
+
+func sparseZeroLen(b byte) int {
+	return int(b&0x3f) + 1
+}
+
+func sparseXZeroLen(p []byte) int {
+	return (int(p[0]&0x3f)<<8 | int(p[1])) + 1
+}
+
+func sparseValValue(b byte) int {
+	return int(b>>2&0x1f) + 1
+}
+
+func sparseValLen(b byte) int {
+	return int(b&0x3) + 1
+}
+
+func sparseValSet(p []byte, val, length int) {
+	p[0] = byte((val-1)<<2|(length-1)) | HLL_SPARSE_VAL_BIT
+}
+
+func sparseZeroSet(p []byte, length int) {
+	p[0] = byte(length - 1)
+}
+
+func sparseXZeroSet(p []byte, length int) {
+	l := length - 1
+	p[0] = byte(l>>8) | HLL_SPARSE_XZERO_BIT
+	p[1] = byte(l & 0xff)
+}
+
+/* ========================= HyperLogLog algorithm  ========================= */
+
+/* Our hash function is MurmurHash2, 64 bit version.
+ * It was modified for Redis in order to provide the same result in
+ * big and little endian archs (endian neutral). */
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ (uint64(len(key)) * m)
+
+	nblocks := len(key) / 8
+	for i := 0; i < nblocks; i++ {
+		k := binary.LittleEndian.Uint64(key[i*8:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+
+	tail := key[nblocks*8:]
+	switch len(tail) {
+	case 7:
+		h ^= uint64(tail[6]) << 48
+		fallthrough
+	case 6:
+		h ^= uint64(tail[5]) << 40
+		fallthrough
+	case 5:
+		h ^= uint64(tail[4]) << 32
+		fallthrough
+	case 4:
+		h ^= uint64(tail[3]) << 24
+		fallthrough
+	case 3:
+		h ^= uint64(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint64(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint64(tail[0])
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+/* Given a string element to add to the HyperLogLog, returns the length
+ * of the pattern 000..1 of the element hash. As a side effect 'regp' is
+ * set to the register index this element hashes to. */
+func patLen(ele []byte) (index int, count uint8) {
+	/* Count the number of zeroes starting from bit HLL_REGISTERS
+	 * (that is a power of two corresponding to the first bit we don't use
+	 * as index). The max run can be 64-P+1 = Q+1 bits.
+	 *
+	 * Note that the final "1" ending the sequence of zeroes must be
+	 * included in the count, so if we find "001" the count is 3, and
+	 * the smallest count possible is no zeroes at all, just a 1 bit
+	 * at the first position, that is a count of 1.
+	 *
+	 * This may sound like inefficient, but actually in the average case
+	 * there are high probabilities to find a 1 after a few iterations. */
+	hash := murmurHash64A(ele, hllHashSeed)
+	index = int(hash & HLL_P_MASK) // Register index.
+	hash >>= HLL_P                 // Remove bits used to address the register.
+	hash |= 1 << HLL_Q             // Make sure the loop terminates and count will be <= Q+1.
+	return index, uint8(bits.TrailingZeros64(hash) + 1)
+}
+
+/* ================== Dense representation implementation ================== */
+
+/* Low level function to set the dense HLL register at 'index' to the
+ * specified value if the current value is smaller than 'count'.
+ *
+ * The function always succeed, however if as a result of the operation
+ * the approximated cardinality changed, 1 is returned. Otherwise 0
+ * is returned. */
+func denseSet(registers []byte, index int, count uint8) int {
+	if count > denseGetRegister(registers, index) {
+		denseSetRegister(registers, index, count)
+		return 1
+	}
+	return 0
+}
+
+/* "Add" the element in the dense hyperloglog data structure.
+ * Actually nothing is added, but the max 0 pattern counter of the subset
+ * the element belongs to is incremented if needed.
+ *
+ * This is just a wrapper to denseSet(), performing the hashing of the
+ * element in order to retrieve the index and zero-run count. */
+func denseAdd(registers []byte, ele []byte) int {
+	index, count := patLen(ele)
+	return denseSet(registers, index, count)
+}
+
+// Compute the register histogram in the dense representation.
+func denseRegHisto(registers []byte, reghisto *[64]int) {
+	for j := 0; j < HLL_REGISTERS; j++ {
+		reghisto[denseGetRegister(registers, j)]++
+	}
+}
+
+/* ================== Sparse representation implementation  ================= */
+
+/* Convert the HLL with sparse representation given as input in its dense
+ * representation, replacing the string of the HLL.
+ *
+ * The function returns ErrInvalid if the sparse representation was not
+ * valid, otherwise nil is returned. */
+func (h *HLL) ToDense() error {
+	sparse := *h
+	// If the representation is already the right one return ASAP.
+	if sparse.Encoding() == HLL_DENSE {
+		return nil
+	}
+
+	/* Create a string of the right size filled with zero bytes.
+	 * Note that the cached cardinality is set to 0 as a side effect
+	 * that is exactly the cardinality of an empty HLL. */
+	dense := make(HLL, HLL_DENSE_SIZE)
+	copy(dense, sparse[:HLL_HDR_SIZE])
+	dense[hllEncodingOffset] = HLL_DENSE
+
+	/* Now read the sparse representation and set non-zero registers
+	 * accordingly. */
+	idx := 0
+	registers := dense.registers()
+	for p, end := hllRegistersOffset, len(sparse); p < end; {
+		if sparseIsZero(sparse[p]) {
+			idx += sparseZeroLen(sparse[p])
+			p++
+		} else if sparseIsXZero(sparse[p]) {
+			if p+1 >= end {
+				return ErrInvalid
+			}
+			idx += sparseXZeroLen(sparse[p:])
+			p += 2
+		} else {
+			runlen := sparseValLen(sparse[p])
+			regval := uint8(sparseValValue(sparse[p]))
+			if runlen+idx > HLL_REGISTERS {
+				break // Overflow.
+			}
+			for ; runlen > 0; runlen-- {
+				denseSetRegister(registers, idx, regval)
+				idx++
+			}
+			p++
+		}
+	}
+
+	/* If the sparse representation was valid, we expect to find idx
+	 * set to HLL_REGISTERS. */
+	if idx != HLL_REGISTERS {
+		return ErrInvalid
+	}
+
+	*h = dense
+	return nil
+}
+
+/* Low level function to set the sparse HLL register at 'index' to the
+ * specified value if the current value is smaller than 'count'.
+ *
+ * The object 'h' is the HLL itself. It needs to be a pointer since, in
+ * order to set the register, the string may need to grow, or be converted
+ * to the dense representation.
+ *
+ * If the value of the register changed as a result of the operation 1 is
+ * returned, otherwise 0. ErrInvalid is returned if the sparse representation
+ * is corrupted.
+ *
+ * As a side effect the function may promote the HLL representation from
+ * sparse to dense: this happens when a register requires to be set to a
+ * value not representable with the sparse representation, or when the
+ * resulting size would be greater than SparseMaxBytes. */
+func (h *HLL) sparseSet(index int, count uint8) (int, error) {
+	/* If the count is too big to be representable by the sparse
+	 * representation switch to dense representation. */
+	if count > HLL_SPARSE_VAL_MAX_VALUE {
+		return h.promote(index, count)
+	}
+
+	s := *h
+
+	/* Step 1: we need to locate the opcode we need to modify to check
+	 * if a value update is actually needed. */
+	sparse := hllRegistersOffset
+	end := len(s)
+	p := sparse
+	prev := -1
+	first := 0
+	span := 0
+	for p < end {
+		oplen := 1
+		if sparseIsZero(s[p]) {
+			span = sparseZeroLen(s[p])
+		} else if sparseIsVal(s[p]) {
+			span = sparseValLen(s[p])
+		} else { // XZERO
+			if p+1 >= end {
+				return 0, ErrInvalid
+			}
+			span = sparseXZeroLen(s[p:])
+			oplen = 2
+		}
+		// Break if this opcode covers the register as 'index'.
+		if index <= first+span-1 {
+			break
+		}
+		prev = p
+		p += oplen
+		first += span
+	}
+	if span == 0 || p >= end {
+		return 0, ErrInvalid // Invalid format.
+	}
+
+	/* Cache current opcode type to avoid using the macro again and
+	 * again for something that will not change.
+	 * Also cache the run-length of the opcode. */
+	isZero, isXZero, isVal := false, false, false
+	runlen := 0
+	if sparseIsZero(s[p]) {
+		isZero = true
+		runlen = sparseZeroLen(s[p])
+	} else if sparseIsXZero(s[p]) {
+		isXZero = true
+		runlen = sparseXZeroLen(s[p:])
+	} else {
+		isVal = true
+		runlen = sparseValLen(s[p])
+	}
+
+	/* Step 2: After the loop:
+	 *
+	 * 'first' stores to the index of the first register covered
+	 *  by the current opcode, which is pointed by 'p'.
+	 *
+	 * 'prev' is the opcode before the current one, -1 if the current
+	 *  opcode is the first.
+	 *
+	 * 'span' is set to the number of registers covered by the current
+	 *  opcode.
+	 *
+	 * There are different cases in order to update the data structure
+	 * in place without generating it from scratch:
+	 *
+	 * A) If it is a VAL opcode already set to a value >= our 'count'
+	 *    no update is needed, regardless of the VAL run-length field.
+	 *    In this case PFADD returns 0 since no changes are performed.
+	 *
+	 * B) If it is a VAL opcode with len = 1 (representing only our
+	 *    register) and the value is less than 'count', we just update it
+	 *    since this is a trivial case. */
+	if isVal {
+		oldcount := sparseValValue(s[p])
+		// Case A.
+		if oldcount >= int(count) {
+			return 0, nil
+		}
+
+		// Case B.
+		if runlen == 1 {
+			sparseValSet(s[p:], int(count), 1)
+			return h.sparseUpdated(prev), nil
+		}
+	}
+
+	/* C) Another trivial to handle case is a ZERO opcode with a len of 1.
+	 * We can just replace it with a VAL opcode with our value and len of 1. */
+	if isZero && runlen == 1 {
+		sparseValSet(s[p:], int(count), 1)
+		return h.sparseUpdated(prev), nil
+	}
+
+	/* D) General case.
+	 *
+	 * The other cases are more complex: our register requires to be updated
+	 * and is either currently represented by a VAL opcode with len > 1,
+	 * by a ZERO opcode with len > 1, or by an XZERO opcode.
+	 *
+	 * In those cases the original opcode must be split into multiple
+	 * opcodes. The worst case is an XZERO split in the middle resulting into
+	 * XZERO - VAL - XZERO, so the resulting sequence max length is
+	 * 5 bytes.
+	 *
+	 * We perform the split writing the new sequence into the 'seq' buffer
+	 * with 'n' as length. Later the new sequence is inserted in place
+	 * of the old one, possibly moving what is on the right a few bytes
+	 * if the new sequence is longer than the older one. */
+	var seq [5]byte
+	n := 0
+	last := first + span - 1
+	if isZero || isXZero {
+		// Handle splitting of ZERO / XZERO.
+		if index != first {
+			length := index - first
+			if length > HLL_SPARSE_ZERO_MAX_LEN {
+				sparseXZeroSet(seq[n:], length)
+				n += 2
+			} else {
+				sparseZeroSet(seq[n:], length)
+				n++
+			}
+		}
+		sparseValSet(seq[n:], int(count), 1)
+		n++
+		if index != last {
+			length := last - index
+			if length > HLL_SPARSE_ZERO_MAX_LEN {
+				sparseXZeroSet(seq[n:], length)
+				n += 2
+			} else {
+				sparseZeroSet(seq[n:], length)
+				n++
+			}
+		}
+	} else {
+		// Handle splitting of VAL.
+		curval := sparseValValue(s[p])
+		if index != first {
+			sparseValSet(seq[n:], curval, index-first)
+			n++
+		}
+		sparseValSet(seq[n:], int(count), 1)
+		n++
+		if index != last {
+			sparseValSet(seq[n:], curval, last-index)
+			n++
+		}
+	}
+
+	/* Step 3: substitute the new sequence with the old one.
+	 *
+	 * The string grows by up to 3 bytes in the worst case (XZERO split into
+	 * XZERO-VAL-XZERO), unless it would grow past SparseMaxBytes. */
+	oldlen := 1
+	if isXZero {
+		oldlen = 2
+	}
+	deltalen := n - oldlen
+	if deltalen > 0 && len(s)+deltalen > SparseMaxBytes {
+		return h.promote(index, count)
+	}
+	next := p + oldlen
+	if deltalen > 0 {
+		s = append(s, seq[:deltalen]...)
+	}
+	copy(s[next+deltalen:], s[next:end])
+	s = s[:end+deltalen]
+	copy(s[p:], seq[:n])
+	*h = s
+
+	return h.sparseUpdated(prev), nil
+}
+
+/* Step 4 of sparseSet(): merge adjacent VAL opcodes with the same value
+ * starting from the opcode before the updated one, and invalidate the cached
+ * cardinality. Always return 1, the register was updated. */
+func (h *HLL) sparseUpdated(prev int) int {
+	/* Here we try to merge adjacent VAL opcodes with the same value, if
+	 * possible.
+	 *
+	 * The merging process is done in a single pass, starting from the
+	 * opcode before the one we updated, checking up to 5 opcodes. */
+	s := *h
+	p := prev
+	if p < 0 {
+		p = hllRegistersOffset
+	}
+	end := len(s)
+	for scanlen := 5; p < end && scanlen > 0; scanlen-- {
+		if sparseIsXZero(s[p]) {
+			p += 2
+			continue
+		} else if sparseIsZero(s[p]) {
+			p++
+			continue
+		}
+		/* We need two adjacent VAL opcodes to try a merge, having
+		 * the same value, and a len that fits the VAL opcode max len. */
+		if p+1 < end && sparseIsVal(s[p+1]) {
+			v1 := sparseValValue(s[p])
+			v2 := sparseValValue(s[p+1])
+			if v1 == v2 {
+				length := sparseValLen(s[p]) + sparseValLen(s[p+1])
+				if length <= HLL_SPARSE_VAL_MAX_LEN {
+					sparseValSet(s[p+1:], v1, length)
+					copy(s[p:], s[p+1:end])
+					end--
+					s = s[:end]
+					/* After a merge we reiterate without incrementing 'p'
+					 * in order to try to merge the just merged value with
+					 * a value on its right. */
+					continue
+				}
+			}
+		}
+		p++
+	}
+	*h = s
+
+	// Invalidate the cached cardinality.
+	s.InvalidateCache()
+	return 1
+}
+
+// Promote to dense representation, then set the register.
+func (h *HLL) promote(index int, count uint8) (int, error) {
+	if err := h.ToDense(); err != nil {
+		return 0, err // Corrupted HLL.
+	}
+
+	/* We need to call denseAdd() to perform the operation after the
+	 * conversion. However the result must be 1, since if we need to
+	 * convert from sparse to dense a register requires to be updated.
+	 *
+	 * Note that this in turn means that PFADD will make sure the command
+	 * is propagated to slaves / AOF, so if there is a sparse -> dense
+	 * conversion, it will be performed in all the slaves as well. */
+	if denseSet(h.registers(), index, count) != 1 {
+		panic("dense set after the promotion of the HLL didn't update the register")
+	}
+	return 1, nil
+}
+
+// Compute the register histogram in the sparse representation.
+func sparseRegHisto(sparse []byte, reghisto *[64]int) error {
+	idx := 0
+	for p, end := 0, len(sparse); p < end; {
+		if sparseIsZero(sparse[p]) {
+			runlen := sparseZeroLen(sparse[p])
+			idx += runlen
+			reghisto[0] += runlen
+			p++
+		} else if sparseIsXZero(sparse[p]) {
+			if p+1 >= end {
+				return ErrInvalid
+			}
+			runlen := sparseXZeroLen(sparse[p:])
+			idx += runlen
+			reghisto[0] += runlen
+			p += 2
+		} else {
+			runlen := sparseValLen(sparse[p])
+			idx += runlen
+			reghisto[sparseValValue(sparse[p])] += runlen
+			p++
+		}
+	}
+	if idx != HLL_REGISTERS {
+		return ErrInvalid
+	}
+	return nil
+}
+
+/* ========================= HyperLogLog Count ==============================
+ * This is the core of the algorithm where the approximated count is
+ * computed. The function uses the lower level denseRegHisto() and
+ * sparseRegHisto() functions as helpers to compute histogram of register
+ * values part of the computation, which is representation-specific, while
+ * all the rest is common. */
+
+// Implements the register histogram calculation for the raw registers.
+func rawRegHisto(registers []byte, reghisto *[64]int) {
+	for _, reg := range registers[:HLL_REGISTERS] {
+		reghisto[reg]++
+	}
+}
+
+// Helper function sigma as defined in "New cardinality estimation algorithms
+// for HyperLogLog sketches" Otmar Ertl, arXiv:1702.01284
+func sigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	var zPrime float64
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		zPrime = z
+		z += x * y
+		y += y
+		if zPrime == z {
+			break
+		}
+	}
+	return z
+}
+
+// Helper function tau as defined in "New cardinality estimation algorithms
+// for HyperLogLog sketches" Otmar Ertl, arXiv:1702.01284
+func tau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	var zPrime float64
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		zPrime = z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			break
+		}
+	}
+	return z / 3
+}
+
+/* Return the approximated cardinality of the set based on the harmonic
+ * mean of the registers values. ErrInvalid is returned if the sparse
+ * representation is corrupted. */
+func (h HLL) Count() (uint64, error) {
+	var reghisto [64]int
+
+	// Compute register histogram
+	switch h.Encoding() {
+	case HLL_DENSE:
+		denseRegHisto(h.registers(), &reghisto)
+	case HLL_SPARSE:
+		if err := sparseRegHisto(h.registers(), &reghisto); err != nil {
+			return 0, err
+		}
+	case HLL_RAW:
+		rawRegHisto(h.registers(), &reghisto)
+	default:
+		panic("Unknown HyperLogLog encoding in HLL.Count()")
+	}
+	return countRegHisto(&reghisto), nil
+}
+
+/* Estimate cardinality from register histogram. See:
+ * "New cardinality estimation algorithms for HyperLogLog sketches"
+ * Otmar Ertl, arXiv:1702.01284 */
+func countRegHisto(reghisto *[64]int) uint64 {
+	m := float64(HLL_REGISTERS)
+	z := m * tau((m-float64(reghisto[HLL_Q+1]))/m)
+	for j := HLL_Q; j >= 1; j-- {
+		z += float64(reghisto[j])
+		z *= 0.5
+	}
+	z += m * sigma(float64(reghisto[0])/m)
+	return uint64(math.Round(HLL_ALPHA_INF * m * m / z))
+}
+
+/* Return the approximated cardinality of the raw registers, one byte per
+ * register, as filled by Merge(). */
+func CountRegisters(max []byte) uint64 {
+	var reghisto [64]int
+	rawRegHisto(max, &reghisto)
+	return countRegHisto(&reghisto)
+}
+
+/* Call denseAdd() or sparseSet() according to the HLL encoding. Return 1
+ * if the approximated cardinality changed. */
+func (h *HLL) Add(ele []byte) (int, error) {
+	switch h.Encoding() {
+	case HLL_DENSE:
+		return denseAdd(h.registers(), ele), nil
+	case HLL_SPARSE:
+		index, count := patLen(ele)
+		return h.sparseSet(index, count)
+	default:
+		return 0, ErrInvalid // Invalid representation.
+	}
+}
+
+/* Set the register at index to count, if greater than the current one.
+ * Return 1 if the register changed. */
+func (h *HLL) Set(index int, count uint8) (int, error) {
+	switch h.Encoding() {
+	case HLL_DENSE:
+		return denseSet(h.registers(), index, count), nil
+	case HLL_SPARSE:
+		return h.sparseSet(index, count)
+	default:
+		return 0, ErrInvalid
+	}
+}
+
+/* Merge by computing MAX(registers[i],hll[i]) the HyperLogLog 'h'
+ * with an array of uint8_t HLL_REGISTERS registers pointed by 'max'.
+ *
+ * The HLL may use dense or sparse representation, ErrInvalid is returned
+ * if the sparse representation is corrupted. */
+func (h HLL) Merge(max []byte) error {
+	if h.Encoding() == HLL_DENSE {
+		registers := h.registers()
+		for i := 0; i < HLL_REGISTERS; i++ {
+			if val := denseGetRegister(registers, i); val > max[i] {
+				max[i] = val
+			}
+		}
+		return nil
+	}
+
+	sparse := h.registers()
+	i := 0
+	for p, end := 0, len(sparse); p < end; {
+		if sparseIsZero(sparse[p]) {
+			i += sparseZeroLen(sparse[p])
+			p++
+		} else if sparseIsXZero(sparse[p]) {
+			if p+1 >= end {
+				return ErrInvalid
+			}
+			i += sparseXZeroLen(sparse[p:])
+			p += 2
+		} else {
+			runlen := sparseValLen(sparse[p])
+			regval := uint8(sparseValValue(sparse[p]))
+			if runlen+i > HLL_REGISTERS {
+				break // Overflow.
+			}
+			for ; runlen > 0; runlen-- {
+				if regval > max[i] {
+					max[i] = regval
+				}
+				i++
+			}
+			p++
+		}
+	}
+	if i != HLL_REGISTERS {
+		return ErrInvalid
+	}
+	return nil
+}
+
+/* Set the registers of a dense HLL to the raw registers in max, as filled
+ * by Merge(). */
+func (h HLL) DenseCompress(max []byte) {
+	registers := h.registers()
+	for i := 0; i < HLL_REGISTERS; i++ {
+		denseSetRegister(registers, i, max[i])
+	}
+}
+
+/* Return the value of every register. The HLL must use the dense
+ * representation. */
+func (h HLL) Registers() []uint8 {
+	regs := make([]uint8, HLL_REGISTERS)
+	registers := h.registers()
+	for j := range regs {
+		regs[j] = denseGetRegister(registers, j)
+	}
+	return regs
+}
+
+/* Return a human readable form of the opcodes of a sparse HLL, like
+ * "Z:1000 v:2,1 z:19 v:3,2 Z:16362". */
+func (h HLL) DecodeSparse() string {
+	var decoded strings.Builder
+	sparse := h.registers()
+	for p := 0; p < len(sparse); {
+		if sparseIsZero(sparse[p]) {
+			fmt.Fprintf(&decoded, "z:%d ", sparseZeroLen(sparse[p]))
+			p++
+		} else if sparseIsXZero(sparse[p]) && p+1 < len(sparse) {
+			fmt.Fprintf(&decoded, "Z:%d ", sparseXZeroLen(sparse[p:]))
+			p += 2
+		} else if sparseIsVal(sparse[p]) {
+			fmt.Fprintf(&decoded, "v:%d,%d ", sparseValValue(sparse[p]), sparseValLen(sparse[p]))
+			p++
+		} else {
+			break
+		}
+	}
+	return strings.TrimRight(decoded.String(), " ")
+}
+
+/* This function is the implementation of PFSELFTEST: it checks the register
+ * access of the dense representation, and that the approximation error of
+ * the cardinality is within the expected bounds for both the dense and the
+ * sparse representations, which must agree. */
+func SelfTest() error {
+	bitcounters := make(HLL, HLL_DENSE_SIZE)
+	registers := bitcounters.registers()
+	var bytecounters [HLL_REGISTERS]uint8
+
+	/* Test 1: access registers.
+	 * The test is conceived to test that the different counters of our data
+	 * structure are accessible and that setting their values both result in
+	 * the correct value to be retained and not affect adjacent values. */
+	for j := 0; j < HLL_TEST_CYCLES; j++ {
+		/* Set the HLL counters and an array of unsigned byes of the
+		 * same size to the same set of random values. */
+		for i := 0; i < HLL_REGISTERS; i++ {
+			r := uint8(rand.Intn(HLL_REGISTER_MAX + 1))
+			bytecounters[i] = r
+			denseSetRegister(registers, i, r)
+		}
+		// Check that we are able to retrieve the same values.
+		for i := 0; i < HLL_REGISTERS; i++ {
+			if val := denseGetRegister(registers, i); val != bytecounters[i] {
+				return fmt.Errorf("TESTFAILED Register error, counter %d should be %d but is %d",
+					i, bytecounters[i], val)
+			}
+		}
+	}
+
+	/* Test 2: approximation error.
+	 * The test adds unique elements and check that the estimated value
+	 * is always reasonable bounds.
+	 *
+	 * We check that the error is smaller than a few times than the expected
+	 * standard error, to make it very unlikely for the test to fail because
+	 * of a "bad" run.
+	 *
+	 * The test is performed with both dense and sparse HLLs at the same
+	 * time also verifying that the computed cardinality is the same. */
+	for i := range registers {
+		registers[i] = 0
+	}
+	o := New()
+	relerr := 1.04 / math.Sqrt(HLL_REGISTERS)
+	checkpoint := int64(1)
+	seed := rand.Uint64()
+	ele := make([]byte, 8)
+	for j := int64(1); j <= 10000000; j++ {
+		binary.LittleEndian.PutUint64(ele, uint64(j)^seed)
+		denseAdd(registers, ele)
+		if _, err := o.Add(ele); err != nil {
+			return err
+		}
+		if j != checkpoint {
+			continue
+		}
+
+		// Make sure that for small cardinalities we use sparse encoding.
+		if j < int64(SparseMaxBytes/2) && o.Encoding() != HLL_SPARSE {
+			return errors.New("TESTFAILED sparse encoding not used")
+		}
+
+		// Check that dense and sparse representations agree.
+		dense, _ := bitcounters.Count()
+		if sparse, err := o.Count(); err != nil || dense != sparse {
+			return errors.New("TESTFAILED dense/sparse disagree")
+		}
+
+		// Check error.
+		abserr := checkpoint - int64(dense)
+		maxerr := int64(math.Ceil(relerr * 6 * float64(checkpoint)))
+
+		/* Adjust the max error for very small cardinalities,
+		 * otherwise the test would fail with a lot of false positives. */
+		if j == 10 {
+			maxerr = 1
+		}
+
+		if abserr < 0 {
+			abserr = -abserr
+		}
+		if abserr > maxerr {
+			return fmt.Errorf("TESTFAILED Too big error. card:%d abserr:%d", checkpoint, abserr)
+		}
+		checkpoint *= 10
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package hyperloglog
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("adds 10 millions of elements")
+	}
+	if err := SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	h := New()
+	if !IsValid(h) || h.Encoding() != HLL_SPARSE {
+		t.Fatalf("new HLL is not a valid sparse HLL")
+	}
+	if got := h.DecodeSparse(); got != "Z:16384" {
+		t.Fatalf("new HLL decoded as %q", got)
+	}
+	if card, ok := h.CachedCard(); !ok || card != 0 {
+		t.Fatalf("cached cardinality is (%d, %v), expected (0, true)", card, ok)
+	}
+}
+
+/* Setting the same registers of a sparse and a dense HLL must give the same
+ * registers, whatever the order, the splits and the merges of the opcodes. */
+func TestSparseSet(t *testing.T) {
+	sparse := New()
+	dense := New()
+	if err := dense.ToDense(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		index := rand.Intn(HLL_REGISTERS)
+		count := uint8(rand.Intn(HLL_SPARSE_VAL_MAX_VALUE) + 1)
+		if i%4 == 0 {
+			// Hit adjacent registers to exercise the merge of VAL opcodes.
+			index = 1000 + rand.Intn(8)
+			count = uint8(rand.Intn(3) + 1)
+		}
+		s, err := sparse.Set(index, count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, _ := dense.Set(index, count)
+		if s != d {
+			t.Fatalf("set %d to %d returned %d on sparse and %d on dense", index, count, s, d)
+		}
+	}
+	if sparse.Encoding() != HLL_SPARSE {
+		t.Fatalf("sparse HLL was promoted with %d bytes", len(sparse))
+	}
+
+	sc, err := sparse.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, _ := dense.Count()
+	if sc != dc {
+		t.Fatalf("sparse count %d, dense count %d", sc, dc)
+	}
+	if err := sparse.ToDense(); err != nil {
+		t.Fatal(err)
+	}
+	sr, dr := sparse.Registers(), dense.Registers()
+	for i := range sr {
+		if sr[i] != dr[i] {
+			t.Fatalf("register %d is %d, expected %d", i, sr[i], dr[i])
+		}
+	}
+}
+
+func TestPromotion(t *testing.T) {
+	h := New()
+	// A value not representable by the sparse encoding.
+	if _, err := h.Set(5, HLL_SPARSE_VAL_MAX_VALUE+1); err != nil {
+		t.Fatal(err)
+	}
+	if h.Encoding() != HLL_DENSE || len(h) != HLL_DENSE_SIZE {
+		t.Fatalf("HLL not promoted to dense")
+	}
+	if reg := h.Registers()[5]; reg != HLL_SPARSE_VAL_MAX_VALUE+1 {
+		t.Fatalf("register is %d after promotion", reg)
+	}
+
+	// Growing past SparseMaxBytes.
+	h = New()
+	for i := 0; h.Encoding() == HLL_SPARSE; i++ {
+		if len(h) > SparseMaxBytes {
+			t.Fatalf("sparse HLL has %d bytes", len(h))
+		}
+		h.Add([]byte(fmt.Sprint(i)))
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := New(), New()
+	for i := 0; i < 1000; i++ {
+		a.Add([]byte(fmt.Sprint("a", i)))
+		b.Add([]byte(fmt.Sprint("b", i)))
+	}
+	b.ToDense()
+
+	max := make([]byte, HLL_REGISTERS)
+	if err := a.Merge(max); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Merge(max); err != nil {
+		t.Fatal(err)
+	}
+	if card := CountRegisters(max); card < 1900 || card > 2100 {
+		t.Fatalf("merged cardinality is %d, expected about 2000", card)
+	}
+}
+
+func TestCorrupted(t *testing.T) {
+	h := New()
+	h.Add([]byte("a"))
+
+	// One register more than HLL_REGISTERS.
+	tail := append(HLL{}, h...)
+	tail = append(tail, 0)
+	if _, err := tail.Count(); err != ErrInvalid {
+		t.Fatalf("additional opcode at tail not detected")
+	}
+	if err := tail.ToDense(); err != ErrInvalid {
+		t.Fatalf("additional opcode at tail not detected by ToDense")
+	}
+	if err := tail.Merge(make([]byte, HLL_REGISTERS)); err != ErrInvalid {
+		t.Fatalf("additional opcode at tail not detected by Merge")
+	}
+
+	// Truncated XZERO opcode.
+	truncated := New()[:HLL_HDR_SIZE+1]
+	if _, err := truncated.Count(); err != ErrInvalid {
+		t.Fatalf("truncated HLL not detected")
+	}
+
+	if IsValid([]byte("HYLL")) || IsValid(append([]byte("HYLX"), h[4:]...)) {
+		t.Fatalf("invalid header not detected")
+	}
+}
@@ -2,11 +2,25 @@ package list
 
 import (
 	"container/list"
+	"unsafe"
 
 	"github.com/SteveZhangBit/redigo/rtype"
+	"github.com/SteveZhangBit/redigo/rtype/list/quicklist"
 	"github.com/SteveZhangBit/redigo/rtype/rstring"
 )
 
+const (
+	REDIS_LIST_MAX_LISTPACK_SIZE = -2
+	REDIS_LIST_COMPRESS_DEPTH    = 0
+)
+
+/* The fill factor and the compress depth of the quicklists created by New,
+ * set by list-max-listpack-size and list-compress-depth. */
+var (
+	MaxListpackSize = REDIS_LIST_MAX_LISTPACK_SIZE
+	CompressDepth   = REDIS_LIST_COMPRESS_DEPTH
+)
+
 type LLElement struct {
 	e *list.Element
 }
@@ -145,68 +159,319 @@ func (l *LinkedList) Iterator(head int) rtype.Iterator {
 	return NewIterator(l, head)
 }
 
-func New() rtype.List {
+func (l *LinkedList) IteratorAt(index int, head int) rtype.Iterator {
+	return NewIteratorAt(l, index, head)
+}
+
+func (l *LinkedList) DeleteRange(index int, count int) {
+	e := l.Index(index)
+	for ; count > 0 && e != nil; count-- {
+		next := e.Next()
+		l.Remove(e)
+		e = next
+	}
+}
+
+func (l *LinkedList) MemoryUsage(samples int) int64 {
+	var elesize int64
+	var count int
+	for e := l.l.Front(); e != nil && (samples == 0 || count < samples); e = e.Next() {
+		elesize += int64(unsafe.Sizeof(*e)) + e.Value.(rtype.String).MemoryUsage(0)
+		count++
+	}
+	size := int64(unsafe.Sizeof(*l) + unsafe.Sizeof(*l.l))
+	if count > 0 {
+		size += int64(float64(elesize) / float64(count) * float64(l.l.Len()))
+	}
+	return size
+}
+
+func NewLinkedList() rtype.List {
 	l := list.New()
 	l.Init()
 	return &LinkedList{l: l}
 }
 
-type ListIterator struct {
-	l    rtype.List
-	node rtype.ListElement
-	head int
+/*-----------------------------------------------------------------------------
+ * Quicklist-backed list API
+ *----------------------------------------------------------------------------*/
+
+/* QLElement is an element of a QuickList. Like in Redis, an element is only
+ * valid until the list is modified: the element removed from the list by
+ * PopFront or PopBack is detached, and only holds the value. */
+type QLElement struct {
+	l   *QuickList
+	e   *quicklist.Entry
+	val rtype.String
 }
 
-func (l *ListIterator) HasNext() bool {
-	if l.node == nil {
-		if l.head == rtype.REDIS_LIST_HEAD {
-			return l.l.Front() != nil
-		} else {
-			return l.l.Back() != nil
-		}
+func (q *QLElement) Prev() rtype.ListElement {
+	if e := q.e.Prev(); e != nil {
+		return &QLElement{l: q.l, e: e}
 	}
+	return nil
+}
 
-	if l.head == rtype.REDIS_LIST_HEAD {
-		return l.node.Next() != nil
-	} else {
-		return l.node.Prev() != nil
+func (q *QLElement) Next() rtype.ListElement {
+	if e := q.e.Next(); e != nil {
+		return &QLElement{l: q.l, e: e}
 	}
+	return nil
 }
 
-func (l *ListIterator) Next() interface{} {
-	if l.node == nil {
-		if l.head == rtype.REDIS_LIST_HEAD {
-			l.node = l.l.Front()
-		} else {
-			l.node = l.l.Back()
-		}
+func (q *QLElement) Value() rtype.String {
+	if q.val == nil {
+		q.val = q.e.GetString()
+	}
+	return q.val
+}
+
+func (q *QLElement) SetValue(v rtype.String) {
+	q.l.ql.Replace(q.e, v.Bytes())
+	q.val = v
+}
+
+type QuickList struct {
+	ql *quicklist.Quicklist
+}
+
+func (l *QuickList) element(e *quicklist.Entry) rtype.ListElement {
+	if e != nil {
+		return &QLElement{l: l, e: e}
+	}
+	return nil
+}
+
+func (l *QuickList) Front() rtype.ListElement {
+	return l.element(l.ql.Index(0))
+}
+
+func (l *QuickList) Back() rtype.ListElement {
+	return l.element(l.ql.Index(-1))
+}
+
+func (l *QuickList) InsertAfter(v rtype.String, at rtype.ListElement) {
+	l.ql.InsertAfter(at.(*QLElement).e, v.Bytes())
+}
+
+func (l *QuickList) InsertBefore(v rtype.String, at rtype.ListElement) {
+	l.ql.InsertBefore(at.(*QLElement).e, v.Bytes())
+}
+
+func (l *QuickList) Len() int {
+	return l.ql.Count()
+}
+
+/* Elements are not linked one by one in a quicklist, so moving an element
+ * means removing it and inserting its value again. The index of at is taken
+ * before the removal, since the removal invalidates at. */
+func (l *QuickList) move(e, at rtype.ListElement, after bool) {
+	from, to := e.(*QLElement).e.Index(), at.(*QLElement).e.Index()
+	if from == to {
+		return
+	}
+	v := l.Remove(e)
+	if from < to {
+		to--
+	}
+	if after {
+		l.ql.InsertAfter(l.ql.Index(to), v.Bytes())
 	} else {
-		if l.head == rtype.REDIS_LIST_HEAD {
-			l.node = l.node.Next()
-		} else {
-			l.node = l.node.Prev()
+		l.ql.InsertBefore(l.ql.Index(to), v.Bytes())
+	}
+}
+
+func (l *QuickList) MoveAfter(e, at rtype.ListElement) {
+	l.move(e, at, true)
+}
+
+func (l *QuickList) MoveBefore(e, at rtype.ListElement) {
+	l.move(e, at, false)
+}
+
+func (l *QuickList) MoveToFront(e rtype.ListElement) {
+	l.PushFront(l.Remove(e))
+}
+
+func (l *QuickList) MoveToBack(e rtype.ListElement) {
+	l.PushBack(l.Remove(e))
+}
+
+func (l *QuickList) PushBack(v rtype.String) {
+	l.ql.PushTail(v.Bytes())
+}
+
+func (l *QuickList) PushFront(v rtype.String) {
+	l.ql.PushHead(v.Bytes())
+}
+
+func (l *QuickList) Remove(e rtype.ListElement) rtype.String {
+	v := e.Value()
+	l.ql.DelEntry(e.(*QLElement).e, true)
+	return v
+}
+
+// Return the element with the value.
+func (l *QuickList) SearchKey(v rtype.String) rtype.ListElement {
+	b := v.Bytes()
+	for e := l.ql.Index(0); e != nil; e = e.Next() {
+		if e.Compare(b) {
+			return l.element(e)
 		}
 	}
+	return nil
+}
 
-	return l.node
+/* Return the element at that index. Whole nodes are skipped when seeking the
+ * element, so this is O(N/fill) instead of O(N). */
+func (l *QuickList) Index(n int) rtype.ListElement {
+	return l.element(l.ql.Index(n))
 }
 
-func (l *ListIterator) Remove() {
-	if l.node == nil {
+// Pop the tail of the list and push it to the front.
+func (l *QuickList) Rotate() {
+	if l.ql.Count() <= 1 {
+		return
+	}
+	v, _ := l.ql.Pop(quicklist.QUICKLIST_TAIL)
+	l.ql.PushHead(v)
+}
+
+func (l *QuickList) pop(where int) rtype.ListElement {
+	if v, ok := l.ql.Pop(where); ok {
+		return &QLElement{l: l, val: rstring.New(v)}
+	}
+	return nil
+}
+
+func (l *QuickList) PopFront() rtype.ListElement {
+	return l.pop(quicklist.QUICKLIST_HEAD)
+}
+
+func (l *QuickList) PopBack() rtype.ListElement {
+	return l.pop(quicklist.QUICKLIST_TAIL)
+}
+
+func (l *QuickList) Iterator(head int) rtype.Iterator {
+	if head == rtype.REDIS_LIST_HEAD {
+		return l.IteratorAt(0, head)
+	}
+	return l.IteratorAt(-1, head)
+}
+
+/* The element at index is reached skipping whole nodes, then the iteration
+ * goes on from there without seeking again. */
+func (l *QuickList) IteratorAt(index int, head int) rtype.Iterator {
+	return &QuickListIterator{l: l, index: index, head: head}
+}
+
+/* Whole nodes in the range are dropped at once, instead of deleting their
+ * elements one by one. */
+func (l *QuickList) DeleteRange(index int, count int) {
+	l.ql.DelRange(index, count)
+}
+
+func (l *QuickList) MemoryUsage(samples int) int64 {
+	return int64(unsafe.Sizeof(*l)) + l.ql.MemoryUsage(samples)
+}
+
+func New() rtype.List {
+	return &QuickList{ql: quicklist.New(MaxListpackSize, CompressDepth)}
+}
+
+/* QuickListIterator removes elements through the quicklist, so that the
+ * iteration continues from the element next to the removed one. */
+type QuickListIterator struct {
+	l       *QuickList
+	index   int // the index of the first returned element
+	head    int
+	started bool
+	cur     *quicklist.Entry // the last returned element
+	next    *quicklist.Entry // the element returned by the next call to Next
+}
+
+func (l *QuickListIterator) start() {
+	if !l.started {
+		l.started = true
+		l.next = l.l.ql.Index(l.index)
+	}
+}
+
+func (l *QuickListIterator) HasNext() bool {
+	l.start()
+	return l.next != nil
+}
+
+func (l *QuickListIterator) Next() interface{} {
+	l.start()
+	if l.cur = l.next; l.cur == nil {
+		return nil
+	}
+	if l.head == rtype.REDIS_LIST_HEAD {
+		l.next = l.cur.Next()
+	} else {
+		l.next = l.cur.Prev()
+	}
+	return &QLElement{l: l.l, e: l.cur}
+}
+
+func (l *QuickListIterator) Remove() {
+	if l.cur == nil {
 		return
 	}
+	l.next = l.l.ql.DelEntry(l.cur, l.head == rtype.REDIS_LIST_HEAD)
+	l.cur = nil
+}
+
+type ListIterator struct {
+	l       rtype.List
+	index   int // the index of the first returned element
+	head    int
+	started bool
+	cur     rtype.ListElement // the last returned element
+	next    rtype.ListElement // the element returned by the next call to Next
+}
+
+func (l *ListIterator) start() {
+	if !l.started {
+		l.started = true
+		l.next = l.l.Index(l.index)
+	}
+}
 
-	var next rtype.ListElement
+func (l *ListIterator) HasNext() bool {
+	l.start()
+	return l.next != nil
+}
 
+func (l *ListIterator) Next() interface{} {
+	l.start()
+	if l.cur = l.next; l.cur == nil {
+		return nil
+	}
 	if l.head == rtype.REDIS_LIST_HEAD {
-		next = l.node.Next()
+		l.next = l.cur.Next()
 	} else {
-		next = l.node.Prev()
+		l.next = l.cur.Prev()
 	}
-	l.l.Remove(l.node)
-	l.node = next
+	return l.cur
+}
+
+func (l *ListIterator) Remove() {
+	if l.cur == nil {
+		return
+	}
+	l.l.Remove(l.cur)
+	l.cur = nil
 }
 
 func NewIterator(l rtype.List, head int) rtype.Iterator {
-	return &ListIterator{l: l, head: head}
+	if head == rtype.REDIS_LIST_HEAD {
+		return NewIteratorAt(l, 0, head)
+	}
+	return NewIteratorAt(l, -1, head)
+}
+
+func NewIteratorAt(l rtype.List, index int, head int) rtype.Iterator {
+	return &ListIterator{l: l, index: index, head: head}
 }
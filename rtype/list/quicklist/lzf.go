@@ -0,0 +1,215 @@
+package quicklist
+
+import "sync"
+
+/* This is a Go translation of LZF, the very small data compression library
+ * by Marc Alexander Lehmann used by Redis to compress the interior nodes of
+ * quicklists. The output is compatible with lzf_compress() and
+ * lzf_decompress() as configured in Redis (HLOG 16, VERY_FAST). */
+
+const (
+	lzfHLog  = 16
+	lzfHSize = 1 << lzfHLog
+
+	lzfMaxLit = 1 << 5
+	lzfMaxOff = 1 << 13
+	lzfMaxRef = (1 << 8) + (1 << 3)
+)
+
+/* The hash tables are reused across calls. Like in Redis, where the table is
+ * not initialized (INIT_HTAB is 0), stale slots are harmless since every
+ * match is verified against the input. */
+var lzfHTabPool = sync.Pool{
+	New: func() interface{} { return new([lzfHSize]int) },
+}
+
+func lzfFirst(in []byte, ip int) uint32 {
+	return uint32(in[ip])<<8 | uint32(in[ip+1])
+}
+
+func lzfNext(v uint32, in []byte, ip int) uint32 {
+	return v<<8 | uint32(in[ip+2])
+}
+
+func lzfIdx(h uint32) uint32 {
+	return ((h >> (3*8 - lzfHLog)) - h*5) & (lzfHSize - 1)
+}
+
+/* Compress in into out, that should be at most as large as in since there
+ * is no point in keeping an output larger than the input. Return the number
+ * of bytes written to out, or 0 if the compressed data does not fit out. */
+func lzfCompress(in []byte, out []byte) int {
+	inLen, outLen := len(in), len(out)
+	if inLen == 0 || outLen == 0 {
+		return 0
+	}
+
+	/* The hash table stores positions in the input plus one, so that the
+	 * zero value means an empty slot. */
+	htab := lzfHTabPool.Get().(*[lzfHSize]int)
+	defer lzfHTabPool.Put(htab)
+	ip, op := 0, 0
+	lit := 0
+	op++ // start run
+
+	var hval uint32
+	if inLen > 2 {
+		hval = lzfFirst(in, ip)
+	}
+	for ip < inLen-2 {
+		hval = lzfNext(hval, in, ip)
+		slot := lzfIdx(hval)
+		ref := htab[slot] - 1
+		htab[slot] = ip + 1
+
+		if off := ip - ref - 1; ref > 0 && ref < ip && off < lzfMaxOff &&
+			in[ref+2] == in[ip+2] && in[ref] == in[ip] && in[ref+1] == in[ip+1] {
+			// match found at in[ref]
+			length := 2
+			maxlen := inLen - ip - length
+			if maxlen > lzfMaxRef {
+				maxlen = lzfMaxRef
+			}
+
+			if op+3+1 >= outLen { // first a faster conservative test
+				if lit == 0 && op-1+3+1 >= outLen || lit != 0 && op+3+1 >= outLen {
+					return 0 // second the exact but rare test
+				}
+			}
+
+			out[op-lit-1] = byte(lit - 1) // stop run
+			if lit == 0 {
+				op-- // undo run if length is zero
+			}
+
+			for {
+				length++
+				if length >= maxlen || in[ref+length] != in[ip+length] {
+					break
+				}
+			}
+
+			length -= 2 // length is now #octets - 1
+			ip++
+
+			if length < 7 {
+				out[op] = byte(off>>8) + byte(length<<5)
+				op++
+			} else {
+				out[op] = byte(off>>8) + 7<<5
+				out[op+1] = byte(length - 7)
+				op += 2
+			}
+			out[op] = byte(off)
+			op++
+
+			lit = 0
+			op++ // start run
+
+			ip += length + 1
+			if ip >= inLen-2 {
+				break
+			}
+
+			ip -= 2
+			hval = lzfFirst(in, ip)
+
+			hval = lzfNext(hval, in, ip)
+			htab[lzfIdx(hval)] = ip + 1
+			ip++
+
+			hval = lzfNext(hval, in, ip)
+			htab[lzfIdx(hval)] = ip + 1
+			ip++
+		} else {
+			// one more literal byte we must copy
+			if op >= outLen {
+				return 0
+			}
+			lit++
+			out[op] = in[ip]
+			op++
+			ip++
+
+			if lit == lzfMaxLit {
+				out[op-lit-1] = byte(lit - 1) // stop run
+				lit = 0
+				op++ // start run
+			}
+		}
+	}
+
+	if op+3 > outLen { // at most 3 bytes can be missing here
+		return 0
+	}
+
+	for ip < inLen {
+		lit++
+		out[op] = in[ip]
+		op++
+		ip++
+
+		if lit == lzfMaxLit {
+			out[op-lit-1] = byte(lit - 1) // stop run
+			lit = 0
+			op++ // start run
+		}
+	}
+
+	out[op-lit-1] = byte(lit - 1) // end run
+	if lit == 0 {
+		op-- // undo run if length is zero
+	}
+	return op
+}
+
+/* Decompress in into out, that must be large enough to hold the original
+ * data. Return the number of bytes written to out, or 0 if the compressed
+ * data is corrupted or out is too small. */
+func lzfDecompress(in []byte, out []byte) int {
+	inLen, outLen := len(in), len(out)
+	ip, op := 0, 0
+
+	for ip < inLen {
+		ctrl := int(in[ip])
+		ip++
+
+		if ctrl < 1<<5 { // literal run
+			ctrl++
+			if op+ctrl > outLen || ip+ctrl > inLen {
+				return 0
+			}
+			copy(out[op:], in[ip:ip+ctrl])
+			op += ctrl
+			ip += ctrl
+		} else { // back reference
+			length := ctrl >> 5
+			ref := op - (ctrl&0x1f)<<8 - 1
+
+			if ip >= inLen {
+				return 0
+			}
+			if length == 7 {
+				length += int(in[ip])
+				ip++
+				if ip >= inLen {
+					return 0
+				}
+			}
+			ref -= int(in[ip])
+			ip++
+
+			if op+length+2 > outLen || ref < 0 {
+				return 0
+			}
+
+			// The reference may overlap the output, copy one byte at a time.
+			for length += 2; length > 0; length-- {
+				out[op] = out[ref]
+				op++
+				ref++
+			}
+		}
+	}
+	return op
+}
@@ -0,0 +1,675 @@
+package quicklist
+
+import (
+	"unsafe"
+
+	"github.com/SteveZhangBit/redigo/rtype"
+	"github.com/SteveZhangBit/redigo/rtype/listpack"
+)
+
+/* quicklist is a Go translation of quicklist.c in Redis.
+ *
+ * A quicklist is a doubly linked list of listpacks: every node holds a
+ * packed block of elements, so the per-element overhead of a linked list is
+ * paid only once per node. Nodes deeper than compress nodes from both the
+ * ends of the list are compressed with LZF, since in most workloads only the
+ * elements near the head and the tail are accessed. */
+
+/* Optimization levels for size-based filling. Note that the largest possible
+ * limit is 64k, so even if each record takes just one byte, it still won't
+ * overflow the 16 bit count field of the listpack header. */
+var optimizationLevel = []int{4096, 8192, 16384, 32768, 65536}
+
+const (
+	// Maximum size in bytes of any multi-element listpack with a count limit.
+	SIZE_SAFETY_LIMIT = 8192
+
+	// Maximum estimate of the listpack entry overhead.
+	SIZE_ESTIMATE_OVERHEAD = 8
+
+	// Minimum listpack size in bytes for attempting compression.
+	MIN_COMPRESS_BYTES = 48
+
+	/* Minimum size reduction in bytes to store compressed quicklistNode data.
+	 * This also prevents us from storing compression if the compression
+	 * resulted in a larger size than the original data. */
+	MIN_COMPRESS_IMPROVE = 8
+
+	FILL_MAX     = 1<<15 - 1
+	COMPRESS_MAX = 1<<16 - 1
+)
+
+const (
+	QUICKLIST_HEAD = 0
+	QUICKLIST_TAIL = -1
+)
+
+/* Node is a single packed block of the quicklist. When the node is
+ * compressed lp is nil and compressed holds the LZF data, sz is always the
+ * size of the uncompressed listpack. */
+type Node struct {
+	prev, next *Node
+	lp         *listpack.Listpack
+	compressed []byte
+	sz         int
+	count      int
+}
+
+func (n *Node) IsCompressed() bool {
+	return n.lp == nil
+}
+
+/* Return the listpack of the node for reading. If the node is compressed
+ * the data is decompressed in a new listpack, and the node is left as it
+ * is. */
+func (n *Node) listpack() *listpack.Listpack {
+	if n.lp != nil {
+		return n.lp
+	}
+	buf := make([]byte, n.sz)
+	if lzfDecompress(n.compressed, buf) != n.sz {
+		panic("quicklist: corrupted compressed node")
+	}
+	return listpack.NewFromBytes(buf)
+}
+
+// Decompress the node in place, so that it can be modified.
+func (n *Node) decompress() {
+	if n != nil && n.lp == nil {
+		n.lp = n.listpack()
+		n.compressed = nil
+	}
+}
+
+/* Compress the node in place. Nothing is done if the node is too small or
+ * the compression does not save at least MIN_COMPRESS_IMPROVE bytes. */
+func (n *Node) compress() {
+	if n == nil || n.lp == nil || n.sz < MIN_COMPRESS_BYTES {
+		return
+	}
+	buf := make([]byte, n.sz)
+	sz := lzfCompress(n.lp.Raw(), buf)
+	if sz == 0 || sz+MIN_COMPRESS_IMPROVE >= n.sz {
+		return
+	}
+	n.compressed = append([]byte(nil), buf[:sz]...)
+	n.lp = nil
+}
+
+func (n *Node) updateSz() {
+	n.sz = n.lp.Bytes()
+}
+
+func (n *Node) memoryUsage() int64 {
+	if n.lp == nil {
+		return int64(unsafe.Sizeof(*n)) + int64(cap(n.compressed))
+	}
+	return int64(unsafe.Sizeof(*n)) + int64(n.lp.BlobSize())
+}
+
+type Quicklist struct {
+	head, tail *Node
+	count      int // total count of all entries in all listpacks
+	len        int // number of quicklist nodes
+	fill       int // fill factor for individual nodes
+	compress   int // depth of end nodes not to compress; 0 = off
+}
+
+/* Create a new quicklist. The fill factor is the same of the
+ * list-max-listpack-size option: positive values are the maximum number of
+ * elements of every node, negative values from -1 to -5 limit the size of
+ * the nodes to 4, 8, 16, 32 and 64 kb. compress is the same of the
+ * list-compress-depth option. */
+func New(fill, compress int) *Quicklist {
+	if fill > FILL_MAX {
+		fill = FILL_MAX
+	} else if fill < -len(optimizationLevel) {
+		fill = -len(optimizationLevel)
+	}
+	if compress > COMPRESS_MAX {
+		compress = COMPRESS_MAX
+	} else if compress < 0 {
+		compress = 0
+	}
+	return &Quicklist{fill: fill, compress: compress}
+}
+
+// Return the number of elements in the quicklist.
+func (ql *Quicklist) Count() int {
+	return ql.count
+}
+
+// Return the number of nodes of the quicklist.
+func (ql *Quicklist) Len() int {
+	return ql.len
+}
+
+/* Return the memory used by the quicklist. Only up to samples nodes are
+ * inspected, the size of the others is extrapolated from their average
+ * size. If samples is 0 all the nodes are inspected. */
+func (ql *Quicklist) MemoryUsage(samples int) int64 {
+	var nodesize int64
+	var count int
+	for n := ql.head; n != nil && (samples == 0 || count < samples); n = n.next {
+		nodesize += n.memoryUsage()
+		count++
+	}
+	size := int64(unsafe.Sizeof(*ql))
+	if count > 0 {
+		size += int64(float64(nodesize) / float64(count) * float64(ql.len))
+	}
+	return size
+}
+
+/* Force the node nodes from both the ends of the list to be uncompressed,
+ * and compress node (if not nil) and the first nodes past the compress
+ * depth. */
+func (ql *Quicklist) compressAround(node *Node) {
+	if ql.len == 0 {
+		return
+	}
+
+	/* If length is less than our compress depth (from both sides),
+	 * we can't compress anything. */
+	if ql.compress == 0 || ql.len < ql.compress*2 {
+		return
+	}
+
+	/* Iterate until we reach compress depth for both sides of the list.
+	 * Note: because we do length checks at the *top* of this function,
+	 *       we can skip explicit null checks below. Everything exists. */
+	forward, reverse := ql.head, ql.tail
+	inDepth := false
+	for depth := 0; depth < ql.compress; depth++ {
+		forward.decompress()
+		reverse.decompress()
+		if forward == node || reverse == node {
+			inDepth = true
+		}
+
+		/* We passed into compress depth of opposite side of the quicklist
+		 * so there's no need to compress anything and we can exit. */
+		if forward == reverse || forward.next == reverse {
+			return
+		}
+		forward, reverse = forward.next, reverse.prev
+	}
+
+	if !inDepth {
+		node.compress()
+	}
+
+	// At this point, forward and reverse are one node beyond depth.
+	forward.compress()
+	reverse.compress()
+}
+
+/* Insert newNode after or before oldNode. If oldNode is nil, the list must
+ * be empty and newNode becomes both head and tail. */
+func (ql *Quicklist) insertNode(oldNode, newNode *Node, after bool) {
+	if after {
+		newNode.prev = oldNode
+		if oldNode != nil {
+			newNode.next = oldNode.next
+			if oldNode.next != nil {
+				oldNode.next.prev = newNode
+			}
+			oldNode.next = newNode
+		}
+		if ql.tail == oldNode {
+			ql.tail = newNode
+		}
+	} else {
+		newNode.next = oldNode
+		if oldNode != nil {
+			newNode.prev = oldNode.prev
+			if oldNode.prev != nil {
+				oldNode.prev.next = newNode
+			}
+			oldNode.prev = newNode
+		}
+		if ql.head == oldNode {
+			ql.head = newNode
+		}
+	}
+	// If this insert creates the only element so far, initialize head/tail.
+	if ql.len == 0 {
+		ql.head, ql.tail = newNode, newNode
+	}
+	ql.len++
+
+	// Update the compression of the nodes around the new one.
+	ql.compressAround(newNode)
+}
+
+func (ql *Quicklist) delNode(node *Node) {
+	if node.next != nil {
+		node.next.prev = node.prev
+	}
+	if node.prev != nil {
+		node.prev.next = node.next
+	}
+	if node == ql.tail {
+		ql.tail = node.prev
+	}
+	if node == ql.head {
+		ql.head = node.next
+	}
+	ql.len--
+	ql.count -= node.count
+
+	/* If we deleted a node within our compress depth, we now have compressed
+	 * nodes needing to be decompressed. */
+	ql.compressAround(nil)
+}
+
+// Return true if an element of sz bytes can be added to the node.
+func (ql *Quicklist) allowInsert(node *Node, sz int) bool {
+	if node == nil {
+		return false
+	}
+	newSz := node.sz + sz + SIZE_ESTIMATE_OVERHEAD
+	if ql.fill >= 0 {
+		/* Ensure that the node does not exceed the safety limit, and that
+		 * it has less elements than the fill factor. */
+		return newSz <= SIZE_SAFETY_LIMIT && node.count < ql.fill
+	}
+	return newSz <= optimizationLevel[-ql.fill-1]
+}
+
+func newNode() *Node {
+	n := &Node{lp: listpack.New()}
+	n.updateSz()
+	return n
+}
+
+/* Add a new entry to the head or the tail of the quicklist. Return true if
+ * a new node was created. */
+func (ql *Quicklist) Push(value []byte, where int) bool {
+	if where == QUICKLIST_HEAD {
+		return ql.PushHead(value)
+	}
+	return ql.PushTail(value)
+}
+
+/* Add a new entry to the head node of the quicklist. Return true if a new
+ * head node was created. */
+func (ql *Quicklist) PushHead(value []byte) bool {
+	created := false
+	if ql.allowInsert(ql.head, len(value)) {
+		ql.head.decompress()
+		ql.head.lp.Prepend(value)
+		ql.head.updateSz()
+	} else {
+		n := newNode()
+		n.lp.Prepend(value)
+		n.updateSz()
+		ql.insertNode(ql.head, n, false)
+		created = true
+	}
+	ql.count++
+	ql.head.count++
+	return created
+}
+
+/* Add a new entry to the tail node of the quicklist. Return true if a new
+ * tail node was created. */
+func (ql *Quicklist) PushTail(value []byte) bool {
+	created := false
+	if ql.allowInsert(ql.tail, len(value)) {
+		ql.tail.decompress()
+		ql.tail.lp.Append(value)
+		ql.tail.updateSz()
+	} else {
+		n := newNode()
+		n.lp.Append(value)
+		n.updateSz()
+		ql.insertNode(ql.tail, n, true)
+		created = true
+	}
+	ql.count++
+	ql.tail.count++
+	return created
+}
+
+/* Entry is the position of an element inside the quicklist. Entries are
+ * invalidated by any modification of the quicklist, except the ones returned
+ * by the modification itself. */
+type Entry struct {
+	ql     *Quicklist
+	node   *Node
+	lp     *listpack.Listpack // the listpack of node, maybe decompressed
+	p      int                // position of the element in lp
+	offset int                // index of the element inside node
+}
+
+/* Return the element. Integer encoded elements are returned as integers,
+ * with isInt set. */
+func (e *Entry) Get() (s []byte, v int64, isInt bool) {
+	return e.lp.Get(e.p)
+}
+
+// Return a copy of the element as bytes.
+func (e *Entry) Bytes() []byte {
+	return e.lp.GetBytes(e.p)
+}
+
+// Return a copy of the element as a String object.
+func (e *Entry) GetString() rtype.String {
+	return e.lp.GetString(e.p)
+}
+
+// Return the zero-based index of the element in the quicklist.
+func (e *Entry) Index() int {
+	index := e.offset
+	for n := e.node.prev; n != nil; n = n.prev {
+		index += n.count
+	}
+	return index
+}
+
+func (e *Entry) Compare(s []byte) bool {
+	return e.lp.Compare(e.p, s)
+}
+
+func (ql *Quicklist) nodeEntry(node *Node, offset int) *Entry {
+	if node == nil {
+		return nil
+	}
+	lp := node.listpack()
+	return &Entry{ql: ql, node: node, lp: lp, p: lp.Seek(offset), offset: offset}
+}
+
+// Return the entry after e, or nil if e is the last one.
+func (e *Entry) Next() *Entry {
+	if p := e.lp.Next(e.p); p != -1 {
+		return &Entry{ql: e.ql, node: e.node, lp: e.lp, p: p, offset: e.offset + 1}
+	}
+	return e.ql.nodeEntry(e.node.next, 0)
+}
+
+// Return the entry before e, or nil if e is the first one.
+func (e *Entry) Prev() *Entry {
+	if p := e.lp.Prev(e.p); p != -1 {
+		return &Entry{ql: e.ql, node: e.node, lp: e.lp, p: p, offset: e.offset - 1}
+	}
+	if prev := e.node.prev; prev != nil {
+		return e.ql.nodeEntry(prev, prev.count-1)
+	}
+	return nil
+}
+
+/* Return the entry at the specified zero-based index, where 0 is the head,
+ * 1 is the element next to head and so on. Negative integers are used in
+ * order to count from the tail, -1 is the last element, -2 the penultimate
+ * and so on. If the index is out of range nil is returned. */
+func (ql *Quicklist) Index(idx int) *Entry {
+	forward := idx >= 0
+	index := idx
+	if !forward {
+		index = -idx - 1
+	}
+	if index >= ql.count {
+		return nil
+	}
+
+	var n *Node
+	var accum int
+	if forward {
+		n = ql.head
+	} else {
+		n = ql.tail
+	}
+	for n != nil {
+		if accum+n.count > index {
+			break
+		}
+		accum += n.count
+		if forward {
+			n = n.next
+		} else {
+			n = n.prev
+		}
+	}
+	if n == nil {
+		return nil
+	}
+
+	offset := index - accum
+	if !forward {
+		offset = n.count - 1 - offset
+	}
+	return ql.nodeEntry(n, offset)
+}
+
+/* Split node into two parts, node keeps the first offset elements and the
+ * new node, inserted after node, gets the others. */
+func (ql *Quicklist) splitNode(node *Node, offset int) *Node {
+	node.decompress()
+	left, right := listpack.New(), listpack.New()
+	i := 0
+	for p := node.lp.First(); p != -1; p = node.lp.Next(p) {
+		if i < offset {
+			left.Append(node.lp.GetBytes(p))
+		} else {
+			right.Append(node.lp.GetBytes(p))
+		}
+		i++
+	}
+
+	n := &Node{lp: right, count: node.count - offset}
+	n.updateSz()
+	node.lp, node.count = left, offset
+	node.updateSz()
+	ql.insertNode(node, n, true)
+	ql.compressAround(node)
+	return n
+}
+
+/* Insert a new entry before or after the existing entry e.
+ *
+ * If after is true, the new value is inserted after e, otherwise the new
+ * value is inserted before e. */
+func (ql *Quicklist) insert(e *Entry, value []byte, after bool) {
+	node := e.node
+	sz := len(value)
+	full := !ql.allowInsert(node, sz)
+	atTail := after && e.offset == node.count-1
+	atHead := !after && e.offset == 0
+
+	switch {
+	case !full:
+		// The node has room, insert the element directly.
+		node.decompress()
+		if after {
+			node.lp.Insert(value, e.p, listpack.LP_AFTER)
+		} else {
+			node.lp.Insert(value, e.p, listpack.LP_BEFORE)
+		}
+		node.updateSz()
+		node.count++
+		ql.compressAround(node)
+
+	case atTail && ql.allowInsert(node.next, sz):
+		// Insert at the head of the next node.
+		next := node.next
+		next.decompress()
+		next.lp.Prepend(value)
+		next.updateSz()
+		next.count++
+		ql.compressAround(next)
+
+	case atHead && ql.allowInsert(node.prev, sz):
+		// Insert at the tail of the previous node.
+		prev := node.prev
+		prev.decompress()
+		prev.lp.Append(value)
+		prev.updateSz()
+		prev.count++
+		ql.compressAround(prev)
+
+	case atTail || atHead:
+		/* The neighbors are full too, or they do not exist: create a new
+		 * node with the element between them. */
+		n := newNode()
+		n.lp.Append(value)
+		n.updateSz()
+		n.count++
+		ql.insertNode(node, n, after)
+
+	default:
+		/* The node is full and we need to insert in the middle of it: split
+		 * the node where the element should go and add the element to the
+		 * first part if there is room, to the second otherwise. */
+		offset := e.offset
+		if after {
+			offset++
+		}
+		right := ql.splitNode(node, offset)
+		switch {
+		case ql.allowInsert(node, sz):
+			node.decompress()
+			node.lp.Append(value)
+			node.updateSz()
+			node.count++
+			ql.compressAround(node)
+		case ql.allowInsert(right, sz):
+			right.decompress()
+			right.lp.Prepend(value)
+			right.updateSz()
+			right.count++
+			ql.compressAround(right)
+		default:
+			n := newNode()
+			n.lp.Append(value)
+			n.updateSz()
+			n.count++
+			ql.insertNode(node, n, true)
+		}
+	}
+	ql.count++
+}
+
+func (ql *Quicklist) InsertBefore(e *Entry, value []byte) {
+	ql.insert(e, value, false)
+}
+
+func (ql *Quicklist) InsertAfter(e *Entry, value []byte) {
+	ql.insert(e, value, true)
+}
+
+// Replace the element of entry e with value.
+func (ql *Quicklist) Replace(e *Entry, value []byte) {
+	node := e.node
+	node.decompress()
+	node.lp.Replace(e.p, value)
+	node.updateSz()
+	ql.compressAround(node)
+}
+
+/* Delete the element of entry e. Return the entry next to the deleted one,
+ * in the direction of the head if forward is false, so that an iteration
+ * can continue after the deletion. */
+func (ql *Quicklist) DelEntry(e *Entry, forward bool) *Entry {
+	node := e.node
+	prev, next := node.prev, node.next
+
+	node.decompress()
+	lp := node.lp
+	pp := lp.Prev(e.p)
+	np := lp.Delete(e.p)
+	node.updateSz()
+	node.count--
+	ql.count--
+
+	if node.count == 0 {
+		ql.delNode(node)
+		node = nil
+	} else {
+		ql.compressAround(node)
+	}
+
+	/* The node may have been compressed again, but lp is still a valid
+	 * copy of its elements. */
+	if forward {
+		if node != nil && np != -1 {
+			return &Entry{ql: ql, node: node, lp: lp, p: np, offset: e.offset}
+		}
+		return ql.nodeEntry(next, 0)
+	}
+	if node != nil && pp != -1 {
+		return &Entry{ql: ql, node: node, lp: lp, p: pp, offset: e.offset - 1}
+	}
+	if prev != nil {
+		return ql.nodeEntry(prev, prev.count-1)
+	}
+	return nil
+}
+
+/* Delete count elements starting at the zero-based index start, negative
+ * indexes count from the tail. The nodes entirely inside the range are
+ * unlinked without touching their listpacks. Return the number of deleted
+ * elements. */
+func (ql *Quicklist) DelRange(start, count int) int {
+	if count <= 0 {
+		return 0
+	}
+
+	/* Limit the range to the elements after start, -1 is the last element
+	 * so there are only -start elements from a negative start. */
+	extent := count
+	if start >= 0 && extent > ql.count-start {
+		extent = ql.count - start
+	} else if start < 0 && extent > -start {
+		extent = -start
+	}
+
+	e := ql.Index(start)
+	if e == nil {
+		return 0
+	}
+
+	node, offset := e.node, e.offset
+	deleted := 0
+	for extent > 0 {
+		next := node.next
+
+		del := node.count - offset
+		if del > extent {
+			del = extent
+		}
+		if offset == 0 && del == node.count {
+			// The whole node is in the range, unlink it.
+			ql.delNode(node)
+		} else {
+			node.decompress()
+			node.lp.DeleteRange(node.lp.Seek(offset), del)
+			node.updateSz()
+			node.count -= del
+			ql.count -= del
+			ql.compressAround(node)
+		}
+
+		extent -= del
+		deleted += del
+		node, offset = next, 0
+	}
+	return deleted
+}
+
+/* Delete the element at the head or the tail of the quicklist and return a
+ * copy of it. Return false if the quicklist is empty. */
+func (ql *Quicklist) Pop(where int) ([]byte, bool) {
+	var e *Entry
+	if where == QUICKLIST_HEAD {
+		e = ql.Index(0)
+	} else {
+		e = ql.Index(-1)
+	}
+	if e == nil {
+		return nil, false
+	}
+	value := e.Bytes()
+	ql.DelEntry(e, where == QUICKLIST_HEAD)
+	return value, true
+}
@@ -0,0 +1,253 @@
+package quicklist
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func check(t *testing.T, ql *Quicklist, expected []string) {
+	if ql.Count() != len(expected) {
+		t.Fatalf("count is %d, expected %d", ql.Count(), len(expected))
+	}
+	i := 0
+	for e := ql.Index(0); e != nil; e = e.Next() {
+		if got := string(e.Bytes()); got != expected[i] {
+			t.Fatalf("element %d is %q, expected %q", i, got, expected[i])
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Fatalf("iterated %d elements, expected %d", i, len(expected))
+	}
+	for e := ql.Index(-1); e != nil; e = e.Prev() {
+		i--
+		if got := string(e.Bytes()); got != expected[i] {
+			t.Fatalf("element %d is %q going backward, expected %q", i, got, expected[i])
+		}
+	}
+
+	count, nodes := 0, 0
+	for n := ql.head; n != nil; n = n.next {
+		if n.count == 0 {
+			t.Fatalf("empty node in the quicklist")
+		}
+		if n.listpack().Length() != n.count {
+			t.Fatalf("node count is %d, the listpack has %d elements", n.count, n.listpack().Length())
+		}
+		// The nodes within the compress depth are never compressed.
+		if ql.compress > 0 && ql.len >= ql.compress*2 && (nodes < ql.compress || ql.len-nodes <= ql.compress) && n.IsCompressed() {
+			t.Fatalf("node %d of %d is compressed with depth %d", nodes, ql.len, ql.compress)
+		}
+		count += n.count
+		nodes++
+	}
+	if count != ql.count || nodes != ql.len {
+		t.Fatalf("wrong count %d or number of nodes %d", count, nodes)
+	}
+}
+
+func TestLZF(t *testing.T) {
+	inputs := [][]byte{
+		[]byte("a"),
+		[]byte("hello hello hello hello hello hello"),
+		bytes.Repeat([]byte("abcdefgh"), 1000),
+		[]byte(strings.Repeat("x", 300) + "y" + strings.Repeat("x", 300)),
+	}
+	random := make([]byte, 5000)
+	rand.Read(random)
+	inputs = append(inputs, random)
+
+	for _, in := range inputs {
+		out := make([]byte, len(in)+len(in)/16+64)
+		n := lzfCompress(in, out)
+		if n == 0 {
+			t.Fatalf("failed to compress %d bytes", len(in))
+		}
+		dec := make([]byte, len(in))
+		if m := lzfDecompress(out[:n], dec); m != len(in) || !bytes.Equal(dec, in) {
+			t.Fatalf("decompressed data differs from the input of %d bytes", len(in))
+		}
+	}
+
+	// Compressible data is actually compressed.
+	in := bytes.Repeat([]byte("abcdefgh"), 1000)
+	out := make([]byte, len(in))
+	if n := lzfCompress(in, out); n == 0 || n > len(in)/10 {
+		t.Fatalf("compressed %d bytes to %d", len(in), n)
+	}
+	// Too small output buffers are detected.
+	if n := lzfCompress(random, make([]byte, len(random)/2)); n != 0 {
+		t.Fatalf("random data compressed to %d bytes", n)
+	}
+}
+
+func TestPushPop(t *testing.T) {
+	for _, fill := range []int{-2, 1, 4, 128} {
+		for _, compress := range []int{0, 1, 2} {
+			ql := New(fill, compress)
+			var expected []string
+			for i := 0; i < 500; i++ {
+				v := strconv.Itoa(i) + strings.Repeat("v", i%50)
+				if i%3 == 0 {
+					ql.PushHead([]byte(v))
+					expected = append([]string{v}, expected...)
+				} else {
+					ql.PushTail([]byte(v))
+					expected = append(expected, v)
+				}
+			}
+			check(t, ql, expected)
+
+			for len(expected) > 0 {
+				if v, ok := ql.Pop(QUICKLIST_HEAD); !ok || string(v) != expected[0] {
+					t.Fatalf("popped %q from the head, expected %q", v, expected[0])
+				}
+				expected = expected[1:]
+				if len(expected) == 0 {
+					break
+				}
+				if v, ok := ql.Pop(QUICKLIST_TAIL); !ok || string(v) != expected[len(expected)-1] {
+					t.Fatalf("popped %q from the tail, expected %q", v, expected[len(expected)-1])
+				}
+				expected = expected[:len(expected)-1]
+			}
+			check(t, ql, nil)
+			if _, ok := ql.Pop(QUICKLIST_HEAD); ok {
+				t.Fatalf("popped from an empty quicklist")
+			}
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	ql := New(7, 1)
+	var expected []string
+	for i := 0; i < 100; i++ {
+		ql.PushTail([]byte(strconv.Itoa(i)))
+		expected = append(expected, strconv.Itoa(i))
+	}
+	for i := -100; i < 100; i++ {
+		j := i
+		if j < 0 {
+			j += 100
+		}
+		e := ql.Index(i)
+		if e == nil || string(e.Bytes()) != expected[j] || e.Index() != j {
+			t.Fatalf("wrong element at index %d", i)
+		}
+	}
+	if ql.Index(100) != nil || ql.Index(-101) != nil {
+		t.Fatalf("index out of range should return nil")
+	}
+}
+
+func TestRandomOperations(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, fill := range []int{-1, 3, 16} {
+		for _, compress := range []int{0, 1, 3} {
+			ql := New(fill, compress)
+			var expected []string
+			for i := 0; i < 3000; i++ {
+				v := strconv.Itoa(r.Intn(1000)) + strings.Repeat("x", r.Intn(100))
+				if len(expected) == 0 {
+					ql.PushTail([]byte(v))
+					expected = append(expected, v)
+					continue
+				}
+				idx := r.Intn(len(expected))
+				switch r.Intn(5) {
+				case 0:
+					ql.InsertBefore(ql.Index(idx), []byte(v))
+					expected = append(expected[:idx], append([]string{v}, expected[idx:]...)...)
+				case 1:
+					ql.InsertAfter(ql.Index(idx), []byte(v))
+					idx++
+					expected = append(expected[:idx], append([]string{v}, expected[idx:]...)...)
+				case 2:
+					ql.Replace(ql.Index(idx), []byte(v))
+					expected[idx] = v
+				case 3:
+					ql.DelEntry(ql.Index(idx), r.Intn(2) == 0)
+					expected = append(expected[:idx], expected[idx+1:]...)
+				case 4:
+					ql.PushHead([]byte(v))
+					expected = append([]string{v}, expected...)
+				}
+			}
+			check(t, ql, expected)
+		}
+	}
+}
+
+func TestDelEntryWhileIterating(t *testing.T) {
+	for _, forward := range []bool{true, false} {
+		ql := New(3, 1)
+		var expected []string
+		for i := 0; i < 50; i++ {
+			ql.PushTail([]byte(strconv.Itoa(i % 5)))
+			if i%5 != 0 {
+				expected = append(expected, strconv.Itoa(i%5))
+			}
+		}
+
+		// Remove all the zeros, visiting every other element once.
+		var e *Entry
+		if forward {
+			e = ql.Index(0)
+		} else {
+			e = ql.Index(-1)
+		}
+		visited := 0
+		for e != nil {
+			visited++
+			if e.Compare([]byte("0")) {
+				e = ql.DelEntry(e, forward)
+			} else if forward {
+				e = e.Next()
+			} else {
+				e = e.Prev()
+			}
+		}
+		if visited != 50 {
+			t.Fatalf("visited %d elements, expected 50", visited)
+		}
+		check(t, ql, expected)
+	}
+}
+
+func TestDelRange(t *testing.T) {
+	for _, fill := range []int{1, 3, 4, -2} {
+		for _, tc := range []struct{ start, count int }{
+			{0, 0}, {0, 5}, {0, 100}, {2, 7}, {5, 3}, {-4, 2}, {-4, 10}, {-30, 30}, {30, 1}, {-31, 1},
+		} {
+			ql := New(fill, 1)
+			var elems []string
+			for i := 0; i < 30; i++ {
+				ql.PushTail([]byte(strconv.Itoa(i)))
+				elems = append(elems, strconv.Itoa(i))
+			}
+
+			start := tc.start
+			if start < 0 {
+				start += len(elems)
+			}
+			var expected []string
+			deleted := 0
+			for i, e := range elems {
+				if start >= 0 && i >= start && i < start+tc.count {
+					deleted++
+				} else {
+					expected = append(expected, e)
+				}
+			}
+
+			if n := ql.DelRange(tc.start, tc.count); n != deleted {
+				t.Fatalf("fill %d, DelRange(%d, %d) deleted %d, expected %d", fill, tc.start, tc.count, n, deleted)
+			}
+			check(t, ql, expected)
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package listpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"unsafe"
+
+	"github.com/SteveZhangBit/redigo/rtype"
+	"github.com/SteveZhangBit/redigo/rtype/rstring"
+)
+
+/* Listpack -- A lists of strings serialization format
+ *
+ * This is a Go translation of listpack.c in Redis, which implements the
+ * specification you can find at: https://github.com/antirez/listpack
+ *
+ * A listpack is a single contiguous buffer with the following layout:
+ *
+ *     <tot-bytes> <num-elements> <element-1> ... <element-N> <end>
+ *
+ * The header is 6 bytes: the total bytes of the listpack as a 32 bit
+ * unsigned integer, and the number of elements as a 16 bit unsigned integer
+ * (or LP_HDR_NUMELE_UNKNOWN when the elements are 65535 or more). Both are
+ * stored in little endian. The listpack is terminated by a single byte set
+ * to LP_EOF.
+ *
+ * Every element is composed of the encoding type, that also holds the length
+ * of the element for small strings and integers, the element data, and the
+ * "backlen": the length of encoding+data encoded from right to left, so that
+ * the listpack can be traversed from the tail to the head.
+ *
+ * Strings that can be represented as 64 bit signed integers are always
+ * stored in the integer encoding. */
+
+const (
+	LP_HDR_SIZE           = 6 // 32 bit total len + 16 bit number of elements.
+	LP_HDR_NUMELE_UNKNOWN = math.MaxUint16
+	LP_MAX_BACKLEN_SIZE   = 5
+	LP_EOF                = 0xFF
+
+	/* The maximum size of a listpack, larger listpacks should be converted
+	 * by the caller to the regular encoding, see SafeToAdd(). */
+	LISTPACK_MAX_SAFETY_SIZE = 1 << 30
+)
+
+const (
+	LP_ENCODING_7BIT_UINT      = 0
+	LP_ENCODING_7BIT_UINT_MASK = 0x80
+
+	LP_ENCODING_6BIT_STR      = 0x80
+	LP_ENCODING_6BIT_STR_MASK = 0xC0
+
+	LP_ENCODING_13BIT_INT      = 0xC0
+	LP_ENCODING_13BIT_INT_MASK = 0xE0
+
+	LP_ENCODING_12BIT_STR      = 0xE0
+	LP_ENCODING_12BIT_STR_MASK = 0xF0
+
+	LP_ENCODING_16BIT_INT = 0xF1
+	LP_ENCODING_24BIT_INT = 0xF2
+	LP_ENCODING_32BIT_INT = 0xF3
+	LP_ENCODING_64BIT_INT = 0xF4
+	LP_ENCODING_32BIT_STR = 0xF0
+)
+
+// Where to insert an element relatively to a given position.
+const (
+	LP_BEFORE = iota
+	LP_AFTER
+	LP_REPLACE
+)
+
+type Listpack struct {
+	buf []byte
+}
+
+// Create a new, empty listpack.
+func New() *Listpack {
+	lp := &Listpack{buf: make([]byte, LP_HDR_SIZE+1)}
+	lp.setTotalBytes()
+	lp.setNumElements(0)
+	lp.buf[LP_HDR_SIZE] = LP_EOF
+	return lp
+}
+
+/* Create a listpack using buf, that must be a valid listpack as returned by
+ * Raw(), as buffer. */
+func NewFromBytes(buf []byte) *Listpack {
+	return &Listpack{buf: buf}
+}
+
+// Return the underlying buffer of the listpack.
+func (lp *Listpack) Raw() []byte {
+	return lp.buf
+}
+
+func (lp *Listpack) setTotalBytes() {
+	binary.LittleEndian.PutUint32(lp.buf[0:], uint32(len(lp.buf)))
+}
+
+func (lp *Listpack) numElements() int {
+	return int(binary.LittleEndian.Uint16(lp.buf[4:]))
+}
+
+func (lp *Listpack) setNumElements(n int) {
+	if n >= LP_HDR_NUMELE_UNKNOWN {
+		n = LP_HDR_NUMELE_UNKNOWN
+	}
+	binary.LittleEndian.PutUint16(lp.buf[4:], uint16(n))
+}
+
+/* Return true if the string s represents a 64 bit signed integer exactly,
+ * that is without leading zeroes, spaces or a plus sign, so that converting
+ * the integer back to a string returns the same string. The same as
+ * lpStringToInt64() in Redis. */
+func stringToInt64(s []byte) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	if len(s) == 1 && s[0] == '0' {
+		return 0, true
+	}
+	p := s
+	if p[0] == '-' {
+		p = p[1:]
+	}
+	// The first digit should be 1-9, otherwise the string should just be 0.
+	if len(p) == 0 || p[0] < '1' || p[0] > '9' {
+		return 0, false
+	}
+	for _, c := range p {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	v, err := strconv.ParseInt(string(s), 10, 64)
+	return v, err == nil
+}
+
+/* Encode the integer v using the smallest encoding that can represent it. */
+func encodeInt(v int64) []byte {
+	switch {
+	case v >= 0 && v <= 127:
+		return []byte{byte(v)}
+	case v >= -4096 && v <= 4095:
+		uv := uint64(v)
+		if v < 0 {
+			uv = (1 << 13) + uint64(v)
+		}
+		return []byte{byte(uv>>8) | LP_ENCODING_13BIT_INT, byte(uv)}
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		return []byte{LP_ENCODING_16BIT_INT, byte(v), byte(v >> 8)}
+	case v >= -(1<<23) && v <= (1<<23)-1:
+		return []byte{LP_ENCODING_24BIT_INT, byte(v), byte(v >> 8), byte(v >> 16)}
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		buf := make([]byte, 5)
+		buf[0] = LP_ENCODING_32BIT_INT
+		binary.LittleEndian.PutUint32(buf[1:], uint32(v))
+		return buf
+	default:
+		buf := make([]byte, 9)
+		buf[0] = LP_ENCODING_64BIT_INT
+		binary.LittleEndian.PutUint64(buf[1:], uint64(v))
+		return buf
+	}
+}
+
+/* Encode the string s, prefixed by the encoding type holding its length. */
+func encodeString(s []byte) []byte {
+	var buf []byte
+	l := len(s)
+	switch {
+	case l < 64:
+		buf = append(make([]byte, 0, 1+l), LP_ENCODING_6BIT_STR|byte(l))
+	case l < 4096:
+		buf = append(make([]byte, 0, 2+l), byte(l>>8)|LP_ENCODING_12BIT_STR, byte(l))
+	default:
+		buf = make([]byte, 5, 5+l)
+		buf[0] = LP_ENCODING_32BIT_STR
+		binary.LittleEndian.PutUint32(buf[1:], uint32(l))
+	}
+	return append(buf, s...)
+}
+
+/* Store a reverse-encoded variable length field, representing the length
+ * of the previous element of size l, in the target buffer. The length of
+ * the field is between 1 and 5 bytes. */
+func encodeBacklen(buf []byte, l int) []byte {
+	switch {
+	case l <= 127:
+		return append(buf, byte(l))
+	case l < 16383:
+		return append(buf, byte(l>>7), byte(l&127)|128)
+	case l < 2097151:
+		return append(buf, byte(l>>14), byte((l>>7)&127)|128, byte(l&127)|128)
+	case l < 268435455:
+		return append(buf, byte(l>>21), byte((l>>14)&127)|128, byte((l>>7)&127)|128, byte(l&127)|128)
+	default:
+		return append(buf, byte(l>>28), byte((l>>21)&127)|128, byte((l>>14)&127)|128,
+			byte((l>>7)&127)|128, byte(l&127)|128)
+	}
+}
+
+// Return the number of bytes encodeBacklen() uses to store the length l.
+func backlenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+/* Decode the backlen ending at the byte p and return the length of the
+ * previous element. */
+func (lp *Listpack) decodeBacklen(p int) int {
+	var val, shift uint
+	for {
+		val |= uint(lp.buf[p]&127) << shift
+		if lp.buf[p]&128 == 0 || shift >= 28 {
+			break
+		}
+		shift += 7
+		p--
+	}
+	return int(val)
+}
+
+/* Return the encoded length of the element at p, that is the number of
+ * bytes of its encoding type and data, without the backlen. */
+func (lp *Listpack) currentEncodedSize(p int) int {
+	b := lp.buf[p]
+	switch {
+	case b&LP_ENCODING_7BIT_UINT_MASK == LP_ENCODING_7BIT_UINT:
+		return 1
+	case b&LP_ENCODING_6BIT_STR_MASK == LP_ENCODING_6BIT_STR:
+		return 1 + int(b&0x3F)
+	case b&LP_ENCODING_13BIT_INT_MASK == LP_ENCODING_13BIT_INT:
+		return 2
+	case b&LP_ENCODING_12BIT_STR_MASK == LP_ENCODING_12BIT_STR:
+		return 2 + (int(b&0x0F)<<8 | int(lp.buf[p+1]))
+	case b == LP_ENCODING_16BIT_INT:
+		return 3
+	case b == LP_ENCODING_24BIT_INT:
+		return 4
+	case b == LP_ENCODING_32BIT_INT:
+		return 5
+	case b == LP_ENCODING_64BIT_INT:
+		return 9
+	case b == LP_ENCODING_32BIT_STR:
+		return 5 + int(binary.LittleEndian.Uint32(lp.buf[p+1:]))
+	case b == LP_EOF:
+		return 1
+	}
+	panic("listpack: invalid encoding")
+}
+
+// Return the total number of bytes used by the element at p.
+func (lp *Listpack) entrySize(p int) int {
+	l := lp.currentEncodedSize(p)
+	return l + backlenSize(l)
+}
+
+// Return the number of bytes used by the listpack.
+func (lp *Listpack) Bytes() int {
+	return len(lp.buf)
+}
+
+/* Return the number of elements inside the listpack. When the number of
+ * elements doesn't fit the header the listpack is scanned. */
+func (lp *Listpack) Length() int {
+	if n := lp.numElements(); n != LP_HDR_NUMELE_UNKNOWN {
+		return n
+	}
+	var count int
+	for p := lp.First(); p != -1; p = lp.Next(p) {
+		count++
+	}
+	/* If the count is again within range of the header numele field,
+	 * set it. */
+	lp.setNumElements(count)
+	return count
+}
+
+/* Return the position of the first element of the listpack, or -1 if the
+ * listpack is empty. */
+func (lp *Listpack) First() int {
+	if lp.buf[LP_HDR_SIZE] == LP_EOF {
+		return -1
+	}
+	return LP_HDR_SIZE
+}
+
+/* Return the position of the last element of the listpack, or -1 if the
+ * listpack is empty. */
+func (lp *Listpack) Last() int {
+	return lp.Prev(len(lp.buf) - 1)
+}
+
+/* Return the position of the element after the one at p, or -1 if p is the
+ * last element. */
+func (lp *Listpack) Next(p int) int {
+	p += lp.entrySize(p)
+	if lp.buf[p] == LP_EOF {
+		return -1
+	}
+	return p
+}
+
+/* Return the position of the element before the one at p, or -1 if p is the
+ * first element. */
+func (lp *Listpack) Prev(p int) int {
+	if p == LP_HDR_SIZE {
+		return -1
+	}
+	l := lp.decodeBacklen(p - 1)
+	return p - l - backlenSize(l)
+}
+
+/* Return the element at p. Integer encoded elements are returned as an
+ * integer with isInt set to true, otherwise s is the string, which points
+ * directly into the listpack and is only valid until it is modified. */
+func (lp *Listpack) Get(p int) (s []byte, v int64, isInt bool) {
+	b := lp.buf[p]
+	var uval uint64
+	var negstart, negmax uint64
+
+	switch {
+	case b&LP_ENCODING_7BIT_UINT_MASK == LP_ENCODING_7BIT_UINT:
+		return nil, int64(b & 0x7F), true
+	case b&LP_ENCODING_6BIT_STR_MASK == LP_ENCODING_6BIT_STR:
+		return lp.buf[p+1 : p+1+int(b&0x3F)], 0, false
+	case b&LP_ENCODING_13BIT_INT_MASK == LP_ENCODING_13BIT_INT:
+		uval = uint64(b&0x1F)<<8 | uint64(lp.buf[p+1])
+		negstart, negmax = 1<<12, 8191
+	case b&LP_ENCODING_12BIT_STR_MASK == LP_ENCODING_12BIT_STR:
+		l := int(b&0x0F)<<8 | int(lp.buf[p+1])
+		return lp.buf[p+2 : p+2+l], 0, false
+	case b == LP_ENCODING_16BIT_INT:
+		uval = uint64(binary.LittleEndian.Uint16(lp.buf[p+1:]))
+		negstart, negmax = 1<<15, math.MaxUint16
+	case b == LP_ENCODING_24BIT_INT:
+		uval = uint64(lp.buf[p+1]) | uint64(lp.buf[p+2])<<8 | uint64(lp.buf[p+3])<<16
+		negstart, negmax = 1<<23, (1<<24)-1
+	case b == LP_ENCODING_32BIT_INT:
+		uval = uint64(binary.LittleEndian.Uint32(lp.buf[p+1:]))
+		negstart, negmax = 1<<31, math.MaxUint32
+	case b == LP_ENCODING_64BIT_INT:
+		return nil, int64(binary.LittleEndian.Uint64(lp.buf[p+1:])), true
+	case b == LP_ENCODING_32BIT_STR:
+		l := int(binary.LittleEndian.Uint32(lp.buf[p+1:]))
+		return lp.buf[p+5 : p+5+l], 0, false
+	default:
+		panic("listpack: invalid encoding")
+	}
+
+	/* We reach this code path only for integer encodings.
+	 * Convert the unsigned value to the signed one using two's complement
+	 * rule. */
+	if uval >= negstart {
+		/* This three steps conversion should avoid undefined behaviors
+		 * in the unsigned -> signed conversion. */
+		uval = negmax - uval
+		return nil, -int64(uval) - 1, true
+	}
+	return nil, int64(uval), true
+}
+
+/* Return a copy of the element at p as a string, converting integers to
+ * their decimal representation. */
+func (lp *Listpack) GetBytes(p int) []byte {
+	s, v, isInt := lp.Get(p)
+	if isInt {
+		return strconv.AppendInt(nil, v, 10)
+	}
+	return append([]byte(nil), s...)
+}
+
+/* Insert, delete or replace the specified string element ele at the
+ * position p. The where argument is one of LP_BEFORE, LP_AFTER or
+ * LP_REPLACE. Passing len(lp) - 1, that is the EOF byte, as position with
+ * LP_BEFORE appends the element.
+ *
+ * Return the position of the inserted element. */
+func (lp *Listpack) Insert(ele []byte, p int, where int) int {
+	/* If we need to insert after the current element, we just jump to the
+	 * next element (that could be the EOF one) and handle the case of
+	 * inserting before. So the function will actually deal with just two
+	 * cases: LP_BEFORE and LP_REPLACE. */
+	if where == LP_AFTER {
+		p += lp.entrySize(p)
+		where = LP_BEFORE
+	}
+
+	var entry []byte
+	if v, ok := stringToInt64(ele); ok {
+		entry = encodeInt(v)
+	} else {
+		entry = encodeString(ele)
+	}
+	entry = encodeBacklen(entry, len(entry))
+
+	if where == LP_REPLACE {
+		old := lp.entrySize(p)
+		if len(entry) == old {
+			copy(lp.buf[p:], entry)
+			return p
+		}
+		buf := make([]byte, 0, len(lp.buf)-old+len(entry))
+		buf = append(buf, lp.buf[:p]...)
+		buf = append(buf, entry...)
+		lp.buf = append(buf, lp.buf[p+old:]...)
+	} else {
+		lp.buf = append(lp.buf, entry...) // Grow the buffer.
+		copy(lp.buf[p+len(entry):], lp.buf[p:len(lp.buf)-len(entry)])
+		copy(lp.buf[p:], entry)
+		if n := lp.numElements(); n != LP_HDR_NUMELE_UNKNOWN {
+			lp.setNumElements(n + 1)
+		}
+	}
+	lp.setTotalBytes()
+	return p
+}
+
+// Append the specified element ele at the end of the listpack.
+func (lp *Listpack) Append(ele []byte) int {
+	return lp.Insert(ele, len(lp.buf)-1, LP_BEFORE)
+}
+
+// Prepend the specified element ele at the start of the listpack.
+func (lp *Listpack) Prepend(ele []byte) int {
+	return lp.Insert(ele, LP_HDR_SIZE, LP_BEFORE)
+}
+
+// Replace the element at p with ele.
+func (lp *Listpack) Replace(p int, ele []byte) int {
+	return lp.Insert(ele, p, LP_REPLACE)
+}
+
+/* Remove the element at p from the listpack. Return the position of the
+ * element that took its place, or -1 if p was the last element. */
+func (lp *Listpack) Delete(p int) int {
+	size := lp.entrySize(p)
+	lp.buf = append(lp.buf[:p], lp.buf[p+size:]...)
+	lp.setTotalBytes()
+	if n := lp.numElements(); n != LP_HDR_NUMELE_UNKNOWN {
+		lp.setNumElements(n - 1)
+	} else {
+		lp.Length() // Try to fit the count in the header again.
+	}
+	if lp.buf[p] == LP_EOF {
+		return -1
+	}
+	return p
+}
+
+/* Delete num consecutive elements starting at the element at p. Return the
+ * position of the element after the deleted ones, or -1. */
+func (lp *Listpack) DeleteRange(p int, num int) int {
+	for ; num > 0 && p != -1; num-- {
+		p = lp.Delete(p)
+	}
+	return p
+}
+
+/* Seek the specified element and returns its position. Positive and
+ * negative indexes are supported, -1 is the last element, -2 the penultimate
+ * and so forth. If the index is out of range -1 is returned. */
+func (lp *Listpack) Seek(index int) int {
+	numele := lp.Length()
+	if index < 0 {
+		index = numele + index
+	}
+	if index < 0 || index >= numele {
+		return -1 // Out of range the other side.
+	}
+
+	/* We want to scan right-to-left if the element we are looking for
+	 * is past the half of the listpack. */
+	if index > numele/2 {
+		p := lp.Last()
+		for index = numele - 1 - index; index > 0; index-- {
+			p = lp.Prev(p)
+		}
+		return p
+	}
+	p := lp.First()
+	for ; index > 0; index-- {
+		p = lp.Next(p)
+	}
+	return p
+}
+
+/* Return true if the element at p is equal to the string s. */
+func (lp *Listpack) Compare(p int, s []byte) bool {
+	ele, v, isInt := lp.Get(p)
+	if isInt {
+		x, ok := stringToInt64(s)
+		return ok && x == v
+	}
+	return bytes.Equal(ele, s)
+}
+
+/* Find the element equal to s starting from the element at p. After every
+ * compared element skip elements are skipped, so for example a skip of 1
+ * only compares the fields of a listpack of field-value pairs. Return the
+ * position of the matching element or -1 if it was not found. */
+func (lp *Listpack) Find(p int, s []byte, skip int) int {
+	for skipcnt := 0; p != -1; p = lp.Next(p) {
+		if skipcnt == 0 {
+			if lp.Compare(p, s) {
+				return p
+			}
+			skipcnt = skip
+		} else {
+			skipcnt--
+		}
+	}
+	return -1
+}
+
+/* Return true if adding add bytes to the listpack keeps it under the
+ * safety size: larger listpacks should be converted to another encoding. */
+func (lp *Listpack) SafeToAdd(add int) bool {
+	return len(lp.buf)+add <= LISTPACK_MAX_SAFETY_SIZE
+}
+
+/* Return the number of bytes used by the listpack in memory, including the
+ * unused capacity of the buffer. */
+func (lp *Listpack) BlobSize() int {
+	return int(unsafe.Sizeof(*lp)) + cap(lp.buf)
+}
+
+/* Return a copy of the element at p as a String object, integer encoded
+ * elements are returned as integers. */
+func (lp *Listpack) GetString(p int) rtype.String {
+	s, v, isInt := lp.Get(p)
+	if isInt {
+		return rstring.NewFromInt64(v)
+	}
+	return &rstring.BytesString{Val: append([]byte(nil), s...)}
+}
@@ -0,0 +1,129 @@
+package listpack
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var samples = []string{
+	"0", "127", "128", "-1", "4095", "-4096", "32767", "-32768", "8388607",
+	"-8388608", "2147483647", "-2147483648", "9223372036854775807",
+	"-9223372036854775808", "", "a", "hello", "007", "+1", "-0",
+	strings.Repeat("x", 63), strings.Repeat("y", 64), strings.Repeat("z", 4095),
+	strings.Repeat("w", 4096), strings.Repeat("v", 20000),
+}
+
+func check(t *testing.T, lp *Listpack, expected []string) {
+	if lp.Length() != len(expected) {
+		t.Fatalf("length is %d, expected %d", lp.Length(), len(expected))
+	}
+	i := 0
+	for p := lp.First(); p != -1; p = lp.Next(p) {
+		if got := string(lp.GetBytes(p)); got != expected[i] {
+			t.Fatalf("element %d is %q, expected %q", i, got, expected[i])
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Fatalf("iterated %d elements, expected %d", i, len(expected))
+	}
+	for p := lp.Last(); p != -1; p = lp.Prev(p) {
+		i--
+		if got := string(lp.GetBytes(p)); got != expected[i] {
+			t.Fatalf("element %d is %q going backward, expected %q", i, got, expected[i])
+		}
+	}
+	if lp.Bytes() != len(lp.buf) || int(lp.buf[len(lp.buf)-1]) != LP_EOF {
+		t.Fatalf("corrupted listpack")
+	}
+}
+
+func TestAppendAndIterate(t *testing.T) {
+	lp := New()
+	check(t, lp, nil)
+	for _, s := range samples {
+		lp.Append([]byte(s))
+	}
+	check(t, lp, samples)
+}
+
+func TestIntegerEncoding(t *testing.T) {
+	lp := New()
+	for _, s := range samples {
+		p := lp.Append([]byte(s))
+		_, v, isInt := lp.Get(p)
+		x, err := strconv.ParseInt(s, 10, 64)
+		canonical := err == nil && strconv.FormatInt(x, 10) == s
+		if isInt != canonical || (isInt && v != x) {
+			t.Fatalf("%q decoded as (%d, %v)", s, v, isInt)
+		}
+	}
+}
+
+func TestInsertDeleteReplace(t *testing.T) {
+	lp := New()
+	lp.Append([]byte("b"))
+	lp.Prepend([]byte("a"))
+	lp.Insert([]byte("c"), lp.Last(), LP_AFTER)
+	lp.Insert([]byte("1000"), lp.Seek(1), LP_BEFORE)
+	check(t, lp, []string{"a", "1000", "b", "c"})
+
+	lp.Replace(lp.Seek(1), []byte(strings.Repeat("x", 200)))
+	lp.Replace(lp.Seek(-1), []byte("d"))
+	check(t, lp, []string{"a", strings.Repeat("x", 200), "b", "d"})
+
+	p := lp.Delete(lp.Seek(1))
+	if !lp.Compare(p, []byte("b")) {
+		t.Fatalf("delete returned the wrong position")
+	}
+	if lp.Delete(lp.Seek(-1)) != -1 {
+		t.Fatalf("deleting the last element should return -1")
+	}
+	check(t, lp, []string{"a", "b"})
+
+	lp.DeleteRange(lp.First(), 2)
+	check(t, lp, nil)
+}
+
+func TestSeekAndFind(t *testing.T) {
+	lp := New()
+	for i := 0; i < 100; i++ {
+		lp.Append([]byte(strconv.Itoa(i)))
+		lp.Append([]byte("v" + strconv.Itoa(i)))
+	}
+	for i := 0; i < 200; i++ {
+		if lp.Seek(i) != lp.Seek(i-200) {
+			t.Fatalf("seek %d and %d differ", i, i-200)
+		}
+	}
+	if lp.Seek(200) != -1 || lp.Seek(-201) != -1 {
+		t.Fatalf("seek out of range should return -1")
+	}
+
+	p := lp.Find(lp.First(), []byte("42"), 1)
+	if p != lp.Seek(84) || !bytes.Equal(lp.GetBytes(lp.Next(p)), []byte("v42")) {
+		t.Fatalf("find returned the wrong position")
+	}
+	// Values are skipped, so they are never matched.
+	if lp.Find(lp.First(), []byte("v42"), 1) != -1 {
+		t.Fatalf("find should skip the values")
+	}
+}
+
+func TestUnknownLength(t *testing.T) {
+	lp := New()
+	for i := 0; i < LP_HDR_NUMELE_UNKNOWN+10; i++ {
+		lp.Append([]byte("a"))
+	}
+	if lp.Length() != LP_HDR_NUMELE_UNKNOWN+10 {
+		t.Fatalf("wrong length %d", lp.Length())
+	}
+	for i := 0; i < 20; i++ {
+		lp.Delete(lp.First())
+	}
+	if lp.Length() != LP_HDR_NUMELE_UNKNOWN-10 || lp.numElements() != LP_HDR_NUMELE_UNKNOWN-10 {
+		t.Fatalf("wrong length %d", lp.Length())
+	}
+}
@@ -3,6 +3,7 @@ package rstring
 import (
 	"bytes"
 	"strconv"
+	"unsafe"
 
 	"github.com/SteveZhangBit/redigo/rtype"
 	"github.com/SteveZhangBit/redigo/util"
@@ -29,6 +30,10 @@ func (s *BytesString) Append(b []byte) rtype.String {
 	return s
 }
 
+func (s *BytesString) MemoryUsage(samples int) int64 {
+	return int64(unsafe.Sizeof(*s)) + int64(cap(s.Val))
+}
+
 type IntString struct {
 	Val int64
 }
@@ -42,11 +47,14 @@ func (i *IntString) Bytes() []byte {
 }
 
 func (i *IntString) Len() int64 {
-	var count int64
+	// The sign and zero take one byte too.
+	count := int64(1)
 	x := i.Val
-	for x > 0 {
+	if x < 0 {
+		count++
+	}
+	for x /= 10; x != 0; x /= 10 {
 		count++
-		x /= 10
 	}
 	return count
 }
@@ -55,9 +63,13 @@ func (i *IntString) Append(b []byte) rtype.String {
 	return &BytesString{append(i.Bytes(), b...)}
 }
 
+func (i *IntString) MemoryUsage(samples int) int64 {
+	return int64(unsafe.Sizeof(*i))
+}
+
 func New(val []byte) rtype.String {
 	// Check whether can be convert to integer
-	if val[0] == '+' || val[0] == '-' || (val[0] >= '0' && val[0] <= '9') {
+	if len(val) > 0 && (val[0] == '+' || val[0] == '-' || (val[0] >= '0' && val[0] <= '9')) {
 		if x, ok := util.ParseInt(val, 10, 64); ok {
 			return &IntString{x}
 		}
@@ -76,10 +76,11 @@ func (s *SDS) Copy(b interface{}) {
 	}
 }
 
+/* Grow the sds to have the specified length. Bytes that were not part of
+ * the original length of the sds will be set to zero. */
 func (s *SDS) GrowZero(n int) {
-	n = n - s.Len()
-	for i := 0; i < n; i++ {
-		*s = append(*s, ' ')
+	if n = n - s.Len(); n > 0 {
+		*s = append(*s, make([]byte, n)...)
 	}
 }
 
@@ -1,5 +1,10 @@
 package rtype
 
+import (
+	"bytes"
+	"time"
+)
+
 const (
 	REDIS_HASH_KEY = 1 << iota
 	REDIS_HASH_VALUE
@@ -10,7 +15,29 @@ const (
 	REDIS_LIST_HEAD = 1
 )
 
+/* Approximate memory used by the Go runtime for the header of a map and
+ * for every entry of a map, in addition to the keys and values themselves.
+ * They are only used in order to estimate the memory usage of the values. */
+const (
+	MapOverhead      = 48
+	MapEntryOverhead = 8
+)
+
+/* The number of elements sampled by default when computing the memory used
+ * by an aggregate value, like OBJ_COMPUTE_SIZE_DEF_SAMPLES in Redis. */
+const REDIS_COMPUTE_SIZE_DEF_SAMPLES = 5
+
+/* Every value stored in the key space implements Object. MemoryUsage returns
+ * the number of bytes used by the value. For aggregate values only up to
+ * samples elements are inspected and the size of the other elements is
+ * extrapolated from their average size. If samples is 0 all the elements
+ * are inspected. */
+type Object interface {
+	MemoryUsage(samples int) int64
+}
+
 type String interface {
+	Object
 	String() string
 	Bytes() []byte
 	Len() int64
@@ -18,6 +45,7 @@ type String interface {
 }
 
 type HashMap interface {
+	Object
 	/* Add an element, discard the old if the key already exists.
 	 * Return false on insert and true on update. */
 	Set(key []byte, v String) bool
@@ -25,9 +53,28 @@ type HashMap interface {
 	Delete(key []byte)
 	Len() int
 	Iterate(iterf func(key []byte, v String))
+	// The hash must not be empty.
+	RandomField() (key []byte, v String)
+	/* Call scanf for a part of the fields, starting from the cursor, 0 for
+	 * the first call, and return the cursor for the next call, 0 when the
+	 * iteration is complete. Every call returns about count fields. */
+	Scan(cursor uint64, count int, scanf func(key []byte, v String)) uint64
+
+	/* The fields may have an expire, the Unix time at which they are
+	 * deleted like the expires of the keys. GetExpire returns -1 if the
+	 * field has no expire. Setting a field again removes its expire. */
+	GetExpire(key []byte) time.Duration
+	SetExpire(key []byte, when time.Duration)
+	RemoveExpire(key []byte) bool
+	// Return true if at least one field has an expire.
+	HasExpires() bool
+	/* Delete the fields already expired at the Unix time now. Return the
+	 * number of deleted fields. */
+	DeleteExpired(now time.Duration) int
 }
 
 type List interface {
+	Object
 	Front() ListElement
 	Back() ListElement
 	InsertAfter(v String, at ListElement)
@@ -46,6 +93,10 @@ type List interface {
 	PopFront() ListElement
 	PopBack() ListElement
 	Iterator(head int) Iterator
+	// Iterate in the head direction starting at the element at index.
+	IteratorAt(index int, head int) Iterator
+	// Delete count elements starting at the element at index.
+	DeleteRange(index int, count int)
 }
 
 type ListElement interface {
@@ -56,14 +107,18 @@ type ListElement interface {
 }
 
 type Set interface {
+	Object
 	Add(v String) bool
 	Remove(v String) bool
 	Size() int
 	IsMember(v String) bool
 	RandomElement() String
+	// Call iterf for every element, until it returns false.
+	Iterate(iterf func(v String) bool)
 }
 
 type ZSet interface {
+	Object
 	Add(score float64, v String) bool
 	Update(score float64, v String) bool
 	Get(v String) (float64, bool)
@@ -73,6 +128,14 @@ type ZSet interface {
 	Tail() ZSetItem
 	GetByRank(rank uint) ZSetItem
 	GetRank(score float64, v String) uint
+	FirstInRange(r *ZRangeSpec) ZSetItem
+	LastInRange(r *ZRangeSpec) ZSetItem
+	FirstInLexRange(r *ZLexRangeSpec) ZSetItem
+	LastInLexRange(r *ZLexRangeSpec) ZSetItem
+	// Delete the elements in the range, return the number of deleted elements.
+	DeleteRangeByScore(r *ZRangeSpec) int
+	DeleteRangeByLex(r *ZLexRangeSpec) int
+	DeleteRangeByRank(start, end uint) int // 1-based, inclusive
 }
 
 type ZSetItem interface {
@@ -82,6 +145,86 @@ type ZSetItem interface {
 	Score() float64
 }
 
+/* Struct to hold a inclusive/exclusive range spec by score comparison. */
+type ZRangeSpec struct {
+	Min, Max     float64
+	MinEx, MaxEx bool // are min or max exclusive?
+}
+
+func (r *ZRangeSpec) ValueGteMin(value float64) bool {
+	if r.MinEx {
+		return value > r.Min
+	}
+	return value >= r.Min
+}
+
+func (r *ZRangeSpec) ValueLteMax(value float64) bool {
+	if r.MaxEx {
+		return value < r.Max
+	}
+	return value <= r.Max
+}
+
+/* Return true if the range can't contain any element, i.e. when min is
+ * greater than max, or when they are equal and one of them is exclusive. */
+func (r *ZRangeSpec) IsEmpty() bool {
+	return r.Min > r.Max || (r.Min == r.Max && (r.MinEx || r.MaxEx))
+}
+
+/* The special strings "-" and "+" of lex ranges are represented by these
+ * two slices, that compare respectively smaller and greater than any other
+ * string. They are recognized by identity, like shared.minstring and
+ * shared.maxstring in Redis, so "[-" and "[+" are still ordinary bounds. */
+var (
+	ZLexMinString = []byte("-")
+	ZLexMaxString = []byte("+")
+)
+
+func isSameSlice(a, b []byte) bool {
+	return len(a) == len(b) && len(a) > 0 && &a[0] == &b[0]
+}
+
+/* This is just a wrapper to bytes.Compare() that is able to handle
+ * ZLexMinString and ZLexMaxString as corner cases. */
+func CompareLex(a, b []byte) int {
+	if isSameSlice(a, b) {
+		return 0
+	}
+	if isSameSlice(a, ZLexMinString) || isSameSlice(b, ZLexMaxString) {
+		return -1
+	}
+	if isSameSlice(a, ZLexMaxString) || isSameSlice(b, ZLexMinString) {
+		return 1
+	}
+	return bytes.Compare(a, b)
+}
+
+/* Struct to hold an inclusive/exclusive range spec by lexicographic
+ * comparison. */
+type ZLexRangeSpec struct {
+	Min, Max     []byte // May be set to ZLexMinString or ZLexMaxString
+	MinEx, MaxEx bool   // are min or max exclusive?
+}
+
+func (r *ZLexRangeSpec) ValueGteMin(value []byte) bool {
+	if r.MinEx {
+		return CompareLex(value, r.Min) > 0
+	}
+	return CompareLex(value, r.Min) >= 0
+}
+
+func (r *ZLexRangeSpec) ValueLteMax(value []byte) bool {
+	if r.MaxEx {
+		return CompareLex(value, r.Max) < 0
+	}
+	return CompareLex(value, r.Max) <= 0
+}
+
+func (r *ZLexRangeSpec) IsEmpty() bool {
+	cmp := CompareLex(r.Min, r.Max)
+	return cmp > 0 || (cmp == 0 && (r.MinEx || r.MaxEx))
+}
+
 type Iterator interface {
 	HasNext() bool
 	Next() interface{}
@@ -2,68 +2,140 @@ package set
 
 import (
 	"math/rand"
+	"strconv"
 	"time"
+	"unsafe"
 
 	"github.com/SteveZhangBit/redigo/rtype"
+	"github.com/SteveZhangBit/redigo/rtype/listpack"
 	"github.com/SteveZhangBit/redigo/rtype/rstring"
 	"github.com/SteveZhangBit/redigo/rtype/set/intset"
 )
 
+const (
+	REDIS_SET_MAX_INTSET_ENTRIES   = 512
+	REDIS_SET_MAX_LISTPACK_ENTRIES = 128
+	REDIS_SET_MAX_LISTPACK_VALUE   = 64
+)
+
+/* Sets made only of integers are encoded as intsets while they have up to
+ * MaxIntsetEntries elements (set-max-intset-entries). Other sets are encoded
+ * as listpacks while they have up to MaxListpackEntries elements and no
+ * element longer than MaxListpackValue bytes (set-max-listpack-entries and
+ * set-max-listpack-value). */
+var (
+	MaxIntsetEntries   = REDIS_SET_MAX_INTSET_ENTRIES
+	MaxListpackEntries = REDIS_SET_MAX_LISTPACK_ENTRIES
+	MaxListpackValue   = REDIS_SET_MAX_LISTPACK_VALUE
+)
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-type HashSet map[string]struct{}
+/* HashSet is a set stored in a hash table. The elements are also kept in a
+ * slice, with the hash table mapping every element to its index, so that
+ * random elements are picked in O(1): removed elements are replaced by the
+ * last one of the slice. */
+type HashSet struct {
+	dict  map[string]int
+	elems []string
+}
 
-func (h HashSet) Add(val rtype.String) bool {
-	key := val.String()
-	if _, ok := h[key]; !ok {
-		h[key] = struct{}{}
+func (h *HashSet) add(key string) bool {
+	if _, ok := h.dict[key]; !ok {
+		h.dict[key] = len(h.elems)
+		h.elems = append(h.elems, key)
 		return true
 	}
 	return false
 }
 
-func (h HashSet) Remove(val rtype.String) bool {
-	if _, ok := h[val.String()]; ok {
-		delete(h, val.String())
+func (h *HashSet) Add(val rtype.String) bool {
+	return h.add(val.String())
+}
+
+func (h *HashSet) Remove(val rtype.String) bool {
+	key := val.String()
+	if i, ok := h.dict[key]; ok {
+		last := len(h.elems) - 1
+		h.elems[i] = h.elems[last]
+		h.dict[h.elems[i]] = i
+		h.elems[last] = "" // Don't retain the string.
+		h.elems = h.elems[:last]
+		delete(h.dict, key)
 		return true
 	}
 	return false
 }
 
-func (h HashSet) Size() int {
-	return len(h)
+func (h *HashSet) Size() int {
+	return len(h.elems)
 }
 
-func (h HashSet) IsMember(val rtype.String) bool {
-	_, ok := h[val.String()]
+func (h *HashSet) IsMember(val rtype.String) bool {
+	_, ok := h.dict[val.String()]
 	return ok
 }
 
-func (h HashSet) RandomElement() rtype.String {
-	var val string
-	count, i := rand.Intn(h.Size()), 0
-	for val = range h {
-		if i < count {
-			i++
-		} else {
+func (h *HashSet) RandomElement() rtype.String {
+	return rstring.New([]byte(h.elems[rand.Intn(len(h.elems))]))
+}
+
+/* The set must not be modified by iterf, since the elements are visited in
+ * the order of the slice. */
+func (h *HashSet) Iterate(iterf func(v rtype.String) bool) {
+	for _, key := range h.elems {
+		if !iterf(rstring.New([]byte(key))) {
+			return
+		}
+	}
+}
+
+func (h *HashSet) MemoryUsage(samples int) int64 {
+	var elesize int64
+	var count int
+	for _, key := range h.elems {
+		if samples > 0 && count == samples {
 			break
 		}
+		// The string is shared by the slice and the map.
+		elesize += 2*int64(unsafe.Sizeof(key)) + int64(len(key)) + int64(unsafe.Sizeof(0)) + rtype.MapEntryOverhead
+		count++
+	}
+	size := int64(unsafe.Sizeof(*h)) + int64(rtype.MapOverhead)
+	if count > 0 {
+		size += int64(float64(elesize) / float64(count) * float64(len(h.elems)))
 	}
-	return rstring.New([]byte(val))
+	return size
+}
+
+func NewHashSet(sizeHint int) *HashSet {
+	return &HashSet{dict: make(map[string]int, sizeHint), elems: make([]string, 0, sizeHint)}
 }
 
 type IntsetSet struct {
 	s *intset.IntSet
 }
 
+/* Only integers can be added to an intset: the caller should convert the set
+ * with Convert() before adding anything else, see CanAdd(). */
 func (i *IntsetSet) Add(val rtype.String) bool {
 	return i.s.Add(val.(*rstring.IntString).Val)
 }
 
+/* Return true if the value can be added to the intset without converting
+ * it to a hash table, that is if it is an integer. */
+func (i *IntsetSet) CanAdd(val rtype.String) bool {
+	_, ok := val.(*rstring.IntString)
+	return ok
+}
+
 func (i *IntsetSet) Remove(val rtype.String) bool {
-	return i.s.Remove(val.(*rstring.IntString).Val)
+	if x, ok := val.(*rstring.IntString); ok {
+		return i.s.Remove(x.Val)
+	}
+	return false
 }
 
 func (i *IntsetSet) Size() int {
@@ -71,28 +143,128 @@ func (i *IntsetSet) Size() int {
 }
 
 func (i *IntsetSet) IsMember(val rtype.String) bool {
-	return i.s.Find(val.(*rstring.IntString).Val)
+	if x, ok := val.(*rstring.IntString); ok {
+		return i.s.Find(x.Val)
+	}
+	return false
 }
 
 func (i *IntsetSet) RandomElement() rtype.String {
 	return rstring.NewFromInt64(i.s.Random())
 }
 
-func (i *IntsetSet) Convert() HashSet {
-	hs := make(HashSet)
+func (i *IntsetSet) Iterate(iterf func(v rtype.String) bool) {
+	for j := 0; j < i.Size(); j++ {
+		if !iterf(rstring.NewFromInt64(i.s.Get(j))) {
+			return
+		}
+	}
+}
+
+func (i *IntsetSet) MemoryUsage(samples int) int64 {
+	return int64(unsafe.Sizeof(*i)) + int64(i.s.BlobSize())
+}
+
+func (i *IntsetSet) Convert() *HashSet {
+	hs := NewHashSet(i.Size())
+	for j := 0; j < i.Size(); j++ {
+		hs.add(strconv.FormatInt(i.s.Get(j), 10))
+	}
+	return hs
+}
+
+/* Return true if the intset can be converted to a listpack that also holds
+ * val without crossing the set-max-listpack-* thresholds. */
+func (i *IntsetSet) FitsListpack(val rtype.String) bool {
+	if i.Size() >= MaxListpackEntries || val.Len() > int64(MaxListpackValue) {
+		return false
+	}
+	if i.Size() > 0 {
+		// The longest elements are the smallest and the greatest ones.
+		minlen := len(strconv.FormatInt(i.s.Get(0), 10))
+		maxlen := len(strconv.FormatInt(i.s.Get(i.Size()-1), 10))
+		if minlen > MaxListpackValue || maxlen > MaxListpackValue {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *IntsetSet) ConvertToListpack() *ListpackSet {
+	l := NewListpack()
 	for j := 0; j < i.Size(); j++ {
-		hs[rstring.NewFromInt64(i.s.Get(j)).String()] = struct{}{}
+		l.lp.Append(strconv.AppendInt(nil, i.s.Get(j), 10))
+	}
+	return l
+}
+
+/* ListpackSet is a small set stored as a listpack of its elements. */
+type ListpackSet struct {
+	lp *listpack.Listpack
+}
+
+func (l *ListpackSet) Add(val rtype.String) bool {
+	if l.IsMember(val) {
+		return false
+	}
+	l.lp.Append(val.Bytes())
+	return true
+}
+
+func (l *ListpackSet) Remove(val rtype.String) bool {
+	if p := l.lp.Find(l.lp.First(), val.Bytes(), 0); p != -1 {
+		l.lp.Delete(p)
+		return true
+	}
+	return false
+}
+
+func (l *ListpackSet) Size() int {
+	return l.lp.Length()
+}
+
+func (l *ListpackSet) IsMember(val rtype.String) bool {
+	return l.lp.Find(l.lp.First(), val.Bytes(), 0) != -1
+}
+
+func (l *ListpackSet) RandomElement() rtype.String {
+	return l.lp.GetString(l.lp.Seek(rand.Intn(l.Size())))
+}
+
+func (l *ListpackSet) Iterate(iterf func(v rtype.String) bool) {
+	for p := l.lp.First(); p != -1; p = l.lp.Next(p) {
+		if !iterf(l.lp.GetString(p)) {
+			return
+		}
+	}
+}
+
+func (l *ListpackSet) MemoryUsage(samples int) int64 {
+	return int64(unsafe.Sizeof(*l)) + int64(l.lp.BlobSize())
+}
+
+func (l *ListpackSet) Convert() *HashSet {
+	hs := NewHashSet(l.Size())
+	for p := l.lp.First(); p != -1; p = l.lp.Next(p) {
+		hs.add(string(l.lp.GetBytes(p)))
 	}
 	return hs
 }
 
-func New(val rtype.String) rtype.Set {
-	var s rtype.Set
-	switch val.(type) {
-	case *rstring.BytesString:
-		s = make(HashSet)
-	case *rstring.IntString:
-		s = &IntsetSet{s: intset.New()}
+func NewListpack() *ListpackSet {
+	return &ListpackSet{lp: listpack.New()}
+}
+
+/* Factory method to return a set that *can* hold "val". When the object has
+ * an integer-encodable value, an intset will be returned. Otherwise a
+ * listpack or a regular hash table, depending on sizeHint, that is the
+ * number of elements the set is expected to hold. */
+func New(val rtype.String, sizeHint int) rtype.Set {
+	if _, ok := val.(*rstring.IntString); ok && sizeHint <= MaxIntsetEntries {
+		return &IntsetSet{s: intset.New()}
+	}
+	if sizeHint <= MaxListpackEntries {
+		return NewListpack()
 	}
-	return s
+	return NewHashSet(sizeHint)
 }
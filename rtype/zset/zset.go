@@ -1,10 +1,28 @@
 package zset
 
 import (
+	"bytes"
+	"strconv"
+	"unsafe"
+
 	"github.com/SteveZhangBit/redigo/rtype"
+	"github.com/SteveZhangBit/redigo/rtype/listpack"
 	"github.com/SteveZhangBit/redigo/rtype/zset/zskiplist"
 )
 
+const (
+	REDIS_ZSET_MAX_LISTPACK_ENTRIES = 128
+	REDIS_ZSET_MAX_LISTPACK_VALUE   = 64
+)
+
+/* Sorted sets are encoded as listpacks while they have up to
+ * MaxListpackEntries elements and no element longer than MaxListpackValue
+ * bytes (zset-max-listpack-entries and zset-max-listpack-value). */
+var (
+	MaxListpackEntries = REDIS_ZSET_MAX_LISTPACK_ENTRIES
+	MaxListpackValue   = REDIS_ZSET_MAX_LISTPACK_VALUE
+)
+
 // This package is the same of ZSETs in redis. The following instruction is copied from t_zset.c.
 
 /*-----------------------------------------------------------------------------
@@ -59,7 +77,13 @@ func (z *ZSetSkiplist) Add(score float64, v rtype.String) bool {
 }
 
 func (z *ZSetSkiplist) Update(score float64, v rtype.String) bool {
-	if z.zsl.Delete(score, v) && z.zsl.Insert(score, v) != nil {
+	curscore, ok := z.dict[v.String()]
+	if !ok {
+		return false
+	}
+	/* Remove and re-insert when score changes. The node is found by the
+	 * old score, since the skiplist is ordered by it. */
+	if z.zsl.Delete(curscore, v) && z.zsl.Insert(score, v) != nil {
 		z.dict[v.String()] = score
 		return true
 	}
@@ -108,6 +132,390 @@ func (z *ZSetSkiplist) GetRank(score float64, v rtype.String) uint {
 	return z.zsl.GetRank(score, v)
 }
 
+func (z *ZSetSkiplist) FirstInRange(r *rtype.ZRangeSpec) rtype.ZSetItem {
+	if ln := z.zsl.FirstInRange(r); ln != nil {
+		return &ZSetSkiplistItem{e: ln}
+	}
+	return nil
+}
+
+func (z *ZSetSkiplist) LastInRange(r *rtype.ZRangeSpec) rtype.ZSetItem {
+	if ln := z.zsl.LastInRange(r); ln != nil {
+		return &ZSetSkiplistItem{e: ln}
+	}
+	return nil
+}
+
+func (z *ZSetSkiplist) FirstInLexRange(r *rtype.ZLexRangeSpec) rtype.ZSetItem {
+	if ln := z.zsl.FirstInLexRange(r); ln != nil {
+		return &ZSetSkiplistItem{e: ln}
+	}
+	return nil
+}
+
+func (z *ZSetSkiplist) LastInLexRange(r *rtype.ZLexRangeSpec) rtype.ZSetItem {
+	if ln := z.zsl.LastInLexRange(r); ln != nil {
+		return &ZSetSkiplistItem{e: ln}
+	}
+	return nil
+}
+
+func (z *ZSetSkiplist) DeleteRangeByScore(r *rtype.ZRangeSpec) int {
+	return int(z.zsl.DeleteRangeByScore(r, z.dict))
+}
+
+func (z *ZSetSkiplist) DeleteRangeByLex(r *rtype.ZLexRangeSpec) int {
+	return int(z.zsl.DeleteRangeByLex(r, z.dict))
+}
+
+func (z *ZSetSkiplist) DeleteRangeByRank(start, end uint) int {
+	return int(z.zsl.DeleteRangeByRank(start, end, z.dict))
+}
+
+func (z *ZSetSkiplist) MemoryUsage(samples int) int64 {
+	var elesize int64
+	var count int
+	for x := z.zsl.Header.Level[0].Forward; x != nil && (samples == 0 || count < samples); x = x.Level[0].Forward {
+		// The skiplist node, plus the entry of the element in the dict.
+		elesize += int64(unsafe.Sizeof(*x)) + int64(len(x.Level))*int64(unsafe.Sizeof(x.Level[0])) +
+			x.Obj.MemoryUsage(0)
+		elesize += int64(unsafe.Sizeof("")+unsafe.Sizeof(x.Score)) + x.Obj.Len() + rtype.MapEntryOverhead
+		count++
+	}
+	size := int64(unsafe.Sizeof(*z)+unsafe.Sizeof(*z.zsl)) + rtype.MapOverhead
+	size += int64(unsafe.Sizeof(*z.zsl.Header)) + zskiplist.ZSkiplistMaxLevel*int64(unsafe.Sizeof(z.zsl.Header.Level[0]))
+	if count > 0 {
+		size += int64(float64(elesize) / float64(count) * float64(z.Len()))
+	}
+	return size
+}
+
 func New() rtype.ZSet {
 	return &ZSetSkiplist{zsl: zskiplist.New(), dict: make(map[string]float64)}
 }
+
+/*-----------------------------------------------------------------------------
+ * Listpack-backed sorted set API
+ *----------------------------------------------------------------------------*/
+
+/* Small sorted sets are stored as a listpack of element-score pairs, the
+ * element of every pair coming just before its score. The pairs are ordered
+ * by score, and elements with the same score lexicographically. */
+
+type ZSetListpackItem struct {
+	z    *ZSetListpack
+	eptr int
+}
+
+func (z *ZSetListpackItem) Next() rtype.ZSetItem {
+	if eptr := z.z.lp.Next(z.z.lp.Next(z.eptr)); eptr != -1 {
+		return &ZSetListpackItem{z: z.z, eptr: eptr}
+	}
+	return nil
+}
+
+func (z *ZSetListpackItem) Prev() rtype.ZSetItem {
+	if sptr := z.z.lp.Prev(z.eptr); sptr != -1 {
+		return &ZSetListpackItem{z: z.z, eptr: z.z.lp.Prev(sptr)}
+	}
+	return nil
+}
+
+func (z *ZSetListpackItem) Value() rtype.String {
+	return z.z.lp.GetString(z.eptr)
+}
+
+func (z *ZSetListpackItem) Score() float64 {
+	return z.z.getScore(z.z.lp.Next(z.eptr))
+}
+
+type ZSetListpack struct {
+	lp *listpack.Listpack
+}
+
+func (z *ZSetListpack) getScore(sptr int) float64 {
+	s, v, isInt := z.lp.Get(sptr)
+	if isInt {
+		return float64(v)
+	}
+	score, _ := strconv.ParseFloat(string(s), 64)
+	return score
+}
+
+/* Compare the element at eptr with cstr, the same as zzlCompareElements()
+ * in Redis. Return 0 for equal, < 0 for "smaller" and > 0 for "bigger". */
+func (z *ZSetListpack) compareElements(eptr int, cstr []byte) int {
+	return bytes.Compare(z.getElement(eptr), cstr)
+}
+
+/* Find the pointer to the element v, return -1 when it is not part of the
+ * sorted set. */
+func (z *ZSetListpack) find(v rtype.String) (eptr int, score float64) {
+	ele := v.Bytes()
+	for eptr = z.lp.First(); eptr != -1; eptr = z.lp.Next(z.lp.Next(eptr)) {
+		if z.lp.Compare(eptr, ele) {
+			return eptr, z.getScore(z.lp.Next(eptr))
+		}
+	}
+	return -1, 0
+}
+
+// Insert (element, score) pair in listpack. This function assumes the element is not yet present.
+func (z *ZSetListpack) insert(score float64, ele []byte) {
+	scorebuf := strconv.AppendFloat(nil, score, 'g', -1, 64)
+	for eptr := z.lp.First(); eptr != -1; eptr = z.lp.Next(z.lp.Next(eptr)) {
+		s := z.getScore(z.lp.Next(eptr))
+		if s > score || (s == score && z.compareElements(eptr, ele) > 0) {
+			/* First element with score larger than score for element to be
+			 * inserted, or with the same score and a bigger element. This
+			 * means we should take its spot in the list to maintain
+			 * ordering. Insert the element before it, then the score just
+			 * after the inserted element. */
+			eptr = z.lp.Insert(ele, eptr, listpack.LP_BEFORE)
+			z.lp.Insert(scorebuf, eptr, listpack.LP_AFTER)
+			return
+		}
+	}
+	// Push on tail of list when it was not yet inserted.
+	z.lp.Append(ele)
+	z.lp.Append(scorebuf)
+}
+
+func (z *ZSetListpack) Add(score float64, v rtype.String) bool {
+	z.insert(score, v.Bytes())
+	return true
+}
+
+func (z *ZSetListpack) Update(score float64, v rtype.String) bool {
+	if eptr, _ := z.find(v); eptr != -1 {
+		z.lp.DeleteRange(eptr, 2)
+		z.insert(score, v.Bytes())
+		return true
+	}
+	return false
+}
+
+func (z *ZSetListpack) Get(v rtype.String) (float64, bool) {
+	eptr, score := z.find(v)
+	return score, eptr != -1
+}
+
+func (z *ZSetListpack) Delete(score float64, v rtype.String) bool {
+	if eptr, _ := z.find(v); eptr != -1 {
+		z.lp.DeleteRange(eptr, 2)
+		return true
+	}
+	return false
+}
+
+func (z *ZSetListpack) Len() int {
+	return z.lp.Length() / 2
+}
+
+func (z *ZSetListpack) Head() rtype.ZSetItem {
+	if eptr := z.lp.First(); eptr != -1 {
+		return &ZSetListpackItem{z: z, eptr: eptr}
+	}
+	return nil
+}
+
+func (z *ZSetListpack) Tail() rtype.ZSetItem {
+	if sptr := z.lp.Last(); sptr != -1 {
+		return &ZSetListpackItem{z: z, eptr: z.lp.Prev(sptr)}
+	}
+	return nil
+}
+
+// Ranks are 1-based, like in the skiplist.
+func (z *ZSetListpack) GetByRank(rank uint) rtype.ZSetItem {
+	if rank == 0 {
+		return nil
+	}
+	if eptr := z.lp.Seek(int(rank-1) * 2); eptr != -1 {
+		return &ZSetListpackItem{z: z, eptr: eptr}
+	}
+	return nil
+}
+
+func (z *ZSetListpack) GetRank(score float64, v rtype.String) uint {
+	ele := v.Bytes()
+	var rank uint = 1
+	for eptr := z.lp.First(); eptr != -1; eptr = z.lp.Next(z.lp.Next(eptr)) {
+		if z.lp.Compare(eptr, ele) {
+			return rank
+		}
+		rank++
+	}
+	return 0
+}
+
+// Returns if there is a part of the zset is in range.
+func (z *ZSetListpack) isInRange(r *rtype.ZRangeSpec) bool {
+	// Test for ranges that will always be empty.
+	if r.IsEmpty() {
+		return false
+	}
+	p := z.lp.Last() // Last score.
+	if p == -1 || !r.ValueGteMin(z.getScore(p)) {
+		return false
+	}
+	p = z.lp.Seek(1) // First score.
+	return r.ValueLteMax(z.getScore(p))
+}
+
+/* Find pointer to the first element contained in the specified range.
+ * Returns nil when no element is contained in the range. */
+func (z *ZSetListpack) FirstInRange(r *rtype.ZRangeSpec) rtype.ZSetItem {
+	// If everything is out of range, return early.
+	if !z.isInRange(r) {
+		return nil
+	}
+	for eptr := z.lp.First(); eptr != -1; eptr = z.lp.Next(z.lp.Next(eptr)) {
+		score := z.getScore(z.lp.Next(eptr))
+		if r.ValueGteMin(score) {
+			// Check if score <= max.
+			if r.ValueLteMax(score) {
+				return &ZSetListpackItem{z: z, eptr: eptr}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+/* Find pointer to the last element contained in the specified range.
+ * Returns nil when no element is contained in the range. */
+func (z *ZSetListpack) LastInRange(r *rtype.ZRangeSpec) rtype.ZSetItem {
+	// If everything is out of range, return early.
+	if !z.isInRange(r) {
+		return nil
+	}
+	for sptr := z.lp.Last(); sptr != -1; sptr = z.lp.Prev(z.lp.Prev(sptr)) {
+		score := z.getScore(sptr)
+		if r.ValueLteMax(score) {
+			// Check if score >= min.
+			if r.ValueGteMin(score) {
+				return &ZSetListpackItem{z: z, eptr: z.lp.Prev(sptr)}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+func (z *ZSetListpack) getElement(eptr int) []byte {
+	s, v, isInt := z.lp.Get(eptr)
+	if isInt {
+		s = strconv.AppendInt(nil, v, 10)
+	}
+	return s
+}
+
+// Returns if there is a part of the zset is in the lex range.
+func (z *ZSetListpack) isInLexRange(r *rtype.ZLexRangeSpec) bool {
+	// Test for ranges that will always be empty.
+	if r.IsEmpty() {
+		return false
+	}
+	p := z.lp.Last()
+	if p == -1 || !r.ValueGteMin(z.getElement(z.lp.Prev(p))) {
+		return false
+	}
+	return r.ValueLteMax(z.getElement(z.lp.First()))
+}
+
+/* Find pointer to the first element contained in the specified lex range.
+ * Returns nil when no element is contained in the range. */
+func (z *ZSetListpack) FirstInLexRange(r *rtype.ZLexRangeSpec) rtype.ZSetItem {
+	// If everything is out of range, return early.
+	if !z.isInLexRange(r) {
+		return nil
+	}
+	for eptr := z.lp.First(); eptr != -1; eptr = z.lp.Next(z.lp.Next(eptr)) {
+		ele := z.getElement(eptr)
+		if r.ValueGteMin(ele) {
+			// Check if ele <= max.
+			if r.ValueLteMax(ele) {
+				return &ZSetListpackItem{z: z, eptr: eptr}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+/* Find pointer to the last element contained in the specified lex range.
+ * Returns nil when no element is contained in the range. */
+func (z *ZSetListpack) LastInLexRange(r *rtype.ZLexRangeSpec) rtype.ZSetItem {
+	// If everything is out of range, return early.
+	if !z.isInLexRange(r) {
+		return nil
+	}
+	for sptr := z.lp.Last(); sptr != -1; sptr = z.lp.Prev(z.lp.Prev(sptr)) {
+		eptr := z.lp.Prev(sptr)
+		ele := z.getElement(eptr)
+		if r.ValueLteMax(ele) {
+			// Check if ele >= min.
+			if r.ValueGteMin(ele) {
+				return &ZSetListpackItem{z: z, eptr: eptr}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+func (z *ZSetListpack) DeleteRangeByScore(r *rtype.ZRangeSpec) (deleted int) {
+	first := z.FirstInRange(r)
+	if first == nil {
+		return 0
+	}
+	eptr := first.(*ZSetListpackItem).eptr
+	for eptr != -1 && r.ValueLteMax(z.getScore(z.lp.Next(eptr))) {
+		// Delete both the element and the score.
+		eptr = z.lp.DeleteRange(eptr, 2)
+		deleted++
+	}
+	return
+}
+
+func (z *ZSetListpack) DeleteRangeByLex(r *rtype.ZLexRangeSpec) (deleted int) {
+	first := z.FirstInLexRange(r)
+	if first == nil {
+		return 0
+	}
+	eptr := first.(*ZSetListpackItem).eptr
+	for eptr != -1 && r.ValueLteMax(z.getElement(eptr)) {
+		// Delete both the element and the score.
+		eptr = z.lp.DeleteRange(eptr, 2)
+		deleted++
+	}
+	return
+}
+
+// Delete all the elements with rank between start and end, both 1-based and inclusive.
+func (z *ZSetListpack) DeleteRangeByRank(start, end uint) int {
+	num := end - start + 1
+	if eptr := z.lp.Seek(int(start-1) * 2); eptr != -1 {
+		z.lp.DeleteRange(eptr, int(num)*2)
+		return int(num)
+	}
+	return 0
+}
+
+func (z *ZSetListpack) MemoryUsage(samples int) int64 {
+	return int64(unsafe.Sizeof(*z)) + int64(z.lp.BlobSize())
+}
+
+// Convert the listpack to a skiplist holding the same elements.
+func (z *ZSetListpack) Convert() *ZSetSkiplist {
+	zs := New().(*ZSetSkiplist)
+	for eptr := z.lp.First(); eptr != -1; eptr = z.lp.Next(z.lp.Next(eptr)) {
+		zs.Add(z.getScore(z.lp.Next(eptr)), z.lp.GetString(eptr))
+	}
+	return zs
+}
+
+func NewListpack() *ZSetListpack {
+	return &ZSetListpack{lp: listpack.New()}
+}
@@ -1,6 +1,7 @@
 package zskiplist
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
 	"strings"
@@ -75,6 +76,12 @@ func (z *ZSkiplist) String() string {
 	return fmt.Sprintf("[\n\t%s\n]", strings.Join(objs, ",\n\t"))
 }
 
+/* Elements with the same score are ordered byte-wise, like in the listpack
+ * encoding, so that lex ranges work with both encodings. */
+func compareObjects(a, b rtype.String) int {
+	return bytes.Compare(a.Bytes(), b.Bytes())
+}
+
 /* Returns a random level for the new skiplist node we are going to create.
  * The return value of this function is between 1 and ZSKIPLIST_MAXLEVEL
  * (both inclusive), with a powerlaw-alike distribution where higher
@@ -104,7 +111,7 @@ func (z *ZSkiplist) Insert(score float64, obj rtype.String) *ZSkiplistNode {
 			rank[i] = rank[i+1]
 		}
 		for x.Level[i].Forward != nil && (x.Level[i].Forward.Score < score ||
-			(x.Level[i].Forward.Score == score && rstring.CompareStringObjects(x.Level[i].Forward.Obj, obj) < 0)) {
+			(x.Level[i].Forward.Score == score && compareObjects(x.Level[i].Forward.Obj, obj) < 0)) {
 			rank[i] += x.Level[i].Span
 			x = x.Level[i].Forward
 		}
@@ -176,7 +183,7 @@ func (z *ZSkiplist) Delete(score float64, obj rtype.String) bool {
 	x := z.Header
 	for i := z.Level - 1; i >= 0; i-- {
 		for x.Level[i].Forward != nil && (x.Level[i].Forward.Score < score ||
-			(x.Level[i].Forward.Score == score && rstring.CompareStringObjects(x.Level[i].Forward.Obj, obj) < 0)) {
+			(x.Level[i].Forward.Score == score && compareObjects(x.Level[i].Forward.Obj, obj) < 0)) {
 			x = x.Level[i].Forward
 		}
 		update[i] = x
@@ -191,13 +198,224 @@ func (z *ZSkiplist) Delete(score float64, obj rtype.String) bool {
 	return false
 }
 
-// func (z *ZSkiplist) FirstInRange(zrangespec *range) {
+// Returns if there is a part of the zset is in range.
+func (z *ZSkiplist) IsInRange(r *rtype.ZRangeSpec) bool {
+	// Test for ranges that will always be empty.
+	if r.IsEmpty() {
+		return false
+	}
+	x := z.Tail
+	if x == nil || !r.ValueGteMin(x.Score) {
+		return false
+	}
+	x = z.Header.Level[0].Forward
+	if x == nil || !r.ValueLteMax(x.Score) {
+		return false
+	}
+	return true
+}
+
+/* Find the first node that is contained in the specified range.
+ * Returns nil when no element is contained in the range. */
+func (z *ZSkiplist) FirstInRange(r *rtype.ZRangeSpec) *ZSkiplistNode {
+	// If everything is out of range, return early.
+	if !z.IsInRange(r) {
+		return nil
+	}
+
+	x := z.Header
+	for i := z.Level - 1; i >= 0; i-- {
+		// Go forward while *OUT* of range.
+		for x.Level[i].Forward != nil && !r.ValueGteMin(x.Level[i].Forward.Score) {
+			x = x.Level[i].Forward
+		}
+	}
+
+	// This is an inner range, so the next node cannot be nil.
+	x = x.Level[0].Forward
+
+	// Check if score <= max.
+	if !r.ValueLteMax(x.Score) {
+		return nil
+	}
+	return x
+}
+
+/* Find the last node that is contained in the specified range.
+ * Returns nil when no element is contained in the range. */
+func (z *ZSkiplist) LastInRange(r *rtype.ZRangeSpec) *ZSkiplistNode {
+	// If everything is out of range, return early.
+	if !z.IsInRange(r) {
+		return nil
+	}
 
-// }
+	x := z.Header
+	for i := z.Level - 1; i >= 0; i-- {
+		// Go forward while *IN* range.
+		for x.Level[i].Forward != nil && r.ValueLteMax(x.Level[i].Forward.Score) {
+			x = x.Level[i].Forward
+		}
+	}
 
-// func (z *ZSkiplist) LastInRange(zrangespec *range) {
+	// This is an inner range, so this node cannot be nil.
 
-// }
+	// Check if score >= min.
+	if !r.ValueGteMin(x.Score) {
+		return nil
+	}
+	return x
+}
+
+/* Returns if there is a part of the zset is in the lex range. Lex ranges
+ * only make sense when all the elements have the same score. */
+func (z *ZSkiplist) IsInLexRange(r *rtype.ZLexRangeSpec) bool {
+	// Test for ranges that will always be empty.
+	if r.IsEmpty() {
+		return false
+	}
+	x := z.Tail
+	if x == nil || !r.ValueGteMin(x.Obj.Bytes()) {
+		return false
+	}
+	x = z.Header.Level[0].Forward
+	if x == nil || !r.ValueLteMax(x.Obj.Bytes()) {
+		return false
+	}
+	return true
+}
+
+/* Find the first node that is contained in the specified lex range.
+ * Returns nil when no element is contained in the range. */
+func (z *ZSkiplist) FirstInLexRange(r *rtype.ZLexRangeSpec) *ZSkiplistNode {
+	// If everything is out of range, return early.
+	if !z.IsInLexRange(r) {
+		return nil
+	}
+
+	x := z.Header
+	for i := z.Level - 1; i >= 0; i-- {
+		// Go forward while *OUT* of range.
+		for x.Level[i].Forward != nil && !r.ValueGteMin(x.Level[i].Forward.Obj.Bytes()) {
+			x = x.Level[i].Forward
+		}
+	}
+
+	// This is an inner range, so the next node cannot be nil.
+	x = x.Level[0].Forward
+
+	// Check if obj <= max.
+	if !r.ValueLteMax(x.Obj.Bytes()) {
+		return nil
+	}
+	return x
+}
+
+/* Find the last node that is contained in the specified lex range.
+ * Returns nil when no element is contained in the range. */
+func (z *ZSkiplist) LastInLexRange(r *rtype.ZLexRangeSpec) *ZSkiplistNode {
+	// If everything is out of range, return early.
+	if !z.IsInLexRange(r) {
+		return nil
+	}
+
+	x := z.Header
+	for i := z.Level - 1; i >= 0; i-- {
+		// Go forward while *IN* range.
+		for x.Level[i].Forward != nil && r.ValueLteMax(x.Level[i].Forward.Obj.Bytes()) {
+			x = x.Level[i].Forward
+		}
+	}
+
+	// This is an inner range, so this node cannot be nil.
+
+	// Check if obj >= min.
+	if !r.ValueGteMin(x.Obj.Bytes()) {
+		return nil
+	}
+	return x
+}
+
+/* Delete all the elements with score between min and max from the skiplist.
+ * Min and max are inclusive, so a score >= min || score <= max is deleted.
+ * Note that this function takes the reference to the hash table view of the
+ * sorted set, in order to remove the elements from the hash table too. */
+func (z *ZSkiplist) DeleteRangeByScore(r *rtype.ZRangeSpec, dict map[string]float64) (removed uint) {
+	var update [ZSkiplistMaxLevel]*ZSkiplistNode
+
+	x := z.Header
+	for i := z.Level - 1; i >= 0; i-- {
+		for x.Level[i].Forward != nil && !r.ValueGteMin(x.Level[i].Forward.Score) {
+			x = x.Level[i].Forward
+		}
+		update[i] = x
+	}
+
+	// Current node is the last with score < or <= min.
+	x = x.Level[0].Forward
+
+	// Delete nodes while in range.
+	for x != nil && r.ValueLteMax(x.Score) {
+		next := x.Level[0].Forward
+		z.deletNode(x, update[:])
+		delete(dict, x.Obj.String())
+		removed++
+		x = next
+	}
+	return
+}
+
+func (z *ZSkiplist) DeleteRangeByLex(r *rtype.ZLexRangeSpec, dict map[string]float64) (removed uint) {
+	var update [ZSkiplistMaxLevel]*ZSkiplistNode
+
+	x := z.Header
+	for i := z.Level - 1; i >= 0; i-- {
+		for x.Level[i].Forward != nil && !r.ValueGteMin(x.Level[i].Forward.Obj.Bytes()) {
+			x = x.Level[i].Forward
+		}
+		update[i] = x
+	}
+
+	// Current node is the last with element < or <= min.
+	x = x.Level[0].Forward
+
+	// Delete nodes while in range.
+	for x != nil && r.ValueLteMax(x.Obj.Bytes()) {
+		next := x.Level[0].Forward
+		z.deletNode(x, update[:])
+		delete(dict, x.Obj.String())
+		removed++
+		x = next
+	}
+	return
+}
+
+/* Delete all the elements with rank between start and end from the skiplist.
+ * Start and end are inclusive. Note that start and end need to be 1-based */
+func (z *ZSkiplist) DeleteRangeByRank(start, end uint, dict map[string]float64) (removed uint) {
+	var update [ZSkiplistMaxLevel]*ZSkiplistNode
+	var traversed uint
+
+	x := z.Header
+	for i := z.Level - 1; i >= 0; i-- {
+		for x.Level[i].Forward != nil && traversed+x.Level[i].Span < start {
+			traversed += x.Level[i].Span
+			x = x.Level[i].Forward
+		}
+		update[i] = x
+	}
+
+	traversed++
+	x = x.Level[0].Forward
+	for x != nil && traversed <= end {
+		next := x.Level[0].Forward
+		z.deletNode(x, update[:])
+		delete(dict, x.Obj.String())
+		removed++
+		traversed++
+		x = next
+	}
+	return
+}
 
 /* Find the rank for an element by both score and key.
  * Returns 0 when the element cannot be found, rank otherwise.
@@ -207,12 +425,12 @@ func (z *ZSkiplist) GetRank(score float64, obj rtype.String) (rank uint) {
 	x := z.Header
 	for i := z.Level - 1; i >= 0; i-- {
 		for x.Level[i].Forward != nil && (x.Level[i].Forward.Score < score ||
-			(x.Level[i].Forward.Score == score && rstring.CompareStringObjects(x.Level[i].Forward.Obj, obj) < 0)) {
+			(x.Level[i].Forward.Score == score && compareObjects(x.Level[i].Forward.Obj, obj) <= 0)) {
 			rank += x.Level[i].Span
 			x = x.Level[i].Forward
 		}
 		// x might be equal to zsl->header, so test if obj is non-NULL
-		if x.Obj != nil && x.Obj == obj {
+		if x.Obj != nil && rstring.EqualStringObjects(x.Obj, obj) {
 			return
 		}
 	}
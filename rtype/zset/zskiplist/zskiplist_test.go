@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/SteveZhangBit/redigo/rtype"
 	"github.com/SteveZhangBit/redigo/rtype/rstring"
 )
 
@@ -26,3 +27,70 @@ func Test(t *testing.T) {
 	// }
 	// fmt.Println(z)
 }
+
+func TestRange(t *testing.T) {
+	z := New()
+	for i := 0; i < 100; i++ {
+		z.Insert(float64(i), rstring.New([]byte(fmt.Sprintf("e%d", i))))
+	}
+
+	r := &rtype.ZRangeSpec{Min: 10, Max: 20, MinEx: true}
+	first, last := z.FirstInRange(r), z.LastInRange(r)
+	if first == nil || first.Score != 11 || last == nil || last.Score != 20 {
+		t.Fatalf("wrong range boundaries %v, %v", first, last)
+	}
+	if count := z.GetRank(last.Score, last.Obj) - z.GetRank(first.Score, first.Obj) + 1; count != 10 {
+		t.Fatalf("count is %d, expected 10", count)
+	}
+	if z.FirstInRange(&rtype.ZRangeSpec{Min: 100, Max: 200}) != nil ||
+		z.LastInRange(&rtype.ZRangeSpec{Min: 5, Max: 5, MaxEx: true}) != nil {
+		t.Fatalf("empty ranges should return nil")
+	}
+
+	z = New()
+	for _, e := range []string{"a", "b", "c", "d"} {
+		z.Insert(0, rstring.New([]byte(e)))
+	}
+	lr := &rtype.ZLexRangeSpec{Min: []byte("b"), Max: rtype.ZLexMaxString}
+	first, last = z.FirstInLexRange(lr), z.LastInLexRange(lr)
+	if first == nil || first.Obj.String() != "b" || last == nil || last.Obj.String() != "d" {
+		t.Fatalf("wrong lex range boundaries %v, %v", first, last)
+	}
+	lr = &rtype.ZLexRangeSpec{Min: rtype.ZLexMinString, Max: []byte("a"), MaxEx: true}
+	if z.FirstInLexRange(lr) != nil {
+		t.Fatalf("empty lex range should return nil")
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	z := New()
+	dict := make(map[string]float64)
+	for i := 0; i < 100; i++ {
+		obj := rstring.New([]byte(fmt.Sprintf("e%02d", i)))
+		z.Insert(float64(i), obj)
+		dict[obj.String()] = float64(i)
+	}
+
+	if n := z.DeleteRangeByScore(&rtype.ZRangeSpec{Min: 10, Max: 20, MaxEx: true}, dict); n != 10 {
+		t.Fatalf("deleted %d elements by score, expected 10", n)
+	}
+	if n := z.DeleteRangeByRank(1, 5, dict); n != 5 {
+		t.Fatalf("deleted %d elements by rank, expected 5", n)
+	}
+	lr := &rtype.ZLexRangeSpec{Min: []byte("e90"), Max: rtype.ZLexMaxString}
+	if n := z.DeleteRangeByLex(lr, dict); n != 10 {
+		t.Fatalf("deleted %d elements by lex, expected 10", n)
+	}
+	if z.Length != 75 || len(dict) != 75 {
+		t.Fatalf("length is %d and dict has %d elements, expected 75", z.Length, len(dict))
+	}
+	if x := z.Header.Level[0].Forward; x.Score != 5 || z.Tail.Score != 89 {
+		t.Fatalf("wrong head %v or tail %v", x, z.Tail)
+	}
+	for rank := uint(1); rank <= z.Length; rank++ {
+		x := z.GetElementByRank(rank)
+		if x == nil || z.GetRank(x.Score, x.Obj) != rank {
+			t.Fatalf("wrong element at rank %d", rank)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/* Basic TCP socket stuff made a bit less boring, the same as anet.c in Redis.
+ *
+ * net.Listen always uses the backlog configured in the kernel, so in order
+ * to honor the tcp-backlog option we create the listening socket by hand and
+ * then hand it over to the net package. */
+
+func anetListen(family int, sa syscall.Sockaddr, backlog int) (net.Listener, error) {
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, fmt.Errorf("creating socket: %s", err)
+	}
+	syscall.CloseOnExec(fd)
+
+	// Make sure connection-intensive things like the redis benckmark
+	// will be able to close/open sockets a zillion of times
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("setsockopt SO_REUSEADDR: %s", err)
+	}
+	if family == syscall.AF_INET6 {
+		// Serve IPv4 clients too when binding the IPv6 wildcard address.
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0)
+	}
+	if err = syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("bind: %s", err)
+	}
+	if err = syscall.Listen(fd, backlog); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("listen: %s", err)
+	}
+
+	// net.FileListener dups the descriptor, so we can close our copy.
+	f := os.NewFile(uintptr(fd), "")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+/* Create a TCP socket listening on the specified address and port. An empty
+ * address binds every interface, trying IPv6 (dual stack) first. */
+func anetTcpServer(addr string, port int, backlog int) (net.Listener, error) {
+	if addr == "" || addr == "*" {
+		sa6 := &syscall.SockaddrInet6{Port: port}
+		if l, err := anetListen(syscall.AF_INET6, sa6, backlog); err == nil {
+			return l, nil
+		}
+		return anetListen(syscall.AF_INET, &syscall.SockaddrInet4{Port: port}, backlog)
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		ips, err := net.LookupIP(addr)
+		if err != nil || len(ips) == 0 {
+			return nil, fmt.Errorf("can't resolve %s: %v", addr, err)
+		}
+		ip = ips[0]
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		sa := &syscall.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip4)
+		return anetListen(syscall.AF_INET, sa, backlog)
+	}
+	sa := &syscall.SockaddrInet6{Port: port}
+	copy(sa.Addr[:], ip.To16())
+	return anetListen(syscall.AF_INET6, sa, backlog)
+}
+
+/* Check that server.tcp_backlog can be actually enforced in Linux according
+ * to the value of /proc/sys/net/core/somaxconn, or warn about it. */
+func (r *RedigoServer) checkTcpBacklogSettings() {
+	if b, err := ioutil.ReadFile("/proc/sys/net/core/somaxconn"); err == nil {
+		if somaxconn, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && somaxconn < r.TCPBacklog {
+			r.RedigoLog(REDIS_WARNING, "WARNING: The TCP backlog setting of %d cannot be enforced because /proc/sys/net/core/somaxconn is set to the lower value of %d.", r.TCPBacklog, somaxconn)
+		}
+	}
+}
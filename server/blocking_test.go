@@ -0,0 +1,457 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* These tests exercise the blocking operations through real connections, so
+ * that the client goroutines, the timeouts and the serving of the blocked
+ * clients run concurrently. Run them with -race. */
+
+var (
+	testServerOnce sync.Once
+	testServerSock string
+)
+
+// Start a server listening only on a Unix socket, shared by all the tests.
+func startTestServer() string {
+	testServerOnce.Do(func() {
+		testServerSock = filepath.Join(os.TempDir(), fmt.Sprintf("redigo-test-%d.sock", os.Getpid()))
+		s := NewServer()
+		s.BindAddr = nil
+		s.UnixSocket = testServerSock
+		go s.Init()
+	})
+	return testServerSock
+}
+
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTestServer(t *testing.T) *testConn {
+	sock := startTestServer()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("unix", sock)
+		if err == nil {
+			return &testConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("can't connect to the test server: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (c *testConn) Close() {
+	c.conn.Close()
+}
+
+func (c *testConn) send(args ...string) {
+	c.pipeline(args)
+}
+
+// Send several commands with a single write.
+func (c *testConn) pipeline(cmds ...[]string) {
+	var buf strings.Builder
+	for _, args := range cmds {
+		fmt.Fprintf(&buf, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := c.conn.Write([]byte(buf.String())); err != nil {
+		c.t.Errorf("writing %v: %s", cmds, err)
+	}
+}
+
+/* Read a reply: status and bulk replies are returned as strings, integers as
+ * int64, multi bulk replies as []interface{}, and null replies as nil. Errors
+ * are reported to the test, as they can be read by any goroutine. */
+func (c *testConn) read() interface{} {
+	reply, err := c.readReply()
+	if err != nil {
+		c.t.Errorf("reading reply: %s", err)
+	}
+	return reply
+}
+
+func (c *testConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		elems := make([]interface{}, n)
+		for i := range elems {
+			if elems[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return elems, nil
+	default:
+		return nil, fmt.Errorf("unknown reply type %q", line)
+	}
+}
+
+func (c *testConn) do(args ...string) interface{} {
+	c.send(args...)
+	return c.read()
+}
+
+var blockedFlagsRe = regexp.MustCompile(`flags=\S*b`)
+
+// Wait until exactly n clients are blocked.
+func (c *testConn) waitBlocked(n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		list, _ := c.do("client", "list").(string)
+		if len(blockedFlagsRe.FindAllString(list, -1)) == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("%d clients never got blocked:\n%s", n, list)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+/* Producers push jobs to a few lists while consumers wait for them with
+ * BLPOP and BRPOP. Every job must be delivered exactly once, and in the
+ * order it was pushed to its list. */
+func TestBlockingPopDeliversJobsOnce(t *testing.T) {
+	const (
+		producers = 4
+		jobs      = 250 // per producer
+	)
+	// Jobs are pushed on the right of the l* lists, and on the left of r0.
+	keys := []string{"jobs:l0", "jobs:l1", "jobs:r0"}
+
+	c := dialTestServer(t)
+	defer c.Close()
+	c.do(append([]string{"del"}, keys...)...)
+
+	type delivery struct {
+		key      string
+		producer int
+		seq      int
+	}
+	var mu sync.Mutex
+	delivered := make(map[string]int)
+	received := 0
+	done := make(chan struct{})
+
+	consume := func(cmd string, keys ...string) {
+		cc := dialTestServer(t)
+		defer cc.Close()
+
+		var seen []delivery
+		defer func() {
+			/* Jobs are popped from the head of a FIFO, so a consumer must
+			 * see the jobs of a producer in a list in increasing order. */
+			last := make(map[string]int)
+			for _, d := range seen {
+				k := fmt.Sprint(d.key, d.producer)
+				if prev, ok := last[k]; ok && prev >= d.seq {
+					t.Errorf("%s delivered job %d of producer %d after job %d", d.key, d.seq, d.producer, prev)
+				}
+				last[k] = d.seq
+			}
+		}()
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			reply := cc.do(append(append([]string{cmd}, keys...), "0.05")...)
+			if reply == nil {
+				continue // Timeout.
+			}
+			kv, ok := reply.([]interface{})
+			if !ok || len(kv) != 2 {
+				t.Errorf("%s replied %v", cmd, reply)
+				return
+			}
+			job := kv[1].(string)
+			var d delivery
+			d.key = kv[0].(string)
+			fmt.Sscanf(job, "p%d:%d", &d.producer, &d.seq)
+			seen = append(seen, d)
+
+			mu.Lock()
+			delivered[job]++
+			received++
+			mu.Unlock()
+		}
+	}
+
+	var consumers sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			consume("blpop", keys[0], keys[1])
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			consume("brpop", keys[2])
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			cc := dialTestServer(t)
+			defer cc.Close()
+			for seq := 0; seq < jobs; seq++ {
+				key := keys[seq%len(keys)]
+				push := "rpush"
+				if key == "jobs:r0" {
+					push = "lpush"
+				}
+				cc.do(push, key, fmt.Sprintf("p%d:%d", p, seq))
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		n := received
+		mu.Unlock()
+		if n >= producers*jobs || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	consumers.Wait()
+
+	if len(delivered) != producers*jobs {
+		t.Errorf("%d jobs delivered, %d pushed", len(delivered), producers*jobs)
+	}
+	for job, n := range delivered {
+		if n != 1 {
+			t.Errorf("job %s delivered %d times", job, n)
+		}
+	}
+	for _, key := range keys {
+		if n := c.do("llen", key); n != int64(0) {
+			t.Errorf("%d jobs left in %s", n, key)
+		}
+	}
+}
+
+// The clients blocked for the same key are served in the order they blocked.
+func TestBlockedClientsServedInOrder(t *testing.T) {
+	c := dialTestServer(t)
+	defer c.Close()
+	c.do("del", "fifo")
+
+	var clients []*testConn
+	for i := 0; i < 5; i++ {
+		cc := dialTestServer(t)
+		defer cc.Close()
+		cc.send("blpop", "fifo", "0")
+		c.waitBlocked(i + 1)
+		clients = append(clients, cc)
+	}
+
+	c.do("rpush", "fifo", "0", "1", "2", "3", "4", "5")
+	for i, cc := range clients {
+		want := []interface{}{"fifo", strconv.Itoa(i)}
+		if reply := cc.read(); !reflect.DeepEqual(reply, want) {
+			t.Errorf("client %d got %v, expected %v", i, reply, want)
+		}
+	}
+	if reply := c.do("lrange", "fifo", "0", "-1"); !reflect.DeepEqual(reply, []interface{}{"5"}) {
+		t.Errorf("list is %v after serving the clients", reply)
+	}
+}
+
+/* The commands pipelined after a blocking one are read while the client is
+ * blocked, and they must not change the arguments of the blocked command
+ * that is executed again when the key is ready. */
+func TestBlockingPopWithPipelinedCommands(t *testing.T) {
+	c := dialTestServer(t)
+	defer c.Close()
+	c.do("del", "pipe:q", "pipe:zz")
+
+	b := dialTestServer(t)
+	defer b.Close()
+	b.pipeline([]string{"blpop", "pipe:q", "0"}, []string{"get", "pipe:zz"})
+	c.waitBlocked(1)
+	// Let the reader read the GET.
+	time.Sleep(10 * time.Millisecond)
+
+	c.do("rpush", "pipe:q", "hello")
+	if reply, want := b.read(), []interface{}{"pipe:q", "hello"}; !reflect.DeepEqual(reply, want) {
+		t.Errorf("blpop replied %v, expected %v", reply, want)
+	}
+	if reply := b.read(); reply != nil {
+		t.Errorf("get replied %v", reply)
+	}
+	if n := c.do("exists", "pipe:q"); n != int64(0) {
+		t.Errorf("the element was left in the list")
+	}
+}
+
+/* Push elements right when the timeout of the blocked clients fires: every
+ * element is either popped or left in the list, and the client gets exactly
+ * one reply, either the element or the null reply of the timeout. */
+func TestBlockingTimeoutRacesServe(t *testing.T) {
+	const iterations = 50
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			key := fmt.Sprintf("race:%d", g)
+			consumer := dialTestServer(t)
+			defer consumer.Close()
+			producer := dialTestServer(t)
+			defer producer.Close()
+			producer.do("del", key)
+
+			popped := 0
+			for i := 0; i < iterations; i++ {
+				consumer.send("blpop", key, "0.02")
+				time.Sleep(time.Duration(10+rand.Intn(20)) * time.Millisecond)
+				producer.do("rpush", key, strconv.Itoa(i))
+
+				reply := consumer.read()
+				if reply != nil {
+					popped++
+					if want := []interface{}{key, strconv.Itoa(i)}; !reflect.DeepEqual(reply, want) {
+						t.Errorf("blpop replied %v, expected %v", reply, want)
+						return
+					}
+				}
+
+				left := producer.do("llen", key)
+				if reply == nil && left != int64(1) || reply != nil && left != int64(0) {
+					t.Errorf("blpop replied %v with %v elements left", reply, left)
+					return
+				}
+				producer.do("del", key)
+
+				// A second reply for the same BLPOP would be read here.
+				if pong := consumer.do("ping"); pong != "PONG" {
+					t.Errorf("ping replied %v", pong)
+					return
+				}
+			}
+			t.Logf("%s: %d of %d elements popped before the timeout", key, popped, iterations)
+		}(g)
+	}
+	wg.Wait()
+}
+
+/* A push wakes up a chain of clients: serving a BLMOVE pushes to a list
+ * another client is blocked on, and so on. BLMPOP takes up to COUNT elements
+ * from the first non empty list. */
+func TestBlockingMoveWakeups(t *testing.T) {
+	c := dialTestServer(t)
+	defer c.Close()
+	c.do("del", "chain:a", "chain:b", "chain:c", "chain:x", "mpop:1", "mpop:2")
+
+	a := dialTestServer(t)
+	defer a.Close()
+	a.send("blmove", "chain:a", "chain:b", "LEFT", "RIGHT", "0")
+	c.waitBlocked(1)
+
+	b := dialTestServer(t)
+	defer b.Close()
+	b.send("brpoplpush", "chain:b", "chain:c", "0")
+	c.waitBlocked(2)
+
+	m := dialTestServer(t)
+	defer m.Close()
+	m.send("blmpop", "0", "2", "chain:x", "chain:c", "LEFT", "COUNT", "2")
+	c.waitBlocked(3)
+
+	c.do("rpush", "chain:a", "job")
+	if reply := a.read(); reply != "job" {
+		t.Errorf("blmove replied %v", reply)
+	}
+	if reply := b.read(); reply != "job" {
+		t.Errorf("brpoplpush replied %v", reply)
+	}
+	if reply, want := m.read(), []interface{}{"chain:c", []interface{}{"job"}}; !reflect.DeepEqual(reply, want) {
+		t.Errorf("blmpop replied %v, expected %v", reply, want)
+	}
+	if n := c.do("exists", "chain:a", "chain:b", "chain:c"); n != int64(0) {
+		t.Errorf("%d lists of the chain still exist", n)
+	}
+
+	m.send("blmpop", "0", "2", "mpop:1", "mpop:2", "RIGHT", "COUNT", "2")
+	c.waitBlocked(1)
+	c.do("rpush", "mpop:2", "e1", "e2", "e3")
+	if reply, want := m.read(), []interface{}{"mpop:2", []interface{}{"e3", "e2"}}; !reflect.DeepEqual(reply, want) {
+		t.Errorf("blmpop replied %v, expected %v", reply, want)
+	}
+	if reply := c.do("lrange", "mpop:2", "0", "-1"); !reflect.DeepEqual(reply, []interface{}{"e1"}) {
+		t.Errorf("mpop:2 is %v", reply)
+	}
+
+	// A BLMOVE to the same list rotates it, and timeouts leave lists untouched.
+	a.send("blmove", "chain:a", "chain:a", "LEFT", "RIGHT", "0.01")
+	if reply := a.read(); reply != nil {
+		t.Errorf("blmove timed out with %v", reply)
+	}
+	if n := c.do("exists", "chain:a"); n != int64(0) {
+		t.Errorf("blmove timeout created the list")
+	}
+}
@@ -2,12 +2,14 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
+	"io"
 	"net"
 	"time"
 
 	"github.com/SteveZhangBit/redigo"
 	"github.com/SteveZhangBit/redigo/protocol"
-	"io"
 )
 
 // Client flags
@@ -33,13 +35,36 @@ const (
 	REDIS_PUBSUB                         // Client is in Pub/Sub mode.
 )
 
+// Client classes for client limits, currently used only for output buffer limits.
+const (
+	REDIS_CLIENT_TYPE_NORMAL = iota // Normal req-reply clients + MONITORs
+	REDIS_CLIENT_TYPE_SLAVE         // Slaves.
+	REDIS_CLIENT_TYPE_PUBSUB        // Clients subscribed to PubSub channels.
+	REDIS_CLIENT_TYPE_COUNT
+)
+
+var clientTypeNames = []string{"normal", "replica", "pubsub"}
+
+type ClientBufferLimitConfig struct {
+	HardLimitBytes   int64
+	SoftLimitBytes   int64
+	SoftLimitSeconds int
+}
+
 type RedigoClient struct {
 	protocol.Writer
 	protocol.Reader
 
 	*RedigoPubSub
 
-	Flags int
+	id            uint64 // Client incremental unique ID.
+	Flags         int
+	authenticated bool // when requirepass is non-empty
+
+	ctime           time.Time // Client creation time
+	lastinteraction time.Time // time of the last interaction, used for timeout
+	// Time when the output buffer soft limit was reached, zero if not reached.
+	obufSoftLimitReachedTime time.Time
 
 	db     *RedigoDB
 	server *RedigoServer
@@ -48,23 +73,45 @@ type RedigoClient struct {
 	outwriter *bufio.Writer
 	lastcmd   *RedigoCommand
 
-	bpop    *ClientBlockState
-	blocked chan struct{}
+	bpop *ClientBlockState
+	/* The commands read from the socket by readQueryFromClient(), which
+	 * closes readerDone when the socket can't be read anymore. */
+	queries    chan clientQuery
+	readerDone chan struct{}
+	quit       chan struct{} // Closed when the client goroutine exits
+	// Signaled once the client was served after being blocked.
+	unblocked chan struct{}
+}
+
+type clientQuery struct {
+	arg *redigo.CommandArg
+	err error
 }
 
+/* The state of a client blocked in a blocking operation. All the fields,
+ * like the blocking state of the DBs, are only accessed holding the server
+ * lock. */
 type ClientBlockState struct {
+	Type    int // The type of the keys, REDIS_BLOCKED_LIST or REDIS_BLOCKED_ZSET
 	Timeout time.Duration
 	Keys    map[string]struct{}
+	/* The blocking command, executed again when one of the keys is ready:
+	 * this time it finds data to serve the client. */
+	Cmd *RedigoCommand
+	Arg *redigo.CommandArg
 }
 
 func NewClient() *RedigoClient {
+	now := time.Now()
 	c := &RedigoClient{
-		bpop:    &ClientBlockState{Keys: make(map[string]struct{})},
-		blocked: make(chan struct{}),
+		ctime:           now,
+		lastinteraction: now,
+		bpop:            &ClientBlockState{Keys: make(map[string]struct{})},
+		queries:         make(chan clientQuery),
+		readerDone:      make(chan struct{}),
+		quit:            make(chan struct{}),
+		unblocked:       make(chan struct{}, 1),
 	}
-	c.Writer = protocol.NewRESPWriter(c.conn)
-	c.Reader = protocol.NewRESPReader(c.conn)
-
 	return c
 }
 
@@ -85,61 +132,279 @@ func (r *RedigoClient) SelectDB(id int) bool {
 	}
 }
 
+func (r *RedigoClient) SetAuthenticated(ok bool) {
+	r.authenticated = ok
+}
+
 func (r *RedigoClient) init() {
+	r.Writer = protocol.NewRESPWriter(r.conn)
+	r.Reader = protocol.NewRESPReader(r.conn)
 	r.outwriter = bufio.NewWriter(r.conn)
 
 	r.SelectDB(0)
+	go r.readQueryFromClient()
 	go r.readNextCommand()
 }
 
 func (r *RedigoClient) Close() error {
-	r.server.RedigoLog(REDIS_DEBUG, "Closing connection on: %s", r.conn.RemoteAddr())
+	r.server.RedigoLog(REDIS_DEBUG, "Closing connection on: %s", r.addr())
 	r.server.delClient <- r
 	return r.conn.Close()
 }
 
+/* Read the commands from the socket and pass them to readNextCommand().
+ * Reading goes on while the client is blocked, so that a client closing
+ * the connection is noticed and unblocked. */
+func (r *RedigoClient) readQueryFromClient() {
+	defer close(r.readerDone)
+	for {
+		arg, err := r.Read()
+		if err == io.EOF {
+			return
+		}
+		select {
+		case r.queries <- clientQuery{arg: arg, err: err}:
+		case <-r.quit:
+			return
+		}
+	}
+}
+
 func (r *RedigoClient) readNextCommand() {
-	var arg *redigo.CommandArg
-	var err error
+	defer close(r.quit)
 
 	for {
-		// If the client is set to be blocked
-		if r.Flags&REDIS_BLOCKED > 0 {
-			if r.bpop.Timeout > 0 {
-				select {
-				case <-time.After(r.bpop.Timeout):
-					r.AddReply(protocol.NullMultiBulk)
-					r.unblock(false)
-				case <-r.blocked:
-				}
-			} else {
-				<-r.blocked
-			}
+		var q clientQuery
+		select {
+		case q = <-r.queries:
+		case <-r.readerDone:
+			r.Close()
+			return
 		}
 
-		arg, err = r.Read()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			r.AddReplyError(err.Error())
+		if q.err != nil {
+			r.AddReplyError(q.err.Error())
 			r.setProtocolError()
 		} else {
-			arg.Client = r
-			r.server.processCommand(arg)
+			q.arg.Client = r
+			r.server.processCommand(q.arg)
 
-			if err = r.Flush(); err != nil {
-				r.server.RedigoLog(REDIS_VERBOSE, "Error writing to client: %s", err)
-				break
-			} else if r.Flags&REDIS_CLOSE_AFTER_REPLY > 0 {
-				break
+			// If the client is set to be blocked, wait to be served.
+			if !r.waitUnblocked() {
+				r.Close()
+				return
 			}
 		}
+
+		if err := r.Flush(); err != nil {
+			r.server.RedigoLog(REDIS_VERBOSE, "Error writing to client: %s", err)
+			break
+		}
+		r.server.lock.Lock()
+		r.Flags &= ^REDIS_UNBLOCKED
+		flags := r.Flags
+		r.server.lock.Unlock()
+		if flags&REDIS_CLOSE_AFTER_REPLY > 0 {
+			break
+		}
 	}
 	r.Close()
 }
 
+/* Wait until a blocked client is served, or its timeout is reached.
+ * Return false if the connection was closed in the meantime. This is a
+ * no-op for clients that are not blocked. */
+func (r *RedigoClient) waitUnblocked() bool {
+	r.server.lock.Lock()
+	blocked, timeout := r.Flags&REDIS_BLOCKED > 0, r.bpop.Timeout
+	r.server.lock.Unlock()
+	if !blocked {
+		return true
+	}
+
+	// A zero timeout blocks forever, the timer channel is never ready.
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case <-r.unblocked:
+		return true
+	case <-deadline:
+	case <-r.readerDone:
+	}
+
+	/* Timeout or connection closed. The client may have been served in the
+	 * meantime by another client holding the lock: it's still blocked only
+	 * if it was not, otherwise the reply is already there and unblocked is
+	 * signaled. */
+	r.server.lock.Lock()
+	defer r.server.lock.Unlock()
+	if r.Flags&REDIS_BLOCKED == 0 {
+		<-r.unblocked
+		return true
+	}
+	r.unblock()
+	select {
+	case <-r.readerDone:
+		return false
+	default:
+		// Reply with a null reply when the timeout is reached.
+		r.AddReply(protocol.NullMultiBulk)
+		return true
+	}
+}
+
+/* Return the peer address of the client in the ip:port form. Clients
+ * connected via Unix domain socket report the socket path instead. */
+func (r *RedigoClient) addr() string {
+	if r.Flags&REDIS_UNIX_SOCKET > 0 {
+		return r.server.UnixSocket + ":0"
+	}
+	return r.conn.RemoteAddr().String()
+}
+
+/* Whether the client connected from the same host: either through the Unix
+ * domain socket or from a loopback address. */
+func (r *RedigoClient) isLocal() bool {
+	if r.Flags&REDIS_UNIX_SOCKET > 0 {
+		return true
+	}
+	if addr, ok := r.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.IsLoopback()
+	}
+	return false
+}
+
+/* Concatenate a string representing the state of a client in an human
+ * readable format, into the buffer. */
+func (r *RedigoClient) catClientInfoString(buf *bytes.Buffer) {
+	var flags []byte
+	if r.Flags&REDIS_SLAVE > 0 {
+		flags = append(flags, 'S')
+	}
+	if r.Flags&REDIS_MASTER > 0 {
+		flags = append(flags, 'M')
+	}
+	if r.Flags&REDIS_MULTI > 0 {
+		flags = append(flags, 'x')
+	}
+	if r.Flags&REDIS_BLOCKED > 0 {
+		flags = append(flags, 'b')
+	}
+	if r.Flags&REDIS_DIRTY_CAS > 0 {
+		flags = append(flags, 'd')
+	}
+	if r.Flags&REDIS_CLOSE_AFTER_REPLY > 0 {
+		flags = append(flags, 'c')
+	}
+	if r.Flags&REDIS_UNBLOCKED > 0 {
+		flags = append(flags, 'u')
+	}
+	if r.Flags&REDIS_CLOSE_ASAP > 0 {
+		flags = append(flags, 'A')
+	}
+	if r.Flags&REDIS_UNIX_SOCKET > 0 {
+		flags = append(flags, 'U')
+	}
+	if r.Flags&REDIS_READONLY > 0 {
+		flags = append(flags, 'r')
+	}
+	if len(flags) == 0 {
+		flags = append(flags, 'N')
+	}
+
+	cmd := "NULL"
+	if r.lastcmd != nil {
+		cmd = r.lastcmd.Name
+	}
+
+	now := time.Now()
+	fmt.Fprintf(buf, "id=%d addr=%s age=%d idle=%d flags=%s db=%d omem=%d cmd=%s\n",
+		r.id,
+		r.addr(),
+		int64(now.Sub(r.ctime)/time.Second),
+		int64(now.Sub(r.lastinteraction)/time.Second),
+		flags,
+		r.db.id,
+		r.Buffered(),
+		cmd)
+}
+
+/* Get the class of a client, used in order to enforce limits to different
+ * classes of clients. */
+func (r *RedigoClient) getClientType() int {
+	if r.Flags&REDIS_SLAVE > 0 && r.Flags&REDIS_MONITOR == 0 {
+		return REDIS_CLIENT_TYPE_SLAVE
+	}
+	if r.Flags&REDIS_PUBSUB > 0 {
+		return REDIS_CLIENT_TYPE_PUBSUB
+	}
+	return REDIS_CLIENT_TYPE_NORMAL
+}
+
+/* The function checks if the client reached output buffer soft or hard
+ * limit, and also update the state needed to check the soft limit as
+ * a side effect.
+ *
+ * Return value: true if the client reached the soft or the hard limit.
+ *               Otherwise false is returned. */
+func (r *RedigoClient) checkClientOutputBufferLimits() bool {
+	used := int64(r.Buffered())
+	limit := r.server.ClientObufLimits[r.getClientType()]
+
+	hard := limit.HardLimitBytes > 0 && used >= limit.HardLimitBytes
+	soft := limit.SoftLimitBytes > 0 && used >= limit.SoftLimitBytes
+
+	/* We need to check if the soft limit is reached continuously for the
+	 * specified amount of seconds. */
+	if soft {
+		if r.obufSoftLimitReachedTime.IsZero() {
+			r.obufSoftLimitReachedTime = time.Now()
+			soft = false // First time we see the soft limit reached
+		} else if time.Now().Sub(r.obufSoftLimitReachedTime) <= time.Duration(limit.SoftLimitSeconds)*time.Second {
+			soft = false // The client still did not reached the max number of seconds for the soft limit to be considered reached.
+		}
+	} else {
+		r.obufSoftLimitReachedTime = time.Time{}
+	}
+	return soft || hard
+}
+
+/* Asynchronously close a client if soft or hard limit is reached on the
+ * output buffer size. The caller can check if the client will be closed
+ * checking if the client REDIS_CLOSE_ASAP flag is set.
+ *
+ * Note: we need to close the client asynchronously because this function is
+ * called from contexts where the client can't be freed safely, i.e. from the
+ * lower level functions pushing data inside the client output buffers. */
+func (r *RedigoClient) closeClientOnOutputBufferLimitReached() {
+	if r.Flags&REDIS_CLOSE_ASAP > 0 {
+		return
+	}
+	if r.checkClientOutputBufferLimits() {
+		r.server.RedigoLog(REDIS_WARNING, "Client %s scheduled to be closed ASAP for overcoming of output buffer limits.", r.addr())
+		r.server.freeClientAsync(r)
+	}
+}
+
+/* Close the client ASAP if it reached the output buffer limits, returning
+ * true if the client is going to be closed. Commands emitting replies of
+ * unbounded size call it to stop as soon as the reply can't be delivered. */
+func (r *RedigoClient) CloseOnOutputBufferLimitReached() bool {
+	r.closeClientOnOutputBufferLimitReached()
+	return r.Flags&REDIS_CLOSE_ASAP > 0
+}
+
+/* The flags are read by CLIENT LIST from the goroutines of other clients,
+ * so they are only modified holding the server lock. */
 func (r *RedigoClient) setProtocolError() {
+	r.server.lock.Lock()
 	r.Flags |= REDIS_CLOSE_AFTER_REPLY
+	r.server.lock.Unlock()
 }
 
 func (r *RedigoClient) LookupKeyReadOrReply(key []byte, reply []byte) interface{} {
@@ -160,8 +425,10 @@ func (r *RedigoClient) LookupKeyWriteOrReply(key []byte, reply []byte) interface
 
 /*================================= blocking APIs ======================================*/
 
-// Set a client in blocking mode for the specified key, with the specified timeout
-func (r *RedigoClient) BlockForKeys(keys [][]byte, timeout time.Duration) {
+/* Set a client in blocking mode for the specified keys of type btype, with
+ * the specified timeout. */
+func (r *RedigoClient) BlockForKeys(btype int, keys [][]byte, timeout time.Duration) {
+	r.bpop.Type = btype
 	r.bpop.Timeout = timeout
 
 	for i := 0; i < len(keys); i++ {
@@ -190,16 +457,52 @@ func (r *RedigoClient) block() {
 }
 
 /* Unblock a client calling the right function depending on the kind
- * of operation the client is blocking for. */
-func (r *RedigoClient) unblock(signal bool) {
+ * of operation the client is blocking for. The client goroutine is not
+ * woken up, see wakeUp(). */
+func (r *RedigoClient) unblock() {
 	r.unblockWaitingData()
 	/* Clear the flags, and put the client in the unblocked list so that
 	 * we'll process new commands in its query buffer ASAP. */
 	r.Flags &= ^REDIS_BLOCKED
 	r.Flags |= REDIS_UNBLOCKED
 	r.server.blockedClients--
-	if signal {
-		r.blocked <- struct{}{}
+}
+
+/* Wake up the goroutine of a client served after being blocked, once the
+ * reply is ready, so that the reply is sent and the next commands are
+ * processed. */
+func (r *RedigoClient) wakeUp() {
+	r.unblocked <- struct{}{}
+}
+
+/* Return the positions of the client in the lists of the clients blocked
+ * for its keys. */
+func (r *RedigoClient) blockingPositions() map[string]int {
+	pos := make(map[string]int, len(r.bpop.Keys))
+	for key := range r.bpop.Keys {
+		for idx, c := range r.db.blockingKeys[key] {
+			if c == r {
+				pos[key] = idx
+				break
+			}
+		}
+	}
+	return pos
+}
+
+/* Move a client that blocked again, after it was served, back to the
+ * positions it had in the lists of the clients blocked for its keys, so
+ * that it doesn't lose its turn. Blocking again appended it at the end. */
+func (r *RedigoClient) restoreBlockingPositions(pos map[string]int) {
+	for key := range r.bpop.Keys {
+		cls := r.db.blockingKeys[key]
+		idx, ok := pos[key]
+		last := len(cls) - 1
+		if !ok || idx >= last || cls[last] != r {
+			continue
+		}
+		copy(cls[idx+1:], cls[idx:last])
+		cls[idx] = r
 	}
 }
 
@@ -207,22 +510,23 @@ func (r *RedigoClient) unblock(signal bool) {
  * You should never call this function directly, but unblockClient() instead. */
 func (r *RedigoClient) unblockWaitingData() {
 	for key := range r.bpop.Keys {
-		var idx int
-		var c *RedigoClient
 		// Remove this client from the list of clients waiting for this key
 		cls := r.db.blockingKeys[key]
-		for idx, c = range cls {
+		for idx, c := range cls {
 			if c == r {
+				cls = append(cls[:idx:idx], cls[idx+1:]...)
 				break
 			}
 		}
-		r.db.blockingKeys[key] = append(cls[:idx], cls[idx+1:]...)
 		// If the list is empty we need to remove it to avoid wasting memory
 		if len(cls) == 0 {
 			delete(r.db.blockingKeys, key)
+		} else {
+			r.db.blockingKeys[key] = cls
 		}
 
 		// Cleanup the client structure
 		delete(r.bpop.Keys, key)
 	}
+	r.bpop.Cmd, r.bpop.Arg = nil, nil
 }
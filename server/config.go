@@ -0,0 +1,519 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/SteveZhangBit/redigo/rtype/hash"
+	"github.com/SteveZhangBit/redigo/rtype/hyperloglog"
+	"github.com/SteveZhangBit/redigo/rtype/list"
+	"github.com/SteveZhangBit/redigo/rtype/set"
+	"github.com/SteveZhangBit/redigo/rtype/zset"
+	"github.com/SteveZhangBit/redigo/util"
+)
+
+/* The config table.
+ *
+ * Every entry is composed of the following fields:
+ *
+ * name: the name of the option, as used in the config file and by CONFIG.
+ * set: parses the arguments of the option and stores them into the server.
+ * get: returns the current value of the option as a string.
+ * mutable: whether the option can be changed at runtime with CONFIG SET.
+ *          Options that only make sense at startup (like the listening
+ *          sockets) can only be specified in the config file. */
+type configOption struct {
+	name    string
+	set     func(r *RedigoServer, argv []string) error
+	get     func(r *RedigoServer) string
+	mutable bool
+}
+
+var errConfigArgs = errors.New("wrong number of arguments")
+
+var configTable []*configOption = []*configOption{
+	{"port", setConfigPort, getConfigPort, false},
+	{"bind", setConfigBind, getConfigBind, false},
+	{"unixsocket", setConfigUnixSocket, getConfigUnixSocket, false},
+	{"unixsocketperm", setConfigUnixSocketPerm, getConfigUnixSocketPerm, false},
+	{"tcp-backlog", setConfigTCPBacklog, getConfigTCPBacklog, false},
+	{"tcp-keepalive", setConfigTCPKeepAlive, getConfigTCPKeepAlive, true},
+	{"protected-mode", setConfigProtectedMode, getConfigProtectedMode, true},
+	{"maxclients", setConfigMaxClients, getConfigMaxClients, true},
+	{"timeout", setConfigTimeout, getConfigTimeout, true},
+	{"requirepass", setConfigRequirePass, getConfigRequirePass, true},
+	{"client-output-buffer-limit", setConfigClientObufLimit, getConfigClientObufLimit, true},
+	{"maxmemory", setConfigMaxMemory, getConfigMaxMemory, true},
+	{"maxmemory-policy", setConfigMaxMemoryPolicy, getConfigMaxMemoryPolicy, true},
+	{"maxmemory-samples", setConfigMaxMemorySamples, getConfigMaxMemorySamples, true},
+	{"lfu-log-factor", setConfigLFULogFactor, getConfigLFULogFactor, true},
+	{"lfu-decay-time", setConfigLFUDecayTime, getConfigLFUDecayTime, true},
+	{"databases", setConfigDatabases, getConfigDatabases, false},
+	{"loglevel", setConfigLogLevel, getConfigLogLevel, true},
+	{"set-max-intset-entries", setConfigSetMaxIntsetEntries, getConfigSetMaxIntsetEntries, true},
+	{"list-max-listpack-size", setConfigListMaxListpackSize, getConfigListMaxListpackSize, true},
+	{"list-compress-depth", setConfigListCompressDepth, getConfigListCompressDepth, true},
+	{"set-max-listpack-entries", setConfigSetMaxListpackEntries, getConfigSetMaxListpackEntries, true},
+	{"set-max-listpack-value", setConfigSetMaxListpackValue, getConfigSetMaxListpackValue, true},
+	{"hash-max-listpack-entries", setConfigHashMaxListpackEntries, getConfigHashMaxListpackEntries, true},
+	{"hash-max-listpack-value", setConfigHashMaxListpackValue, getConfigHashMaxListpackValue, true},
+	{"zset-max-listpack-entries", setConfigZSetMaxListpackEntries, getConfigZSetMaxListpackEntries, true},
+	{"zset-max-listpack-value", setConfigZSetMaxListpackValue, getConfigZSetMaxListpackValue, true},
+	{"hll-sparse-max-bytes", setConfigHLLSparseMaxBytes, getConfigHLLSparseMaxBytes, true},
+}
+
+func lookupConfigOption(name string) *configOption {
+	name = strings.ToLower(name)
+	for _, o := range configTable {
+		if o.name == name {
+			return o
+		}
+	}
+	return nil
+}
+
+func yesnotoi(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	default:
+		return false, errors.New("argument must be 'yes' or 'no'")
+	}
+}
+
+func itoyesno(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func setConfigInt(argv []string, min, max int, x *int) error {
+	if len(argv) != 1 {
+		return errConfigArgs
+	}
+	if v, err := strconv.Atoi(argv[0]); err != nil || v < min || v > max {
+		return errors.New("Invalid argument")
+	} else {
+		*x = v
+	}
+	return nil
+}
+
+func setConfigPort(r *RedigoServer, argv []string) error {
+	if err := setConfigInt(argv, 0, 65535, &r.Port); err != nil {
+		return errors.New("Invalid port")
+	}
+	return nil
+}
+
+func getConfigPort(r *RedigoServer) string {
+	return strconv.Itoa(r.Port)
+}
+
+func setConfigBind(r *RedigoServer, argv []string) error {
+	if len(argv) == 0 {
+		return errConfigArgs
+	}
+	r.BindAddr = append([]string{}, argv...)
+	return nil
+}
+
+func getConfigBind(r *RedigoServer) string {
+	return strings.Join(r.BindAddr, " ")
+}
+
+func setConfigUnixSocket(r *RedigoServer, argv []string) error {
+	if len(argv) != 1 {
+		return errConfigArgs
+	}
+	r.UnixSocket = argv[0]
+	return nil
+}
+
+func getConfigUnixSocket(r *RedigoServer) string {
+	return r.UnixSocket
+}
+
+func setConfigUnixSocketPerm(r *RedigoServer, argv []string) error {
+	if len(argv) != 1 {
+		return errConfigArgs
+	}
+	if perm, err := strconv.ParseUint(argv[0], 8, 32); err != nil || perm > 0777 {
+		return errors.New("Invalid socket file permissions")
+	} else {
+		r.UnixSocketPerm = os.FileMode(perm)
+	}
+	return nil
+}
+
+func getConfigUnixSocketPerm(r *RedigoServer) string {
+	return fmt.Sprintf("%o", uint32(r.UnixSocketPerm))
+}
+
+func setConfigTCPBacklog(r *RedigoServer, argv []string) error {
+	if err := setConfigInt(argv, 0, math.MaxInt32, &r.TCPBacklog); err != nil {
+		return errors.New("Invalid backlog value")
+	}
+	return nil
+}
+
+func getConfigTCPBacklog(r *RedigoServer) string {
+	return strconv.Itoa(r.TCPBacklog)
+}
+
+func setConfigTCPKeepAlive(r *RedigoServer, argv []string) error {
+	if err := setConfigInt(argv, 0, math.MaxInt32, &r.TCPKeepAlive); err != nil {
+		return errors.New("Invalid tcp-keepalive value")
+	}
+	return nil
+}
+
+func getConfigTCPKeepAlive(r *RedigoServer) string {
+	return strconv.Itoa(r.TCPKeepAlive)
+}
+
+func setConfigProtectedMode(r *RedigoServer, argv []string) (err error) {
+	if len(argv) != 1 {
+		return errConfigArgs
+	}
+	r.ProtectedMode, err = yesnotoi(argv[0])
+	return
+}
+
+func getConfigProtectedMode(r *RedigoServer) string {
+	return itoyesno(r.ProtectedMode)
+}
+
+func setConfigMaxClients(r *RedigoServer, argv []string) error {
+	if err := setConfigInt(argv, 1, math.MaxInt32, &r.MaxClients); err != nil {
+		return errors.New("Invalid max clients limit")
+	}
+	return nil
+}
+
+func getConfigMaxClients(r *RedigoServer) string {
+	return strconv.Itoa(r.MaxClients)
+}
+
+func setConfigTimeout(r *RedigoServer, argv []string) error {
+	if err := setConfigInt(argv, 0, math.MaxInt32, &r.MaxIdleTime); err != nil {
+		return errors.New("Invalid timeout value")
+	}
+	return nil
+}
+
+func getConfigTimeout(r *RedigoServer) string {
+	return strconv.Itoa(r.MaxIdleTime)
+}
+
+// An empty value (CONFIG SET requirepass "") disables authentication.
+func setConfigRequirePass(r *RedigoServer, argv []string) error {
+	if len(argv) > 1 {
+		return errConfigArgs
+	}
+	r.RequirePass = strings.Join(argv, "")
+	return nil
+}
+
+func getConfigRequirePass(r *RedigoServer) string {
+	return r.RequirePass
+}
+
+/* client-output-buffer-limit <class> <hard> <soft> <soft-seconds> [...]
+ * Every class can be specified once per line, and limits of the classes not
+ * mentioned are left untouched. */
+func setConfigClientObufLimit(r *RedigoServer, argv []string) error {
+	if len(argv) == 0 || len(argv)%4 != 0 {
+		return errConfigArgs
+	}
+
+	/* Parse all the limits before setting any of them, so that a syntax
+	 * error leaves the configuration untouched. */
+	limits := r.ClientObufLimits
+	for i := 0; i < len(argv); i += 4 {
+		class := -1
+		switch strings.ToLower(argv[i]) {
+		case "normal":
+			class = REDIS_CLIENT_TYPE_NORMAL
+		case "replica", "slave":
+			class = REDIS_CLIENT_TYPE_SLAVE
+		case "pubsub":
+			class = REDIS_CLIENT_TYPE_PUBSUB
+		default:
+			return errors.New("Invalid client class specified in buffer limit configuration.")
+		}
+
+		hard, ok1 := util.MemToInt64(argv[i+1])
+		soft, ok2 := util.MemToInt64(argv[i+2])
+		seconds, err := strconv.Atoi(argv[i+3])
+		if !ok1 || !ok2 || err != nil || hard < 0 || soft < 0 || seconds < 0 {
+			return errors.New("Error in hard, soft or soft_seconds setting in client output buffer limit configuration.")
+		}
+		limits[class] = ClientBufferLimitConfig{hard, soft, seconds}
+	}
+	r.ClientObufLimits = limits
+	return nil
+}
+
+func getConfigClientObufLimit(r *RedigoServer) string {
+	var args []string
+	for class, l := range r.ClientObufLimits {
+		args = append(args, fmt.Sprintf("%s %d %d %d",
+			clientTypeNames[class], l.HardLimitBytes, l.SoftLimitBytes, l.SoftLimitSeconds))
+	}
+	return strings.Join(args, " ")
+}
+
+func setConfigMaxMemory(r *RedigoServer, argv []string) error {
+	if len(argv) != 1 {
+		return errConfigArgs
+	}
+	if x, ok := util.MemToInt64(argv[0]); !ok || x < 0 {
+		return errors.New("Invalid maxmemory value")
+	} else {
+		r.MaxMemory = x
+	}
+	if r.MaxMemory > 0 && r.dbs != nil && r.usedMemory() > r.MaxMemory {
+		r.RedigoLog(REDIS_WARNING, "WARNING: the new maxmemory value set via CONFIG SET is smaller than the current memory usage. This will result in keys eviction and/or inability to accept new write commands depending on the maxmemory-policy.")
+	}
+	return nil
+}
+
+func getConfigMaxMemory(r *RedigoServer) string {
+	return strconv.FormatInt(r.MaxMemory, 10)
+}
+
+func setConfigMaxMemoryPolicy(r *RedigoServer, argv []string) error {
+	if len(argv) != 1 {
+		return errConfigArgs
+	}
+	for i, name := range maxmemoryPolicyNames {
+		if strings.ToLower(argv[0]) == name {
+			r.MaxMemoryPolicy = i
+			return nil
+		}
+	}
+	return errors.New("Invalid maxmemory policy")
+}
+
+func getConfigMaxMemoryPolicy(r *RedigoServer) string {
+	return maxmemoryPolicyNames[r.MaxMemoryPolicy]
+}
+
+func setConfigMaxMemorySamples(r *RedigoServer, argv []string) error {
+	if err := setConfigInt(argv, 1, math.MaxInt32, &r.MaxMemorySamples); err != nil {
+		return errors.New("maxmemory-samples must be 1 or greater")
+	}
+	return nil
+}
+
+func getConfigMaxMemorySamples(r *RedigoServer) string {
+	return strconv.Itoa(r.MaxMemorySamples)
+}
+
+func setConfigLFULogFactor(r *RedigoServer, argv []string) error {
+	if err := setConfigInt(argv, 0, math.MaxInt32, &r.LFULogFactor); err != nil {
+		return errors.New("lfu-log-factor must be 0 or greater")
+	}
+	return nil
+}
+
+func getConfigLFULogFactor(r *RedigoServer) string {
+	return strconv.Itoa(r.LFULogFactor)
+}
+
+func setConfigLFUDecayTime(r *RedigoServer, argv []string) error {
+	if err := setConfigInt(argv, 0, math.MaxInt32, &r.LFUDecayTime); err != nil {
+		return errors.New("lfu-decay-time must be 0 or greater")
+	}
+	return nil
+}
+
+func getConfigLFUDecayTime(r *RedigoServer) string {
+	return strconv.Itoa(r.LFUDecayTime)
+}
+
+func setConfigDatabases(r *RedigoServer, argv []string) error {
+	if err := setConfigInt(argv, 1, 1<<20, &r.DBNum); err != nil {
+		return errors.New("Invalid number of databases")
+	}
+	return nil
+}
+
+func getConfigDatabases(r *RedigoServer) string {
+	return strconv.Itoa(r.DBNum)
+}
+
+var logLevels = []string{"debug", "verbose", "notice", "warning"}
+
+func setConfigLogLevel(r *RedigoServer, argv []string) error {
+	if len(argv) != 1 {
+		return errConfigArgs
+	}
+	for i, l := range logLevels {
+		if strings.ToLower(argv[0]) == l {
+			r.Verbosity = i
+			return nil
+		}
+	}
+	return errors.New("Invalid log level. Must be one of debug, notice, warning")
+}
+
+func getConfigLogLevel(r *RedigoServer) string {
+	return logLevels[r.Verbosity]
+}
+
+func setConfigSetMaxIntsetEntries(r *RedigoServer, argv []string) error {
+	return setConfigInt(argv, 0, math.MaxInt32, &set.MaxIntsetEntries)
+}
+
+func getConfigSetMaxIntsetEntries(r *RedigoServer) string {
+	return strconv.Itoa(set.MaxIntsetEntries)
+}
+
+func setConfigListMaxListpackSize(r *RedigoServer, argv []string) error {
+	return setConfigInt(argv, math.MinInt32, math.MaxInt32, &list.MaxListpackSize)
+}
+
+func getConfigListMaxListpackSize(r *RedigoServer) string {
+	return strconv.Itoa(list.MaxListpackSize)
+}
+
+func setConfigListCompressDepth(r *RedigoServer, argv []string) error {
+	return setConfigInt(argv, 0, math.MaxInt32, &list.CompressDepth)
+}
+
+func getConfigListCompressDepth(r *RedigoServer) string {
+	return strconv.Itoa(list.CompressDepth)
+}
+
+func setConfigSetMaxListpackEntries(r *RedigoServer, argv []string) error {
+	return setConfigInt(argv, 0, math.MaxInt32, &set.MaxListpackEntries)
+}
+
+func getConfigSetMaxListpackEntries(r *RedigoServer) string {
+	return strconv.Itoa(set.MaxListpackEntries)
+}
+
+func setConfigSetMaxListpackValue(r *RedigoServer, argv []string) error {
+	return setConfigInt(argv, 0, math.MaxInt32, &set.MaxListpackValue)
+}
+
+func getConfigSetMaxListpackValue(r *RedigoServer) string {
+	return strconv.Itoa(set.MaxListpackValue)
+}
+
+func setConfigHashMaxListpackEntries(r *RedigoServer, argv []string) error {
+	return setConfigInt(argv, 0, math.MaxInt32, &hash.MaxListpackEntries)
+}
+
+func getConfigHashMaxListpackEntries(r *RedigoServer) string {
+	return strconv.Itoa(hash.MaxListpackEntries)
+}
+
+func setConfigHashMaxListpackValue(r *RedigoServer, argv []string) error {
+	return setConfigInt(argv, 0, math.MaxInt32, &hash.MaxListpackValue)
+}
+
+func getConfigHashMaxListpackValue(r *RedigoServer) string {
+	return strconv.Itoa(hash.MaxListpackValue)
+}
+
+func setConfigZSetMaxListpackEntries(r *RedigoServer, argv []string) error {
+	return setConfigInt(argv, 0, math.MaxInt32, &zset.MaxListpackEntries)
+}
+
+func getConfigZSetMaxListpackEntries(r *RedigoServer) string {
+	return strconv.Itoa(zset.MaxListpackEntries)
+}
+
+func setConfigZSetMaxListpackValue(r *RedigoServer, argv []string) error {
+	return setConfigInt(argv, 0, math.MaxInt32, &zset.MaxListpackValue)
+}
+
+func getConfigZSetMaxListpackValue(r *RedigoServer) string {
+	return strconv.Itoa(zset.MaxListpackValue)
+}
+
+func setConfigHLLSparseMaxBytes(r *RedigoServer, argv []string) error {
+	return setConfigInt(argv, 0, math.MaxInt32, &hyperloglog.SparseMaxBytes)
+}
+
+func getConfigHLLSparseMaxBytes(r *RedigoServer) string {
+	return strconv.Itoa(hyperloglog.SparseMaxBytes)
+}
+
+/*================================ Config file loading =================================== */
+
+/* Load the server configuration from the specified filename.
+ * The file format is the same of redis.conf: one option per line, with the
+ * option name followed by its arguments. Empty lines and lines starting with
+ * '#' are skipped. Any error is fatal, as in Redis. */
+func (r *RedigoServer) LoadServerConfig(filename string) {
+	f, err := os.Open(filename)
+	if err != nil {
+		r.RedigoLog(REDIS_WARNING, "Fatal error, can't open config file '%s'", filename)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for linenum := 1; scanner.Scan(); linenum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		argv := strings.Fields(line)
+		if err = r.setConfigOption(argv[0], argv[1:]); err != nil {
+			r.RedigoLog(REDIS_WARNING|REDIS_LOG_RAW, "\n*** FATAL CONFIG FILE ERROR ***")
+			r.RedigoLog(REDIS_WARNING|REDIS_LOG_RAW, "Reading the configuration file, at line %d", linenum)
+			r.RedigoLog(REDIS_WARNING|REDIS_LOG_RAW, ">>> '%s'", line)
+			r.RedigoLog(REDIS_WARNING|REDIS_LOG_RAW, "%s", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func (r *RedigoServer) setConfigOption(name string, argv []string) error {
+	if o := lookupConfigOption(name); o == nil {
+		return errors.New("Bad directive or wrong number of arguments")
+	} else {
+		return o.set(r, argv)
+	}
+}
+
+/*================================ CONFIG GET / SET =================================== */
+
+/* Return the name-value pairs of all the options matching the glob-style
+ * pattern, ready to be sent to the client as a flat multi bulk reply. */
+func (r *RedigoServer) ConfigGet(pattern string) []string {
+	var pairs []string
+	for _, o := range configTable {
+		if util.StringMatchPattern(pattern, o.name, true) {
+			pairs = append(pairs, o.name, o.get(r))
+		}
+	}
+	return pairs
+}
+
+/* Set the option to the new value. Like in Redis, options taking multiple
+ * arguments receive them as a single space separated string. */
+func (r *RedigoServer) ConfigSet(name string, value string) error {
+	o := lookupConfigOption(name)
+	if o == nil || !o.mutable {
+		return fmt.Errorf("Unsupported CONFIG parameter: %s", name)
+	}
+	if err := o.set(r, strings.Fields(value)); err != nil {
+		return fmt.Errorf("Invalid argument '%s' for CONFIG SET '%s'", value, name)
+	}
+	return nil
+}
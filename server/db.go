@@ -4,10 +4,23 @@ import (
 	"fmt"
 	"math/rand"
 	"time"
+	"unsafe"
 
+	"github.com/SteveZhangBit/redigo"
 	"github.com/SteveZhangBit/redigo/rtype"
 )
 
+/* Estimated size of the entries of every key in the maps of a DB, not
+ * counting the bytes of the key itself. */
+const (
+	dictEntrySize   = int64(unsafe.Sizeof("")+unsafe.Sizeof(interface{}(nil))) + rtype.MapEntryOverhead
+	lruEntrySize    = int64(unsafe.Sizeof("")+unsafe.Sizeof(uint32(0))) + rtype.MapEntryOverhead
+	expireEntrySize = int64(unsafe.Sizeof("")+unsafe.Sizeof(time.Duration(0))) + rtype.MapEntryOverhead
+)
+
+// Max number of hashes with field expires to check per DB every cron loop.
+const ACTIVE_EXPIRE_CYCLE_HASHES_PER_LOOP = 20
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
@@ -20,13 +33,21 @@ type RedigoDB struct {
 	readyKeys    map[string]struct{}
 
 	dict    map[string]interface{}
-	expires map[string]time.Duration
+	expires map[string]time.Duration // Unix time of expiration of the keys
+	/* LRU time (relative to server.lruclock) or LFU data (least significant
+	 * 8 bits frequency and most significant 16 bits access time) of every
+	 * key, the same as the lru field of robj in Redis. */
+	lru map[string]uint32
+	// Keys of the hashes having fields with an expire.
+	hexpires map[string]struct{}
 }
 
 func NewDB() *RedigoDB {
 	return &RedigoDB{
 		dict:         make(map[string]interface{}),
 		expires:      make(map[string]time.Duration),
+		lru:          make(map[string]uint32),
+		hexpires:     make(map[string]struct{}),
 		blockingKeys: make(map[string][]*RedigoClient),
 		readyKeys:    make(map[string]struct{}),
 	}
@@ -41,18 +62,18 @@ func (r *RedigoDB) GetDict() map[string]interface{} {
 }
 
 func (r *RedigoDB) LookupKey(key []byte) interface{} {
-	/* TODO: Update the access time for the ageing algorithm.
-	 * Don't do it if we have a saving child, as this will trigger
-	 * a copy on write madness. */
-
-	o, _ := r.dict[string(key)]
+	o, ok := r.dict[string(key)]
+	if ok {
+		// Update the access time for the ageing algorithm.
+		r.lru[string(key)] = r.server.touchLRU(r.lru[string(key)])
+	}
 	return o
 }
 
 func (r *RedigoDB) LookupKeyRead(key []byte) interface{} {
 	r.ExpireIfNeed(key)
 
-	if o, ok := r.dict[string(key)]; !ok {
+	if o := r.LookupKey(key); o == nil {
 		r.server.keyspaceMisses++
 		return nil
 	} else {
@@ -73,8 +94,15 @@ func (r *RedigoDB) LookupKeyWrite(key []byte) interface{} {
 func (r *RedigoDB) Add(key []byte, val interface{}) {
 	if _, ok := r.dict[string(key)]; !ok {
 		r.dict[string(key)] = val
-		if _, ok = val.(rtype.List); ok {
-			r.signalListAsReady(key)
+		r.lru[string(key)] = r.server.initialLRU()
+		switch v := val.(type) {
+		case rtype.List, rtype.ZSet:
+			r.signalKeyAsReady(key)
+		case rtype.HashMap:
+			// A hash moved from another key may have fields with an expire.
+			if v.HasExpires() {
+				r.hexpires[string(key)] = struct{}{}
+			}
 		}
 	} else {
 		panic(fmt.Sprintf("The key %s already exists.", key))
@@ -95,6 +123,8 @@ func (r *RedigoDB) Delete(key []byte) (ok bool) {
 	}
 	if _, ok = r.dict[string(key)]; ok {
 		delete(r.dict, string(key))
+		delete(r.lru, string(key))
+		delete(r.hexpires, string(key))
 	}
 	return
 }
@@ -110,8 +140,12 @@ func (r *RedigoDB) SetKeyPersist(key []byte, val interface{}) {
 		r.Add(key, val)
 	} else {
 		r.dict[string(key)] = val
+		switch val.(type) {
+		case rtype.List, rtype.ZSet:
+			r.signalKeyAsReady(key)
+		}
 	}
-	r.removeExpire(key)
+	r.RemoveExpire(key)
 	r.SignalModifyKey(key)
 }
 
@@ -120,6 +154,63 @@ func (r *RedigoDB) Exists(key []byte) (ok bool) {
 	return
 }
 
+/* Return the memory used by the key, its value and its entries in the
+ * DB, sampling up to samples elements of aggregate values. Like the OBJECT
+ * command, the key is not expired and its access time is not updated. */
+func (r *RedigoDB) MemoryUsage(key []byte, samples int) (int64, bool) {
+	o, ok := r.dict[string(key)]
+	if !ok {
+		return 0, false
+	}
+	usage := o.(rtype.Object).MemoryUsage(samples)
+	usage += int64(len(key)) + dictEntrySize + lruEntrySize
+	return usage, true
+}
+
+/* Return the approximated time elapsed since the last access to the key,
+ * without updating it. Only meaningful when the LRU field holds the access
+ * time, that is when an LFU maxmemory policy is not selected. */
+func (r *RedigoDB) GetIdleTime(key []byte) (time.Duration, bool) {
+	if _, ok := r.dict[string(key)]; !ok {
+		return 0, false
+	}
+	return r.server.estimateObjectIdleTime(r.lru[string(key)]), true
+}
+
+/* Return the logarithmic access frequency counter of the key, decremented
+ * according to lfu-decay-time. Only meaningful when an LFU maxmemory policy
+ * is selected. */
+func (r *RedigoDB) GetLFUFrequency(key []byte) (int, bool) {
+	if _, ok := r.dict[string(key)]; !ok {
+		return 0, false
+	}
+	return int(r.server.LFUDecrAndReturn(r.lru[string(key)])), true
+}
+
+/* Return up to count keys taken at random from the key space, or from the
+ * keys with an expire set if volatile is true. The random iteration order of
+ * Go maps makes this cheap, even if the distribution is not perfect: the same
+ * is true for dictGetSomeKeys() in Redis. */
+func (r *RedigoDB) sampleKeys(count int, volatile bool) []string {
+	keys := make([]string, 0, count)
+	if volatile {
+		for k := range r.expires {
+			if len(keys) == count {
+				break
+			}
+			keys = append(keys, k)
+		}
+	} else {
+		for k := range r.dict {
+			if len(keys) == count {
+				break
+			}
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
 func (r *RedigoDB) RandomKey() (key []byte) {
 	keys := make([]string, len(r.dict))
 
@@ -151,7 +242,10 @@ func (r *RedigoDB) SignalModifyKey(key []byte) {
 
 }
 
-func (r *RedigoDB) signalListAsReady(key []byte) {
+/* If the specified key has clients blocked waiting for list or sorted set
+ * pushes, this function will put the key reference into the
+ * server.ready_keys list. */
+func (r *RedigoDB) signalKeyAsReady(key []byte) {
 	// No clients blocking for this key? No need to queue it
 	if _, ok := r.blockingKeys[string(key)]; !ok {
 		return
@@ -174,26 +268,126 @@ func (r *RedigoDB) signalListAsReady(key []byte) {
  * Expires API
  *----------------------------------------------------------------------------*/
 
+/* Expire times are stored as Unix times in the expires dict, but a
+ * time.Duration is used as the type since the DB interface predates the
+ * implementation. */
+func unixTime(t time.Time) time.Duration {
+	return time.Duration(t.UnixNano())
+}
+
+/* This function is called when we are going to perform some operation
+ * in a given key, but such key may be already logically expired even if
+ * it still exists in the database. The main way this function is called
+ * is via lookupKey*() family of functions.
+ *
+ * The expired fields of a hash are deleted as well, and the hash is deleted
+ * if no field is left.
+ *
+ * The return value of the function is false if the key is still valid,
+ * otherwise the function returns true if the key is expired, and deletes
+ * it from the database. */
 func (r *RedigoDB) ExpireIfNeed(key []byte) bool {
-	return false
+	when := r.GetExpire(key)
+	if when < 0 { // No expire for this key
+		return r.expireHashFieldsIfNeed(key)
+	}
+	if unixTime(time.Now()) <= when {
+		return r.expireHashFieldsIfNeed(key)
+	}
+
+	// Delete the key
+	r.server.StatExpiredKeys++
+	r.Delete(key)
+	r.SignalModifyKey(key)
+	return true
 }
 
+/* Return the expire time of the specified key, or -1 if no expire
+ * is associated with this key (i.e. the key is non volatile) */
 func (r *RedigoDB) GetExpire(key []byte) time.Duration {
+	if when, ok := r.expires[string(key)]; ok {
+		return when
+	}
 	return time.Duration(-1)
 }
 
-func (r *RedigoDB) SetExpire(key []byte, t time.Duration) {
-
+/* Set an expire to the specified key. The expire time is the Unix time at
+ * which the key will be removed. The key must exist. */
+func (r *RedigoDB) SetExpire(key []byte, when time.Duration) {
+	if _, ok := r.dict[string(key)]; !ok {
+		panic(fmt.Sprintf("Set expire on key %s that doesn't exist.", key))
+	}
+	r.expires[string(key)] = when
 }
 
-func (r *RedigoDB) removeExpire(key []byte) {
-
+/* Remove the expire of the specified key, making it persistent. Return
+ * false if the key had no expire. */
+func (r *RedigoDB) RemoveExpire(key []byte) bool {
+	if _, ok := r.expires[string(key)]; ok {
+		delete(r.expires, string(key))
+		return true
+	}
+	return false
 }
 
-// func (r *RedigoDB) setExpire(key string, when time.Time) {
+/* Set an expire to the field of the hash stored at the specified key. The
+ * key is tracked so that the field is deleted by the active expire cycle
+ * even if the hash is never accessed again. The key and the field must
+ * exist. */
+func (r *RedigoDB) SetFieldExpire(key []byte, field []byte, when time.Duration) {
+	h, ok := r.dict[string(key)].(rtype.HashMap)
+	if !ok {
+		panic(fmt.Sprintf("Set field expire on key %s that is not a hash.", key))
+	}
+	h.SetExpire(field, when)
+	r.hexpires[string(key)] = struct{}{}
+}
 
-// }
+/* Delete the fields of the hash stored at key that are logically expired,
+ * the same way ExpireIfNeed does for the keys. Return true if no field is
+ * left, so that the hash was deleted from the database. */
+func (r *RedigoDB) expireHashFieldsIfNeed(key []byte) bool {
+	h, ok := r.dict[string(key)].(rtype.HashMap)
+	if !ok || !h.HasExpires() {
+		return false
+	}
+	deleted := h.DeleteExpired(unixTime(time.Now()))
+	if deleted == 0 {
+		return false
+	}
 
-// func (r *RedigoDB) getExpire(key string) time.Time {
+	r.server.StatExpiredFields += deleted
+	r.server.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_HASH, "hexpired", key, r.id)
+	if h.Len() == 0 {
+		r.Delete(key)
+		r.server.NotifyKeyspaceEvent(redigo.REDIS_NOTIFY_GENERIC, "del", key, r.id)
+	}
+	r.SignalModifyKey(key)
+	return h.Len() == 0
+}
 
-// }
+/* Try to delete the expired fields of the hashes of every DB. Since most of
+ * the hashes are not accessed again once their fields are set, this is what
+ * reclaims the memory of the expired fields in the common case.
+ *
+ * Only ACTIVE_EXPIRE_CYCLE_HASHES_PER_LOOP hashes per DB are checked at every
+ * call, so that the cron never blocks the server for long. The random
+ * iteration order of the maps gives every tracked hash a chance. Hashes
+ * left without field expires are no longer tracked. */
+func (r *RedigoServer) activeExpireHashFieldsCycle() {
+	for _, db := range r.dbs {
+		checked := 0
+		for key := range db.hexpires {
+			if checked == ACTIVE_EXPIRE_CYCLE_HASHES_PER_LOOP {
+				break
+			}
+			checked++
+			if db.ExpireIfNeed([]byte(key)) {
+				continue
+			}
+			if h, ok := db.dict[key].(rtype.HashMap); !ok || !h.HasExpires() {
+				delete(db.hexpires, key)
+			}
+		}
+	}
+}
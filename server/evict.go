@@ -0,0 +1,420 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"runtime/metrics"
+	"time"
+
+	"github.com/SteveZhangBit/redigo/rtype"
+)
+
+/* ----------------------------------------------------------------------------
+ * Data structures
+ * --------------------------------------------------------------------------*/
+
+const (
+	REDIS_MAXMEMORY_VOLATILE_LRU = iota
+	REDIS_MAXMEMORY_VOLATILE_LFU
+	REDIS_MAXMEMORY_VOLATILE_TTL
+	REDIS_MAXMEMORY_VOLATILE_RANDOM
+	REDIS_MAXMEMORY_ALLKEYS_LRU
+	REDIS_MAXMEMORY_ALLKEYS_LFU
+	REDIS_MAXMEMORY_ALLKEYS_RANDOM
+	REDIS_MAXMEMORY_NO_EVICTION
+)
+
+var maxmemoryPolicyNames = []string{
+	"volatile-lru",
+	"volatile-lfu",
+	"volatile-ttl",
+	"volatile-random",
+	"allkeys-lru",
+	"allkeys-lfu",
+	"allkeys-random",
+	"noeviction",
+}
+
+const (
+	REDIS_DEFAULT_MAXMEMORY_SAMPLES = 5
+	REDIS_DEFAULT_LFU_LOG_FACTOR    = 10
+	REDIS_DEFAULT_LFU_DECAY_TIME    = 1
+)
+
+const (
+	REDIS_LRU_BITS             = 24
+	REDIS_LRU_CLOCK_MAX        = (1 << REDIS_LRU_BITS) - 1 // Max value of obj->lru
+	REDIS_LRU_CLOCK_RESOLUTION = 1000                      // LRU clock resolution in ms
+
+	LFU_INIT_VAL = 5
+)
+
+/* To improve the quality of the LRU approximation we take a set of keys
+ * that are good candidate for eviction across freeMemoryIfNeeded() calls.
+ *
+ * Entries inside the eviciton pool are taken ordered by idle time, putting
+ * greater idle times to the right (ascending order).
+ *
+ * When an LFU policy is used instead, a reverse frequency indication is used
+ * instead of the idle time, so that we still evict by larger value (larger
+ * inverse frequency means to evict keys with the least frequent accesses). */
+const EVPOOL_SIZE = 16
+
+type evictionPoolEntry struct {
+	idle uint64 // Object idle time (inverse frequency for LFU)
+	key  string // Key name.
+	dbid int    // Key DB number.
+}
+
+/* ----------------------------------------------------------------------------
+ * Implementation of eviction, aging and LRU
+ * --------------------------------------------------------------------------*/
+
+/* Return the LRU clock, based on the clock resolution. This is a time
+ * in a reduced-bits format that can be used to set and check the
+ * object->lru field of redisObject structures. */
+func getLRUClock() uint32 {
+	return uint32(time.Now().UnixNano()/int64(time.Millisecond)/REDIS_LRU_CLOCK_RESOLUTION) & REDIS_LRU_CLOCK_MAX
+}
+
+/* This function is used to obtain the current LRU clock.
+ * If the current resolution is lower than the frequency we refresh the
+ * LRU clock (as it should be in production servers) we return the
+ * precomputed value, otherwise we need to resort to a system call. */
+func (r *RedigoServer) LRUClock() uint32 {
+	if 1000/REDIS_DEFAULT_HZ <= REDIS_LRU_CLOCK_RESOLUTION {
+		return r.lruclock
+	}
+	return getLRUClock()
+}
+
+/* Given an object returns the min number of milliseconds the object was never
+ * requested, using an approximated LRU algorithm. */
+func (r *RedigoServer) estimateObjectIdleTime(lru uint32) time.Duration {
+	lruclock := r.LRUClock()
+	if lruclock >= lru {
+		return time.Duration(lruclock-lru) * REDIS_LRU_CLOCK_RESOLUTION * time.Millisecond
+	}
+	return time.Duration(lruclock+(REDIS_LRU_CLOCK_MAX-lru)) * REDIS_LRU_CLOCK_RESOLUTION * time.Millisecond
+}
+
+/* ----------------------------------------------------------------------------
+ * LFU (Least Frequently Used) implementation.
+ *
+ * We have 24 total bits of space in each object in order to implement
+ * an LFU (Least Frequently Used) eviction policy, since we re-use the
+ * LRU field for this purpose.
+ *
+ * We split the 24 bits into two fields:
+ *
+ *          16 bits      8 bits
+ *     +----------------+--------+
+ *     + Last decr time | LOG_C  |
+ *     +----------------+--------+
+ *
+ * LOG_C is a logarithmic counter that provides an indication of the access
+ * frequency. However this field must also be decremented otherwise what used
+ * to be a frequently accessed key in the past, will remain ranked like that
+ * forever, while we want the algorithm to adapt to access pattern changes.
+ *
+ * So the remaining 16 bits are used in order to store the "decrement time",
+ * a reduced-precision Unix time (we take 16 bits of the time converted
+ * in minutes since we don't care about wrapping around) where the LOG_C
+ * counter is halved if it has an high value, or just decremented if it
+ * has a low value.
+ * --------------------------------------------------------------------------*/
+
+/* Return the current time in minutes, just taking the least significant
+ * 16 bits. The returned time is suitable to be stored as LDT (last decrement
+ * time) for the LFU implementation. */
+func LFUGetTimeInMinutes() uint32 {
+	return uint32(time.Now().Unix()/60) & 65535
+}
+
+/* Given an object last access time, compute the minimum number of minutes
+ * that elapsed since the last access. Handle overflow (ldt greater than
+ * the current 16 bits minutes time) considering the time as wrapping
+ * exactly once. */
+func LFUTimeElapsed(ldt uint32) uint32 {
+	now := LFUGetTimeInMinutes()
+	if now >= ldt {
+		return now - ldt
+	}
+	return 65535 - ldt + now
+}
+
+/* Logarithmically increment a counter. The greater is the current counter value
+ * the less likely is that it gets really implemented. Saturate it at 255. */
+func (r *RedigoServer) LFULogIncr(counter uint32) uint32 {
+	if counter == 255 {
+		return 255
+	}
+	baseval := float64(counter) - LFU_INIT_VAL
+	if baseval < 0 {
+		baseval = 0
+	}
+	p := 1.0 / (baseval*float64(r.LFULogFactor) + 1)
+	if rand.Float64() < p {
+		counter++
+	}
+	return counter
+}
+
+/* If the object decrement time is reached decrement the LFU counter but
+ * do not update LFU fields of the object, we update the access time
+ * and counter in an explicit way when the object is really accessed.
+ * The counter is decremented by one for every lfu-decay-time minutes
+ * elapsed since the last decrement time.
+ * Return the object frequency counter.
+ *
+ * This function is used in order to scan the dataset for the best object
+ * to fit: as we check for the candidate, we incrementally decrement the
+ * counter of the scanned objects if needed. */
+func (r *RedigoServer) LFUDecrAndReturn(lru uint32) uint32 {
+	ldt := lru >> 8
+	counter := lru & 255
+	var periods uint32
+	if r.LFUDecayTime > 0 {
+		periods = LFUTimeElapsed(ldt) / uint32(r.LFUDecayTime)
+	}
+	if periods > 0 {
+		if periods > counter {
+			return 0
+		}
+		return counter - periods
+	}
+	return counter
+}
+
+/* Return true if an LFU maxmemory policy is selected, so the LRU field of
+ * the objects holds the LFU data instead of the access time. */
+func (r *RedigoServer) IsLFUPolicy() bool {
+	return r.MaxMemoryPolicy == REDIS_MAXMEMORY_VOLATILE_LFU || r.MaxMemoryPolicy == REDIS_MAXMEMORY_ALLKEYS_LFU
+}
+
+/* Return the value the LRU field of a new object is initialized with. */
+func (r *RedigoServer) initialLRU() uint32 {
+	if r.IsLFUPolicy() {
+		return LFUGetTimeInMinutes()<<8 | LFU_INIT_VAL
+	}
+	return r.LRUClock()
+}
+
+/* Return the updated LRU field of an object that is being accessed. */
+func (r *RedigoServer) touchLRU(lru uint32) uint32 {
+	if r.IsLFUPolicy() {
+		counter := r.LFUDecrAndReturn(lru)
+		counter = r.LFULogIncr(counter)
+		return LFUGetTimeInMinutes()<<8 | counter
+	}
+	return r.LRUClock()
+}
+
+/* ----------------------------------------------------------------------------
+ * Memory usage
+ * --------------------------------------------------------------------------*/
+
+var memorySamples = []metrics.Sample{
+	{Name: "/memory/classes/heap/objects:bytes"},
+	{Name: "/gc/cycles/total:gc-cycles"},
+	{Name: "/memory/classes/total:bytes"},
+	{Name: "/memory/classes/heap/released:bytes"},
+}
+
+/* Return the amount of memory used by the server. We take the bytes of the
+ * heap objects reported by the Go runtime, which are only released by the
+ * garbage collector: the memory of the keys we evicted is deducted until the
+ * next GC cycle so that we don't evict the whole dataset while waiting for
+ * the collector to notice. */
+func (r *RedigoServer) usedMemory() int64 {
+	metrics.Read(memorySamples)
+	used := int64(memorySamples[0].Value.Uint64())
+	if cycles := memorySamples[1].Value.Uint64(); cycles != r.lastGCCycles {
+		r.lastGCCycles = cycles
+		r.evictedNotCollected = 0
+	}
+
+	if used -= r.evictedNotCollected; used < 0 {
+		used = 0
+	}
+	if used > r.StatPeakMemory {
+		r.StatPeakMemory = used
+	}
+	return used
+}
+
+/* Return the memory obtained by the Go runtime from the OS and not released
+ * yet, which is the closest thing to the RSS of the process we can get. */
+func residentMemory() int64 {
+	metrics.Read(memorySamples)
+	return int64(memorySamples[2].Value.Uint64() - memorySamples[3].Value.Uint64())
+}
+
+/* ----------------------------------------------------------------------------
+ * The external API for eviction: freeMemroyIfNeeded() is called by the
+ * server when there is data to add in order to make space if needed.
+ * --------------------------------------------------------------------------*/
+
+/* This is an helper function for freeMemoryIfNeeded(), it is used in order
+ * to populate the evictionPool with a few entries every time we want to
+ * expire a key. Keys with idle time smaller than one of the current
+ * keys are added. Keys are always added if there are free entries.
+ *
+ * We insert keys on place in ascending order, so keys with the smaller
+ * idle time are on the left, and keys with the higher idle time on the
+ * right. */
+func (r *RedigoServer) evictionPoolPopulate(db *RedigoDB, volatile bool, pool []evictionPoolEntry) []evictionPoolEntry {
+	for _, key := range db.sampleKeys(r.MaxMemorySamples, volatile) {
+		var idle uint64
+
+		/* Calculate the idle time according to the policy. This is called
+		 * idle just because the code initially handled LRU, but is in fact
+		 * just a score where an higher score means better candidate. */
+		switch r.MaxMemoryPolicy {
+		case REDIS_MAXMEMORY_VOLATILE_LRU, REDIS_MAXMEMORY_ALLKEYS_LRU:
+			idle = uint64(r.estimateObjectIdleTime(db.lru[key]))
+		case REDIS_MAXMEMORY_VOLATILE_LFU, REDIS_MAXMEMORY_ALLKEYS_LFU:
+			/* When we use an LRU policy, we sort the keys by idle time
+			 * so that we expire keys starting from greater idle time.
+			 * However when the policy is an LFU one, we have a frequency
+			 * estimation, and we want to evict keys with lower frequency
+			 * first. So inside the pool we put objects using the inverted
+			 * frequency subtracting the actual frequency to the maximum
+			 * frequency of 255. */
+			idle = 255 - uint64(r.LFUDecrAndReturn(db.lru[key]))
+		case REDIS_MAXMEMORY_VOLATILE_TTL:
+			// In this case the sooner the expire the better.
+			idle = math.MaxUint64 - uint64(db.expires[key])
+		}
+
+		/* Insert the element inside the pool.
+		 * First, find the first empty bucket or the first populated
+		 * bucket that has an idle time smaller than our idle time. */
+		k := 0
+		for k < len(pool) && pool[k].idle < idle {
+			k++
+		}
+		if k == 0 && len(pool) == EVPOOL_SIZE {
+			/* Can't insert if the element is < the worst element we have
+			 * and there are no empty buckets. */
+			continue
+		}
+
+		entry := evictionPoolEntry{idle: idle, key: key, dbid: db.id}
+		if len(pool) < EVPOOL_SIZE {
+			// Inserting into empty position. No setup needed before insert.
+			pool = append(pool, evictionPoolEntry{})
+			copy(pool[k+1:], pool[k:])
+		} else {
+			/* No free space on right? Insert at k-1, shifting all the
+			 * elements from 0 to k-1 to the left, discarding the element
+			 * with smaller idle time. */
+			k--
+			copy(pool[:k], pool[1:k+1])
+		}
+		pool[k] = entry
+	}
+	return pool
+}
+
+/* This function is periodically called to see if there is memory to free
+ * according to the current "maxmemory" settings. In case we are over the
+ * memory limit, the function will try to free some memory to return back
+ * under the limit.
+ *
+ * The function returns true if we are under the memory limit or if we
+ * were over the limit, but the attempt to free memory was successful.
+ * Otehrwise if we are over the memory limit, but not enough memory
+ * was freed to return back under the limit, the function returns false. */
+func (r *RedigoServer) freeMemoryIfNeeded() bool {
+	if r.MaxMemory == 0 {
+		return true
+	}
+
+	used := r.usedMemory()
+	if used <= r.MaxMemory {
+		return true
+	}
+	if r.MaxMemoryPolicy == REDIS_MAXMEMORY_NO_EVICTION {
+		return false // We need to free memory, but policy forbids.
+	}
+
+	// Compute how much memory we need to free.
+	tofree := used - r.MaxMemory
+	var freed int64
+	for freed < tofree {
+		var bestkey string
+		var bestdb *RedigoDB
+
+		switch r.MaxMemoryPolicy {
+		case REDIS_MAXMEMORY_VOLATILE_RANDOM, REDIS_MAXMEMORY_ALLKEYS_RANDOM:
+			/* When evicting a random key, we try to evict a key for
+			 * each DB, so we use the static 'next_db' variable to
+			 * incrementally visit all DBs. */
+			volatile := r.MaxMemoryPolicy == REDIS_MAXMEMORY_VOLATILE_RANDOM
+			for i := 0; i < len(r.dbs); i++ {
+				db := r.dbs[r.evictNextDB]
+				r.evictNextDB = (r.evictNextDB + 1) % len(r.dbs)
+				if keys := db.sampleKeys(1, volatile); len(keys) > 0 {
+					bestkey, bestdb = keys[0], db
+					break
+				}
+			}
+
+		default:
+			volatile := r.MaxMemoryPolicy == REDIS_MAXMEMORY_VOLATILE_LRU ||
+				r.MaxMemoryPolicy == REDIS_MAXMEMORY_VOLATILE_LFU ||
+				r.MaxMemoryPolicy == REDIS_MAXMEMORY_VOLATILE_TTL
+			for bestdb == nil {
+				/* We don't want to make local-db choices when expiring keys,
+				 * so to start populate the eviction pool sampling keys from
+				 * every DB. */
+				var total int
+				for _, db := range r.dbs {
+					keys := len(db.dict)
+					if volatile {
+						keys = len(db.expires)
+					}
+					if keys > 0 {
+						r.evictionPool = r.evictionPoolPopulate(db, volatile, r.evictionPool)
+						total += keys
+					}
+				}
+				if total == 0 {
+					break // No keys to evict.
+				}
+
+				// Go backward from best to worst element to evict.
+				for k := len(r.evictionPool) - 1; k >= 0; k-- {
+					e := r.evictionPool[k]
+					r.evictionPool = r.evictionPool[:k]
+					db := r.dbs[e.dbid]
+					/* The key may have been deleted or its expire removed
+					 * since it was sampled, so check it is still there. */
+					if _, ok := db.dict[e.key]; !ok {
+						continue
+					}
+					if _, ok := db.expires[e.key]; volatile && !ok {
+						continue
+					}
+					bestkey, bestdb = e.key, db
+					break
+				}
+			}
+		}
+
+		// No key can be freed.
+		if bestdb == nil {
+			return false
+		}
+
+		// Finally remove the selected key.
+		delta, _ := bestdb.MemoryUsage([]byte(bestkey), rtype.REDIS_COMPUTE_SIZE_DEF_SAMPLES)
+		bestdb.Delete([]byte(bestkey))
+		bestdb.SignalModifyKey([]byte(bestkey))
+		r.StatEvictedKeys++
+		r.evictedNotCollected += delta
+		freed += delta
+	}
+	return true
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"unsafe"
+
+	"github.com/SteveZhangBit/redigo"
+	"github.com/SteveZhangBit/redigo/rtype"
+)
+
+/* Return a MemoryOverhead filled with memory overhead information used
+ * for the MEMORY STATS command. */
+func (r *RedigoServer) GetMemoryOverheadData() *redigo.MemoryOverhead {
+	mh := &redigo.MemoryOverhead{}
+	used := r.usedMemory()
+	var memTotal int64
+
+	mh.TotalAllocated = used
+	mh.StartupAllocated = r.StatStartupMemory
+	mh.PeakAllocated = r.StatPeakMemory
+	if rss := residentMemory(); used > 0 {
+		mh.Fragmentation = float64(rss) / float64(used)
+	}
+	memTotal += mh.StartupAllocated
+
+	// The client structure and its pending output buffer.
+	for e := r.clients.Front(); e != nil; e = e.Next() {
+		c := e.Value.(*RedigoClient)
+		mem := int64(unsafe.Sizeof(*c)) + int64(c.Buffered())
+		if c.Flags&REDIS_SLAVE != 0 {
+			mh.ClientsSlaves += mem
+		} else {
+			mh.ClientsNormal += mem
+		}
+	}
+	memTotal += mh.ClientsSlaves + mh.ClientsNormal
+
+	for _, db := range r.dbs {
+		keyscount := int64(len(db.dict))
+		if keyscount == 0 {
+			continue
+		}
+		mh.TotalKeys += keyscount
+
+		mem := int64(2*rtype.MapOverhead) + keyscount*(dictEntrySize+lruEntrySize)
+		mh.DB = append(mh.DB, redigo.DBMemoryOverhead{ID: db.id, OverheadHTMain: mem})
+		memTotal += mem
+
+		mem = int64(rtype.MapOverhead) + int64(len(db.expires))*expireEntrySize
+		mh.DB[len(mh.DB)-1].OverheadHTExpires = mem
+		memTotal += mem
+	}
+
+	mh.OverheadTotal = memTotal
+	if used > memTotal {
+		mh.Dataset = used - memTotal
+	}
+
+	/* Metrics computed after subtracting the startup memory from
+	 * the total memory. */
+	netUsage := used - mh.StartupAllocated
+	if mh.PeakAllocated > 0 {
+		mh.PeakPerc = float64(used) * 100 / float64(mh.PeakAllocated)
+	}
+	if netUsage > 0 {
+		mh.DatasetPerc = float64(mh.Dataset) * 100 / float64(netUsage)
+		if mh.TotalKeys > 0 {
+			mh.BytesPerKey = netUsage / mh.TotalKeys
+		}
+	}
+	return mh
+}
+
+/* Implement MEMORY DOCTOR. An English speaking report about the memory
+ * condition of the server. */
+func (r *RedigoServer) GetMemoryDoctorReport() string {
+	var emptydb bool      // Instance is empty or almost empty.
+	var bigPeak bool      // Memory peak is much larger than used mem.
+	var highFrag bool     // High fragmentation.
+	var bigSlaveBuf bool  // Slave buffers are too big.
+	var bigClientBuf bool // Client buffers are too big.
+	var numReports int
+	mh := r.GetMemoryOverheadData()
+
+	if mh.TotalAllocated < 1024*1024*5 {
+		emptydb = true
+		numReports++
+	} else {
+		// Peak is > 150% of current used memory?
+		if float64(mh.PeakAllocated)/float64(mh.TotalAllocated) > 1.5 {
+			bigPeak = true
+			numReports++
+		}
+
+		// Fragmentation is higher than 1.4?
+		if mh.Fragmentation > 1.4 {
+			highFrag = true
+			numReports++
+		}
+
+		// Clients using more than 200k each average?
+		var numslaves, numclients int64
+		for e := r.clients.Front(); e != nil; e = e.Next() {
+			if e.Value.(*RedigoClient).Flags&REDIS_SLAVE != 0 {
+				numslaves++
+			} else {
+				numclients++
+			}
+		}
+		if numclients > 0 && mh.ClientsNormal/numclients > 1024*200 {
+			bigClientBuf = true
+			numReports++
+		}
+
+		// Slaves using more than 10 MB each?
+		if numslaves > 0 && mh.ClientsSlaves/numslaves > 1024*1024*10 {
+			bigSlaveBuf = true
+			numReports++
+		}
+	}
+
+	var s bytes.Buffer
+	if numReports == 0 {
+		s.WriteString("Hi Sam, I can't find any memory issue in your instance. " +
+			"I can only account for what occurs on this base.\n")
+	} else if emptydb {
+		s.WriteString("Hi Sam, this instance is empty or is using very little memory, " +
+			"my issues detector can't be used in these conditions. " +
+			"Please, leave for your mission on Earth and fill it with some data. " +
+			"The new Sam and I will be back to our programming as soon as I " +
+			"finished rebooting.\n")
+	} else {
+		s.WriteString("Sam, I detected a few issues in this Redis instance memory implants:\n\n")
+		if bigPeak {
+			s.WriteString(" * Peak memory: In the past this instance used more than 150% the memory that is currently using. " +
+				"The Go runtime returns the memory to the operating system only gradually after a peak, so you can expect " +
+				"to see a big fragmentation ratio, however this is actually harmless and is only due to the memory peak, " +
+				"and if the Redis instance Resident Set Size (RSS) is currently bigger than expected, the memory will be used " +
+				"as soon as you fill the Redis instance with more data. If the memory peak was only occasional and you want " +
+				"to reclaim memory now, the only option is to shutdown and restart the instance.\n\n")
+		}
+		if highFrag {
+			s.WriteString(" * High fragmentation: This instance has a memory fragmentation greater than 1.4 (this means that " +
+				"the memory the Go runtime obtained from the operating system is much larger than the sum of the logical " +
+				"allocations Redis performed). This problem is usually due either to a large peak memory (check if there " +
+				"is a peak memory entry above in the report) or may result from a workload that causes the heap to " +
+				"fragment memory a lot. If the problem is a large peak memory, then there is no issue.\n\n")
+		}
+		if bigSlaveBuf {
+			s.WriteString(" * Big slave buffers: The slave output buffers in this instance are greater than 10MB for each " +
+				"slave (on average). This likely means that there is some slave instance that is struggling receiving " +
+				"data, either because it is too slow or because of networking issues. As a result, data piles on the " +
+				"master output buffers. Please try to identify what slave is not receiving data correctly and why. You " +
+				"can use the CLIENT LIST command to check the output buffers of each slave.\n\n")
+		}
+		if bigClientBuf {
+			s.WriteString(" * Big client buffers: The clients output buffers in this instance are greater than 200K per " +
+				"client (on average). This may result from different causes, like Pub/Sub clients subscribed to channels " +
+				"but not receiving data fast enough, so that data piles on the Redis instance output buffer, or clients " +
+				"sending commands with large replies or very large sequences of commands in the same pipeline. Please use " +
+				"the CLIENT LIST command in order to investigate the issue if it causes problems in your instance, or to " +
+				"understand better why certain clients are using a big amount of memory.\n\n")
+		}
+		s.WriteString("I'm here to keep you safe, Sam. I want to help you.\n")
+	}
+	return s.String()
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"container/list"
 	"fmt"
 	"log"
@@ -12,12 +13,17 @@ import (
 
 	"github.com/SteveZhangBit/redigo"
 	"github.com/SteveZhangBit/redigo/command"
+	"github.com/SteveZhangBit/redigo/protocol"
 	"github.com/SteveZhangBit/redigo/rtype"
 	"github.com/SteveZhangBit/redigo/util"
 )
 
 const (
-	REDIS_MAX_INTSET_ENTRIES = 512
+	REDIS_MAX_CLIENTS            = 10000
+	REDIS_DEFAULT_TCP_BACKLOG    = 511
+	REDIS_DEFAULT_TCP_KEEPALIVE  = 300
+	REDIS_DEFAULT_CLIENT_TIMEOUT = 0 // Default client timeout: infinite
+	REDIS_DEFAULT_HZ             = 10
 )
 
 const (
@@ -121,6 +127,9 @@ var RedigoCommandTable []*RedigoCommand = []*RedigoCommand{
 	{"setrange", command.SETRANGECommand, 4, "wm", 0, 0, 0},
 	{"getrange", command.GETRANGECommand, 4, "r", 0, 0, 0},
 	{"substr", command.GETRANGECommand, 4, "r", 0, 0, 0},
+	{"getex", command.GETEXCommand, -2, "wF", 0, 0, 0},
+	{"getdel", command.GETDELCommand, 2, "wF", 0, 0, 0},
+	{"lcs", command.LCSCommand, -3, "r", 0, 0, 0},
 	{"incr", command.INCRCommand, 2, "wmF", 0, 0, 0},
 	{"decr", command.DECRCommand, 2, "wmF", 0, 0, 0},
 	{"mget", command.MGETCommand, -2, "r", 0, 0, 0},
@@ -129,24 +138,29 @@ var RedigoCommandTable []*RedigoCommand = []*RedigoCommand{
 	{"rpushx", command.RPUSHXCommand, 3, "wmF", 0, 0, 0},
 	{"lpushx", command.LPUSHXCommand, 3, "wmF", 0, 0, 0},
 	{"linsert", command.LINSERTCommand, 5, "wm", 0, 0, 0},
-	{"rpop", command.RPOPCommand, 2, "wF", 0, 0, 0},
-	{"lpop", command.LPOPCommand, 2, "wF", 0, 0, 0},
+	{"rpop", command.RPOPCommand, -2, "wF", 0, 0, 0},
+	{"lpop", command.LPOPCommand, -2, "wF", 0, 0, 0},
 	{"brpop", command.BRPOPCommand, -3, "ws", 0, 0, 0},
 	{"brpoplpush", command.BRPOPLPUSHCommand, 4, "wms", 0, 0, 0},
+	{"blmove", command.BLMOVECommand, 6, "wms", 0, 0, 0},
+	{"blmpop", command.BLMPOPCommand, -5, "wms", 0, 0, 0},
 	{"blpop", command.BLPOPCommand, -3, "ws", 0, 0, 0},
 	{"llen", command.LLENCommand, 2, "rF", 0, 0, 0},
 	{"lindex", command.LINDEXCommand, 3, "r", 0, 0, 0},
 	{"lset", command.LSETCommand, 4, "wm", 0, 0, 0},
 	{"lrange", command.LRANGECommand, 4, "r", 0, 0, 0},
+	{"lpos", command.LPOSCommand, -3, "r", 0, 0, 0},
 	{"ltrim", command.LTRIMCommand, 4, "w", 0, 0, 0},
 	{"lrem", command.LREMCommand, 4, "w", 0, 0, 0},
 	{"rpoplpush", command.RPOPLPUSHCommand, 3, "wm", 0, 0, 0},
+	{"lmove", command.LMOVECommand, 5, "wm", 0, 0, 0},
+	{"lmpop", command.LMPOPCommand, -4, "w", 0, 0, 0},
 	{"sadd", command.SADDCommand, -3, "wmF", 0, 0, 0},
 	{"srem", command.SREMCommand, -3, "wF", 0, 0, 0},
 	{"smove", command.SMOVECommand, 4, "wF", 0, 0, 0},
 	{"sismember", command.SISMEMBERCommand, 3, "rF", 0, 0, 0},
 	{"scard", command.SCARDCommand, 2, "rF", 0, 0, 0},
-	{"spop", command.SPOPCommand, 2, "wRsF", 0, 0, 0},
+	{"spop", command.SPOPCommand, -2, "wRsF", 0, 0, 0},
 	{"srandmember", command.SRANDMEMBERCommand, -2, "rR", 0, 0, 0},
 	{"sinter", command.SINTERCommand, -2, "rS", 0, 0, 0},
 	{"sinterstore", command.SINTERSTORECommand, -3, "wm", 0, 0, 0},
@@ -154,7 +168,9 @@ var RedigoCommandTable []*RedigoCommand = []*RedigoCommand{
 	{"sunionstore", command.SUNIONSTORECommand, -3, "wm", 0, 0, 0},
 	{"sdiff", command.SDIFFCommand, -2, "rS", 0, 0, 0},
 	{"sdiffstore", command.SDIFFSTORECommand, -3, "wm", 0, 0, 0},
-	{"smembers", command.SINTERCommand, 2, "rS", 0, 0, 0},
+	{"smembers", command.SMEMBERSCommand, 2, "rS", 0, 0, 0},
+	{"smismember", command.SMISMEMBERCommand, -3, "rF", 0, 0, 0},
+	{"sintercard", command.SINTERCARDCommand, -3, "r", 0, 0, 0},
 	{"sscan", command.SSCANCommand, -3, "rR", 0, 0, 0},
 	{"zadd", command.ZADDCommand, -4, "wmF", 0, 0, 0},
 	{"zincrby", command.ZINCRBYCommand, 4, "wmF", 0, 0, 0},
@@ -164,6 +180,10 @@ var RedigoCommandTable []*RedigoCommand = []*RedigoCommand{
 	{"zremrangebylex", command.ZREMRANGEBYLEXCommand, 4, "w", 0, 0, 0},
 	{"zunionstore", command.ZUNIONSTORECommand, -4, "wm", 0, 0, 0},
 	{"zinterstore", command.ZINTERSTORECommand, -4, "wm", 0, 0, 0},
+	{"zdiffstore", command.ZDIFFSTORECommand, -4, "wm", 0, 0, 0},
+	{"zunion", command.ZUNIONCommand, -3, "r", 0, 0, 0},
+	{"zinter", command.ZINTERCommand, -3, "r", 0, 0, 0},
+	{"zdiff", command.ZDIFFCommand, -3, "r", 0, 0, 0},
 	{"zrange", command.ZRANGECommand, -4, "r", 0, 0, 0},
 	{"zrangebyscore", command.ZRANGEBYSCORECommand, -4, "r", 0, 0, 0},
 	{"zrevrangebyscore", command.ZREVRANGEBYSCORECommand, -4, "r", 0, 0, 0},
@@ -172,6 +192,12 @@ var RedigoCommandTable []*RedigoCommand = []*RedigoCommand{
 	{"zcount", command.ZCOUNTCommand, 4, "rF", 0, 0, 0},
 	{"zlexcount", command.ZLEXCOUNTCommand, 4, "rF", 0, 0, 0},
 	{"zrevrange", command.ZREVRANGECommand, -4, "r", 0, 0, 0},
+	{"zpopmin", command.ZPOPMINCommand, -2, "wF", 0, 0, 0},
+	{"zpopmax", command.ZPOPMAXCommand, -2, "wF", 0, 0, 0},
+	{"zmpop", command.ZMPOPCommand, -4, "wF", 0, 0, 0},
+	{"bzpopmin", command.BZPOPMINCommand, -3, "ws", 0, 0, 0},
+	{"bzpopmax", command.BZPOPMAXCommand, -3, "ws", 0, 0, 0},
+	{"bzmpop", command.BZMPOPCommand, -5, "ws", 0, 0, 0},
 	{"zcard", command.ZCARDCommand, 2, "rF", 0, 0, 0},
 	{"zscore", command.ZSCORECommand, 3, "rF", 0, 0, 0},
 	{"zrank", command.ZRANKCommand, 3, "rF", 0, 0, 0},
@@ -191,6 +217,19 @@ var RedigoCommandTable []*RedigoCommand = []*RedigoCommand{
 	{"hgetall", command.HGETALLCommand, 2, "r", 0, 0, 0},
 	{"hexists", command.HEXISTSCommand, 3, "rF", 0, 0, 0},
 	{"hscan", command.HSCANCommand, -3, "rR", 0, 0, 0},
+	{"hstrlen", command.HSTRLENCommand, 3, "rF", 0, 0, 0},
+	{"hrandfield", command.HRANDFIELDCommand, -2, "rR", 0, 0, 0},
+	{"hexpire", command.HEXPIRECommand, -6, "wF", 0, 0, 0},
+	{"hpexpire", command.HPEXPIRECommand, -6, "wF", 0, 0, 0},
+	{"hexpireat", command.HEXPIREATCommand, -6, "wF", 0, 0, 0},
+	{"hpexpireat", command.HPEXPIREATCommand, -6, "wF", 0, 0, 0},
+	{"httl", command.HTTLCommand, -5, "rF", 0, 0, 0},
+	{"hpttl", command.HPTTLCommand, -5, "rF", 0, 0, 0},
+	{"hexpiretime", command.HEXPIRETIMECommand, -5, "rF", 0, 0, 0},
+	{"hpexpiretime", command.HPEXPIRETIMECommand, -5, "rF", 0, 0, 0},
+	{"hpersist", command.HPERSISTCommand, -5, "wF", 0, 0, 0},
+	{"hgetex", command.HGETEXCommand, -5, "wF", 0, 0, 0},
+	{"hsetex", command.HSETEXCommand, -6, "wmF", 0, 0, 0},
 	{"incrby", command.INCRBYCommand, 3, "wmF", 0, 0, 0},
 	{"decrby", command.DECRBYCommand, 3, "wmF", 0, 0, 0},
 	{"incrbyfloat", command.INCRBYFLOATCommand, 3, "wmF", 0, 0, 0},
@@ -252,7 +291,8 @@ var RedigoCommandTable []*RedigoCommand = []*RedigoCommand{
 	// {"readonly", command.READONLYCommand, 1, "rF", 0, 0, 0},
 	// {"readwrite", command.READWRITECommand, 1, "rF", 0, 0, 0},
 	// {"dump", command.DUMPCommand, 2, "r", 0, 0, 0},
-	// {"object", command.OBJECTCommand, 3, "r", 0, 0, 0},
+	{"object", command.OBJECTCommand, -2, "r", 0, 0, 0},
+	{"memory", command.MEMORYCommand, -2, "r", 0, 0, 0},
 	{"client", command.CLIENTCommand, -2, "rs", 0, 0, 0},
 	// {"eval", command.EVALCommand, -3, "s", 0, 0, 0},
 	// {"evalsha", command.EVALSHACommand, -3, "s", 0, 0, 0},
@@ -262,30 +302,53 @@ var RedigoCommandTable []*RedigoCommand = []*RedigoCommand{
 	{"bitop", command.BITOPCommand, -4, "wm", 0, 0, 0},
 	{"bitcount", command.BITCOUNTCommand, -2, "r", 0, 0, 0},
 	{"bitpos", command.BITPOSCommand, -3, "r", 0, 0, 0},
+	{"bitfield", command.BITFIELDCommand, -2, "wm", 0, 0, 0},
+	{"bitfield_ro", command.BITFIELD_ROCommand, -2, "r", 0, 0, 0},
 	// {"wait", command.WAITCommand, 3, "rs", 0, 0, 0},
 	{"command", command.COMMANDCommand, 0, "rlt", 0, 0, 0},
-	// {"pfselftest", command.PFSELFTESTCommand, 1, "r", 0, 0, 0},
-	// {"pfadd", command.PFADDCommand, -2, "wmF", 0, 0, 0},
-	// {"pfcount", command.PFCOUNTCommand, -2, "r", 0, 0, 0},
-	// {"pfmerge", command.PFMERGECommand, -2, "wm", 0, 0, 0},
-	// {"pfdebug", command.PFDEBUGCommand, -3, "w", 0, 0, 0},
+	{"pfselftest", command.PFSELFTESTCommand, 1, "r", 0, 0, 0},
+	{"pfadd", command.PFADDCommand, -2, "wmF", 0, 0, 0},
+	{"pfcount", command.PFCOUNTCommand, -2, "r", 0, 0, 0},
+	{"pfmerge", command.PFMERGECommand, -2, "wm", 0, 0, 0},
+	{"pfdebug", command.PFDEBUGCommand, -3, "w", 0, 0, 0},
+	{"geoadd", command.GEOADDCommand, -5, "wm", 0, 0, 0},
+	{"geosearch", command.GEOSEARCHCommand, -7, "r", 0, 0, 0},
+	{"geosearchstore", command.GEOSEARCHSTORECommand, -8, "wm", 0, 0, 0},
+	{"geohash", command.GEOHASHCommand, -2, "r", 0, 0, 0},
+	{"geopos", command.GEOPOSCommand, -2, "r", 0, 0, 0},
+	{"geodist", command.GEODISTCommand, -4, "r", 0, 0, 0},
 	// {"latency", command.LATENCYCommand, -2, "arslt", 0, 0, 0},
 }
 
 type RedigoServer struct {
 	PID int
 	// Networking
-	Port      int
-	BindAddr  []string
-	clients   *list.List
-	listeners []net.Listener
-	newClient chan *RedigoClient
-	delClient chan *RedigoClient
+	Port           int
+	BindAddr       []string
+	UnixSocket     string      // UNIX socket path
+	UnixSocketPerm os.FileMode // UNIX socket permission
+	clients        *list.List
+	listeners      []net.Listener
+	newClient      chan *RedigoClient
+	delClient      chan *RedigoClient
+	nextClientID   uint64 // Next client unique ID. Incremental.
+	TCPBacklog     int    // TCP listen() backlog
+	TCPKeepAlive   int    // Set SO_KEEPALIVE if non-zero, in seconds
+	ProtectedMode  bool   // Don't accept external connections.
+	MaxClients     int    // Max number of simultaneous clients
+	MaxIdleTime    int    // Client timeout in seconds
+	// Output buffer limits for every class of clients
+	ClientObufLimits [REDIS_CLIENT_TYPE_COUNT]ClientBufferLimitConfig
+	clientsToClose   []*RedigoClient // Clients to close asynchronously
+	// Security
+	RequirePass string // Pass for AUTH command, or empty
 	// Logging
 	Verbosity int
 	// Command
 	Commands map[string]*RedigoCommand
-	rwLock   sync.RWMutex
+	/* Commands are executed one at a time, like in Redis: even read only
+	 * commands modify the key space (LRU/LFU info, lazy expire, stats). */
+	lock sync.Mutex
 	// DB
 	DBNum int
 	dbs   []*RedigoDB
@@ -294,11 +357,32 @@ type RedigoServer struct {
 	keyspaceMisses int
 	keyspaceHits   int
 	// Status
-	StatStartTime   time.Time
-	StatNumCommands int
+	StatStartTime         time.Time
+	StatStartupMemory     int64 // Memory used right after the initialization
+	StatPeakMemory        int64 // Max used memory record
+	StatExpiredKeys       int   // Number of expired keys
+	StatExpiredFields     int   // Number of expired hash fields
+	StatEvictedKeys       int   // Number of evicted keys (maxmemory)
+	StatNumCommands       int
+	StatNumConnections    int // Number of connections received
+	StatRejectedConn      int // Clients rejected because of maxclients
+	StatProtectedModeConn int // Clients rejected because of protected mode
+	// Limits
+	MaxMemory           int64 // Max number of memory bytes to use
+	MaxMemoryPolicy     int   // Policy for key eviction
+	MaxMemorySamples    int   // Pricision of random sampling
+	LFULogFactor        int   // LFU logarithmic counter factor.
+	LFUDecayTime        int   // LFU counter decay factor.
+	lruclock            uint32
+	evictionPool        []evictionPoolEntry
+	evictNextDB         int    // Next DB to visit by random eviction
+	lastGCCycles        uint64 // GC cycles when the used memory was checked
+	evictedNotCollected int64  // Memory of evicted keys not yet collected by GC
 	// Blocked clients
 	blockedClients int
 	readyKeys      []ReadyKey
+	// Keyspace events of the expired hash fields
+	*RedigoPubSub
 }
 
 /* The following structure represents a node in the server.ready_keys list,
@@ -317,17 +401,35 @@ type ReadyKey struct {
 	Key []byte
 }
 
+var clientBufferLimitsDefaults = [REDIS_CLIENT_TYPE_COUNT]ClientBufferLimitConfig{
+	{0, 0, 0}, // normal
+	{1024 * 1024 * 256, 1024 * 1024 * 64, 60}, // slave
+	{1024 * 1024 * 32, 1024 * 1024 * 8, 60},   // pubsub
+}
+
 /* =================================server init methods ======================================= */
 
 func NewServer() *RedigoServer {
 	s := &RedigoServer{
-		PID:       os.Getpid(),
-		Port:      6379,
-		BindAddr:  []string{""},
-		newClient: make(chan *RedigoClient, 1),
-		delClient: make(chan *RedigoClient, 1),
-		Verbosity: REDIS_WARNING,
-		DBNum:     4,
+		PID:              os.Getpid(),
+		Port:             6379,
+		BindAddr:         []string{""},
+		TCPBacklog:       REDIS_DEFAULT_TCP_BACKLOG,
+		TCPKeepAlive:     REDIS_DEFAULT_TCP_KEEPALIVE,
+		ProtectedMode:    true,
+		MaxClients:       REDIS_MAX_CLIENTS,
+		MaxIdleTime:      REDIS_DEFAULT_CLIENT_TIMEOUT,
+		ClientObufLimits: clientBufferLimitsDefaults,
+		MaxMemoryPolicy:  REDIS_MAXMEMORY_NO_EVICTION,
+		MaxMemorySamples: REDIS_DEFAULT_MAXMEMORY_SAMPLES,
+		LFULogFactor:     REDIS_DEFAULT_LFU_LOG_FACTOR,
+		LFUDecayTime:     REDIS_DEFAULT_LFU_DECAY_TIME,
+		lruclock:         getLRUClock(),
+		newClient:        make(chan *RedigoClient, 1),
+		delClient:        make(chan *RedigoClient, 1),
+		Verbosity:        REDIS_WARNING,
+		DBNum:            4,
+		nextClientID:     1,
 	}
 	s.clients = list.New()
 	s.clients.Init()
@@ -380,6 +482,10 @@ func (r *RedigoServer) AddDirty(i int) {
 	r.dirty += i
 }
 
+func (r *RedigoServer) GetRequirePass() string {
+	return r.RequirePass
+}
+
 func (r *RedigoServer) Init() {
 	// Open the TCP listening socket for the user commands.
 	r.listen()
@@ -401,24 +507,37 @@ func (r *RedigoServer) Init() {
 
 	// A few stats we don't want to reset: server startup time, and peak mem.
 	r.StatStartTime = time.Now()
+	r.StatStartupMemory = r.usedMemory()
 
 	// Add system interrupt listener
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
+	// Timer for the background tasks, called server.hz times per second.
+	cron := time.NewTicker(time.Second / REDIS_DEFAULT_HZ)
+	defer cron.Stop()
 	// Waiting to process commands, add clients or remove closed clients
 	for {
 		select {
 		case c := <-r.newClient:
-			r.RedigoLog(REDIS_DEBUG, "New connection on %s", c.conn.RemoteAddr())
-			r.clients.PushBack(c)
+			r.RedigoLog(REDIS_DEBUG, "New connection on %s", c.addr())
+			/* The client list is also read by commands like CLIENT LIST,
+			 * so only touch it while holding the command lock. */
+			r.lock.Lock()
+			r.acceptCommonHandler(c)
+			r.lock.Unlock()
+
+		case <-cron.C:
+			r.serverCron()
 
 		case c := <-r.delClient:
+			r.lock.Lock()
 			for e := r.clients.Front(); e != nil; e = e.Next() {
 				if e.Value == c {
 					r.clients.Remove(e)
 					break
 				}
 			}
+			r.lock.Unlock()
 
 		case <-interrupt:
 			r.RedigoLog(REDIS_WARNING, "Received SIGINT scheduling shutdown...")
@@ -431,9 +550,10 @@ func (r *RedigoServer) Init() {
 }
 
 func (r *RedigoServer) listen() {
+	r.checkTcpBacklogSettings()
 	for _, ip := range r.BindAddr {
 		addr := fmt.Sprintf("%s:%d", ip, r.Port)
-		listener, err := net.Listen("tcp", addr)
+		listener, err := anetTcpServer(ip, r.Port, r.TCPBacklog)
 
 		if err != nil {
 			r.RedigoLog(REDIS_DEBUG, "Creating Server TCP listening socket %s: %s", addr, err)
@@ -441,25 +561,181 @@ func (r *RedigoServer) listen() {
 		}
 
 		r.listeners = append(r.listeners, listener)
-		go func(l net.Listener, addr string) {
-			defer l.Close()
-
-			for {
-				if conn, err := l.Accept(); err != nil {
-					r.RedigoLog(REDIS_DEBUG, "Accepting Server TCP listening socket %s: %s", addr, err)
-					break
-				} else {
-					// Create client
-					c := NewClient()
-					c.server = r
-					c.conn = conn
-					c.init()
-					r.newClient <- c
+		go r.acceptHandler(listener, addr, 0)
+	}
 
-				}
+	// Open the listening Unix domain socket.
+	if r.UnixSocket != "" {
+		// Remove a stale socket file left by a previous instance.
+		os.Remove(r.UnixSocket)
+		listener, err := net.Listen("unix", r.UnixSocket)
+		if err != nil {
+			r.RedigoLog(REDIS_WARNING, "Opening Unix socket: %s", err)
+			os.Exit(1)
+		}
+		if r.UnixSocketPerm != 0 {
+			if err = os.Chmod(r.UnixSocket, r.UnixSocketPerm); err != nil {
+				r.RedigoLog(REDIS_WARNING, "Setting permissions of Unix socket %s: %s", r.UnixSocket, err)
 			}
-		}(listener, addr)
+		}
+
+		r.listeners = append(r.listeners, listener)
+		r.RedigoLog(REDIS_NOTICE, "The server is now ready to accept connections at %s", r.UnixSocket)
+		go r.acceptHandler(listener, r.UnixSocket, REDIS_UNIX_SOCKET)
+	}
+}
+
+/* Accept connections from the listener until it gets closed. Every new
+ * client starts with the specified flags (i.e. REDIS_UNIX_SOCKET), and is
+ * handed to the main loop that takes care of registering it. */
+func (r *RedigoServer) acceptHandler(l net.Listener, addr string, flags int) {
+	defer l.Close()
+
+	for {
+		if conn, err := l.Accept(); err != nil {
+			r.RedigoLog(REDIS_DEBUG, "Accepting Server listening socket %s: %s", addr, err)
+			break
+		} else {
+			// Create client
+			c := NewClient()
+			c.server = r
+			c.conn = conn
+			c.Flags |= flags
+			r.newClient <- c
+		}
+	}
+}
+
+/* Register a freshly accepted client, unless it must be refused because of
+ * the maxclients limit or protected mode. In that case the error is written
+ * straight to the socket, since the client has no reply buffer yet. */
+func (r *RedigoServer) acceptCommonHandler(c *RedigoClient) {
+	r.StatNumConnections++
+
+	/* If maxclient directive is set and this is one client more... close the
+	 * connection. */
+	if r.clients.Len() >= r.MaxClients {
+		c.conn.Write([]byte("-ERR max number of clients reached\r\n"))
+		c.conn.Close()
+		r.StatRejectedConn++
+		return
+	}
+
+	/* If the server is running in protected mode (the default) and there
+	 * is no password set, nor a specific interface is bound, we don't accept
+	 * requests from non loopback interfaces. Instead we try to explain the
+	 * user what to do to fix it if needed. */
+	if r.ProtectedMode && r.RequirePass == "" && r.bindsAllInterfaces() && !c.isLocal() {
+		c.conn.Write(protocol.ProtectedModeErr)
+		c.conn.Close()
+		r.StatProtectedModeConn++
+		return
+	}
+
+	if tc, ok := c.conn.(*net.TCPConn); ok {
+		if r.TCPKeepAlive > 0 {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(time.Duration(r.TCPKeepAlive) * time.Second)
+		} else {
+			tc.SetKeepAlive(false)
+		}
+	}
+
+	c.id = r.nextClientID
+	r.nextClientID++
+	r.clients.PushBack(c)
+	c.init()
+}
+
+// Whether no specific interface was bound, so we are reachable from anywhere.
+func (r *RedigoServer) bindsAllInterfaces() bool {
+	for _, ip := range r.BindAddr {
+		if ip == "" || ip == "*" || ip == "0.0.0.0" || ip == "::" {
+			return true
+		}
+	}
+	return false
+}
+
+/* Return a string describing every connected client, one per line, as
+ * reported by CLIENT LIST. */
+func (r *RedigoServer) GetAllClientsInfoString() string {
+	var buf bytes.Buffer
+	for e := r.clients.Front(); e != nil; e = e.Next() {
+		e.Value.(*RedigoClient).catClientInfoString(&buf)
+	}
+	return buf.String()
+}
+
+/* ================================= cron methods ======================================= */
+
+/* This is our timer handler, called server.hz times per second.
+ * Here is where we do a number of things that need to be done asynchronously,
+ * like closing the clients that reached the idle timeout. */
+func (r *RedigoServer) serverCron() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	/* We have just REDIS_LRU_BITS bits per object for LRU information.
+	 * So we use an (eventually wrapping) LRU clock. */
+	r.lruclock = getLRUClock()
+
+	// Record the max memory used since the server was started.
+	r.usedMemory()
+
+	// Delete the expired fields of the hashes.
+	r.activeExpireHashFieldsCycle()
+
+	r.clientsCron()
+	r.freeClientsInAsyncFreeQueue()
+}
+
+/* Helper function for serverCron(): runs the periodic checks every client
+ * needs, the idle timeout and the output buffer soft limit, which must be
+ * checked even when no more replies are added to the client. */
+func (r *RedigoServer) clientsCron() {
+	now := time.Now()
+	for e := r.clients.Front(); e != nil; e = e.Next() {
+		c := e.Value.(*RedigoClient)
+		r.clientsCronHandleTimeout(c, now)
+		c.closeClientOnOutputBufferLimitReached()
+	}
+}
+
+/* Check for timeouts. Slaves, masters, blocked and Pub/Sub clients are
+ * never closed because of the idle time: blocked clients have their own
+ * timeout, and the others are expected to stay silent for a long time. */
+func (r *RedigoServer) clientsCronHandleTimeout(c *RedigoClient, now time.Time) {
+	if r.MaxIdleTime == 0 || c.Flags&(REDIS_SLAVE|REDIS_MASTER|REDIS_BLOCKED|REDIS_PUBSUB) > 0 {
+		return
+	}
+	if now.Sub(c.lastinteraction) > time.Duration(r.MaxIdleTime)*time.Second {
+		r.RedigoLog(REDIS_VERBOSE, "Closing idle client")
+		/* Closing the connection makes the client goroutine exit, which
+		 * takes care of removing the client from the list. */
+		c.conn.Close()
+	}
+}
+
+/* Schedule a client to be closed at a safe time: the REDIS_CLOSE_ASAP flag
+ * is set so that no more replies get queued, and the connection is closed
+ * by freeClientsInAsyncFreeQueue(). */
+func (r *RedigoServer) freeClientAsync(c *RedigoClient) {
+	if c.Flags&REDIS_CLOSE_ASAP > 0 {
+		return
+	}
+	c.Flags |= REDIS_CLOSE_ASAP
+	r.clientsToClose = append(r.clientsToClose, c)
+}
+
+/* Close the connection of the clients scheduled by freeClientAsync(). The
+ * client goroutine then notices the closed socket and exits, removing the
+ * client from the list of clients. */
+func (r *RedigoServer) freeClientsInAsyncFreeQueue() {
+	for _, c := range r.clientsToClose {
+		c.conn.Close()
 	}
+	r.clientsToClose = r.clientsToClose[:0]
 }
 
 /* ================================= logging methods ======================================= */
@@ -491,7 +767,6 @@ func (r *RedigoServer) processCommand(c *redigo.CommandArg) bool {
 	 * such as wrong arity, bad command name and so forth. */
 
 	cmd, ok := r.Commands[string(util.ToLower(c.Argv[0]))]
-	c.Client.(*RedigoClient).lastcmd = cmd
 	if !ok {
 		c.AddReplyError(fmt.Sprintf("unknown command '%s'", string(c.Argv[0])))
 		c.Client.(*RedigoClient).Flush()
@@ -502,24 +777,54 @@ func (r *RedigoServer) processCommand(c *redigo.CommandArg) bool {
 		return true
 	}
 
+	/* Check if the user is authenticated. The password can be changed at
+	 * runtime by CONFIG SET, so it's read holding the lock. */
+	r.lock.Lock()
+	authRequired := r.RequirePass != "" && !c.Client.(*RedigoClient).authenticated
+	r.lock.Unlock()
+	if authRequired && cmd.Name != "auth" {
+		c.AddReply(protocol.NoAuthErr)
+		c.Client.(*RedigoClient).Flush()
+		return true
+	}
+
+	/* Handle the maxmemory directive.
+	 *
+	 * First we try to free some memory if possible (if there are volatile
+	 * keys in the dataset). If there are not the only thing we can do
+	 * is returning an error. */
+	r.lock.Lock()
+	ok = r.MaxMemory == 0 || r.freeMemoryIfNeeded()
+	r.lock.Unlock()
+	if !ok && cmd.Flags&REDIS_CMD_DENYOOM > 0 {
+		c.AddReply(protocol.OOMErr)
+		c.Client.(*RedigoClient).Flush()
+		return true
+	}
+
 	r.call(c, cmd)
 	c.Client.(*RedigoClient).Flush()
 	return true
 }
 
 func (r *RedigoServer) call(c *redigo.CommandArg, cmd *RedigoCommand) {
-	// Lock
-	if cmd.Flags&REDIS_CMD_WRITE > 0 {
-		r.rwLock.Lock()
-	} else {
-		r.rwLock.RLock()
-	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	/* The last command and interaction time are reported by CLIENT LIST,
+	 * which runs in the goroutine of another client holding the lock. */
+	c.Client.(*RedigoClient).lastcmd = cmd
+	c.Client.(*RedigoClient).lastinteraction = time.Now()
 
 	/* Call the command. */
 	dirty := r.dirty
 	start := time.Now()
 	cmd.Proc(c)
 	duration := time.Now().Sub(start)
+	if cl := c.Client.(*RedigoClient); cl.Flags&REDIS_BLOCKED > 0 {
+		// Remember the command to execute it again once a key is ready.
+		cl.bpop.Cmd, cl.bpop.Arg = cmd, c
+	}
 	dirty = r.dirty - dirty
 	if dirty < 0 {
 		dirty = 0
@@ -529,17 +834,14 @@ func (r *RedigoServer) call(c *redigo.CommandArg, cmd *RedigoCommand) {
 	cmd.Calls++
 
 	r.StatNumCommands++
-	// If there are clients blocked on lists
+	// If there are clients blocked on lists or sorted sets
 	if len(r.readyKeys) > 0 {
-		r.handleClientsBlockedOnLists()
+		r.handleClientsBlockedOnKeys()
 	}
 
-	// Unlock and return
-	if cmd.Flags&REDIS_CMD_WRITE > 0 {
-		r.rwLock.Unlock()
-	} else {
-		r.rwLock.RUnlock()
-	}
+	c.Client.(*RedigoClient).closeClientOnOutputBufferLimitReached()
+	r.freeClientsInAsyncFreeQueue()
+
 }
 
 /* This function should be called by Redis every time a single command,
@@ -550,86 +852,89 @@ func (r *RedigoServer) call(c *redigo.CommandArg, cmd *RedigoCommand) {
  * one new element via some PUSH operation are accumulated into
  * the server.ready_keys list. This function will run the list and will
  * serve clients accordingly. Note that the function will iterate again and
- * again as a result of serving BRPOPLPUSH we can have new blocking clients
- * to serve because of the PUSH side of BRPOPLPUSH. */
-func (r *RedigoServer) handleClientsBlockedOnLists() {
-	l := r.readyKeys
-	for len(l) > 0 {
-		rk := l[0]
-		/* First of all remove this key from db->ready_keys so that
-		 * we can safely call signalListAsReady() against this key. */
-		delete(rk.DB.readyKeys, string(rk.Key))
-
-		/* If the key exists and it's a list, serve blocked clients
-		 * with data. */
-		if o, ok := rk.DB.LookupKeyWrite(rk.Key).(rtype.List); ok {
-			/* We serve clients in the same order they blocked for
-			 * this key, from the first blocked to the last. */
-			if cls, ok := rk.DB.blockingKeys[string(rk.Key)]; ok {
-				for i := 0; i < len(cls); i++ {
-					var where int
-					var reciever *RedigoClient = cls[i]
-					var val rtype.String
-
-					if reciever.lastcmd != nil && reciever.lastcmd.Name == "blpop" {
-						where = rtype.REDIS_LIST_HEAD
-						val = o.PopFront().Value()
-					} else {
-						where = rtype.REDIS_LIST_TAIL
-						val = o.PopBack().Value()
-					}
-
-					if val != nil {
-						reciever.unblock(true)
-						if !r.serveClientBlockedOnList(reciever, rk.Key, rk.DB, val, where) {
-							/* If we failed serving the client we need
-							 * to also undo the POP operation. */
-							if where == rtype.REDIS_LIST_HEAD {
-								o.PushFront(val)
-							} else {
-								o.PushBack(val)
-							}
-						}
-					} else {
-						// ???
-						break
-					}
-				}
-			}
-			if o.Len() == 0 {
-				rk.DB.Delete(rk.Key)
-			}
-			/* We don't call signalModifiedKey() as it was already called
-			 * when an element was pushed on the list. */
+ * again as a result of serving BLMOVE we can have new blocking clients
+ * to serve because of the PUSH side of BLMOVE. */
+func (r *RedigoServer) handleClientsBlockedOnKeys() {
+	for len(r.readyKeys) > 0 {
+		/* Point server.ready_keys to a fresh list and save the current one
+		 * locally. This way as we run the old list we are free to call
+		 * signalKeyAsReady() that may push new elements in server.ready_keys
+		 * when handling clients blocked into BLMOVE. */
+		l := r.readyKeys
+		r.readyKeys = nil
+
+		for _, rk := range l {
+			/* First of all remove this key from db->ready_keys so that
+			 * we can safely call signalKeyAsReady() against this key. */
+			delete(rk.DB.readyKeys, string(rk.Key))
+
+			r.serveClientsBlockedOnKey(rk)
 		}
-		l = append(l[:0], l[1:]...)
 	}
 }
 
-/* This is a helper function for handleClientsBlockedOnLists(). It's work
- * is to serve a specific client (receiver) that is blocked on 'key'
- * in the context of the specified 'db', doing the following:
- *
- * 1) Provide the client with the 'value' element.
- * 2) If the dstkey is not NULL (we are serving a BRPOPLPUSH) also push the
- *    'value' element on the destination list (the LPUSH side of the command).
- * 3) Propagate the resulting BRPOP, BLPOP and additional LPUSH if any into
- *    the AOF and replication channel.
- *
- * The argument 'where' is REDIS_TAIL or REDIS_HEAD, and indicates if the
- * 'value' element was popped fron the head (BLPOP) or tail (BRPOP) so that
- * we can propagate the command properly.
+/* Return the number of elements of the value at key if it is of the type
+ * the clients blocked with btype are waiting for, otherwise 0. */
+func blockedKeyLength(db *RedigoDB, key []byte, btype int) int {
+	switch o := db.LookupKeyWrite(key).(type) {
+	case rtype.List:
+		if btype == redigo.REDIS_BLOCKED_LIST {
+			return o.Len()
+		}
+	case rtype.ZSet:
+		if btype == redigo.REDIS_BLOCKED_ZSET {
+			return o.Len()
+		}
+	}
+	return 0
+}
+
+/* Helper function for handleClientsBlockedOnKeys(). This function is called
+ * when there may be clients blocked on a list or sorted set key, and there
+ * may be new data to fetch (the key is ready).
  *
- * The function returns REDIS_OK if we are able to serve the client, otherwise
- * REDIS_ERR is returned to signal the caller that the list POP operation
- * should be undone as the client was not served: This only happens for
- * BRPOPLPUSH that fails to push the value to the destination key as it is
- * of the wrong type. */
-func (r *RedigoServer) serveClientBlockedOnList(receiver *RedigoClient, key []byte, db *RedigoDB, val rtype.String, where int) bool {
-	receiver.AddReplyMultiBulkLen(2)
-	receiver.AddReplyBulk(key)
-	receiver.AddReplyBulk(val.Bytes())
-	return true
+ * The clients blocked for the type of the value are served in the same
+ * order they blocked for the key, executing again their blocking command,
+ * that this time finds data to pop, until the value is emptied. The command
+ * replies, propagates the changes and notifies the events like when it is
+ * called without blocking. */
+func (r *RedigoServer) serveClientsBlockedOnKey(rk ReadyKey) {
+	var btype int
+	switch rk.DB.LookupKeyWrite(rk.Key).(type) {
+	case rtype.List:
+		btype = redigo.REDIS_BLOCKED_LIST
+	case rtype.ZSet:
+		btype = redigo.REDIS_BLOCKED_ZSET
+	default:
+		return
+	}
+
+	/* Serving a client removes it from the blocking keys, so iterate a
+	 * copy of the clients blocked for this key. */
+	cls := append([]*RedigoClient(nil), rk.DB.blockingKeys[string(rk.Key)]...)
+	for _, receiver := range cls {
+		if receiver.bpop.Type != btype {
+			continue
+		}
+		// The value may have been emptied by the clients served before.
+		if blockedKeyLength(rk.DB, rk.Key, btype) == 0 {
+			break
+		}
+
+		cmd, arg := receiver.bpop.Cmd, receiver.bpop.Arg
+		pos := receiver.blockingPositions()
+		receiver.unblock()
+		cmd.Proc(arg)
+		cmd.Calls++
+		if receiver.Flags&REDIS_BLOCKED > 0 {
+			// Blocked again, the client is still waiting in its turn.
+			receiver.restoreBlockingPositions(pos)
+			receiver.bpop.Cmd, receiver.bpop.Arg = cmd, arg
+			continue
+		}
+		receiver.closeClientOnOutputBufferLimitReached()
+		receiver.wakeUp()
+	}
 }
 
 /*=========================================== Shutdown ======================================== */
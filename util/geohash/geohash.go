@@ -0,0 +1,249 @@
+package geohash
+
+import "math"
+
+/* This package is a port of geohash.c and geohash_helper.c of redis, which
+ * are in turn based on the geohash-int library.
+ *
+ * The positions are encoded as interleaved bits of the latitude and of the
+ * longitude. With GEO_STEP_MAX steps we get 52 bits, which can be stored
+ * without loss of precision as the score of a sorted set element. */
+
+const (
+	GEO_STEP_MAX = 26 // 26*2 = 52 bits.
+
+	// Limits from EPSG:900913 / EPSG:3785 / OSGEO:41001
+	GEO_LAT_MIN  = -85.05112878
+	GEO_LAT_MAX  = 85.05112878
+	GEO_LONG_MIN = -180
+	GEO_LONG_MAX = 180
+)
+
+type HashBits struct {
+	Bits uint64
+	Step uint8
+}
+
+func (h HashBits) IsZero() bool {
+	return h.Bits == 0 && h.Step == 0
+}
+
+type HashRange struct {
+	Min, Max float64
+}
+
+func (r HashRange) IsZero() bool {
+	return r.Max == 0 && r.Min == 0
+}
+
+type HashArea struct {
+	Hash      HashBits
+	Longitude HashRange
+	Latitude  HashRange
+}
+
+type HashNeighbors struct {
+	North, East, West, South                   HashBits
+	NorthEast, SouthEast, NorthWest, SouthWest HashBits
+}
+
+/* Interleave lower bits of x and y, so the bits of x
+ * are in the even positions and bits from y in the odd;
+ * x and y must initially be less than 2**32 (4294967296).
+ * From:  https://graphics.stanford.edu/~seander/bithacks.html#InterleaveBMN */
+func interleave64(xlo, ylo uint32) uint64 {
+	B := [...]uint64{0x5555555555555555, 0x3333333333333333,
+		0x0F0F0F0F0F0F0F0F, 0x00FF00FF00FF00FF,
+		0x0000FFFF0000FFFF}
+	S := [...]uint{1, 2, 4, 8, 16}
+
+	x, y := uint64(xlo), uint64(ylo)
+	for i := len(S) - 1; i >= 0; i-- {
+		x = (x | (x << S[i])) & B[i]
+		y = (y | (y << S[i])) & B[i]
+	}
+	return x | (y << 1)
+}
+
+/* Reverse the interleave process. The latitude is in the lower 32 bits
+ * of the result and the longitude in the higher 32 bits.
+ * Derived from http://stackoverflow.com/questions/4909263 */
+func deinterleave64(interleaved uint64) uint64 {
+	B := [...]uint64{0x5555555555555555, 0x3333333333333333,
+		0x0F0F0F0F0F0F0F0F, 0x00FF00FF00FF00FF,
+		0x0000FFFF0000FFFF, 0x00000000FFFFFFFF}
+	S := [...]uint{0, 1, 2, 4, 8, 16}
+
+	x, y := interleaved, interleaved>>1
+	for i := range S {
+		x = (x | (x >> S[i])) & B[i]
+		y = (y | (y >> S[i])) & B[i]
+	}
+	return x | (y << 32)
+}
+
+// Return the longitude and latitude ranges used to index the positions.
+func GetCoordRange() (longRange, latRange HashRange) {
+	return HashRange{Min: GEO_LONG_MIN, Max: GEO_LONG_MAX}, HashRange{Min: GEO_LAT_MIN, Max: GEO_LAT_MAX}
+}
+
+/* Encode the position using 'step' bits for each coordinate, in the
+ * specified longitude and latitude ranges. Returns false when the
+ * position can't be indexed. */
+func Encode(longRange, latRange HashRange, longitude, latitude float64, step uint8) (hash HashBits, ok bool) {
+	// Check basic arguments sanity.
+	if step > 32 || step == 0 || latRange.IsZero() || longRange.IsZero() {
+		return
+	}
+
+	// Return an error when trying to index outside the supported constraints.
+	if longitude > GEO_LONG_MAX || longitude < GEO_LONG_MIN ||
+		latitude > GEO_LAT_MAX || latitude < GEO_LAT_MIN {
+		return
+	}
+
+	hash.Step = step
+	if latitude < latRange.Min || latitude > latRange.Max ||
+		longitude < longRange.Min || longitude > longRange.Max {
+		return
+	}
+
+	latOffset := (latitude - latRange.Min) / (latRange.Max - latRange.Min)
+	longOffset := (longitude - longRange.Min) / (longRange.Max - longRange.Min)
+
+	// Convert to fixed point based on the step size.
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+
+	/* The maximum of a range is mapped to 1<<step, which doesn't fit in
+	 * step bits: it belongs to the last cell. */
+	maxOffset := float64(uint64(1)<<step - 1)
+	latOffset = math.Min(latOffset, maxOffset)
+	longOffset = math.Min(longOffset, maxOffset)
+	hash.Bits = interleave64(uint32(latOffset), uint32(longOffset))
+	return hash, true
+}
+
+func EncodeWGS84(longitude, latitude float64, step uint8) (HashBits, bool) {
+	longRange, latRange := GetCoordRange()
+	return Encode(longRange, latRange, longitude, latitude, step)
+}
+
+// Decode the hash into the area of the cell it represents.
+func Decode(longRange, latRange HashRange, hash HashBits) (area HashArea, ok bool) {
+	if hash.IsZero() || latRange.IsZero() || longRange.IsZero() {
+		return
+	}
+
+	area.Hash = hash
+	step := hash.Step
+	hashSep := deinterleave64(hash.Bits) // hash = [LAT][LONG]
+
+	latScale := latRange.Max - latRange.Min
+	longScale := longRange.Max - longRange.Min
+
+	ilato := uint32(hashSep)       // get lat part of deinterleaved hash
+	ilono := uint32(hashSep >> 32) // shift over to get long part of hash
+
+	/* Divide by 2**step.
+	 * Then, for 0-1 coordinate, multiply times scale and add
+	 * to the min to get the absolute coordinate. */
+	cells := float64(uint64(1) << step)
+	area.Latitude.Min = latRange.Min + (float64(ilato)/cells)*latScale
+	area.Latitude.Max = latRange.Min + ((float64(ilato)+1)/cells)*latScale
+	area.Longitude.Min = longRange.Min + (float64(ilono)/cells)*longScale
+	area.Longitude.Max = longRange.Min + ((float64(ilono)+1)/cells)*longScale
+	return area, true
+}
+
+func DecodeWGS84(hash HashBits) (HashArea, bool) {
+	longRange, latRange := GetCoordRange()
+	return Decode(longRange, latRange, hash)
+}
+
+// Return the center of the area as a longitude, latitude pair.
+func DecodeAreaToLongLat(area *HashArea) (xy [2]float64) {
+	xy[0] = (area.Longitude.Min + area.Longitude.Max) / 2
+	if xy[0] > GEO_LONG_MAX {
+		xy[0] = GEO_LONG_MAX
+	}
+	if xy[0] < GEO_LONG_MIN {
+		xy[0] = GEO_LONG_MIN
+	}
+	xy[1] = (area.Latitude.Min + area.Latitude.Max) / 2
+	if xy[1] > GEO_LAT_MAX {
+		xy[1] = GEO_LAT_MAX
+	}
+	if xy[1] < GEO_LAT_MIN {
+		xy[1] = GEO_LAT_MIN
+	}
+	return
+}
+
+func DecodeToLongLatWGS84(hash HashBits) (xy [2]float64, ok bool) {
+	area, ok := DecodeWGS84(hash)
+	if !ok {
+		return
+	}
+	return DecodeAreaToLongLat(&area), true
+}
+
+func moveX(hash *HashBits, d int) {
+	if d == 0 {
+		return
+	}
+
+	x := hash.Bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.Bits & 0x5555555555555555
+
+	zz := uint64(0x5555555555555555) >> (64 - uint(hash.Step)*2)
+
+	if d > 0 {
+		x = x + (zz + 1)
+	} else {
+		x = x | zz
+		x = x - (zz + 1)
+	}
+
+	x &= uint64(0xaaaaaaaaaaaaaaaa) >> (64 - uint(hash.Step)*2)
+	hash.Bits = x | y
+}
+
+func moveY(hash *HashBits, d int) {
+	if d == 0 {
+		return
+	}
+
+	x := hash.Bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.Bits & 0x5555555555555555
+
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - uint(hash.Step)*2)
+	if d > 0 {
+		y = y + (zz + 1)
+	} else {
+		y = y | zz
+		y = y - (zz + 1)
+	}
+	y &= uint64(0x5555555555555555) >> (64 - uint(hash.Step)*2)
+	hash.Bits = x | y
+}
+
+// Return the 8 cells around the specified one, at the same step.
+func Neighbors(hash HashBits) (n HashNeighbors) {
+	move := func(dx, dy int) HashBits {
+		h := hash
+		moveX(&h, dx)
+		moveY(&h, dy)
+		return h
+	}
+
+	n.East = move(1, 0)
+	n.West = move(-1, 0)
+	n.South = move(0, -1)
+	n.North = move(0, 1)
+	n.NorthWest = move(-1, 1)
+	n.SouthWest = move(-1, -1)
+	n.NorthEast = move(1, 1)
+	n.SouthEast = move(1, -1)
+	return
+}
@@ -0,0 +1,84 @@
+package geohash
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	// Palermo, as in the GEOADD examples of redis.
+	hash, ok := EncodeWGS84(13.361389, 38.115556, GEO_STEP_MAX)
+	if !ok {
+		t.Fatal("can't encode a valid position")
+	}
+	if bits := Align52Bits(hash); bits != 3479099956230698 {
+		t.Fatalf("52 bits hash is %d", bits)
+	}
+
+	xy, ok := DecodeToLongLatWGS84(hash)
+	if !ok {
+		t.Fatal("can't decode a valid hash")
+	}
+	if math.Abs(xy[0]-13.361389) > 1e-5 || math.Abs(xy[1]-38.115556) > 1e-5 {
+		t.Fatalf("decoded as %v", xy)
+	}
+
+	if _, ok := EncodeWGS84(13.361389, 86, GEO_STEP_MAX); ok {
+		t.Fatal("latitude out of range encoded")
+	}
+}
+
+func TestEncodeLimits(t *testing.T) {
+	for _, xy := range [][2]float64{
+		{GEO_LONG_MAX, GEO_LAT_MAX},
+		{GEO_LONG_MIN, GEO_LAT_MIN},
+		{GEO_LONG_MAX, GEO_LAT_MIN},
+		{GEO_LONG_MIN, GEO_LAT_MAX},
+		{GEO_LONG_MAX, 0},
+		{0, GEO_LAT_MAX},
+	} {
+		hash, ok := EncodeWGS84(xy[0], xy[1], GEO_STEP_MAX)
+		if !ok {
+			t.Fatalf("can't encode %v", xy)
+		}
+		if bits := Align52Bits(hash); bits >= 1<<52 {
+			t.Fatalf("%v encoded as %d, which is more than 52 bits", xy, bits)
+		}
+
+		// The position is in the last cell.
+		area, _ := DecodeWGS84(hash)
+		if xy[0] < area.Longitude.Min || xy[0] > area.Longitude.Max ||
+			xy[1] < area.Latitude.Min || xy[1] > area.Latitude.Max {
+			t.Fatalf("%v is outside of the decoded area %v", xy, area)
+		}
+	}
+}
+
+func TestNeighbors(t *testing.T) {
+	hash, _ := EncodeWGS84(13.361389, 38.115556, 10)
+	area, _ := DecodeWGS84(hash)
+	n := Neighbors(hash)
+
+	north, _ := DecodeWGS84(n.North)
+	if north.Latitude.Min != area.Latitude.Max || north.Longitude != area.Longitude {
+		t.Fatalf("north cell %v is not above %v", north, area)
+	}
+	west, _ := DecodeWGS84(n.West)
+	if west.Longitude.Max != area.Longitude.Min || west.Latitude != area.Latitude {
+		t.Fatalf("west cell %v is not left of %v", west, area)
+	}
+	southEast, _ := DecodeWGS84(n.SouthEast)
+	if southEast.Latitude.Max != area.Latitude.Min || southEast.Longitude.Min != area.Longitude.Max {
+		t.Fatalf("south east cell %v is not below right of %v", southEast, area)
+	}
+}
+
+func TestGetDistance(t *testing.T) {
+	// Palermo - Catania.
+	if d := GetDistance(13.361389, 38.115556, 15.087269, 37.502669); math.Abs(d-166274.15) > 1 {
+		t.Fatalf("distance is %f", d)
+	}
+	if d := GetDistance(10, 10, 10, 11); math.Abs(d-EARTH_RADIUS_IN_METERS*D_R) > 1e-6 {
+		t.Fatalf("distance along a meridian is %f", d)
+	}
+}
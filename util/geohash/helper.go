@@ -0,0 +1,258 @@
+package geohash
+
+import "math"
+
+/* This is a C to Go port of geohash_helper.c of redis. It contains the
+ * helpers used by the GEO commands to compute the areas to search and
+ * the distances between the points. */
+
+const (
+	D_R = math.Pi / 180.0
+
+	// @brief Earth's quatratic mean radius for WGS-84
+	EARTH_RADIUS_IN_METERS = 6372797.560856
+
+	MERCATOR_MAX = 20037726.37
+	MERCATOR_MIN = -20037726.37
+)
+
+// The type of the search area.
+const (
+	CIRCULAR_TYPE = iota + 1
+	RECTANGLE_TYPE
+)
+
+/* Shape is the area of a search: either a circle of Radius around XY,
+ * or a Width x Height rectangle centered in XY. The sizes are expressed in
+ * the unit chosen by the user, Conversion converts them to meters. */
+type Shape struct {
+	Type       int
+	XY         [2]float64 // search center point, XY[0]: lon, XY[1]: lat
+	Conversion float64    // km: 1000
+	Bounds     [4]float64 // bounds[0]: min_lon, bounds[1]: min_lat, bounds[2]: max_lon, bounds[3]: max_lat
+	Radius     float64
+	Width      float64
+	Height     float64
+}
+
+type HashRadius struct {
+	Hash      HashBits
+	Area      HashArea
+	Neighbors HashNeighbors
+}
+
+func degRad(ang float64) float64 { return ang * D_R }
+func radDeg(ang float64) float64 { return ang / D_R }
+
+/* This function is used in order to estimate the step (bits precision)
+ * of the 9 search area boxes during radius queries. */
+func EstimateStepsByRadius(rangeMeters, lat float64) uint8 {
+	if rangeMeters == 0 {
+		return GEO_STEP_MAX
+	}
+	step := 1
+	for rangeMeters < MERCATOR_MAX {
+		rangeMeters *= 2
+		step++
+	}
+	step -= 2 // Make sure range is included in most of the base cases.
+
+	/* Wider range towards the poles... Note: it is possible to do better
+	 * than this approximation by computing the distance between meridians
+	 * at this latitude, but this does the trick for now. */
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+
+	// Frame to valid range.
+	if step < 1 {
+		step = 1
+	}
+	if step > GEO_STEP_MAX {
+		step = GEO_STEP_MAX
+	}
+	return uint8(step)
+}
+
+/* Return the bounding box of the search area by shape:
+ * bounds[0] - bounds[2] is the minimum and maximum longitude
+ * while bounds[1] - bounds[3] is the minimum and maximum latitude.
+ *
+ * Since the higher the latitude, the shorter the arc length, the box
+ * shape is as follows (left and right edges are actually bent):
+ *
+ *    \-----------------/          --------               \-----------------/
+ *     \               /         /          \              \               /
+ *      \  (long,lat) /         / (long,lat) \              \  (long,lat) /
+ *       \           /         /              \             /             \
+ *         ---------          /----------------\           /---------------\
+ *  Northern Hemisphere       Southern Hemisphere         Around the equator
+ */
+func BoundingBox(shape *Shape) (bounds [4]float64) {
+	longitude, latitude := shape.XY[0], shape.XY[1]
+	var height, width float64
+	if shape.Type == CIRCULAR_TYPE {
+		height = shape.Conversion * shape.Radius
+		width = shape.Conversion * shape.Radius
+	} else {
+		height = shape.Conversion * shape.Height / 2
+		width = shape.Conversion * shape.Width / 2
+	}
+
+	latDelta := radDeg(height / EARTH_RADIUS_IN_METERS)
+	longDeltaTop := radDeg(width / EARTH_RADIUS_IN_METERS / math.Cos(degRad(latitude+latDelta)))
+	longDeltaBottom := radDeg(width / EARTH_RADIUS_IN_METERS / math.Cos(degRad(latitude-latDelta)))
+
+	/* The directions of the northern and southern hemispheres
+	 * are opposite, so we choice different points as min/max long/lat. */
+	if latitude < 0 {
+		bounds[0] = longitude - longDeltaBottom
+		bounds[2] = longitude + longDeltaBottom
+	} else {
+		bounds[0] = longitude - longDeltaTop
+		bounds[2] = longitude + longDeltaTop
+	}
+	bounds[1] = latitude - latDelta
+	bounds[3] = latitude + latDelta
+	return
+}
+
+/* Calculate a set of areas (center + 8) that are able to cover a range query
+ * for the specified position and shape. The bounding box is saved in
+ * shape.Bounds. */
+func CalculateAreasByShapeWGS84(shape *Shape) (radius HashRadius) {
+	shape.Bounds = BoundingBox(shape)
+	minLon, minLat := shape.Bounds[0], shape.Bounds[1]
+	maxLon, maxLat := shape.Bounds[2], shape.Bounds[3]
+
+	longitude, latitude := shape.XY[0], shape.XY[1]
+	/* radiusMeters is calculated differently in different search types:
+	 * 1) CIRCULAR_TYPE, just use radius.
+	 * 2) RECTANGLE_TYPE, we use sqrt((width/2)^2 + (height/2)^2) to
+	 * calculate the distance from the center point to the corner. */
+	var radiusMeters float64
+	if shape.Type == CIRCULAR_TYPE {
+		radiusMeters = shape.Radius
+	} else {
+		radiusMeters = math.Sqrt((shape.Width/2)*(shape.Width/2) + (shape.Height/2)*(shape.Height/2))
+	}
+	radiusMeters *= shape.Conversion
+
+	steps := EstimateStepsByRadius(radiusMeters, latitude)
+
+	longRange, latRange := GetCoordRange()
+	hash, _ := Encode(longRange, latRange, longitude, latitude, steps)
+	neighbors := Neighbors(hash)
+	area, _ := Decode(longRange, latRange, hash)
+
+	/* Check if the step is enough at the limits of the covered area.
+	 * Sometimes when the search area is near an edge of the
+	 * area, the estimated step is not small enough, since one of the
+	 * north / south / west / east square is too near to the search area
+	 * to cover everything. */
+	decreaseStep := false
+	{
+		north, _ := Decode(longRange, latRange, neighbors.North)
+		south, _ := Decode(longRange, latRange, neighbors.South)
+		east, _ := Decode(longRange, latRange, neighbors.East)
+		west, _ := Decode(longRange, latRange, neighbors.West)
+
+		if north.Latitude.Max < maxLat ||
+			south.Latitude.Min > minLat ||
+			east.Longitude.Max < maxLon ||
+			west.Longitude.Min > minLon {
+			decreaseStep = true
+		}
+	}
+
+	if steps > 1 && decreaseStep {
+		steps--
+		hash, _ = Encode(longRange, latRange, longitude, latitude, steps)
+		neighbors = Neighbors(hash)
+		area, _ = Decode(longRange, latRange, hash)
+	}
+
+	// Exclude the search areas that are useless.
+	if steps >= 2 {
+		if area.Latitude.Min < minLat {
+			neighbors.South = HashBits{}
+			neighbors.SouthWest = HashBits{}
+			neighbors.SouthEast = HashBits{}
+		}
+		if area.Latitude.Max > maxLat {
+			neighbors.North = HashBits{}
+			neighbors.NorthEast = HashBits{}
+			neighbors.NorthWest = HashBits{}
+		}
+		if area.Longitude.Min < minLon {
+			neighbors.West = HashBits{}
+			neighbors.SouthWest = HashBits{}
+			neighbors.NorthWest = HashBits{}
+		}
+		if area.Longitude.Max > maxLon {
+			neighbors.East = HashBits{}
+			neighbors.SouthEast = HashBits{}
+			neighbors.NorthEast = HashBits{}
+		}
+	}
+	radius.Hash = hash
+	radius.Neighbors = neighbors
+	radius.Area = area
+	return
+}
+
+// Left align the hash to 52 bits, the precision of a sorted set score.
+func Align52Bits(hash HashBits) uint64 {
+	return hash.Bits << (52 - uint(hash.Step)*2)
+}
+
+/* Calculate distance using simplified haversine great circle distance formula.
+ * Given longitude diff is 0 the asin(sqrt(a)) on the haversine is asin(sin(abs(u))).
+ * arcsin(sin(x)) equal to x when x ∈[−𝜋/2,𝜋/2]. Given latitude is between [−𝜋/2,𝜋/2]
+ * we can simplify arcsin(sin(x)) to x. */
+func GetLatDistance(lat1d, lat2d float64) float64 {
+	return EARTH_RADIUS_IN_METERS * math.Abs(degRad(lat2d)-degRad(lat1d))
+}
+
+// Calculate distance using haversine great circle distance formula.
+func GetDistance(lon1d, lat1d, lon2d, lat2d float64) float64 {
+	lon1r := degRad(lon1d)
+	lon2r := degRad(lon2d)
+	v := math.Sin((lon2r - lon1r) / 2)
+	// If v == 0 we can avoid doing expensive math when lons are practically the same.
+	if v == 0.0 {
+		return GetLatDistance(lat1d, lat2d)
+	}
+	lat1r := degRad(lat1d)
+	lat2r := degRad(lat2d)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2.0 * EARTH_RADIUS_IN_METERS * math.Asin(math.Sqrt(a))
+}
+
+func GetDistanceIfInRadiusWGS84(x1, y1, x2, y2, radius float64) (distance float64, ok bool) {
+	distance = GetDistance(x1, y1, x2, y2)
+	return distance, distance <= radius
+}
+
+/* Judge whether a point is in the axis-aligned rectangle, when the distance
+ * between a searched point and the center point is less than or equal to
+ * height/2 or width/2 in height and width, the point is in the rectangle.
+ *
+ * widthM, heightM: the rectangle
+ * x1, y1 : the center of the box
+ * x2, y2 : the point to be searched */
+func GetDistanceIfInRectangle(widthM, heightM, x1, y1, x2, y2 float64) (distance float64, ok bool) {
+	/* Latitude distance is less expensive to compute than longitude distance
+	 * so we check first for the latitude condition. */
+	if latDistance := GetLatDistance(y2, y1); latDistance > heightM/2 {
+		return
+	}
+	if lonDistance := GetDistance(x2, y1, x1, y1); lonDistance > widthM/2 {
+		return
+	}
+	return GetDistance(x1, y1, x2, y2), true
+}
@@ -1,6 +1,8 @@
 package util
 
 import (
+	"math"
+	"strings"
 	"unicode"
 )
 
@@ -253,6 +255,54 @@ func ParseInt(s []byte, base int, bitSize int) (i int64, ok bool) {
 	return n, true
 }
 
+/* Convert a string representing an amount of memory into the number of
+ * bytes, so for instance MemToInt64("1Gb") will return 1073741824 that is
+ * (1024*1024*1024). The unit is case insensitive, and a bare number is
+ * taken as bytes. The boolean is false when the string is invalid. */
+func MemToInt64(s string) (int64, bool) {
+	var mul int64
+
+	// Search the first non digit character.
+	i := 0
+	if i < len(s) && s[i] == '-' {
+		i++
+	}
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+
+	switch strings.ToLower(s[i:]) {
+	case "":
+		mul = 1
+	case "b":
+		mul = 1
+	case "k":
+		mul = 1000
+	case "kb":
+		mul = 1024
+	case "m":
+		mul = 1000 * 1000
+	case "mb":
+		mul = 1024 * 1024
+	case "g":
+		mul = 1000 * 1000 * 1000
+	case "gb":
+		mul = 1024 * 1024 * 1024
+	default:
+		return 0, false
+	}
+
+	x, ok := ParseInt([]byte(s[:i]), 10, 64)
+	if !ok {
+		return 0, false
+	}
+	// Reject the amounts that overflow once multiplied by the unit.
+	if x > math.MaxInt64/mul || x < math.MinInt64/mul {
+		return 0, false
+	}
+	return x * mul, true
+}
+
 // Custom version of bytes.tolower
 
 func ToLower(b []byte) []byte {
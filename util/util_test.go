@@ -19,3 +19,24 @@ func TestStringMatchPattern(t *testing.T) {
 		t.Error("[a-z]?o", "_o")
 	}
 }
+
+func TestMemToInt64(t *testing.T) {
+	cases := map[string]int64{
+		"100":  100,
+		"1k":   1000,
+		"1kb":  1024,
+		"32mb": 32 * 1024 * 1024,
+		"1Gb":  1024 * 1024 * 1024,
+		"2g":   2000 * 1000 * 1000,
+	}
+	for s, expected := range cases {
+		if x, ok := MemToInt64(s); !ok || x != expected {
+			t.Error(s, x, expected)
+		}
+	}
+	for _, s := range []string{"", "mb", "10tb", "1.5gb", "99999999999gb", "-9223372036854775807k"} {
+		if _, ok := MemToInt64(s); ok {
+			t.Error(s)
+		}
+	}
+}